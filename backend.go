@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+// A Backend is what the Deployer uses to look at, and make changes to,
+// a Cloud Foundry.  There are two of them: the CLIBackend, which runs cf
+// commands through the CLI plugin connection, and the APIBackend, which
+// talks to the Cloud Controller v3 API directly.
+//
+// Reads are answered in terms of the CLI plugin models, since that is what
+// the deployer was first written against.  Everything that lives in an org
+// or a space is addressed by name, explicitly; backends are responsible
+// for any targeting they need to do.
+type Backend interface {
+	// Record arranges for every change the backend would make to be passed
+	// to the given function (as a cf command, or an API request) instead of
+	// actually being made.  Reads are still made.
+	Record(func(call []string))
+
+	// Observe arranges for every change the backend actually makes to be
+	// passed to the given function as well, before it is made.
+	Observe(func(call []string))
+
+	// Fork returns a backend for the same foundation, with no hooks set,
+	// so that each step of a deployment can record (or observe) its own
+	// calls.  Forks of the APIBackend may be used concurrently; forks of
+	// the CLIBackend may not, since the CLI only has the one target.
+	Fork() Backend
+
+	CurrentUser() (string, error)
+
+	GetOrgs() ([]plugin_models.GetOrgs_Model, error)
+	GetOrg(org string) (plugin_models.GetOrg_Model, error)
+	GetOrgUsers(org string) ([]plugin_models.GetOrgUsers_Model, error)
+	GetSpace(org, space string) (plugin_models.GetSpace_Model, error)
+	GetSpaceUsers(org, space string) ([]plugin_models.GetSpaceUsers_Model, error)
+	GetApps(org, space string) ([]plugin_models.GetAppsModel, error)
+	GetApp(org, space, app string) (plugin_models.GetAppModel, error)
+	GetServices(org, space string) ([]plugin_models.GetServices_Model, error)
+	GetService(org, space, name string) (plugin_models.GetService_Model, error)
+
+	// GetServiceParameters returns the parameters a service instance
+	// was given, or nil, if they can't be read back (not every broker
+	// lets them be.)
+	GetServiceParameters(org, space, name string) (map[string]interface{}, error)
+
+	// GetServiceTags returns the tags a service instance was given.
+	GetServiceTags(org, space, name string) ([]string, error)
+	SecurityGroupExists(name string) (bool, error)
+	GlobalSecurityGroups(lifecycle string) ([]string, error)
+
+	// SpaceSecurityGroups returns the security groups bound to a space
+	// for the given lifecycle (running or staging.)
+	SpaceSecurityGroups(org, space, lifecycle string) ([]string, error)
+	SSHAllowed(org, space string) (bool, error)
+	GetServiceBrokers() ([]string, error)
+
+	// GetServiceAccess says who can see each plan of a service, failing
+	// with a NotFoundError if no broker offers it.
+	GetServiceAccess(service string) ([]ServicePlanAccess, error)
+
+	CreateUser(user, password string) error
+	CreateSharedDomain(domain string) error
+	CreateQuota(name string) error
+	UpdateQuota(name string, quota *Quota) error
+	CreateSecurityGroup(name string, rules []byte) error
+	UpdateSecurityGroup(name string, rules []byte) error
+	BindGlobalSecurityGroup(name, lifecycle string) error
+	UnbindGlobalSecurityGroup(name, lifecycle string) error
+	BindSecurityGroup(name, org, space, lifecycle string) error
+	UnbindSecurityGroup(name, org, space, lifecycle string) error
+
+	CreateOrg(org string) error
+	DeleteOrg(org string) error
+	CreateOrgDomain(org, domain string) error
+	SetOrgQuota(org, quota string) error
+	CreateSpaceQuota(org, name string, quota *Quota) error
+	UpdateSpaceQuota(org, name string, quota *Quota) error
+	SetOrgRole(org, user, role string) error
+	UnsetOrgRole(org, user, role string) error
+
+	CreateSpace(org, space string) error
+	DeleteSpace(org, space string) error
+	AllowSSH(org, space string, on bool) error
+	SetSpaceQuota(org, space, quota string) error
+	SetSpaceRole(org, space, user, role string) error
+	UnsetSpaceRole(org, space, user, role string) error
+	DeleteOrphanedRoutes(org, space string) error
+
+	// PushApp uploads an application (from the local path, unless it is
+	// a docker image) without starting it.
+	PushApp(org, space string, app *Application, path string) error
+	DeleteApp(org, space, app string) error
+	RenameApp(org, space, app, name string) error
+	MapRoute(org, space, app string, url URL) error
+	UnmapRoute(org, space, app string, url URL) error
+	SetEnv(org, space, app, name, value string) error
+	UnsetEnv(org, space, app, name string) error
+	StartApp(org, space, app string) error
+
+	// ScaleApp changes the number of instances of an application,
+	// without restarting it.  RestageApp stages an application again
+	// (to pick up changes to its environment or service bindings), and
+	// restarts it.
+	ScaleApp(org, space, app string, instances int) error
+	RestageApp(org, space, app string) error
+
+	// CreateService creates a service instance, with the given
+	// parameters (as JSON), if any, and tags.  UpdateService moves one
+	// to another plan, and gives it new parameters and tags, leaving
+	// whichever of those are empty as they are.
+	CreateService(org, space, name, service, plan, parameters string, tags []string) error
+	UpdateService(org, space, name, plan, parameters string, tags []string) error
+	DeleteService(org, space, name string) error
+	BindService(org, space, app, name string) error
+	UnbindService(org, space, app, name string) error
+	CreateUserProvidedService(org, space, name, credentials, route, syslog string) error
+	UpdateUserProvidedService(org, space, name, credentials, route, syslog string) error
+
+	// CreateServiceBroker registers a broker; it is space-scoped if it
+	// is given a space.
+	CreateServiceBroker(name, username, password, url, org, space string) error
+	UpdateServiceBroker(name, username, password, url string) error
+
+	// EnableServiceAccess makes a plan of a service (or all of them, if
+	// no plan is given) visible to an org, or to everyone, if no org is
+	// given.  DisableServiceAccess takes that away again.
+	EnableServiceAccess(service, plan, org string) error
+	DisableServiceAccess(service, plan, org string) error
+}
+
+// A ServicePlanAccess is who can see a plan of a service: everyone, if it
+// is public, or else just the orgs listed (if any.)  The CLI plugin models
+// have nothing for it.
+type ServicePlanAccess struct {
+	Plan   string
+	Public bool
+	Orgs   []string
+}
+
+// A NotFoundError is returned by a backend when the thing it was asked
+// about (or the org or space that it should be in) does not exist.
+type NotFoundError struct {
+	Kind string
+	Name string
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Kind, e.Name)
+}
+
+func isMissing(e error) bool {
+	if _, ok := e.(NotFoundError); ok {
+		return true
+	}
+	/* the CLI only tells us in words */
+	return strings.Contains(e.Error(), "not found")
+}
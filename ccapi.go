@@ -0,0 +1,2077 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+// The APIBackend talks to the Cloud Controller v3 API directly, instead
+// of going through cf commands.  It does not depend on (or change) the
+// CLI's target, and its errors say exactly what went wrong.
+type APIBackend struct {
+	endpoint string
+	token    func() (string, error)
+	client   *http.Client
+	record   func([]string)
+	observe  func([]string)
+
+	/* how often, and for how long, to wait on asynchronous
+	   jobs, package uploads and staging */
+	PollInterval time.Duration
+	Timeout      time.Duration
+}
+
+func NewAPIBackend(endpoint string, token func() (string, error), client *http.Client) *APIBackend {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &APIBackend{
+		endpoint:     strings.TrimRight(endpoint, "/"),
+		token:        token,
+		client:       client,
+		PollInterval: time.Second,
+		Timeout:      15 * time.Minute,
+	}
+}
+
+// NewAPIBackendFromCLI sets up an APIBackend for whatever Cloud Controller
+// the CLI is logged into, with the CLI's access token.
+func NewAPIBackendFromCLI(cf plugin.CliConnection) (*APIBackend, error) {
+	endpoint, err := cf.ApiEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	if endpoint == "" {
+		return nil, fmt.Errorf("no API endpoint set; please run `cf api` and `cf login` first")
+	}
+
+	insecure, _ := cf.IsSSLDisabled()
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+
+	/* the CLI refreshes the token when it has to; don't let
+	   concurrent forks of the backend race to do it */
+	var mu sync.Mutex
+	token := func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return cf.AccessToken()
+	}
+	return NewAPIBackend(endpoint, token, client), nil
+}
+
+func (b *APIBackend) Fork() Backend {
+	f := *b
+	f.record, f.observe = nil, nil
+	return &f
+}
+
+func (b *APIBackend) Record(fn func([]string)) {
+	b.record = fn
+}
+
+func (b *APIBackend) Observe(fn func([]string)) {
+	b.observe = fn
+}
+
+// change records a change (returning true, if it must not be made), or
+// lets any observer know that it is about to be made.
+func (b *APIBackend) change(call []string) bool {
+	if b.record != nil {
+		b.record(call)
+		return true
+	}
+	if b.observe != nil {
+		b.observe(call)
+	}
+	return false
+}
+
+// An APIError is an error response from the Cloud Controller.
+type APIError struct {
+	Method string
+	Path   string
+	Status int
+	Errors []struct {
+		Code   int    `json:"code"`
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+	} `json:"errors"`
+}
+
+func (e *APIError) Error() string {
+	var l []string
+	for _, x := range e.Errors {
+		l = append(l, fmt.Sprintf("%s (%s)", x.Detail, x.Title))
+	}
+	if len(l) == 0 {
+		l = append(l, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("%s %s failed with %d: %s", e.Method, e.Path, e.Status, strings.Join(l, "; "))
+}
+
+func (b *APIBackend) url(path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return b.endpoint + path
+}
+
+// send makes a request of the Cloud Controller, waiting for the job it
+// starts (if it answers with one) to finish, unless told not to.
+func (b *APIBackend) send(method, path, contentType string, body io.Reader, out interface{}, wait bool) error {
+	req, err := http.NewRequest(method, b.url(path), body)
+	if err != nil {
+		return err
+	}
+	token, err := b.token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 400 {
+		e := &APIError{Method: method, Path: path, Status: res.StatusCode}
+		json.Unmarshal(raw, e)
+		if res.StatusCode == 404 {
+			return NotFoundError{Kind: "resource", Name: path}
+		}
+		return e
+	}
+
+	if wait && res.StatusCode == 202 && res.Header.Get("Location") != "" {
+		if err := b.wait(res.Header.Get("Location")); err != nil {
+			return err
+		}
+	}
+
+	if out != nil && len(raw) > 0 {
+		return json.Unmarshal(raw, out)
+	}
+	return nil
+}
+
+// do makes a request of the Cloud Controller, with a JSON body (if in is
+// not nil), decoding the JSON response into out (if that is not nil.)
+// Anything other than a GET is a change, and is recorded instead of made
+// when recording.
+func (b *APIBackend) do(method, path string, in, out interface{}) error {
+	return b.request(method, path, in, out, true)
+}
+
+// begin is do, for requests that leave the Cloud Controller with a job to
+// do that can take longer than anything should wait on a job for (the
+// ones brokers carry out, above all); it doesn't wait for the job, and
+// it's up to the caller to find out how it went.
+func (b *APIBackend) begin(method, path string, in, out interface{}) error {
+	return b.request(method, path, in, out, false)
+}
+
+func (b *APIBackend) request(method, path string, in, out interface{}, wait bool) error {
+	var body []byte
+	if in != nil {
+		/* placeholders are easier to read unescaped */
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(in); err != nil {
+			return err
+		}
+		body = bytes.TrimSpace(buf.Bytes())
+	}
+
+	if os.Getenv("DEBUG") != "" {
+		fmt.Printf(">> %s %s %s\n", method, path, redactions.Body(string(body)))
+	}
+	if method != "GET" {
+		call := []string{method, path}
+		if body != nil {
+			call = append(call, string(body))
+		}
+		if b.change(call) {
+			return nil
+		}
+		if os.Getenv("DRYRUN") != "" {
+			return nil
+		}
+	}
+
+	if body == nil {
+		return b.send(method, path, "", nil, out, wait)
+	}
+	return b.send(method, path, "application/json", bytes.NewReader(body), out, wait)
+}
+
+func (b *APIBackend) poll(what string, fn func() (bool, error)) error {
+	deadline := time.Now().Add(b.Timeout)
+	for {
+		done, err := fn()
+		if err != nil || done {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", what)
+		}
+		time.Sleep(b.PollInterval)
+	}
+}
+
+// wait waits for an asynchronous job to finish.
+func (b *APIBackend) wait(job string) error {
+	return b.poll("job "+job, func() (bool, error) {
+		var j struct {
+			State  string `json:"state"`
+			Errors []struct {
+				Detail string `json:"detail"`
+			} `json:"errors"`
+		}
+		if err := b.send("GET", job, "", nil, &j, false); err != nil {
+			return false, err
+		}
+		switch j.State {
+		case "COMPLETE":
+			return true, nil
+		case "FAILED":
+			var l []string
+			for _, e := range j.Errors {
+				l = append(l, e.Detail)
+			}
+			return false, fmt.Errorf("job %s failed: %s", job, strings.Join(l, "; "))
+		}
+		return false, nil
+	})
+}
+
+type v3Ref struct {
+	GUID string `json:"guid,omitempty"`
+	Name string `json:"name,omitempty"`
+
+	/* roles refer to their users by username */
+	Username string `json:"username,omitempty"`
+}
+
+type v3Relationship struct {
+	Data *v3Ref `json:"data"`
+}
+
+type v3ToMany struct {
+	Data []v3Ref `json:"data"`
+}
+
+type v3Resource struct {
+	GUID          string                    `json:"guid"`
+	Name          string                    `json:"name"`
+	Type          string                    `json:"type"`
+	State         string                    `json:"state"`
+	Host          string                    `json:"host"`
+	Username      string                    `json:"username"`
+	URL           string                    `json:"url"`
+	CreatedAt     string                    `json:"created_at"`
+	UpdatedAt     string                    `json:"updated_at"`
+	Relationships map[string]v3Relationship `json:"relationships"`
+	Error         string                    `json:"error"`
+
+	Droplet      *v3Ref `json:"droplet"`
+	Package      *v3Ref `json:"package"`
+	Destinations []struct {
+		GUID string `json:"guid"`
+		App  v3Ref  `json:"app"`
+	} `json:"destinations"`
+	LastOperation struct {
+		Type        string `json:"type"`
+		State       string `json:"state"`
+		Description string `json:"description"`
+		CreatedAt   string `json:"created_at"`
+		UpdatedAt   string `json:"updated_at"`
+	} `json:"last_operation"`
+	DashboardURL   string   `json:"dashboard_url"`
+	VisibilityType string   `json:"visibility_type"`
+	Tags           []string `json:"tags"`
+}
+
+func (r v3Resource) related(name string) string {
+	if rel, ok := r.Relationships[name]; ok && rel.Data != nil {
+		return rel.Data.GUID
+	}
+	return ""
+}
+
+type v3Page struct {
+	Pagination struct {
+		Next *struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"pagination"`
+	Resources []v3Resource            `json:"resources"`
+	Included  map[string][]v3Resource `json:"included"`
+}
+
+// list fetches every page of a listing, along with anything that it
+// asked to be included, by GUID.
+func (b *APIBackend) list(path string) ([]v3Resource, map[string]v3Resource, error) {
+	var all []v3Resource
+	included := map[string]v3Resource{}
+	for path != "" {
+		var page v3Page
+		if err := b.do("GET", path, nil, &page); err != nil {
+			return nil, nil, err
+		}
+		all = append(all, page.Resources...)
+		for _, l := range page.Included {
+			for _, r := range l {
+				included[r.GUID] = r
+			}
+		}
+		path = ""
+		if page.Pagination.Next != nil {
+			path = page.Pagination.Next.Href
+		}
+	}
+	return all, included, nil
+}
+
+func query(path string, params ...string) string {
+	v := url.Values{}
+	for i := 0; i+1 < len(params); i += 2 {
+		v.Set(params[i], params[i+1])
+	}
+	return path + "?" + v.Encode()
+}
+
+// find looks up the one resource in a listing, or a NotFoundError.
+func (b *APIBackend) find(kind, name, path string, params ...string) (v3Resource, error) {
+	l, _, err := b.list(query(path, params...))
+	if err != nil {
+		return v3Resource{}, err
+	}
+	if len(l) == 0 {
+		return v3Resource{}, NotFoundError{Kind: kind, Name: name}
+	}
+	return l[0], nil
+}
+
+func (b *APIBackend) org(org string) (v3Resource, error) {
+	return b.find("Organization", org, "/v3/organizations", "names", org)
+}
+
+func (b *APIBackend) space(org, space string) (v3Resource, error) {
+	o, err := b.org(org)
+	if err != nil {
+		return o, err
+	}
+	return b.find("Space", space, "/v3/spaces", "names", space, "organization_guids", o.GUID)
+}
+
+func (b *APIBackend) app(org, space, app string) (v3Resource, error) {
+	s, err := b.space(org, space)
+	if err != nil {
+		return s, err
+	}
+	return b.find("App", app, "/v3/apps", "names", app, "space_guids", s.GUID)
+}
+
+func (b *APIBackend) serviceInstance(org, space, name string) (v3Resource, error) {
+	s, err := b.space(org, space)
+	if err != nil {
+		return s, err
+	}
+	return b.find("Service instance", name, "/v3/service_instances", "names", name, "space_guids", s.GUID)
+}
+
+func (b *APIBackend) domain(name string) (v3Resource, error) {
+	return b.find("Domain", name, "/v3/domains", "names", name)
+}
+
+func (b *APIBackend) quota(name string) (v3Resource, error) {
+	return b.find("Quota", name, "/v3/organization_quotas", "names", name)
+}
+
+func (b *APIBackend) spaceQuota(org, name string) (v3Resource, error) {
+	o, err := b.org(org)
+	if err != nil {
+		return o, err
+	}
+	return b.find("Space quota", name, "/v3/space_quotas", "names", name, "organization_guids", o.GUID)
+}
+
+func (b *APIBackend) securityGroup(name string) (v3Resource, error) {
+	return b.find("Security group", name, "/v3/security_groups", "names", name)
+}
+
+func to(guid string) v3Relationship {
+	return v3Relationship{Data: &v3Ref{GUID: guid}}
+}
+
+func (b *APIBackend) CurrentUser() (string, error) {
+	token, err := b.token()
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("unable to make sense of the access token")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", err
+	}
+	var claims struct {
+		Username string `json:"user_name"`
+	}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return "", err
+	}
+	return claims.Username, nil
+}
+
+func (b *APIBackend) GetOrgs() ([]plugin_models.GetOrgs_Model, error) {
+	l, _, err := b.list("/v3/organizations")
+	if err != nil {
+		return nil, err
+	}
+	var orgs []plugin_models.GetOrgs_Model
+	for _, o := range l {
+		orgs = append(orgs, plugin_models.GetOrgs_Model{Guid: o.GUID, Name: o.Name})
+	}
+	return orgs, nil
+}
+
+func (b *APIBackend) GetOrg(org string) (plugin_models.GetOrg_Model, error) {
+	var m plugin_models.GetOrg_Model
+	o, err := b.org(org)
+	if err != nil {
+		return m, err
+	}
+	m.Guid = o.GUID
+	m.Name = o.Name
+
+	if guid := o.related("quota"); guid != "" {
+		var q v3Resource
+		if err := b.do("GET", "/v3/organization_quotas/"+guid, nil, &q); err != nil {
+			return m, err
+		}
+		m.QuotaDefinition.Guid = q.GUID
+		m.QuotaDefinition.Name = q.Name
+	}
+
+	spaces, _, err := b.list(query("/v3/spaces", "organization_guids", o.GUID))
+	if err != nil {
+		return m, err
+	}
+	for _, s := range spaces {
+		m.Spaces = append(m.Spaces, plugin_models.GetOrg_Space{Guid: s.GUID, Name: s.Name})
+	}
+
+	domains, _, err := b.list("/v3/organizations/" + o.GUID + "/domains")
+	if err != nil {
+		return m, err
+	}
+	for _, d := range domains {
+		owner := d.related("organization")
+		m.Domains = append(m.Domains, plugin_models.GetOrg_Domains{
+			Guid:                   d.GUID,
+			Name:                   d.Name,
+			OwningOrganizationGuid: owner,
+			Shared:                 owner == "",
+		})
+	}
+
+	quotas, _, err := b.list(query("/v3/space_quotas", "organization_guids", o.GUID))
+	if err != nil {
+		return m, err
+	}
+	for _, q := range quotas {
+		m.SpaceQuotas = append(m.SpaceQuotas, plugin_models.GetOrg_SpaceQuota{Guid: q.GUID, Name: q.Name})
+	}
+	return m, nil
+}
+
+var roleTypes = map[string]string{
+	"OrgManager":     "organization_manager",
+	"BillingManager": "organization_billing_manager",
+	"OrgAuditor":     "organization_auditor",
+	"OrgUser":        "organization_user",
+	"SpaceManager":   "space_manager",
+	"SpaceDeveloper": "space_developer",
+	"SpaceAuditor":   "space_auditor",
+}
+
+func roleName(t string) string {
+	for name, typ := range roleTypes {
+		if typ == t {
+			return name
+		}
+	}
+	return t
+}
+
+type roleHolder struct {
+	guid     string
+	username string
+	roles    []string
+}
+
+// roles lists who has what role in an org or space, in the order that
+// they were first seen.
+func (b *APIBackend) roles(scope, guid string) ([]*roleHolder, error) {
+	l, users, err := b.list(query("/v3/roles", scope+"_guids", guid, "include", "user"))
+	if err != nil {
+		return nil, err
+	}
+
+	var holders []*roleHolder
+	byGUID := map[string]*roleHolder{}
+	for _, r := range l {
+		u := r.related("user")
+		h, ok := byGUID[u]
+		if !ok {
+			h = &roleHolder{guid: u, username: users[u].Username}
+			byGUID[u] = h
+			holders = append(holders, h)
+		}
+		h.roles = append(h.roles, roleName(r.Type))
+	}
+	return holders, nil
+}
+
+func (b *APIBackend) GetOrgUsers(org string) ([]plugin_models.GetOrgUsers_Model, error) {
+	o, err := b.org(org)
+	if err != nil {
+		return nil, err
+	}
+	holders, err := b.roles("organization", o.GUID)
+	if err != nil {
+		return nil, err
+	}
+	var users []plugin_models.GetOrgUsers_Model
+	for _, h := range holders {
+		users = append(users, plugin_models.GetOrgUsers_Model{Guid: h.guid, Username: h.username, Roles: h.roles})
+	}
+	return users, nil
+}
+
+func (b *APIBackend) GetSpaceUsers(org, space string) ([]plugin_models.GetSpaceUsers_Model, error) {
+	s, err := b.space(org, space)
+	if err != nil {
+		return nil, err
+	}
+	holders, err := b.roles("space", s.GUID)
+	if err != nil {
+		return nil, err
+	}
+	var users []plugin_models.GetSpaceUsers_Model
+	for _, h := range holders {
+		users = append(users, plugin_models.GetSpaceUsers_Model{Guid: h.guid, Username: h.username, Roles: h.roles})
+	}
+	return users, nil
+}
+
+func (b *APIBackend) GetSpace(org, space string) (plugin_models.GetSpace_Model, error) {
+	var m plugin_models.GetSpace_Model
+	s, err := b.space(org, space)
+	if err != nil {
+		return m, err
+	}
+	m.Guid = s.GUID
+	m.Name = s.Name
+	m.Organization.Guid = s.related("organization")
+	m.Organization.Name = org
+
+	if guid := s.related("quota"); guid != "" {
+		var q v3Resource
+		if err := b.do("GET", "/v3/space_quotas/"+guid, nil, &q); err != nil {
+			return m, err
+		}
+		m.SpaceQuota.Guid = q.GUID
+		m.SpaceQuota.Name = q.Name
+	}
+
+	apps, _, err := b.list(query("/v3/apps", "space_guids", s.GUID))
+	if err != nil {
+		return m, err
+	}
+	for _, a := range apps {
+		m.Applications = append(m.Applications, plugin_models.GetSpace_Apps{Guid: a.GUID, Name: a.Name})
+	}
+
+	instances, _, err := b.list(query("/v3/service_instances", "space_guids", s.GUID))
+	if err != nil {
+		return m, err
+	}
+	for _, si := range instances {
+		m.ServiceInstances = append(m.ServiceInstances, plugin_models.GetSpace_ServiceInstance{Guid: si.GUID, Name: si.Name})
+	}
+
+	groups, _, err := b.list(query("/v3/security_groups", "running_space_guids", s.GUID))
+	if err != nil {
+		return m, err
+	}
+	for _, sg := range groups {
+		m.SecurityGroups = append(m.SecurityGroups, plugin_models.GetSpace_SecurityGroup{Guid: sg.GUID, Name: sg.Name})
+	}
+	return m, nil
+}
+
+func (b *APIBackend) GetApps(org, space string) ([]plugin_models.GetAppsModel, error) {
+	s, err := b.space(org, space)
+	if err != nil {
+		return nil, err
+	}
+	l, _, err := b.list(query("/v3/apps", "space_guids", s.GUID))
+	if err != nil {
+		return nil, err
+	}
+	var apps []plugin_models.GetAppsModel
+	for _, a := range l {
+		apps = append(apps, plugin_models.GetAppsModel{Guid: a.GUID, Name: a.Name, State: strings.ToLower(a.State)})
+	}
+	return apps, nil
+}
+
+type v3Process struct {
+	GUID       string `json:"guid"`
+	Instances  int    `json:"instances"`
+	MemoryInMB int64  `json:"memory_in_mb"`
+	DiskInMB   int64  `json:"disk_in_mb"`
+	Command    string `json:"command"`
+}
+
+func (b *APIBackend) GetApp(org, space, app string) (plugin_models.GetAppModel, error) {
+	var m plugin_models.GetAppModel
+	a, err := b.app(org, space, app)
+	if err != nil {
+		return m, err
+	}
+	m.Guid = a.GUID
+	m.Name = a.Name
+	m.State = strings.ToLower(a.State)
+	m.SpaceGuid = a.related("space")
+
+	var web v3Process
+	if err := b.do("GET", "/v3/apps/"+a.GUID+"/processes/web", nil, &web); err != nil && !isMissing(err) {
+		return m, err
+	}
+	m.InstanceCount = web.Instances
+	m.Memory = web.MemoryInMB
+	m.DiskQuota = web.DiskInMB
+	m.Command = web.Command
+
+	if web.GUID != "" {
+		var stats struct {
+			Resources []struct {
+				State   string `json:"state"`
+				Details string `json:"details"`
+				Usage   struct {
+					CPU  float64 `json:"cpu"`
+					Mem  int64   `json:"mem"`
+					Disk int64   `json:"disk"`
+				} `json:"usage"`
+				MemQuota  int64 `json:"mem_quota"`
+				DiskQuota int64 `json:"disk_quota"`
+			} `json:"resources"`
+		}
+		if err := b.do("GET", "/v3/processes/"+web.GUID+"/stats", nil, &stats); err != nil {
+			return m, err
+		}
+		for _, i := range stats.Resources {
+			if i.State == "RUNNING" {
+				m.RunningInstances++
+			}
+			m.Instances = append(m.Instances, plugin_models.GetApp_AppInstanceFields{
+				State:     strings.ToLower(i.State),
+				Details:   i.Details,
+				CpuUsage:  i.Usage.CPU,
+				MemUsage:  i.Usage.Mem,
+				DiskUsage: i.Usage.Disk,
+				MemQuota:  i.MemQuota,
+				DiskQuota: i.DiskQuota,
+			})
+		}
+	}
+
+	var env struct {
+		Var map[string]interface{} `json:"var"`
+	}
+	if err := b.do("GET", "/v3/apps/"+a.GUID+"/environment_variables", nil, &env); err != nil {
+		return m, err
+	}
+	m.EnvironmentVars = env.Var
+
+	routes, domains, err := b.list(query("/v3/routes", "app_guids", a.GUID, "include", "domain"))
+	if err != nil {
+		return m, err
+	}
+	for _, r := range routes {
+		d := domains[r.related("domain")]
+		m.Routes = append(m.Routes, plugin_models.GetApp_RouteSummary{
+			Guid:   r.GUID,
+			Host:   r.Host,
+			Domain: plugin_models.GetApp_DomainFields{Guid: d.GUID, Name: d.Name},
+		})
+	}
+
+	bindings, instances, err := b.list(query("/v3/service_credential_bindings", "app_guids", a.GUID, "include", "service_instance"))
+	if err != nil {
+		return m, err
+	}
+	for _, sb := range bindings {
+		si := instances[sb.related("service_instance")]
+		m.Services = append(m.Services, plugin_models.GetApp_ServiceSummary{Guid: si.GUID, Name: si.Name})
+	}
+
+	pkgs, _, err := b.list(query("/v3/packages", "app_guids", a.GUID, "order_by", "-created_at", "per_page", "1"))
+	if err != nil {
+		return m, err
+	}
+	if len(pkgs) > 0 {
+		m.PackageState = pkgs[0].State
+		if t, err := time.Parse(time.RFC3339, pkgs[0].UpdatedAt); err == nil {
+			m.PackageUpdatedAt = &t
+		}
+	}
+
+	builds, _, err := b.list(query("/v3/builds", "app_guids", a.GUID, "order_by", "-created_at", "per_page", "1"))
+	if err != nil {
+		return m, err
+	}
+	if len(builds) > 0 && builds[0].State == "FAILED" {
+		m.StagingFailedReason = builds[0].Error
+	}
+	return m, nil
+}
+
+func (b *APIBackend) GetService(org, space, name string) (plugin_models.GetService_Model, error) {
+	var m plugin_models.GetService_Model
+	si, err := b.serviceInstance(org, space, name)
+	if err != nil {
+		return m, err
+	}
+	m.Guid = si.GUID
+	m.Name = si.Name
+	m.DashboardUrl = si.DashboardURL
+	m.IsUserProvided = si.Type == "user-provided"
+	m.LastOperation.Type = si.LastOperation.Type
+	m.LastOperation.State = si.LastOperation.State
+	m.LastOperation.Description = si.LastOperation.Description
+	m.LastOperation.CreatedAt = si.LastOperation.CreatedAt
+	m.LastOperation.UpdatedAt = si.LastOperation.UpdatedAt
+
+	if guid := si.related("service_plan"); guid != "" {
+		plans, offerings, err := b.list(query("/v3/service_plans", "guids", guid, "include", "service_offering"))
+		if err != nil {
+			return m, err
+		}
+		if len(plans) > 0 {
+			m.ServicePlan.Guid = plans[0].GUID
+			m.ServicePlan.Name = plans[0].Name
+			m.ServiceOffering.Name = offerings[plans[0].related("service_offering")].Name
+		}
+	}
+	return m, nil
+}
+
+// GetServiceParameters reads the parameters of a service instance from
+// its broker, through the Cloud Controller; brokers that don't support
+// that make it fail, and those parameters can't be read back.
+func (b *APIBackend) GetServiceParameters(org, space, name string) (map[string]interface{}, error) {
+	si, err := b.serviceInstance(org, space, name)
+	if err != nil {
+		return nil, err
+	}
+	var params map[string]interface{}
+	if err := b.do("GET", "/v3/service_instances/"+si.GUID+"/parameters", nil, &params); err != nil {
+		if _, ok := err.(*APIError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	return params, nil
+}
+
+func (b *APIBackend) GetServiceTags(org, space, name string) ([]string, error) {
+	si, err := b.serviceInstance(org, space, name)
+	if err != nil {
+		return nil, err
+	}
+	return si.Tags, nil
+}
+
+func (b *APIBackend) GetServices(org, space string) ([]plugin_models.GetServices_Model, error) {
+	s, err := b.space(org, space)
+	if err != nil {
+		return nil, err
+	}
+	l, _, err := b.list(query("/v3/service_instances", "space_guids", s.GUID))
+	if err != nil {
+		return nil, err
+	}
+
+	var services []plugin_models.GetServices_Model
+	for _, si := range l {
+		svc := plugin_models.GetServices_Model{
+			Guid:           si.GUID,
+			Name:           si.Name,
+			IsUserProvided: si.Type == "user-provided",
+		}
+		svc.LastOperation.Type = si.LastOperation.Type
+		svc.LastOperation.State = si.LastOperation.State
+
+		if guid := si.related("service_plan"); guid != "" {
+			plans, offerings, err := b.list(query("/v3/service_plans", "guids", guid, "include", "service_offering"))
+			if err != nil {
+				return nil, err
+			}
+			if len(plans) > 0 {
+				svc.ServicePlan.Guid = plans[0].GUID
+				svc.ServicePlan.Name = plans[0].Name
+				svc.Service.Name = offerings[plans[0].related("service_offering")].Name
+			}
+		}
+
+		bindings, apps, err := b.list(query("/v3/service_credential_bindings", "service_instance_guids", si.GUID, "include", "app"))
+		if err != nil {
+			return nil, err
+		}
+		for _, sb := range bindings {
+			if a, ok := apps[sb.related("app")]; ok {
+				svc.ApplicationNames = append(svc.ApplicationNames, a.Name)
+			}
+		}
+		services = append(services, svc)
+	}
+	return services, nil
+}
+
+func (b *APIBackend) SecurityGroupExists(name string) (bool, error) {
+	_, err := b.securityGroup(name)
+	if err != nil && isMissing(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *APIBackend) GlobalSecurityGroups(lifecycle string) ([]string, error) {
+	l, _, err := b.list(query("/v3/security_groups", "globally_enabled_"+lifecycle, "true"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, sg := range l {
+		names = append(names, sg.Name)
+	}
+	return names, nil
+}
+
+func (b *APIBackend) SpaceSecurityGroups(org, space, lifecycle string) ([]string, error) {
+	s, err := b.space(org, space)
+	if err != nil {
+		return nil, err
+	}
+	l, _, err := b.list(query("/v3/security_groups", lifecycle+"_space_guids", s.GUID))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, sg := range l {
+		names = append(names, sg.Name)
+	}
+	return names, nil
+}
+
+func (b *APIBackend) SSHAllowed(org, space string) (bool, error) {
+	s, err := b.space(org, space)
+	if err != nil {
+		return false, err
+	}
+	var feature struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := b.do("GET", "/v3/spaces/"+s.GUID+"/features/ssh", nil, &feature); err != nil {
+		return false, err
+	}
+	return feature.Enabled, nil
+}
+
+func (b *APIBackend) GetServiceBrokers() ([]string, error) {
+	l, _, err := b.list("/v3/service_brokers")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, sb := range l {
+		names = append(names, sb.Name)
+	}
+	return names, nil
+}
+
+func (b *APIBackend) GetServiceAccess(service string) ([]ServicePlanAccess, error) {
+	plans, _, err := b.list(query("/v3/service_plans", "service_offering_names", service))
+	if err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, NotFoundError{Kind: "Service", Name: service}
+	}
+
+	var l []ServicePlanAccess
+	for _, p := range plans {
+		a := ServicePlanAccess{Plan: p.Name, Public: p.VisibilityType == "public"}
+		if p.VisibilityType == "organization" {
+			var v struct {
+				Organizations []v3Ref `json:"organizations"`
+			}
+			if err := b.do("GET", "/v3/service_plans/"+p.GUID+"/visibility", nil, &v); err != nil {
+				return nil, err
+			}
+			for _, o := range v.Organizations {
+				a.Orgs = append(a.Orgs, o.Name)
+			}
+		}
+		l = append(l, a)
+	}
+	return l, nil
+}
+
+// CreateUser creates the user in UAA (which the Cloud Controller points
+// us to), and then makes the Cloud Controller aware of them.
+func (b *APIBackend) CreateUser(user, password string) error {
+	var root struct {
+		Links map[string]struct {
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := b.do("GET", "/", nil, &root); err != nil {
+		return err
+	}
+	uaa := root.Links["uaa"].Href
+	if uaa == "" {
+		return fmt.Errorf("the Cloud Controller did not tell us where UAA is")
+	}
+
+	in := map[string]interface{}{
+		"userName": user,
+		"password": password,
+		"origin":   "uaa",
+		"emails":   []map[string]string{{"value": user}},
+	}
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := b.do("POST", uaa+"/Users", in, &out); err != nil {
+		if e, ok := err.(*APIError); ok && e.Status == 409 {
+			return nil
+		}
+		return err
+	}
+	if out.ID == "" {
+		out.ID = placeholder("user", user)
+	}
+	return b.do("POST", "/v3/users", map[string]string{"guid": out.ID}, nil)
+}
+
+func (b *APIBackend) CreateSharedDomain(domain string) error {
+	return b.do("POST", "/v3/domains", map[string]interface{}{"name": domain}, nil)
+}
+
+// megabytes converts a memory size like `1G` or `512m` into megabytes;
+// `unlimited` (and -1) come back as nil.
+func megabytes(s string) (*int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "UNLIMITED" || s == "-1" {
+		return nil, nil
+	}
+	s = strings.TrimSuffix(s, "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "T"):
+		mult, s = 1024*1024, strings.TrimSuffix(s, "T")
+	case strings.HasSuffix(s, "G"):
+		mult, s = 1024, strings.TrimSuffix(s, "G")
+	case strings.HasSuffix(s, "M"):
+		s = strings.TrimSuffix(s, "M")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory size '%s'", s)
+	}
+	n *= mult
+	return &n, nil
+}
+
+func limit(s string) (*int64, error) {
+	if s == "unlimited" || s == "-1" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid limit '%s'", s)
+	}
+	return &n, nil
+}
+
+// quotaBody describes a quota the way the v3 API wants it, for both
+// organization and space quotas.  Like the cf commands, it only sets
+// the limits that the manifest gives.
+func quotaBody(name string, quota *Quota) (map[string]interface{}, error) {
+	apps := map[string]interface{}{}
+	services := map[string]interface{}{}
+	routes := map[string]interface{}{}
+
+	limits := []struct {
+		value string
+		group map[string]interface{}
+		key   string
+		parse func(string) (*int64, error)
+	}{
+		{quota.Memory["total"], apps, "total_memory_in_mb", megabytes},
+		{quota.Memory["per-app-instance"], apps, "per_process_memory_in_mb", megabytes},
+		{quota.TotalAppInstances, apps, "total_instances", limit},
+		{quota.ServiceInstances, services, "total_service_instances", limit},
+		{quota.Routes, routes, "total_routes", limit},
+		{quota.NumRoutesWithResPorts, routes, "total_reserved_ports", limit},
+	}
+	for _, l := range limits {
+		if l.value == "" {
+			continue
+		}
+		n, err := l.parse(l.value)
+		if err != nil {
+			return nil, err
+		}
+		l.group[l.key] = n
+	}
+	if quota.PaidPlans {
+		services["paid_services_allowed"] = true
+	}
+
+	body := map[string]interface{}{"name": name}
+	for k, v := range map[string]map[string]interface{}{"apps": apps, "services": services, "routes": routes} {
+		if len(v) > 0 {
+			body[k] = v
+		}
+	}
+	return body, nil
+}
+
+func (b *APIBackend) CreateQuota(name string) error {
+	if _, err := b.quota(name); err == nil || !isMissing(err) {
+		return err
+	}
+	return b.do("POST", "/v3/organization_quotas", map[string]interface{}{"name": name}, nil)
+}
+
+func (b *APIBackend) UpdateQuota(name string, quota *Quota) error {
+	q, err := b.quota(name)
+	guid, err := b.guid(q, err, "quota", name)
+	if err != nil {
+		return err
+	}
+	body, err := quotaBody(name, quota)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/organization_quotas/"+guid, body, nil)
+}
+
+func (b *APIBackend) CreateSecurityGroup(name string, rules []byte) error {
+	return b.do("POST", "/v3/security_groups", map[string]interface{}{
+		"name":  name,
+		"rules": json.RawMessage(rules),
+	}, nil)
+}
+
+func (b *APIBackend) UpdateSecurityGroup(name string, rules []byte) error {
+	sg, err := b.securityGroup(name)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/security_groups/"+sg.GUID, map[string]interface{}{
+		"rules": json.RawMessage(rules),
+	}, nil)
+}
+
+func (b *APIBackend) setGloballyEnabled(name, lifecycle string, on bool) error {
+	sg, err := b.securityGroup(name)
+	guid, err := b.guid(sg, err, "security-group", name)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/security_groups/"+guid, map[string]interface{}{
+		"globally_enabled": map[string]bool{lifecycle: on},
+	}, nil)
+}
+
+func (b *APIBackend) BindGlobalSecurityGroup(name, lifecycle string) error {
+	return b.setGloballyEnabled(name, lifecycle, true)
+}
+
+func (b *APIBackend) UnbindGlobalSecurityGroup(name, lifecycle string) error {
+	return b.setGloballyEnabled(name, lifecycle, false)
+}
+
+// BindSecurityGroup binds a security group to a space or, like the cf
+// command, to every space in an org if no space is given.
+func (b *APIBackend) BindSecurityGroup(name, org, space, lifecycle string) error {
+	if lifecycle == "" {
+		lifecycle = "running"
+	}
+	sg, err := b.securityGroup(name)
+	guid, err := b.guid(sg, err, "security-group", name)
+	if err != nil {
+		return err
+	}
+
+	var spaces v3ToMany
+	if space != "" {
+		s, err := b.spaceGUID(org, space)
+		if err != nil {
+			return err
+		}
+		spaces.Data = append(spaces.Data, v3Ref{GUID: s})
+	} else {
+		o, err := b.GetOrg(org)
+		if err != nil && !(b.record != nil && isMissing(err)) {
+			return err
+		}
+		for _, s := range o.Spaces {
+			spaces.Data = append(spaces.Data, v3Ref{GUID: s.Guid})
+		}
+	}
+	if len(spaces.Data) == 0 {
+		return nil
+	}
+	return b.do("POST", "/v3/security_groups/"+guid+"/relationships/"+lifecycle+"_spaces", spaces, nil)
+}
+
+func (b *APIBackend) UnbindSecurityGroup(name, org, space, lifecycle string) error {
+	if lifecycle == "" {
+		lifecycle = "running"
+	}
+	sg, err := b.securityGroup(name)
+	if err != nil {
+		return err
+	}
+	s, err := b.space(org, space)
+	if err != nil {
+		return err
+	}
+	return b.do("DELETE", "/v3/security_groups/"+sg.GUID+"/relationships/"+lifecycle+"_spaces/"+s.GUID, nil, nil)
+}
+
+func (b *APIBackend) CreateOrg(org string) error {
+	return b.do("POST", "/v3/organizations", map[string]interface{}{"name": org}, nil)
+}
+
+func (b *APIBackend) DeleteOrg(org string) error {
+	o, err := b.org(org)
+	if err != nil {
+		return err
+	}
+	return b.do("DELETE", "/v3/organizations/"+o.GUID, nil, nil)
+}
+
+// placeholder stands in for the GUID of something that has not been
+// created, because we are only recording (or in a DRYRUN.)
+func placeholder(kind, name string) string {
+	return fmt.Sprintf("<%s:%s>", kind, name)
+}
+
+func pending(guid string) bool {
+	return strings.HasPrefix(guid, "<")
+}
+
+// guid returns the GUID of a resource that was looked up or, when
+// recording, a placeholder for one that does not exist because an earlier
+// (recorded) change would have created it.
+func (b *APIBackend) guid(r v3Resource, err error, kind, name string) (string, error) {
+	if err != nil && b.record != nil && isMissing(err) {
+		return placeholder(kind, name), nil
+	}
+	return r.GUID, err
+}
+
+func (b *APIBackend) orgGUID(org string) (string, error) {
+	o, err := b.org(org)
+	return b.guid(o, err, "org", org)
+}
+
+func (b *APIBackend) spaceGUID(org, space string) (string, error) {
+	s, err := b.space(org, space)
+	return b.guid(s, err, "space", org+"/"+space)
+}
+
+func (b *APIBackend) appGUID(org, space, app string) (string, error) {
+	a, err := b.app(org, space, app)
+	return b.guid(a, err, "app", org+"/"+space+"/"+app)
+}
+
+func (b *APIBackend) CreateOrgDomain(org, domain string) error {
+	guid, err := b.orgGUID(org)
+	if err != nil {
+		return err
+	}
+
+	d, err := b.domain(domain)
+	if err == nil {
+		return b.do("POST", "/v3/domains/"+d.GUID+"/relationships/shared_organizations", v3ToMany{Data: []v3Ref{{GUID: guid}}}, nil)
+	}
+	if !isMissing(err) {
+		return err
+	}
+	return b.do("POST", "/v3/domains", map[string]interface{}{
+		"name":          domain,
+		"relationships": map[string]v3Relationship{"organization": to(guid)},
+	}, nil)
+}
+
+func (b *APIBackend) SetOrgQuota(org, quota string) error {
+	guid, err := b.orgGUID(org)
+	if err != nil {
+		return err
+	}
+	q, err := b.quota(quota)
+	qguid, err := b.guid(q, err, "quota", quota)
+	if err != nil {
+		return err
+	}
+	return b.do("POST", "/v3/organization_quotas/"+qguid+"/relationships/organizations", v3ToMany{Data: []v3Ref{{GUID: guid}}}, nil)
+}
+
+func (b *APIBackend) CreateSpaceQuota(org, name string, quota *Quota) error {
+	guid, err := b.orgGUID(org)
+	if err != nil {
+		return err
+	}
+	body, err := quotaBody(name, quota)
+	if err != nil {
+		return err
+	}
+	body["relationships"] = map[string]v3Relationship{"organization": to(guid)}
+	return b.do("POST", "/v3/space_quotas", body, nil)
+}
+
+func (b *APIBackend) UpdateSpaceQuota(org, name string, quota *Quota) error {
+	q, err := b.spaceQuota(org, name)
+	if err != nil {
+		return err
+	}
+	body, err := quotaBody(name, quota)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/space_quotas/"+q.GUID, body, nil)
+}
+
+func (b *APIBackend) setRole(scope, guid, user, role string) error {
+	typ, ok := roleTypes[role]
+	if !ok {
+		return fmt.Errorf("unknown role '%s'", role)
+	}
+	return b.do("POST", "/v3/roles", map[string]interface{}{
+		"type": typ,
+		"relationships": map[string]v3Relationship{
+			"user": {Data: &v3Ref{Username: user}},
+			scope:  to(guid),
+		},
+	}, nil)
+}
+
+func (b *APIBackend) unsetRole(scope, guid, user, role string) error {
+	typ, ok := roleTypes[role]
+	if !ok {
+		return fmt.Errorf("unknown role '%s'", role)
+	}
+	l, users, err := b.list(query("/v3/roles", scope+"_guids", guid, "types", typ, "include", "user"))
+	if err != nil {
+		return err
+	}
+	for _, r := range l {
+		if users[r.related("user")].Username == user {
+			return b.do("DELETE", "/v3/roles/"+r.GUID, nil, nil)
+		}
+	}
+	return nil
+}
+
+func (b *APIBackend) SetOrgRole(org, user, role string) error {
+	guid, err := b.orgGUID(org)
+	if err != nil {
+		return err
+	}
+	return b.setRole("organization", guid, user, role)
+}
+
+func (b *APIBackend) UnsetOrgRole(org, user, role string) error {
+	o, err := b.org(org)
+	if err != nil {
+		return err
+	}
+	return b.unsetRole("organization", o.GUID, user, role)
+}
+
+func (b *APIBackend) CreateSpace(org, space string) error {
+	guid, err := b.orgGUID(org)
+	if err != nil {
+		return err
+	}
+	return b.do("POST", "/v3/spaces", map[string]interface{}{
+		"name":          space,
+		"relationships": map[string]v3Relationship{"organization": to(guid)},
+	}, nil)
+}
+
+func (b *APIBackend) DeleteSpace(org, space string) error {
+	s, err := b.space(org, space)
+	if err != nil {
+		return err
+	}
+	return b.do("DELETE", "/v3/spaces/"+s.GUID, nil, nil)
+}
+
+func (b *APIBackend) AllowSSH(org, space string, on bool) error {
+	guid, err := b.spaceGUID(org, space)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/spaces/"+guid+"/features/ssh", map[string]bool{"enabled": on}, nil)
+}
+
+func (b *APIBackend) SetSpaceQuota(org, space, quota string) error {
+	guid, err := b.spaceGUID(org, space)
+	if err != nil {
+		return err
+	}
+	q, err := b.spaceQuota(org, quota)
+	qguid, err := b.guid(q, err, "space-quota", org+"/"+quota)
+	if err != nil {
+		return err
+	}
+	return b.do("POST", "/v3/space_quotas/"+qguid+"/relationships/spaces", v3ToMany{Data: []v3Ref{{GUID: guid}}}, nil)
+}
+
+func (b *APIBackend) SetSpaceRole(org, space, user, role string) error {
+	guid, err := b.spaceGUID(org, space)
+	if err != nil {
+		return err
+	}
+	return b.setRole("space", guid, user, role)
+}
+
+func (b *APIBackend) UnsetSpaceRole(org, space, user, role string) error {
+	s, err := b.space(org, space)
+	if err != nil {
+		return err
+	}
+	return b.unsetRole("space", s.GUID, user, role)
+}
+
+func (b *APIBackend) DeleteOrphanedRoutes(org, space string) error {
+	s, err := b.space(org, space)
+	if err != nil {
+		return err
+	}
+	return b.do("DELETE", query("/v3/spaces/"+s.GUID+"/routes", "unmapped", "true"), nil, nil)
+}
+
+// zipDirectory packs up an application directory for upload, leaving
+// out any .git directory.
+func zipDirectory(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		h, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		h.Name = filepath.ToSlash(rel)
+		h.Method = zip.Deflate
+		w, err := z.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *APIBackend) uploadBits(pkg, dir string) error {
+	if os.Getenv("DEBUG") != "" {
+		fmt.Printf(">> POST /v3/packages/%s/upload (%s)\n", pkg, dir)
+	}
+	if b.change([]string{"POST", "/v3/packages/" + pkg + "/upload", dir}) {
+		return nil
+	}
+	if os.Getenv("DRYRUN") != "" {
+		return nil
+	}
+
+	bits, err := zipDirectory(dir)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("bits", "application.zip")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(bits); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := b.send("POST", "/v3/packages/"+pkg+"/upload", w.FormDataContentType(), &body, nil, true); err != nil {
+		return err
+	}
+
+	return b.poll("package "+pkg+" upload", func() (bool, error) {
+		var p v3Resource
+		if err := b.do("GET", "/v3/packages/"+pkg, nil, &p); err != nil {
+			return false, err
+		}
+		if p.State == "FAILED" || p.State == "EXPIRED" {
+			return false, fmt.Errorf("package upload for %s failed", dir)
+		}
+		return p.State == "READY", nil
+	})
+}
+
+// defaultDomain is the domain that apps get routes on when the manifest
+// doesn't say: the first shared domain.
+func (b *APIBackend) defaultDomain() (v3Resource, error) {
+	l, _, err := b.list("/v3/domains")
+	if err != nil {
+		return v3Resource{}, err
+	}
+	for _, d := range l {
+		if d.related("organization") == "" {
+			return d, nil
+		}
+	}
+	return v3Resource{}, NotFoundError{Kind: "Domain", Name: "(default)"}
+}
+
+// PushApp does what `cf push --no-start` does: it creates (or updates)
+// the app, scales it, gives it its route and uploads a new package.
+// Staging happens when it is started.
+func (b *APIBackend) PushApp(org, space string, app *Application, path string) error {
+	sguid, err := b.spaceGUID(org, space)
+	if err != nil {
+		return err
+	}
+
+	lifecycle := map[string]interface{}{"type": "docker", "data": map[string]interface{}{}}
+	if app.Image == "" {
+		var buildpacks []string
+		if app.Buildpack != "" {
+			buildpacks = append(buildpacks, app.Buildpack)
+		}
+		lifecycle = map[string]interface{}{"type": "buildpack", "data": map[string]interface{}{"buildpacks": buildpacks}}
+	}
+
+	var a v3Resource
+	existing, err := b.app(org, space, app.Name)
+	if err == nil {
+		a = existing
+		if err := b.do("PATCH", "/v3/apps/"+a.GUID, map[string]interface{}{"lifecycle": lifecycle}, nil); err != nil {
+			return err
+		}
+	} else if isMissing(err) {
+		if err := b.do("POST", "/v3/apps", map[string]interface{}{
+			"name":          app.Name,
+			"lifecycle":     lifecycle,
+			"relationships": map[string]v3Relationship{"space": to(sguid)},
+		}, &a); err != nil {
+			return err
+		}
+		if a.GUID == "" {
+			a.GUID = placeholder("app", org+"/"+space+"/"+app.Name)
+		}
+	} else {
+		return err
+	}
+
+	scale := map[string]interface{}{"instances": app.Instances}
+	if app.Memory != "" {
+		mb, err := megabytes(app.Memory)
+		if err != nil {
+			return err
+		}
+		scale["memory_in_mb"] = mb
+	}
+	if app.Disk != "" {
+		mb, err := megabytes(app.Disk)
+		if err != nil {
+			return err
+		}
+		scale["disk_in_mb"] = mb
+	}
+	if err := b.do("POST", "/v3/apps/"+a.GUID+"/processes/web/actions/scale", scale, nil); err != nil {
+		return err
+	}
+
+	/* without a list of urls, apps get a route from their hostname
+	   and domain, like `cf push -n ... -d ...` would give them */
+	if len(app.URLs) == 0 && !app.NoRoute {
+		url := URL{Host: app.Hostname, Domain: app.Domain}
+		if url.Host == "" {
+			url.Host = app.Name
+		}
+		if url.Domain == "" {
+			d, err := b.defaultDomain()
+			if err != nil {
+				return err
+			}
+			url.Domain = d.Name
+		}
+		if err := b.MapRoute(org, space, app.Name, url); err != nil {
+			return err
+		}
+	}
+
+	if app.Image != "" {
+		return b.do("POST", "/v3/packages", map[string]interface{}{
+			"type":          "docker",
+			"data":          map[string]string{"image": app.Image},
+			"relationships": map[string]v3Relationship{"app": to(a.GUID)},
+		}, nil)
+	}
+
+	var pkg v3Resource
+	if err := b.do("POST", "/v3/packages", map[string]interface{}{
+		"type":          "bits",
+		"relationships": map[string]v3Relationship{"app": to(a.GUID)},
+	}, &pkg); err != nil {
+		return err
+	}
+	if pkg.GUID == "" {
+		pkg.GUID = placeholder("package", org+"/"+space+"/"+app.Name)
+	}
+	return b.uploadBits(pkg.GUID, path)
+}
+
+func (b *APIBackend) DeleteApp(org, space, app string) error {
+	a, err := b.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	return b.do("DELETE", "/v3/apps/"+a.GUID, nil, nil)
+}
+
+func (b *APIBackend) RenameApp(org, space, app, name string) error {
+	a, err := b.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/apps/"+a.GUID, map[string]interface{}{"name": name}, nil)
+}
+
+func (b *APIBackend) route(space, domain string, url URL) (v3Resource, error) {
+	return b.find("Route", url.String(), "/v3/routes", "hosts", url.Host, "domain_guids", domain, "space_guids", space)
+}
+
+func (b *APIBackend) MapRoute(org, space, app string, url URL) error {
+	sguid, err := b.spaceGUID(org, space)
+	if err != nil {
+		return err
+	}
+	aguid, err := b.appGUID(org, space, app)
+	if err != nil {
+		return err
+	}
+	d, err := b.domain(url.Domain)
+	if err != nil {
+		return err
+	}
+
+	var r v3Resource
+	err = NotFoundError{Kind: "Route", Name: url.String()}
+	if !pending(sguid) {
+		r, err = b.route(sguid, d.GUID, url)
+	}
+	if err != nil && isMissing(err) {
+		err = b.do("POST", "/v3/routes", map[string]interface{}{
+			"host": url.Host,
+			"relationships": map[string]v3Relationship{
+				"space":  to(sguid),
+				"domain": to(d.GUID),
+			},
+		}, &r)
+		if r.GUID == "" {
+			r.GUID = placeholder("route", url.String())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return b.do("POST", "/v3/routes/"+r.GUID+"/destinations", map[string]interface{}{
+		"destinations": []map[string]v3Ref{{"app": {GUID: aguid}}},
+	}, nil)
+}
+
+func (b *APIBackend) UnmapRoute(org, space, app string, url URL) error {
+	s, err := b.space(org, space)
+	if err != nil {
+		return err
+	}
+	a, err := b.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	d, err := b.domain(url.Domain)
+	if err != nil {
+		return err
+	}
+	r, err := b.route(s.GUID, d.GUID, url)
+	if err != nil {
+		return err
+	}
+
+	for _, dest := range r.Destinations {
+		if dest.App.GUID == a.GUID {
+			return b.do("DELETE", "/v3/routes/"+r.GUID+"/destinations/"+dest.GUID, nil, nil)
+		}
+	}
+	return nil
+}
+
+func (b *APIBackend) SetEnv(org, space, app, name, value string) error {
+	guid, err := b.appGUID(org, space, app)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/apps/"+guid+"/environment_variables", map[string]interface{}{
+		"var": map[string]string{name: value},
+	}, nil)
+}
+
+func (b *APIBackend) UnsetEnv(org, space, app, name string) error {
+	guid, err := b.appGUID(org, space, app)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/apps/"+guid+"/environment_variables", map[string]interface{}{
+		"var": map[string]interface{}{name: nil},
+	}, nil)
+}
+
+// StartApp stages the app's newest package (unless it already has been),
+// makes that the app's current droplet, and starts the app -- restarting
+// it if it was running a different droplet.
+func (b *APIBackend) StartApp(org, space, app string) error {
+	return b.start(org, space, app, false)
+}
+
+// RestageApp is StartApp, staging the app's newest package again even if
+// it already has been.
+func (b *APIBackend) RestageApp(org, space, app string) error {
+	return b.start(org, space, app, true)
+}
+
+func (b *APIBackend) ScaleApp(org, space, app string, instances int) error {
+	a, err := b.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	return b.do("POST", "/v3/apps/"+a.GUID+"/processes/web/actions/scale", map[string]interface{}{"instances": instances}, nil)
+}
+
+func (b *APIBackend) start(org, space, app string, restage bool) error {
+	a, err := b.app(org, space, app)
+	if err != nil {
+		if b.record != nil && isMissing(err) {
+			guid, _ := b.guid(a, err, "app", org+"/"+space+"/"+app)
+			return b.do("POST", "/v3/apps/"+guid+"/actions/start", nil, nil)
+		}
+		return err
+	}
+
+	pkgs, _, err := b.list(query("/v3/packages", "app_guids", a.GUID, "order_by", "-created_at", "per_page", "1"))
+	if err != nil {
+		return err
+	}
+	if len(pkgs) == 0 {
+		return fmt.Errorf("app %s has nothing to stage", app)
+	}
+
+	var droplet string
+	staged, _, err := b.list(query("/v3/droplets", "package_guids", pkgs[0].GUID, "states", "STAGED"))
+	if err != nil {
+		return err
+	}
+	if len(staged) > 0 && !restage {
+		droplet = staged[0].GUID
+	} else {
+		var build v3Resource
+		if err := b.do("POST", "/v3/builds", map[string]interface{}{"package": v3Ref{GUID: pkgs[0].GUID}}, &build); err != nil {
+			return err
+		}
+		if b.record == nil && os.Getenv("DRYRUN") == "" {
+			err := b.poll("app "+app+" to stage", func() (bool, error) {
+				if err := b.do("GET", "/v3/builds/"+build.GUID, nil, &build); err != nil {
+					return false, err
+				}
+				if build.State == "FAILED" {
+					return false, fmt.Errorf("app %s failed to stage: %s", app, build.Error)
+				}
+				return build.State == "STAGED", nil
+			})
+			if err != nil {
+				return err
+			}
+			if build.Droplet != nil {
+				droplet = build.Droplet.GUID
+			}
+		}
+	}
+	if droplet == "" {
+		droplet = placeholder("droplet", org+"/"+space+"/"+app)
+	}
+
+	var current struct {
+		Data *v3Ref `json:"data"`
+	}
+	if err := b.do("GET", "/v3/apps/"+a.GUID+"/relationships/current_droplet", nil, &current); err != nil && !isMissing(err) {
+		return err
+	}
+	if current.Data != nil && current.Data.GUID == droplet && a.State == "STARTED" {
+		return nil
+	}
+
+	if err := b.do("PATCH", "/v3/apps/"+a.GUID+"/relationships/current_droplet", v3Relationship{Data: &v3Ref{GUID: droplet}}, nil); err != nil {
+		return err
+	}
+	if a.State == "STARTED" {
+		return b.do("POST", "/v3/apps/"+a.GUID+"/actions/restart", nil, nil)
+	}
+	return b.do("POST", "/v3/apps/"+a.GUID+"/actions/start", nil, nil)
+}
+
+// serviceConfig adds the parameters (JSON) and tags of a service instance
+// to the body of a request that creates or updates it.
+func serviceConfig(body map[string]interface{}, parameters string, tags []string) map[string]interface{} {
+	if parameters != "" {
+		body["parameters"] = json.RawMessage(parameters)
+	}
+	if len(tags) > 0 {
+		body["tags"] = tags
+	}
+	return body
+}
+
+func (b *APIBackend) CreateService(org, space, name, service, plan, parameters string, tags []string) error {
+	sguid, err := b.spaceGUID(org, space)
+	if err != nil {
+		return err
+	}
+	params := []string{"names", plan, "service_offering_names", service}
+	if !pending(sguid) {
+		params = append(params, "space_guids", sguid)
+	}
+	p, err := b.find("Service plan", service+"/"+plan, "/v3/service_plans", params...)
+	if err != nil {
+		return err
+	}
+	return b.begin("POST", "/v3/service_instances", serviceConfig(map[string]interface{}{
+		"type": "managed",
+		"name": name,
+		"relationships": map[string]v3Relationship{
+			"space":        to(sguid),
+			"service_plan": to(p.GUID),
+		},
+	}, parameters, tags), nil)
+}
+
+func (b *APIBackend) UpdateService(org, space, name, plan, parameters string, tags []string) error {
+	s, err := b.GetService(org, space, name)
+	if err != nil {
+		return err
+	}
+	body := serviceConfig(map[string]interface{}{}, parameters, tags)
+	if plan != "" {
+		p, err := b.find("Service plan", s.ServiceOffering.Name+"/"+plan, "/v3/service_plans",
+			"names", plan, "service_offering_names", s.ServiceOffering.Name)
+		if err != nil {
+			return err
+		}
+		body["relationships"] = map[string]v3Relationship{"service_plan": to(p.GUID)}
+	}
+	return b.begin("PATCH", "/v3/service_instances/"+s.Guid, body, nil)
+}
+
+func (b *APIBackend) DeleteService(org, space, name string) error {
+	si, err := b.serviceInstance(org, space, name)
+	if err != nil {
+		return err
+	}
+	return b.do("DELETE", "/v3/service_instances/"+si.GUID, nil, nil)
+}
+
+func (b *APIBackend) binding(org, space, app, name string) (string, string, v3Resource, error) {
+	aguid, err := b.appGUID(org, space, app)
+	if err != nil {
+		return "", "", v3Resource{}, err
+	}
+	si, err := b.serviceInstance(org, space, name)
+	siguid, err := b.guid(si, err, "service", org+"/"+space+"/"+name)
+	if err != nil {
+		return "", "", v3Resource{}, err
+	}
+	if pending(siguid) || pending(aguid) {
+		return aguid, siguid, v3Resource{}, NotFoundError{Kind: "Service binding", Name: app + "/" + name}
+	}
+	sb, err := b.find("Service binding", app+"/"+name, "/v3/service_credential_bindings", "app_guids", aguid, "service_instance_guids", siguid)
+	return aguid, siguid, sb, err
+}
+
+func (b *APIBackend) BindService(org, space, app, name string) error {
+	aguid, siguid, _, err := b.binding(org, space, app, name)
+	if err == nil {
+		/* already bound, just like `cf bind-service` says */
+		return nil
+	}
+	if !isMissing(err) {
+		return err
+	}
+	return b.do("POST", "/v3/service_credential_bindings", map[string]interface{}{
+		"type": "app",
+		"relationships": map[string]v3Relationship{
+			"app":              to(aguid),
+			"service_instance": to(siguid),
+		},
+	}, nil)
+}
+
+func (b *APIBackend) UnbindService(org, space, app, name string) error {
+	_, _, sb, err := b.binding(org, space, app, name)
+	if err != nil {
+		if isMissing(err) {
+			return nil
+		}
+		return err
+	}
+	return b.do("DELETE", "/v3/service_credential_bindings/"+sb.GUID, nil, nil)
+}
+
+func cupsBody(name, credentials, route, syslog string) (map[string]interface{}, error) {
+	body := map[string]interface{}{"name": name}
+	if credentials != "" {
+		var creds interface{}
+		if err := json.Unmarshal([]byte(credentials), &creds); err != nil {
+			return nil, err
+		}
+		body["credentials"] = creds
+	}
+	if route != "" {
+		body["route_service_url"] = route
+	}
+	if syslog != "" {
+		body["syslog_drain_url"] = syslog
+	}
+	return body, nil
+}
+
+func (b *APIBackend) CreateUserProvidedService(org, space, name, credentials, route, syslog string) error {
+	sguid, err := b.spaceGUID(org, space)
+	if err != nil {
+		return err
+	}
+	body, err := cupsBody(name, credentials, route, syslog)
+	if err != nil {
+		return err
+	}
+	body["type"] = "user-provided"
+	body["relationships"] = map[string]v3Relationship{"space": to(sguid)}
+	return b.do("POST", "/v3/service_instances", body, nil)
+}
+
+func (b *APIBackend) UpdateUserProvidedService(org, space, name, credentials, route, syslog string) error {
+	si, err := b.serviceInstance(org, space, name)
+	if err != nil {
+		return err
+	}
+	body, err := cupsBody(name, credentials, route, syslog)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/service_instances/"+si.GUID, body, nil)
+}
+
+func brokerAuthentication(username, password string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "basic",
+		"credentials": map[string]string{
+			"username": username,
+			"password": password,
+		},
+	}
+}
+
+func (b *APIBackend) CreateServiceBroker(name, username, password, url, org, space string) error {
+	body := map[string]interface{}{
+		"name":           name,
+		"url":            url,
+		"authentication": brokerAuthentication(username, password),
+	}
+	if space != "" {
+		sguid, err := b.spaceGUID(org, space)
+		if err != nil {
+			return err
+		}
+		body["relationships"] = map[string]v3Relationship{"space": to(sguid)}
+	}
+	return b.do("POST", "/v3/service_brokers", body, nil)
+}
+
+func (b *APIBackend) UpdateServiceBroker(name, username, password, url string) error {
+	sb, err := b.find("Service broker", name, "/v3/service_brokers", "names", name)
+	if err != nil {
+		return err
+	}
+	return b.do("PATCH", "/v3/service_brokers/"+sb.GUID, map[string]interface{}{
+		"url":            url,
+		"authentication": brokerAuthentication(username, password),
+	}, nil)
+}
+
+// servicePlans looks up the plans of a service (or just the one named),
+// or, when recording, a placeholder for them, if the broker that offers
+// the service would only have been registered by an earlier change.
+func (b *APIBackend) servicePlans(service, plan string) ([]v3Resource, error) {
+	name, params := service, []string{"service_offering_names", service}
+	if plan != "" {
+		name, params = service+"/"+plan, append(params, "names", plan)
+	}
+	l, _, err := b.list(query("/v3/service_plans", params...))
+	if err != nil {
+		return nil, err
+	}
+	if len(l) == 0 {
+		if b.record != nil {
+			return []v3Resource{{GUID: placeholder("service-plan", name)}}, nil
+		}
+		return nil, NotFoundError{Kind: "Service plan", Name: name}
+	}
+	return l, nil
+}
+
+func (b *APIBackend) EnableServiceAccess(service, plan, org string) error {
+	plans, err := b.servicePlans(service, plan)
+	if err != nil {
+		return err
+	}
+	var oguid string
+	if org != "" {
+		if oguid, err = b.orgGUID(org); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range plans {
+		if org == "" {
+			err = b.do("PATCH", "/v3/service_plans/"+p.GUID+"/visibility", map[string]interface{}{"type": "public"}, nil)
+		} else {
+			err = b.do("POST", "/v3/service_plans/"+p.GUID+"/visibility", map[string]interface{}{
+				"type":          "organization",
+				"organizations": []v3Ref{{GUID: oguid}},
+			}, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *APIBackend) DisableServiceAccess(service, plan, org string) error {
+	plans, err := b.servicePlans(service, plan)
+	if err != nil {
+		return err
+	}
+	var oguid string
+	if org != "" {
+		if oguid, err = b.orgGUID(org); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range plans {
+		if org == "" {
+			/* only admins can see it now */
+			err = b.do("PATCH", "/v3/service_plans/"+p.GUID+"/visibility", map[string]interface{}{"type": "admin"}, nil)
+		} else {
+			err = b.do("DELETE", "/v3/service_plans/"+p.GUID+"/visibility/"+oguid, nil, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A ccapi stands in for the Cloud Controller v3 API.  It answers each
+// request (its method, path and query) with the responses set up for it,
+// in turn, repeating the last one, and logs the requests it gets.
+type ccapi struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string][]ccResponse
+	requests  []string
+}
+
+type ccResponse struct {
+	status   int
+	body     string
+	location string
+}
+
+func newCCAPI(t *testing.T) *ccapi {
+	c := &ccapi{responses: map[string][]ccResponse{}}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "bearer t0ken" {
+			http.Error(w, `{"errors":[{"code":1000,"title":"CF-InvalidAuthToken","detail":"Invalid Auth Token"}]}`, 401)
+			return
+		}
+		req := r.Method + " " + r.URL.RequestURI()
+		body, _ := ioutil.ReadAll(r.Body)
+		log := req
+		if len(body) > 0 {
+			log += " " + string(body)
+		}
+
+		c.mu.Lock()
+		c.requests = append(c.requests, log)
+		l, ok := c.responses[req]
+		if len(l) > 1 {
+			c.responses[req] = l[1:]
+		}
+		c.mu.Unlock()
+
+		if !ok {
+			t.Logf("unexpected request: %s", log)
+			http.Error(w, `{"errors":[{"code":10000,"title":"CF-NotFound","detail":"Unknown request"}]}`, 404)
+			return
+		}
+		res := l[0]
+		if res.location != "" {
+			w.Header().Set("Location", c.URL+res.location)
+		}
+		if res.status == 0 {
+			res.status = 200
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(res.status)
+		w.Write([]byte(res.body))
+	}))
+	return c
+}
+
+// on sets up the responses to a request, like `GET /v3/organizations`,
+// in place of any it had.
+func (c *ccapi) on(req string, res ...ccResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses[req] = res
+}
+
+// got returns the requests made, other than GETs, unless asked for.
+func (c *ccapi) got(gets bool) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var l []string
+	for _, r := range c.requests {
+		if gets || !strings.HasPrefix(r, "GET ") {
+			l = append(l, r)
+		}
+	}
+	return l
+}
+
+func (c *ccapi) backend() *APIBackend {
+	b := NewAPIBackend(c.URL+"/", func() (string, error) { return "bearer t0ken", nil }, nil)
+	b.PollInterval = time.Millisecond
+	b.Timeout = time.Second
+	return b
+}
+
+func ok(body string) ccResponse {
+	return ccResponse{body: body}
+}
+
+func page(resources ...string) ccResponse {
+	return ok(`{"pagination":{"next":null},"resources":[` + strings.Join(resources, ",") + `]}`)
+}
+
+// orgAndSpace sets up org `o` (o-guid) with space `s` (s-guid) in it.
+func (c *ccapi) orgAndSpace() {
+	c.on("GET /v3/organizations?names=o", page(`{"guid":"o-guid","name":"o"}`))
+	c.on("GET /v3/spaces?names=s&organization_guids=o-guid", page(`{"guid":"s-guid","name":"s"}`))
+}
+
+func TestAPIPages(t *testing.T) {
+	c := newCCAPI(t)
+	defer c.Close()
+	c.on("GET /v3/organizations", ok(`{
+		"pagination": {"next": {"href": "`+c.URL+`/v3/organizations?page=2"}},
+		"resources": [{"guid": "o1", "name": "system"}, {"guid": "o2", "name": "dev"}]
+	}`))
+	c.on("GET /v3/organizations?page=2", page(`{"guid": "o3", "name": "prod"}`))
+
+	orgs, err := c.backend().GetOrgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range orgs {
+		names = append(names, o.Name)
+	}
+	if want := []string{"system", "dev", "prod"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got orgs %v, want %v", names, want)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	c := newCCAPI(t)
+	defer c.Close()
+	b := c.backend()
+
+	c.on("GET /v3/organizations?names=nope", page())
+	if err := b.DeleteOrg("nope"); !notFound(err) {
+		t.Errorf("deleting a missing org: got %v, want it not to be found", err)
+	}
+
+	c.on(`POST /v3/organizations`, ccResponse{status: 422, body: `{"errors":[{"code":10008,"title":"CF-UnprocessableEntity","detail":"Organization 'o' already exists."}]}`})
+	err := b.CreateOrg("o")
+	if e, ok := err.(*APIError); !ok || e.Status != 422 {
+		t.Fatalf("got %#v, want a 422 APIError", err)
+	}
+	if want := "POST /v3/organizations failed with 422: Organization 'o' already exists. (CF-UnprocessableEntity)"; err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+
+	b = NewAPIBackend(c.URL, func() (string, error) { return "bearer expired", nil }, nil)
+	if _, err := b.GetOrgs(); err == nil || !strings.Contains(err.Error(), "Invalid Auth Token") {
+		t.Errorf("with a bad token: got %v", err)
+	}
+}
+
+func TestAPIJobs(t *testing.T) {
+	c := newCCAPI(t)
+	defer c.Close()
+	b := c.backend()
+
+	c.orgAndSpace()
+	c.on("DELETE /v3/organizations/o-guid", ccResponse{status: 202, location: "/v3/jobs/j1"})
+	c.on("GET /v3/jobs/j1", ok(`{"state":"PROCESSING"}`), ok(`{"state":"PROCESSING"}`), ok(`{"state":"COMPLETE"}`))
+	if err := b.DeleteOrg("o"); err != nil {
+		t.Fatal(err)
+	}
+	polls := 0
+	for _, r := range c.got(true) {
+		if r == "GET /v3/jobs/j1" {
+			polls++
+		}
+	}
+	if polls != 3 {
+		t.Errorf("polled the job %d times, want 3", polls)
+	}
+
+	c.on("DELETE /v3/spaces/s-guid", ccResponse{status: 202, location: "/v3/jobs/j2"})
+	c.on("GET /v3/jobs/j2", ok(`{"state":"FAILED","errors":[{"detail":"Space has service instances"}]}`))
+	if err := b.DeleteSpace("o", "s"); err == nil || !strings.Contains(err.Error(), "Space has service instances") {
+		t.Errorf("got %v, want the job's error", err)
+	}
+
+	c.on("DELETE /v3/organizations/o-guid", ccResponse{status: 202, location: "/v3/jobs/j3"})
+	c.on("GET /v3/jobs/j3", ok(`{"state":"PROCESSING"}`))
+	b.Timeout = 20 * time.Millisecond
+	if err := b.DeleteOrg("o"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got %v, want it to time out", err)
+	}
+}
+
+func TestAPIRecord(t *testing.T) {
+	c := newCCAPI(t)
+	defer c.Close()
+	b := c.backend()
+
+	var calls [][]string
+	b.Record(func(call []string) { calls = append(calls, call) })
+	c.on("GET /v3/organizations?names=new", page())
+	if err := b.CreateOrg("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CreateSpace("new", "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.got(false); len(got) != 0 {
+		t.Errorf("changes were made while recording: %v", got)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("got calls %v, want two", calls)
+	}
+	if want := []string{"POST", "/v3/organizations", `{"name":"new"}`}; !reflect.DeepEqual(calls[0], want) {
+		t.Errorf("got call %v, want %v", calls[0], want)
+	}
+	/* the org doesn't exist yet, so the space refers to it by name */
+	if len(calls[1]) != 3 || !strings.Contains(calls[1][2], `"name":"dev"`) || !strings.Contains(calls[1][2], `"guid":"<`) {
+		t.Errorf("got call %v, want a space in a placeholder org", calls[1])
+	}
+}
+
+func TestAPISetEnv(t *testing.T) {
+	c := newCCAPI(t)
+	defer c.Close()
+
+	c.orgAndSpace()
+	c.on("GET /v3/apps?names=web&space_guids=s-guid", page(`{"guid":"web-guid","name":"web"}`))
+	c.on("PATCH /v3/apps/web-guid/environment_variables", ok(`{"var":{}}`))
+	if err := c.backend().SetEnv("o", "s", "web", "GREETING", "<hello & welcome>"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.got(false), []string{`PATCH /v3/apps/web-guid/environment_variables {"var":{"GREETING":"<hello & welcome>"}}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+}
+
+func TestAPISecurityGroupLifecycles(t *testing.T) {
+	c := newCCAPI(t)
+	defer c.Close()
+	b := c.backend()
+
+	c.orgAndSpace()
+	c.on("GET /v3/security_groups?staging_space_guids=s-guid", page(`{"guid":"sg1","name":"build-proxy"}`))
+	c.on("GET /v3/security_groups?running_space_guids=s-guid", page(`{"guid":"sg2","name":"db"}`, `{"guid":"sg3","name":"mq"}`))
+	for lifecycle, want := range map[string][]string{
+		"staging": {"build-proxy"},
+		"running": {"db", "mq"},
+	} {
+		have, err := b.SpaceSecurityGroups("o", "s", lifecycle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("got %s security groups %v, want %v", lifecycle, have, want)
+		}
+	}
+
+	c.on("GET /v3/security_groups?names=build-proxy", page(`{"guid":"sg1","name":"build-proxy"}`))
+	c.on("DELETE /v3/security_groups/sg1/relationships/staging_spaces/s-guid", ccResponse{status: 204})
+	if err := b.UnbindSecurityGroup("build-proxy", "o", "s", "staging"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.got(false), []string{"DELETE /v3/security_groups/sg1/relationships/staging_spaces/s-guid"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+}
+
+// Brokers can take much longer than any job should be waited on, so
+// creating or updating a service instance returns as soon as the Cloud
+// Controller has taken it on, and its last operation says how it went.
+func TestAPIServiceInstances(t *testing.T) {
+	c := newCCAPI(t)
+	defer c.Close()
+	b := c.backend()
+
+	c.orgAndSpace()
+	c.on("GET /v3/service_plans?names=large&service_offering_names=postgres&space_guids=s-guid", page(`{"guid":"large-guid","name":"large"}`))
+	c.on("POST /v3/service_instances", ccResponse{status: 202, location: "/v3/jobs/j1"})
+	c.on("GET /v3/jobs/j1", ok(`{"state":"POLLING"}`))
+	if err := b.CreateService("o", "s", "db", "postgres", "large", `{"extensions":["hstore"]}`, []string{"primary"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.on("GET /v3/service_instances?names=db&space_guids=s-guid", page(`{
+		"guid": "db-guid", "name": "db", "type": "managed", "tags": ["primary"],
+		"last_operation": {"type": "create", "state": "in progress"},
+		"relationships": {"service_plan": {"data": {"guid": "large-guid"}}}
+	}`))
+	c.on("GET /v3/service_plans?guids=large-guid&include=service_offering", ok(`{
+		"pagination": {"next": null},
+		"resources": [{"guid": "large-guid", "name": "large", "relationships": {"service_offering": {"data": {"guid": "pg-guid"}}}}],
+		"included": {"service_offerings": [{"guid": "pg-guid", "name": "postgres"}]}
+	}`))
+	s, err := b.GetService("o", "s", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LastOperation.State != "in progress" || s.ServicePlan.Name != "large" || s.ServiceOffering.Name != "postgres" {
+		t.Errorf("got service instance %+v", s)
+	}
+	tags, err := b.GetServiceTags("o", "s", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"primary"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("got tags %v, want %v", tags, want)
+	}
+
+	c.on("PATCH /v3/service_instances/db-guid", ccResponse{status: 202, location: "/v3/jobs/j2"})
+	c.on("GET /v3/jobs/j2", ok(`{"state":"POLLING"}`))
+	if err := b.UpdateService("o", "s", "db", "", "", []string{"primary", "replicated"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`POST /v3/service_instances {"name":"db","parameters":{"extensions":["hstore"]},"relationships":{"service_plan":{"data":{"guid":"large-guid"}},"space":{"data":{"guid":"s-guid"}}},"tags":["primary"],"type":"managed"}`,
+		`PATCH /v3/service_instances/db-guid {"tags":["primary","replicated"]}`,
+	}
+	if got := c.got(false); !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, r := range c.got(true) {
+		if strings.HasPrefix(r, "GET /v3/jobs/") {
+			t.Errorf("waited on a service instance's job: %s", r)
+		}
+	}
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+// The CLIBackend makes all of its changes by running cf commands through
+// the CLI, and reads what it can from the CLI plugin API.  Since most of
+// those depend on the CLI's current target, it re-targets as needed.
+type CLIBackend struct {
+	cf      plugin.CliConnection
+	record  func([]string)
+	observe func([]string)
+
+	/* the `org/space` we last targeted (shared with all forks,
+	   since the CLI only has the one target) */
+	targeted *string
+}
+
+func NewCLIBackend(cf plugin.CliConnection) *CLIBackend {
+	return &CLIBackend{cf: cf, targeted: new(string)}
+}
+
+func (b *CLIBackend) Fork() Backend {
+	return &CLIBackend{cf: b.cf, targeted: b.targeted}
+}
+
+func (b *CLIBackend) Record(fn func([]string)) {
+	b.record = fn
+}
+
+func (b *CLIBackend) Observe(fn func([]string)) {
+	b.observe = fn
+}
+
+func (b *CLIBackend) run(args ...string) error {
+	if os.Getenv("DEBUG") != "" {
+		fmt.Printf(">> %s\n", strings.Join(redactions.Call(args), " "))
+	}
+	if b.record != nil {
+		b.record(append([]string{"cf"}, args...))
+		return nil
+	}
+	if b.observe != nil {
+		b.observe(append([]string{"cf"}, args...))
+	}
+	if os.Getenv("DRYRUN") != "" {
+		return nil
+	}
+	if _, err := b.cf.CliCommandWithoutTerminalOutput(args...); err != nil {
+		return &CommandError{Args: args, Err: err}
+	}
+	return nil
+}
+
+// A CommandError is a cf command that failed.  The CLI never tells plugins
+// why, so all there is to go on is what the command was.
+type CommandError struct {
+	Args []string
+	Err  error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+// query runs a cf command that only reads state, so it is
+// safe to run even while recording.
+func (b *CLIBackend) query(args ...string) ([]string, error) {
+	if os.Getenv("DEBUG") != "" {
+		fmt.Printf(">> %s\n", strings.Join(redactions.Call(args), " "))
+	}
+	if os.Getenv("DRYRUN") != "" {
+		return nil, nil
+	}
+	result, err := b.cf.CliCommandWithoutTerminalOutput(args...)
+	if os.Getenv("DEBUG") != "" {
+		for _, l := range result {
+			fmt.Printf("%s\n", redactions.String(l))
+		}
+	}
+	if err != nil {
+		return result, &CommandError{Args: args, Err: err}
+	}
+	return result, nil
+}
+
+// target changes the CLI's notion of the current org (and space), which
+// reads like GetSpace and GetServices depend on.  It doesn't touch the
+// foundation, so it happens while recording too.
+func (b *CLIBackend) target(org, space string) error {
+	if *b.targeted == org+"/"+space {
+		return nil
+	}
+
+	args := []string{"target", "-o", org}
+	if space != "" {
+		args = append(args, "-s", space)
+	}
+	if _, err := b.query(args...); err != nil {
+		*b.targeted = ""
+		return err
+	}
+	*b.targeted = org + "/" + space
+	return nil
+}
+
+func (b *CLIBackend) CurrentUser() (string, error) {
+	return b.cf.Username()
+}
+
+func (b *CLIBackend) GetOrgs() ([]plugin_models.GetOrgs_Model, error) {
+	return b.cf.GetOrgs()
+}
+
+func (b *CLIBackend) GetOrg(org string) (plugin_models.GetOrg_Model, error) {
+	return b.cf.GetOrg(org)
+}
+
+func (b *CLIBackend) GetOrgUsers(org string) ([]plugin_models.GetOrgUsers_Model, error) {
+	return b.cf.GetOrgUsers(org)
+}
+
+func (b *CLIBackend) GetSpace(org, space string) (plugin_models.GetSpace_Model, error) {
+	if err := b.target(org, ""); err != nil {
+		return plugin_models.GetSpace_Model{}, err
+	}
+	return b.cf.GetSpace(space)
+}
+
+func (b *CLIBackend) GetSpaceUsers(org, space string) ([]plugin_models.GetSpaceUsers_Model, error) {
+	return b.cf.GetSpaceUsers(org, space)
+}
+
+func (b *CLIBackend) GetApps(org, space string) ([]plugin_models.GetAppsModel, error) {
+	if err := b.target(org, space); err != nil {
+		return nil, err
+	}
+	return b.cf.GetApps()
+}
+
+func (b *CLIBackend) GetApp(org, space, app string) (plugin_models.GetAppModel, error) {
+	if err := b.target(org, space); err != nil {
+		return plugin_models.GetAppModel{}, err
+	}
+	return b.cf.GetApp(app)
+}
+
+func (b *CLIBackend) GetServices(org, space string) ([]plugin_models.GetServices_Model, error) {
+	if err := b.target(org, space); err != nil {
+		return nil, err
+	}
+	return b.cf.GetServices()
+}
+
+func (b *CLIBackend) GetService(org, space, name string) (plugin_models.GetService_Model, error) {
+	if err := b.target(org, space); err != nil {
+		return plugin_models.GetService_Model{}, err
+	}
+	return b.cf.GetService(name)
+}
+
+// GetServiceParameters asks the Cloud Controller for the parameters of a
+// service instance through `cf curl`, since the CLI has no command for
+// it.  Brokers that don't support it answer with errors, not parameters.
+func (b *CLIBackend) GetServiceParameters(org, space, name string) (map[string]interface{}, error) {
+	s, err := b.GetService(org, space, name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := b.query("curl", "/v3/service_instances/"+s.Guid+"/parameters")
+	if err != nil {
+		return nil, err
+	}
+	var params map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.Join(out, "\n")), &params); err != nil {
+		return nil, nil
+	}
+	if _, failed := params["errors"]; failed {
+		return nil, nil
+	}
+	return params, nil
+}
+
+// GetServiceTags asks the Cloud Controller for the tags of a service
+// instance through `cf curl`, since the plugin API leaves them out.
+func (b *CLIBackend) GetServiceTags(org, space, name string) ([]string, error) {
+	s, err := b.GetService(org, space, name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := b.query("curl", "/v3/service_instances/"+s.Guid)
+	if err != nil {
+		return nil, err
+	}
+	var si struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(strings.Join(out, "\n")), &si); err != nil {
+		return nil, nil
+	}
+	return si.Tags, nil
+}
+
+// SpaceSecurityGroups asks the Cloud Controller for the security groups
+// bound to a space through `cf curl`, since the plugin API only knows
+// about the running ones.
+func (b *CLIBackend) SpaceSecurityGroups(org, space, lifecycle string) ([]string, error) {
+	s, err := b.GetSpace(org, space)
+	if err != nil {
+		return nil, err
+	}
+	out, err := b.query("curl", "/v3/security_groups?per_page=5000&"+lifecycle+"_space_guids="+s.Guid)
+	if err != nil {
+		return nil, err
+	}
+	var page struct {
+		Resources []struct {
+			Name string `json:"name"`
+		} `json:"resources"`
+	}
+	if err := json.Unmarshal([]byte(strings.Join(out, "\n")), &page); err != nil {
+		return nil, err
+	}
+	var l []string
+	for _, sg := range page.Resources {
+		l = append(l, sg.Name)
+	}
+	return l, nil
+}
+
+// TBD Do we need to more specific on testing existence by inspecting err?
+func (b *CLIBackend) SecurityGroupExists(name string) (bool, error) {
+	_, err := b.query("security-group", name)
+	return err == nil, nil
+}
+
+// GlobalSecurityGroups pulls the security group names out of the output
+// of `cf running-security-groups` (or staging-security-groups), which
+// lists them one per line, after a `Name` header.
+func (b *CLIBackend) GlobalSecurityGroups(lifecycle string) ([]string, error) {
+	out, err := b.query(lifecycle + "-security-groups")
+	if err != nil {
+		return nil, err
+	}
+
+	var l []string
+	found := false
+	for _, line := range out {
+		line = strings.TrimSpace(line)
+		if !found {
+			found = line == "Name"
+			continue
+		}
+		if line != "" {
+			l = append(l, line)
+		}
+	}
+	return l, nil
+}
+
+// SSHAllowed asks `cf space-ssh-allowed`, which says whether "ssh support
+// is enabled" or "disabled" in the space.
+func (b *CLIBackend) SSHAllowed(org, space string) (bool, error) {
+	if err := b.target(org, ""); err != nil {
+		return false, err
+	}
+	out, err := b.query("space-ssh-allowed", space)
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(strings.Join(out, "\n"), "enabled"), nil
+}
+
+// GetServiceBrokers pulls the broker names out of the output of `cf
+// service-brokers`, which lists them (with their URLs) after a `name url`
+// header.
+func (b *CLIBackend) GetServiceBrokers() ([]string, error) {
+	out, err := b.query("service-brokers")
+	if err != nil {
+		return nil, err
+	}
+
+	var l []string
+	found := false
+	for _, line := range out {
+		f := strings.Fields(line)
+		if !found {
+			found = len(f) == 2 && f[0] == "name" && f[1] == "url"
+			continue
+		}
+		if len(f) > 0 {
+			l = append(l, f[0])
+		}
+	}
+	return l, nil
+}
+
+// GetServiceAccess picks through the output of `cf service-access -e`,
+// which has a row for each plan of the service, saying whether its access
+// is `all`, `none` or `limited` (to a comma-separated list of orgs.)
+func (b *CLIBackend) GetServiceAccess(service string) ([]ServicePlanAccess, error) {
+	out, err := b.query("service-access", "-e", service)
+	if err != nil {
+		return nil, err
+	}
+
+	var l []ServicePlanAccess
+	for _, line := range out {
+		f := strings.Fields(line)
+		if len(f) < 3 || f[0] != service {
+			continue
+		}
+		a := ServicePlanAccess{Plan: f[1], Public: f[2] == "all"}
+		if f[2] == "limited" && len(f) > 3 {
+			a.Orgs = strings.Split(f[3], ",")
+		}
+		l = append(l, a)
+	}
+	if len(l) == 0 {
+		return nil, NotFoundError{Kind: "Service", Name: service}
+	}
+	return l, nil
+}
+
+func (b *CLIBackend) CreateUser(user, password string) error {
+	return b.run("create-user", user, password)
+}
+
+func (b *CLIBackend) CreateSharedDomain(domain string) error {
+	return b.run("create-shared-domain", domain)
+}
+
+func quotaArgs(quota *Quota) []string {
+	var args []string
+	if quota.Memory["total"] != "" {
+		args = append(args, "-m", quota.Memory["total"])
+	}
+	if quota.Memory["per-app-instance"] != "" {
+		perAppInstance := quota.Memory["per-app-instance"]
+		if perAppInstance == "unlimited" {
+			perAppInstance = "-1"
+		}
+		args = append(args, "-i", perAppInstance)
+	}
+	if quota.TotalAppInstances != "" {
+		appInstances := quota.TotalAppInstances
+		if appInstances == "unlimited" {
+			appInstances = "-1"
+		}
+		args = append(args, "-a", quota.TotalAppInstances)
+	}
+	if quota.ServiceInstances != "" {
+		args = append(args, "-s", quota.ServiceInstances)
+	}
+	if quota.Routes != "" {
+		args = append(args, "-r", quota.Routes)
+	}
+	if quota.PaidPlans {
+		args = append(args, "--allow-paid-service-plans")
+	}
+	if quota.NumRoutesWithResPorts != "" {
+		args = append(args, "--reserved-route-ports", quota.NumRoutesWithResPorts)
+	}
+	return args
+}
+
+func (b *CLIBackend) CreateQuota(name string) error {
+	return b.run("create-quota", name)
+}
+
+func (b *CLIBackend) UpdateQuota(name string, quota *Quota) error {
+	return b.run(append([]string{"update-quota", name}, quotaArgs(quota)...)...)
+}
+
+// securityGroupCommand runs a cf command that wants the security group
+// rules in a file.
+func (b *CLIBackend) securityGroupCommand(cmd, name string, rules []byte) error {
+	fp, err := ioutil.TempFile("", name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+
+	if _, err := fp.Write(rules); err != nil {
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if os.Getenv("DEBUG") != "" {
+		fmt.Printf("security group %s file %s\n", name, fp.Name())
+	}
+	return b.run(cmd, name, fp.Name())
+}
+
+func (b *CLIBackend) CreateSecurityGroup(name string, rules []byte) error {
+	return b.securityGroupCommand("create-security-group", name, rules)
+}
+
+func (b *CLIBackend) UpdateSecurityGroup(name string, rules []byte) error {
+	return b.securityGroupCommand("update-security-group", name, rules)
+}
+
+func (b *CLIBackend) BindGlobalSecurityGroup(name, lifecycle string) error {
+	return b.run("bind-"+lifecycle+"-security-group", name)
+}
+
+func (b *CLIBackend) UnbindGlobalSecurityGroup(name, lifecycle string) error {
+	return b.run("unbind-"+lifecycle+"-security-group", name)
+}
+
+func (b *CLIBackend) BindSecurityGroup(name, org, space, lifecycle string) error {
+	args := []string{"bind-security-group", name, org}
+	if space != "" {
+		args = append(args, space)
+	}
+	if lifecycle != "" && lifecycle != "running" {
+		args = append(args, "--lifecycle", lifecycle)
+	}
+	return b.run(args...)
+}
+
+func (b *CLIBackend) UnbindSecurityGroup(name, org, space, lifecycle string) error {
+	args := []string{"unbind-security-group", name, org, space}
+	if lifecycle != "" && lifecycle != "running" {
+		args = append(args, "--lifecycle", lifecycle)
+	}
+	return b.run(args...)
+}
+
+func (b *CLIBackend) CreateOrg(org string) error {
+	return b.run("create-org", org)
+}
+
+func (b *CLIBackend) DeleteOrg(org string) error {
+	*b.targeted = ""
+	return b.run("delete-org", org, "-f")
+}
+
+func (b *CLIBackend) CreateOrgDomain(org, domain string) error {
+	if err := b.run("share-private-domain", org, domain); err != nil {
+		return b.run("create-domain", org, domain)
+	}
+	return nil
+}
+
+func (b *CLIBackend) SetOrgQuota(org, quota string) error {
+	return b.run("set-quota", org, quota)
+}
+
+func (b *CLIBackend) spaceQuotaCommand(cmd, org, name string, quota *Quota) error {
+	if b.record == nil {
+		if err := b.target(org, ""); err != nil {
+			return err
+		}
+	}
+	return b.run(append([]string{cmd, name}, quotaArgs(quota)...)...)
+}
+
+func (b *CLIBackend) CreateSpaceQuota(org, name string, quota *Quota) error {
+	return b.spaceQuotaCommand("create-space-quota", org, name, quota)
+}
+
+func (b *CLIBackend) UpdateSpaceQuota(org, name string, quota *Quota) error {
+	return b.spaceQuotaCommand("update-space-quota", org, name, quota)
+}
+
+func (b *CLIBackend) SetOrgRole(org, user, role string) error {
+	return b.run("set-org-role", user, org, role)
+}
+
+func (b *CLIBackend) UnsetOrgRole(org, user, role string) error {
+	return b.run("unset-org-role", user, org, role)
+}
+
+func (b *CLIBackend) CreateSpace(org, space string) error {
+	return b.run("create-space", space, "-o", org)
+}
+
+func (b *CLIBackend) DeleteSpace(org, space string) error {
+	*b.targeted = ""
+	return b.run("delete-space", space, "-o", org, "-f")
+}
+
+// spaceCommand runs a cf command that acts on the targeted space.
+func (b *CLIBackend) spaceCommand(org, space string, args ...string) error {
+	if b.record == nil {
+		if err := b.target(org, space); err != nil {
+			return err
+		}
+	}
+	return b.run(args...)
+}
+
+func (b *CLIBackend) AllowSSH(org, space string, on bool) error {
+	if on {
+		return b.spaceCommand(org, "", "allow-space-ssh", space)
+	}
+	return b.spaceCommand(org, "", "disallow-space-ssh", space)
+}
+
+func (b *CLIBackend) SetSpaceQuota(org, space, quota string) error {
+	return b.spaceCommand(org, "", "set-space-quota", space, quota)
+}
+
+func (b *CLIBackend) SetSpaceRole(org, space, user, role string) error {
+	return b.run("set-space-role", user, org, space, role)
+}
+
+func (b *CLIBackend) UnsetSpaceRole(org, space, user, role string) error {
+	return b.run("unset-space-role", user, org, space, role)
+}
+
+func (b *CLIBackend) DeleteOrphanedRoutes(org, space string) error {
+	return b.spaceCommand(org, space, "delete-orphaned-routes", "-f")
+}
+
+func (b *CLIBackend) PushApp(org, space string, app *Application, path string) error {
+	args := []string{"push", app.Name, "--no-start", "-i", fmt.Sprintf("%v", app.Instances)}
+
+	if app.NoRoute {
+		args = append(args, "--no-route")
+	} else {
+		if app.Hostname != "" {
+			args = append(args, "-n", app.Hostname)
+		}
+		if app.Domain != "" {
+			args = append(args, "-d", app.Domain)
+		}
+	}
+	if app.Disk != "" {
+		args = append(args, "-k", app.Disk)
+	}
+	if app.Memory != "" {
+		args = append(args, "-m", app.Memory)
+	}
+	if app.Buildpack != "" {
+		args = append(args, "-b", app.Buildpack)
+	}
+	if app.Image != "" {
+		args = append(args, "-o", app.Image)
+	} else {
+		args = append(args, "-p", path)
+	}
+
+	return b.spaceCommand(org, space, args...)
+}
+
+func (b *CLIBackend) DeleteApp(org, space, app string) error {
+	return b.spaceCommand(org, space, "delete", app, "-f")
+}
+
+func (b *CLIBackend) RenameApp(org, space, app, name string) error {
+	return b.spaceCommand(org, space, "rename", app, name)
+}
+
+func (b *CLIBackend) MapRoute(org, space, app string, url URL) error {
+	return b.spaceCommand(org, space, "map-route", app, url.Domain, "--hostname", url.Host)
+}
+
+func (b *CLIBackend) UnmapRoute(org, space, app string, url URL) error {
+	return b.spaceCommand(org, space, "unmap-route", app, url.Domain, "--hostname", url.Host)
+}
+
+func (b *CLIBackend) SetEnv(org, space, app, name, value string) error {
+	return b.spaceCommand(org, space, "set-env", app, name, value)
+}
+
+func (b *CLIBackend) UnsetEnv(org, space, app, name string) error {
+	return b.spaceCommand(org, space, "unset-env", app, name)
+}
+
+func (b *CLIBackend) StartApp(org, space, app string) error {
+	return b.spaceCommand(org, space, "start", app)
+}
+
+func (b *CLIBackend) ScaleApp(org, space, app string, instances int) error {
+	return b.spaceCommand(org, space, "scale", app, "-i", fmt.Sprintf("%v", instances))
+}
+
+func (b *CLIBackend) RestageApp(org, space, app string) error {
+	return b.spaceCommand(org, space, "restage", app)
+}
+
+func serviceArgs(args []string, parameters string, tags []string) []string {
+	if parameters != "" {
+		args = append(args, "-c", parameters)
+	}
+	if len(tags) > 0 {
+		args = append(args, "-t", strings.Join(tags, ","))
+	}
+	return args
+}
+
+func (b *CLIBackend) CreateService(org, space, name, service, plan, parameters string, tags []string) error {
+	return b.spaceCommand(org, space, serviceArgs([]string{"create-service", service, plan, name}, parameters, tags)...)
+}
+
+func (b *CLIBackend) UpdateService(org, space, name, plan, parameters string, tags []string) error {
+	args := []string{"update-service", name}
+	if plan != "" {
+		args = append(args, "-p", plan)
+	}
+	return b.spaceCommand(org, space, serviceArgs(args, parameters, tags)...)
+}
+
+func (b *CLIBackend) DeleteService(org, space, name string) error {
+	return b.spaceCommand(org, space, "delete-service", name, "-f")
+}
+
+func (b *CLIBackend) BindService(org, space, app, name string) error {
+	return b.spaceCommand(org, space, "bind-service", app, name)
+}
+
+func (b *CLIBackend) UnbindService(org, space, app, name string) error {
+	return b.spaceCommand(org, space, "unbind-service", app, name)
+}
+
+func cupsArgs(cmd, name, credentials, route, syslog string) []string {
+	args := []string{cmd, name}
+	if credentials != "" {
+		args = append(args, "-p", credentials)
+	}
+	if route != "" {
+		args = append(args, "-r", route)
+	}
+	if syslog != "" {
+		args = append(args, "-l", syslog)
+	}
+	return args
+}
+
+func (b *CLIBackend) CreateUserProvidedService(org, space, name, credentials, route, syslog string) error {
+	return b.spaceCommand(org, space, cupsArgs("create-user-provided-service", name, credentials, route, syslog)...)
+}
+
+func (b *CLIBackend) UpdateUserProvidedService(org, space, name, credentials, route, syslog string) error {
+	return b.spaceCommand(org, space, cupsArgs("update-user-provided-service", name, credentials, route, syslog)...)
+}
+
+func (b *CLIBackend) CreateServiceBroker(name, username, password, url, org, space string) error {
+	if space != "" {
+		return b.spaceCommand(org, space, "create-service-broker", name, username, password, url, "--space-scoped")
+	}
+	return b.run("create-service-broker", name, username, password, url)
+}
+
+func (b *CLIBackend) UpdateServiceBroker(name, username, password, url string) error {
+	return b.run("update-service-broker", name, username, password, url)
+}
+
+func serviceAccessArgs(cmd, service, plan, org string) []string {
+	args := []string{cmd, service}
+	if plan != "" {
+		args = append(args, "-p", plan)
+	}
+	if org != "" {
+		args = append(args, "-o", org)
+	}
+	return args
+}
+
+func (b *CLIBackend) EnableServiceAccess(service, plan, org string) error {
+	return b.run(serviceAccessArgs("enable-service-access", service, plan, org)...)
+}
+
+func (b *CLIBackend) DisableServiceAccess(service, plan, org string) error {
+	return b.run(serviceAccessArgs("disable-service-access", service, plan, org)...)
+}
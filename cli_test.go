@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+// cfStub stands in for the cf CLI, answering each command with the output
+// it was given for it, once it has failed as many times as it was told to
+// (the way the CLI fails, without saying why.)  Anything else about the
+// CLI is left out.
+type cfStub struct {
+	plugin.CliConnection
+	out     map[string][]string
+	failing map[string]int
+	ran     []string
+}
+
+func (cf *cfStub) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	cmd := strings.Join(args, " ")
+	cf.ran = append(cf.ran, cmd)
+	if cf.failing[cmd] > 0 {
+		cf.failing[cmd]--
+		return nil, errors.New("Error executing cli core command")
+	}
+	return cf.out[cmd], nil
+}
+
+func (cf *cfStub) GetService(name string) (plugin_models.GetService_Model, error) {
+	return plugin_models.GetService_Model{Guid: name + "-guid", Name: name}, nil
+}
+
+func TestCLIServiceTags(t *testing.T) {
+	cf := &cfStub{out: map[string][]string{
+		"curl /v3/service_instances/db-guid": {`{"guid":"db-guid",`, `"tags":["sql","primary"]}`},
+	}}
+	b := NewCLIBackend(cf)
+	tags, err := b.GetServiceTags("sys", "prod", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != "sql,primary" {
+		t.Errorf("got tags %v, want [sql primary]", tags)
+	}
+
+	t.Setenv("DRYRUN", "yes")
+	tags, err = b.GetServiceTags("sys", "prod", "db")
+	if err != nil || tags != nil {
+		t.Errorf("on a dry run: got %v, %v, want no tags", tags, err)
+	}
+}
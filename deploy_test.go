@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	spruceOp  = regexp.MustCompile(`^\(\(\s*(\w+)\s+(.*?)\s*\)\)$`)
+	spruceArg = regexp.MustCompile(`"[^"]*"|\S+`)
+)
+
+// spruce evaluates the few spruce operators the examples use (grab,
+// concat and inject), standing in for the `spruce merge` that templates
+// like examples/bootstrap.yml are meant to be run through first.
+func spruce(t *testing.T, root map[interface{}]interface{}) interface{} {
+	var eval func(x interface{}) interface{}
+	lookup := func(path string) interface{} {
+		var x interface{} = root
+		for _, k := range strings.Split(path, ".") {
+			m, ok := x.(map[interface{}]interface{})
+			if !ok {
+				t.Fatalf("spruce: nothing at %s", path)
+			}
+			x = m[k]
+		}
+		return eval(x)
+	}
+	eval = func(x interface{}) interface{} {
+		switch v := x.(type) {
+		case string:
+			op := spruceOp.FindStringSubmatch(v)
+			if op == nil {
+				return v
+			}
+			switch op[1] {
+			case "grab":
+				return lookup(op[2])
+			case "concat":
+				s := ""
+				for _, arg := range spruceArg.FindAllString(op[2], -1) {
+					if strings.HasPrefix(arg, `"`) {
+						s += strings.Trim(arg, `"`)
+					} else {
+						s += fmt.Sprint(lookup(arg))
+					}
+				}
+				return s
+			}
+			t.Fatalf("spruce: unsupported operator in %s", v)
+
+		case map[interface{}]interface{}:
+			out := map[interface{}]interface{}{}
+			var injected []interface{}
+			for k, val := range v {
+				if s, ok := val.(string); ok {
+					if op := spruceOp.FindStringSubmatch(s); op != nil && op[1] == "inject" {
+						injected = append(injected, lookup(op[2]))
+						continue
+					}
+				}
+				out[k] = eval(val)
+			}
+			for _, m := range injected {
+				for k, val := range m.(map[interface{}]interface{}) {
+					if _, ok := out[k]; !ok {
+						out[k] = val
+					}
+				}
+			}
+			return out
+
+		case []interface{}:
+			out := make([]interface{}, len(v))
+			for i := range v {
+				out[i] = eval(v[i])
+			}
+			return out
+		}
+		return x
+	}
+	return eval(root)
+}
+
+// loadExample loads one of the examples, as a spruce-merged manifest if
+// it is a spruce template, and makes the directories its applications
+// are pushed from in the working directory, with their repositories
+// cloned already (as repositories of their own.)
+func loadExample(t *testing.T, file string) Manifest {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "((") {
+		var doc map[interface{}]interface{}
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if b, err = yaml.Marshal(spruce(t, doc)); err != nil {
+			t.Fatal(err)
+		}
+		file = filepath.Join(t.TempDir(), filepath.Base(file))
+		if err := ioutil.WriteFile(file, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := LoadManifests([]string{file}, NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, org := range m.Organizations {
+		for _, space := range org.Spaces {
+			for _, app := range space.Applications {
+				dir := app.Path
+				if app.Repository != "" {
+					dir = filepath.Join("apps", app.Name)
+				}
+				if dir == "" {
+					continue
+				}
+				if err := os.MkdirAll(dir, 0777); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("hello\n"), 0666); err != nil {
+					t.Fatal(err)
+				}
+				if app.Repository != "" {
+					git(t, dir, "init", "-q")
+					git(t, dir, "add", ".")
+					git(t, dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "hello")
+				}
+			}
+		}
+	}
+	return m
+}
+
+func git(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+// exampleFoundation returns a fake foundation with what the examples take
+// for granted: the shared domains they route to without defining, and the
+// catalogs of the brokers they register.
+func exampleFoundation() *FakeBackend {
+	b := NewFakeBackend()
+	b.SharedDomains = append(b.SharedDomains, "bosh-lite.com", "global.x.y.z")
+	b.BrokerCatalogs = map[string]map[string][]string{
+		"postgres": {"postgres": {"free"}},
+		"rabbitmq": {"rabbitmq": {"shared"}},
+		"vault":    {"vault": {"shared"}},
+	}
+	return b
+}
+
+// TestPlanExamples plans the deployment of each of the examples to an
+// empty fake foundation, which must be left as it was.
+func TestPlanExamples(t *testing.T) {
+	files, err := filepath.Glob("examples/*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, file := range files {
+		file, _ := filepath.Abs(file)
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			if err := os.Chdir(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			m := loadExample(t, file)
+			b := exampleFoundation()
+			d := &Deployer{manifest: &m, backend: b, plan: &Plan{}}
+			b.Record(d.plan.record)
+			if err := d.Deploy(); err != nil {
+				t.Fatalf("plan failed: %s", err)
+			}
+			if len(d.plan.Actions) == 0 {
+				t.Fatal("plan is empty")
+			}
+			if len(b.Orgs) != 0 {
+				t.Errorf("planning created orgs %v", sortedKeys(b.Orgs))
+			}
+		})
+	}
+}
+
+// TestDeployExamples deploys each of the examples to a fake foundation,
+// and checks that it then matches the manifest, and that deploying it
+// again neither creates nor deletes anything, nor pushes any application.
+// (Some things, like security groups, are updated on every deploy.)
+func TestDeployExamples(t *testing.T) {
+	files, err := filepath.Glob("examples/*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no examples found")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, file := range files {
+		file, _ := filepath.Abs(file)
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			if err := os.Chdir(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			m := loadExample(t, file)
+			b := exampleFoundation()
+			deploy := func() *Plan {
+				d := &Deployer{manifest: &m, backend: b, report: &Plan{}, healthTimeout: time.Second}
+				if err := d.Deploy(); err != nil {
+					t.Fatalf("deploy failed: %s", err)
+				}
+				return d.report
+			}
+
+			if len(deploy().Actions) == 0 {
+				t.Fatal("deploy did nothing")
+			}
+			for _, org := range sortedKeys(m.Organizations) {
+				if _, ok := b.Orgs[org]; !ok {
+					t.Errorf("org %s was not created", org)
+				}
+			}
+
+			drifts, err := (&Deployer{manifest: &m, backend: b}).Drift()
+			if err != nil {
+				t.Fatalf("drift check failed: %s", err)
+			}
+			for _, x := range drifts {
+				t.Errorf("drift after deploying: %s %s %s (want %q, have %q)", x.Op, x.Kind, x.Path, x.Want, x.Have)
+			}
+
+			for _, a := range deploy().Actions {
+				if a.Op == OpCreate || a.Op == OpDelete || a.Op == OpUpdate && a.Kind == "app" {
+					t.Errorf("deploying again did %s %s %s", a.Op, a.Kind, a.Path)
+				}
+			}
+		})
+	}
+}
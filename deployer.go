@@ -7,20 +7,14 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/cloudfoundry/cli/plugin"
+	"github.com/cloudfoundry/cli/plugin/models"
 )
 
-func isMissing(e error) bool {
-	return strings.Contains(e.Error(), "not found")
-}
-
-func parseService(s string) (string, string) {
-	x := strings.SplitN(s, "/", 2)
-	return x[0], x[1]
-}
-
 func boolify(s string) bool {
 	s = strings.ToLower(s)
 	return s == "yes" || s == "y" || s == "on" || s == "enabled"
@@ -28,34 +22,130 @@ func boolify(s string) bool {
 
 type Deployer struct {
 	manifest *Manifest
-	cf       plugin.CliConnection
+	backend  Backend
+
+	/* when non-nil, the deployer is only planning: it still queries
+	   the current state of the foundation, but records the changes
+	   the backend would have made instead of making them. */
+	plan *Plan
+
+	/* when non-nil (and not planning), every action taken is logged
+	   here, along with the changes the backend made for it, for the
+	   structured report; progress messages are then kept quiet. */
+	report *Plan
+
+	/* resource types for which anything not in the manifest is removed */
+	prune Prune
+
+	/* when set, a resource that fails to deploy is recorded in failures
+	   (along with everything skipped because it depends on it), and the
+	   deployment carries on with the rest of the manifest. */
+	keepGoing bool
+	failures  []Failure
+
+	/* how many steps to run at once; each one runs on a fork of
+	   the deployer, whose messages are prefixed with the resource
+	   it is deploying when more than one is running. */
+	parallel int
+	prefix   string
+
+	/* how long to wait for the instances of an application to
+	   come up, when we have to (DefaultHealthTimeout, if zero) */
+	healthTimeout time.Duration
+
+	/* how long to wait for a broker to provision (or update) a
+	   service instance (DefaultServiceTimeout, if zero) */
+	serviceTimeout time.Duration
 }
 
-func (d *Deployer) run(args ...string) error {
-	if os.Getenv("DEBUG") != "" {
-		fmt.Printf(">> %s\n", strings.Join(args, " "))
+// DefaultHealthTimeout is how long the instances of an application are
+// given to come up.
+const DefaultHealthTimeout = 5 * time.Minute
+
+// healthInterval is how often an application is checked on while waiting
+// for it to come up.
+var healthInterval = 2 * time.Second
+
+// DefaultServiceTimeout is how long a service broker is given to
+// provision (or update) a service instance.
+const DefaultServiceTimeout = 30 * time.Minute
+
+// serviceInterval is how often a service instance is checked on while
+// waiting for its broker.
+var serviceInterval = 5 * time.Second
+
+func (d *Deployer) say(format string, args ...interface{}) {
+	if d.plan == nil && d.report == nil {
+		if d.prefix != "" {
+			format = d.prefix + strings.TrimLeft(format, " ")
+		}
+		fmt.Printf(format, args...)
 	}
-	if os.Getenv("DRYRUN") != "" {
-		return nil
+}
+
+func (d *Deployer) act(op, kind, path string) {
+	if log := d.log(); log != nil {
+		log.add(op, kind, path)
 	}
-	_, err := d.cf.CliCommandWithoutTerminalOutput(args...)
-	return err
 }
 
-func (d *Deployer) runWithOutput(args ...string) ([]string, error) {
-	if os.Getenv("DEBUG") != "" {
-		fmt.Printf(">> %s\n", strings.Join(args, " "))
+// note says what was found out about the resource last acted on, and
+// adds it to that action, for the report.
+func (d *Deployer) note(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	d.say("      %s\n", msg)
+	if log := d.log(); log != nil && len(log.Actions) > 0 {
+		log.Actions[len(log.Actions)-1].Detail = msg
+	}
+}
+
+// log returns wherever actions are being logged: the plan, or the report.
+func (d *Deployer) log() *Plan {
+	if d.plan != nil {
+		return d.plan
 	}
-	if os.Getenv("DRYRUN") != "" {
-		return nil, nil
+	return d.report
+}
+
+// fork returns a copy of the deployer for running a single step, with a
+// fork of the backend, and a plan (or report) of its own for the backend
+// to log the step's calls to.  A forked plan still knows what the steps
+// that have already finished are going to create.
+func (d *Deployer) fork(s *step) *Deployer {
+	f := &Deployer{
+		manifest:       d.manifest,
+		backend:        d.backend.Fork(),
+		prune:          d.prune,
+		keepGoing:      d.keepGoing,
+		parallel:       d.parallel,
+		healthTimeout:  d.healthTimeout,
+		serviceTimeout: d.serviceTimeout,
 	}
-	result, err := d.cf.CliCommandWithoutTerminalOutput(args...)
-	if os.Getenv("DEBUG") != "" {
-		for _, l := range result {
-			fmt.Printf("%s\n", l)
-		}
+	if d.parallel > 1 {
+		f.prefix = fmt.Sprintf("[%s %s] ", s.kind, s.path)
+	}
+	if d.plan != nil {
+		f.plan = &Plan{prior: d.plan.Actions}
+		f.backend.Record(f.plan.record)
+	} else if d.report != nil {
+		f.report = &Plan{}
+		f.backend.Observe(f.report.record)
 	}
-	return result, err
+	return f
+}
+
+// absent returns true if the resource at the given path does not exist
+// yet because the plan is going to create it; there is no point in
+// asking the foundation about it (or anything inside of it.)
+func (d *Deployer) absent(path string) bool {
+	return d.plan != nil && d.plan.creates(path)
+}
+
+// tolerate returns true if a failed read should be treated as though
+// the resource simply isn't there -- always under DRYRUN, and for
+// missing resources while planning.
+func (d *Deployer) tolerate(err error) bool {
+	return os.Getenv("DRYRUN") != "" || (d.plan != nil && isMissing(err))
 }
 
 func (d *Deployer) createUser(user string) error {
@@ -64,7 +154,8 @@ func (d *Deployer) createUser(user string) error {
 			/* if we have a username and password, let's set them!
 			   (note that this fails miserably if the user exists but has a different
 			    password.  oh well.) */
-			d.run("create-user", u.Name, u.Password)
+			d.act(OpEnsure, "user", u.Name)
+			d.backend.CreateUser(u.Name, u.Password)
 			return nil
 		}
 	}
@@ -82,17 +173,20 @@ func (d *Deployer) createSharedDomain(domain string) error {
 	   so for now, we just ignore *all* the errors and pretend everything
 	   is going to be just fine thank you very much. */
 
-	d.run("create-shared-domain", domain)
+	d.act(OpEnsure, "shared-domain", domain)
+	d.backend.CreateSharedDomain(domain)
 	return nil
 }
 
 func (d *Deployer) createOrg(org string) error {
-	o, _ := d.cf.GetOrg(org)
+	o, _ := d.backend.GetOrg(org)
 	if o.Guid != "" {
+		d.act(OpNoop, "org", org)
 		return nil
 	}
 
-	if err := d.run("create-org", org); err != nil {
+	d.act(OpCreate, "org", org)
+	if err := d.backend.CreateOrg(org); err != nil {
 		return err
 	}
 
@@ -100,164 +194,169 @@ func (d *Deployer) createOrg(org string) error {
 }
 
 func (d *Deployer) createOrgDomain(org, domain string) error {
-	o, err := d.cf.GetOrg(org)
-	if err != nil && os.Getenv("DRYRUN") == "" {
-		return err
-	}
-
-	for _, d := range o.Domains {
-		if d.Name == domain {
-			return nil
+	path := org + "/" + domain
+	if !d.absent(org) {
+		o, err := d.backend.GetOrg(org)
+		if err != nil && !d.tolerate(err) {
+			return err
 		}
-	}
 
-	if err := d.run("share-private-domain", org, domain); err != nil {
-		if err := d.run("create-domain", org, domain); err != nil {
-			return err
+		for _, dom := range o.Domains {
+			if dom.Name == domain {
+				d.act(OpNoop, "org-domain", path)
+				return nil
+			}
 		}
 	}
 
-	return nil
+	d.act(OpCreate, "org-domain", path)
+	return d.backend.CreateOrgDomain(org, domain)
 }
 
 func (d *Deployer) grantOrgRole(org, user, role string) error {
-	_, err := d.cf.GetOrg(org)
-	if err != nil && os.Getenv("DRYRUN") == "" {
-		return err
-	}
+	path := fmt.Sprintf("%s/%s[%s]", org, user, role)
+	if !d.absent(org) {
+		_, err := d.backend.GetOrg(org)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
 
-	users, err := d.cf.GetOrgUsers(org)
-	if err != nil && os.Getenv("DRYRUN") == "" {
-		return err
-	}
+		users, err := d.backend.GetOrgUsers(org)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
 
-	for _, u := range users {
-		if u.Username == user {
-			for _, r := range u.Roles {
-				if r == role {
-					return nil
+		for _, u := range users {
+			if u.Username == user {
+				for _, r := range u.Roles {
+					if r == role {
+						d.act(OpNoop, "org-role", path)
+						return nil
+					}
 				}
 			}
 		}
 	}
 
-	return d.run("set-org-role", user, org, role)
+	d.act(OpCreate, "org-role", path)
+	return d.backend.SetOrgRole(org, user, role)
 }
 
 func (d *Deployer) createSpace(org, space string) error {
-	o, err := d.cf.GetOrg(org)
-	if err != nil && os.Getenv("DRYRUN") == "" {
-		return err
-	}
-
-	for _, s := range o.Spaces {
-		if s.Name == space {
-			return nil
+	path := org + "/" + space
+	if !d.absent(org) {
+		o, err := d.backend.GetOrg(org)
+		if err != nil && !d.tolerate(err) {
+			return err
 		}
-	}
 
-	if err := d.run("target", "-o", org); err != nil {
-		return err
-	}
-	if err := d.run("create-space", space); err != nil {
-		return err
+		for _, s := range o.Spaces {
+			if s.Name == space {
+				d.act(OpNoop, "space", path)
+				return nil
+			}
+		}
 	}
 
-	return nil
+	d.act(OpCreate, "space", path)
+	return d.backend.CreateSpace(org, space)
 }
 
-func (d *Deployer) enableSSH(space string, on bool) error {
-	if on {
-		return d.run("allow-space-ssh", space)
-	}
-	return d.run("disallow-space-ssh", space)
+func (d *Deployer) enableSSH(org, space string, on bool) error {
+	d.act(OpEnsure, "space-ssh", org+"/"+space)
+	return d.backend.AllowSSH(org, space, on)
 }
 
 func (d *Deployer) grantSpaceRole(org, space, user, role string) error {
-	_, err := d.cf.GetOrg(org)
-	if err != nil && os.Getenv("DRYRUN") == "" {
-		return err
-	}
-
-	if err := d.run("target", "-o", org); err != nil {
-		return err
-	}
-	_, err = d.cf.GetSpace(space)
-	if err != nil && os.Getenv("DRYRUN") == "" {
-		return err
-	}
+	path := fmt.Sprintf("%s/%s/%s[%s]", org, space, user, role)
+	if !d.absent(org + "/" + space) {
+		_, err := d.backend.GetSpace(org, space)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
 
-	users, err := d.cf.GetSpaceUsers(org, space)
-	if err != nil && os.Getenv("DRYRUN") == "" {
-		return err
-	}
+		users, err := d.backend.GetSpaceUsers(org, space)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
 
-	for _, u := range users {
-		if u.Username == user {
-			for _, r := range u.Roles {
-				if r == role {
-					return nil
+		for _, u := range users {
+			if u.Username == user {
+				for _, r := range u.Roles {
+					if r == role {
+						d.act(OpNoop, "space-role", path)
+						return nil
+					}
 				}
 			}
 		}
 	}
 
-	return d.run("set-space-role", user, org, space, role)
+	d.act(OpCreate, "space-role", path)
+	return d.backend.SetSpaceRole(org, space, user, role)
 }
 
-func (d *Deployer) stageApp(app *Application) error {
-	args := []string{"push", app.Name, "--no-start", "-i", fmt.Sprintf("%v", app.Instances)}
-
-	if app.Hostname != "" {
-		args = append(args, "-n", app.Hostname)
+func (d *Deployer) stageApp(org, space string, app *Application, exists bool) error {
+	path := org + "/" + space + "/" + app.Name
+	if exists {
+		d.act(OpUpdate, "app", path)
+	} else {
+		d.act(OpCreate, "app", path)
 	}
-	if app.Domain != "" {
-		args = append(args, "-d", app.Domain)
+
+	dir, err := d.appSource(app)
+	if err != nil {
+		return err
 	}
-	if app.Disk != "" {
-		args = append(args, "-k", app.Disk)
+	return d.backend.PushApp(org, space, app, dir)
+}
+
+// appSource returns the directory to push an application from, cloning
+// its repository first, if need be.  Images have nothing to upload.
+func (d *Deployer) appSource(app *Application) (string, error) {
+	if app.Image != "" {
+		return "", nil
 	}
-	if app.Memory != "" {
-		args = append(args, "-m", app.Memory)
+	if app.Path != "" && app.Repository == "" {
+		return app.Path, nil
 	}
-	if app.Buildpack != "" {
-		args = append(args, "-b", app.Buildpack)
+	if app.Repository == "" {
+		return "", fmt.Errorf("No image, repository or path supplied for '%s' app", app.Name)
 	}
-	if app.Image != "" {
-		args = append(args, "-o", app.Image)
-	} else if app.Repository != "" {
-		wd, _ := os.Getwd()
-		path := wd + "/apps/" + app.Name
+
+	wd, _ := os.Getwd()
+	path := wd + "/apps/" + app.Name
+	if d.plan == nil {
 		os.MkdirAll(path, 0777)
+	}
 
-		files, _ := ioutil.ReadDir(path)
+	files, _ := ioutil.ReadDir(path)
 
-		if len(files) == 0 {
-			gitPath, err := exec.LookPath("git")
-			if err != nil {
-				return err
-			}
-			if err := exec.Command(gitPath, "clone", app.Repository, path).Run(); err != nil {
-				return err
-			}
+	/* there is nothing to clone into when we are only planning */
+	if len(files) == 0 && d.plan == nil {
+		gitPath, err := exec.LookPath("git")
+		if err != nil {
+			return "", err
 		}
-		if app.Path != "" {
-			path = fmt.Sprintf("%s/%s", path, app.Path)
+		if err := exec.Command(gitPath, "clone", app.Repository, path).Run(); err != nil {
+			return "", err
 		}
-		args = append(args, "-p", path)
-	} else if app.Path != "" {
-		args = append(args, "-p", app.Path)
-	} else {
-		return fmt.Errorf("No image, repository or path supplied for '%s' app", app.Name)
 	}
-
-	return d.run(args...)
+	if app.Path != "" {
+		path = fmt.Sprintf("%s/%s", path, app.Path)
+	}
+	return path, nil
 }
 
-func (d *Deployer) mapURLs(app *Application) error {
-	a, err := d.cf.GetApp(app.Name)
-	if err != nil {
-		return err
+func (d *Deployer) mapURLs(org, space string, app *Application) error {
+	path := org + "/" + space + "/" + app.Name
+	var a plugin_models.GetAppModel
+	if !d.absent(path) {
+		var err error
+		a, err = d.backend.GetApp(org, space, app.Name)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
 	}
 
 	want := map[string]URL{}
@@ -280,15 +379,19 @@ func (d *Deployer) mapURLs(app *Application) error {
 		}
 	}
 
-	for u, url := range have {
-		fmt.Printf("    unmapping route %s\n", u)
-		if err := d.run("unmap-route", app.Name, url.Domain, "--hostname", url.Host); err != nil {
+	for _, u := range sortedKeys(have) {
+		url := have[u]
+		d.say("    unmapping route %s\n", u)
+		d.act(OpDelete, "route", path+"->"+u)
+		if err := d.backend.UnmapRoute(org, space, app.Name, url); err != nil {
 			return err
 		}
 	}
-	for u, url := range want {
-		fmt.Printf("    mapping route %s\n", u)
-		if err := d.run("map-route", app.Name, url.Domain, "--hostname", url.Host); err != nil {
+	for _, u := range sortedKeys(want) {
+		url := want[u]
+		d.say("    mapping route %s\n", u)
+		d.act(OpCreate, "route", path+"->"+u)
+		if err := d.backend.MapRoute(org, space, app.Name, url); err != nil {
 			return err
 		}
 	}
@@ -296,454 +399,1283 @@ func (d *Deployer) mapURLs(app *Application) error {
 	return nil
 }
 
-func (d *Deployer) setEnvVar(name, value, app string) error {
-	return d.run("set-env", app, name, value)
+func (d *Deployer) setEnvVar(org, space, name, value, app string) error {
+	d.act(OpEnsure, "env", fmt.Sprintf("%s/%s/%s$%s", org, space, app, name))
+	return d.backend.SetEnv(org, space, app, name, value)
 }
 
-func (d *Deployer) startApp(app *Application) error {
-	return d.run("start", app.Name)
+func (d *Deployer) startApp(org, space string, app *Application) error {
+	d.act(OpEnsure, "app-start", org+"/"+space+"/"+app.Name)
+	return d.backend.StartApp(org, space, app.Name)
 }
 
-func (d *Deployer) createService(name, broker, plan string) error {
-	s, err := d.cf.GetServices()
+// serviceExists checks if the named service instance exists in the
+// given space.
+func (d *Deployer) serviceExists(org, space, name string) (bool, error) {
+	if d.absent(org + "/" + space + "/" + name) {
+		/* an earlier step in the plan already creates it */
+		return true, nil
+	}
+	if d.absent(org + "/" + space) {
+		return false, nil
+	}
+
+	s, err := d.backend.GetServices(org, space)
 	if err != nil {
-		return err
+		if d.tolerate(err) {
+			return false, nil
+		}
+		return false, err
 	}
 
 	for _, svc := range s {
 		if svc.Name == name {
-			/* FIXME: check configuration */
-			return nil
+			return true, nil
 		}
 	}
-
-	return d.run("create-service", broker, plan, name)
+	return false, nil
 }
 
-func (d *Deployer) bindService(service, app string) error {
-	return d.run("bind-service", app, service)
-}
-
-func (d *Deployer) userProvidedService(name, cred, route, syslog string) error {
-	args := []string{"create-user-provided-service", name}
-	if cred != "" {
-		args = append(args, "-p", cred)
+// createService creates a service instance, or, if it already exists,
+// moves it to the plan in its definition, and gives it the parameters
+// in it, if they differ from the ones it has.  (Parameters that can't be
+// read back are left as they are.)  The same goes for its tags, if it
+// is given any.
+func (d *Deployer) createService(org, space, name string, def ServiceDefinition) error {
+	path := org + "/" + space + "/" + name
+	params, err := serviceParameters(def)
+	if err != nil {
+		return fmt.Errorf("the parameters of service instance '%s': %s", path, err)
 	}
-	if route != "" {
-		args = append(args, "-r", route)
+
+	exists, err := d.serviceExists(org, space, name)
+	if err != nil {
+		return err
 	}
-	if syslog != "" {
-		args = append(args, "-l", syslog)
+	if !exists {
+		d.act(OpCreate, "service", path)
+		if err := d.backend.CreateService(org, space, name, def.Service, def.Plan, params, def.Tags); err != nil {
+			return err
+		}
+		return d.waitProvisioned(org, space, name)
 	}
-	if err := d.run(args...); err != nil {
-		args[0] = "update-user-provided-service"
-		return d.run(args...)
+	if d.absent(path) {
+		/* an earlier step in the plan creates it, as defined */
+		d.act(OpNoop, "service", path)
+		return nil
 	}
-	return nil
-}
 
-func (d *Deployer) setQuotaArgs(quota *Quota) []string {
-	var args []string
-	if quota.Memory["total"] != "" {
-		args = append(args, "-m", quota.Memory["total"])
+	s, err := d.backend.GetService(org, space, name)
+	if err != nil && !d.tolerate(err) {
+		return err
 	}
-	if quota.Memory["per-app-instance"] != "" {
-		perAppInstance := quota.Memory["per-app-instance"]
-		if perAppInstance == "unlimited" {
-			perAppInstance = "-1"
+	if s.LastOperation.State == "in progress" {
+		/* still being provisioned, by an earlier deployment */
+		if err := d.waitProvisioned(org, space, name); err != nil {
+			return err
 		}
-		args = append(args, "-i", perAppInstance)
-	}
-	if quota.TotalAppInstances != "" {
-		appInstances := quota.TotalAppInstances
-		if appInstances == "unlimited" {
-			appInstances = "-1"
+		if s, err = d.backend.GetService(org, space, name); err != nil && !d.tolerate(err) {
+			return err
 		}
-		args = append(args, "-a", quota.TotalAppInstances)
 	}
-	if quota.ServiceInstances != "" {
-		args = append(args, "-s", quota.ServiceInstances)
+	if s.ServiceOffering.Name != "" && s.ServiceOffering.Name != def.Service {
+		return fmt.Errorf("service instance '%s' is of service '%s', not '%s'; it would have to be deleted and created again", path, s.ServiceOffering.Name, def.Service)
 	}
-	if quota.Routes != "" {
-		args = append(args, "-r", quota.Routes)
+
+	plan := ""
+	if s.ServicePlan.Name != def.Plan {
+		d.say("      changing the plan of service instance '%s' from %s to %s\n", name, s.ServicePlan.Name, def.Plan)
+		plan = def.Plan
 	}
-	if quota.PaidPlans {
-		args = append(args, "--allow-paid-service-plans")
+	if params != "" {
+		have, err := d.backend.GetServiceParameters(org, space, name)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
+		var want interface{}
+		json.Unmarshal([]byte(params), &want)
+		if have == nil || reflect.DeepEqual(want, have) {
+			params = ""
+		} else {
+			d.say("      updating the parameters of service instance '%s'\n", name)
+		}
 	}
-	if quota.NumRoutesWithResPorts != "" {
-		args = append(args, "--reserved-route-ports", quota.NumRoutesWithResPorts)
+	var tags []string
+	if len(def.Tags) > 0 {
+		have, err := d.backend.GetServiceTags(org, space, name)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
+		if !sameTags(have, def.Tags) {
+			d.say("      changing the tags of service instance '%s' to %s\n", name, strings.Join(def.Tags, ", "))
+			tags = def.Tags
+		}
 	}
-	return args
-}
-
-func (d *Deployer) createUpdateSpaceQuota(qname string, quota *Quota, oname string) error {
-	org, _ := d.cf.GetOrg(oname)
-	if org.Guid == "" {
+	if plan == "" && params == "" && tags == nil {
+		d.act(OpNoop, "service", path)
 		return nil
 	}
-	if err := d.run("target", "-o", oname); err != nil {
+
+	d.act(OpUpdate, "service", path)
+	if err := d.backend.UpdateService(org, space, name, plan, params, tags); err != nil {
 		return err
 	}
-	args := []string{"create-space-quota", qname}
-	args = append(args, d.setQuotaArgs(quota)...)
-	for _, cname := range org.SpaceQuotas {
-		if cname.Name == qname {
-			args[0] = "update-space-quota"
-		}
-	}
-
-	return d.run(args...)
-}
-
-func (d *Deployer) createOrgQuota(qname string) error {
-	return d.run("create-quota", qname)
+	return d.waitProvisioned(org, space, name)
 }
 
-func (d *Deployer) updateOrgQuota(qname string, quota *Quota) error {
-	args := []string{"update-quota", qname}
-	args = append(args, d.setQuotaArgs(quota)...)
-	return d.run(args...)
-}
-
-func (d *Deployer) setQuota(name, quota string, space bool) error {
-	cmd := "set-quota"
-	if space {
-		cmd = "set-space-quota"
+// waitProvisioned waits for the last operation on a service instance (its
+// creation, or an update) to finish, since brokers may carry them out
+// asynchronously, and nothing can be bound to an instance until they have.
+// It fails if the operation does, or if it is still in progress after the
+// service timeout.
+func (d *Deployer) waitProvisioned(org, space, name string) error {
+	if d.plan != nil || os.Getenv("DRYRUN") != "" {
+		return nil
+	}
+	timeout := d.serviceTimeout
+	if timeout <= 0 {
+		timeout = DefaultServiceTimeout
 	}
-	return d.run(cmd, name, quota)
-}
-
-func (d *Deployer) getSecurityGroupFile(sgname string, sgrule *SecurityGroup) (sgFileName string, cleanup bool, err error) {
-	sgFileName = ""
-	cleanup = false
 
-	if sgrule.SecurityGroupFile == "" {
-		rules := dynamicYamlHelper(sgrule.Rules)
-		var rulesJson []byte
-		rulesJson, err = json.Marshal(rules)
-		if err != nil {
-			return
-		}
-		var prettyJson bytes.Buffer
-		json.Indent(&prettyJson, rulesJson, "", "  ")
-		var fp *os.File
-		fp, err = ioutil.TempFile("", sgname)
-		sgFileName = fp.Name()
-		cleanup = true
+	path := org + "/" + space + "/" + name
+	d.act(OpEnsure, "service-operation", path)
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		s, err := d.backend.GetService(org, space, name)
 		if err != nil {
-			return
+			return err
 		}
-		_, err = fp.Write(prettyJson.Bytes())
-		if err != nil {
-			return
+		op := s.LastOperation
+		switch op.State {
+		case "", "succeeded":
+			if op.Type != "" {
+				d.note("%s succeeded", op.Type)
+			}
+			return nil
+		case "failed":
+			d.note("%s failed", op.Type)
+			if op.Description == "" {
+				op.Description = "the broker gave no reason"
+			}
+			return fmt.Errorf("service instance '%s' failed to %s: %s", path, op.Type, op.Description)
 		}
-		_, err = fp.WriteString("\n")
-		if err != nil {
-			return
+		if time.Now().After(deadline) {
+			d.note("%s %s", op.Type, op.State)
+			return fmt.Errorf("service instance '%s' was still %s (%s) after %s", path, op.State, op.Type, timeout)
 		}
-		fp.Close()
-		if os.Getenv("DEBUG") != "" {
-			fmt.Printf("security group rule %s\n%s\n", sgname, prettyJson.String())
+		if !waiting {
+			d.say("      waiting for the broker to %s service instance '%s'\n", op.Type, name)
+			waiting = true
 		}
-	} else {
-		sgFileName = sgrule.SecurityGroupFile
+		time.Sleep(serviceInterval)
 	}
-	if os.Getenv("DEBUG") != "" {
-		fmt.Printf("security group %s file %s\n", sgname, sgFileName)
-	}
-	return
 }
 
-// TBD Do we need to more specific on testing existence by inspecting err?
-func (d *Deployer) testSecurityGroup(sgname string) error {
-	return d.run("security-group", sgname)
+// sameTags tells whether two lists of tags hold the same ones, in
+// whatever order.
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
 }
 
-func (d *Deployer) createSecurityGroup(sgname, file string) error {
-	return d.run("create-security-group", sgname, file)
+// serviceParameters returns the parameters of a service definition as
+// JSON, or nothing, if it has none.
+func serviceParameters(def ServiceDefinition) (string, error) {
+	if def.Parameters == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(dynamicYamlHelper(def.Parameters))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
-func (d *Deployer) updateSecurityGroup(sgname, file string) error {
-	return d.run("update-security-group", sgname, file)
+func (d *Deployer) bindService(org, space, service, app string) error {
+	d.act(OpEnsure, "service-binding", fmt.Sprintf("%s/%s/%s->%s", org, space, app, service))
+	return d.backend.BindService(org, space, app, service)
 }
 
-func (d *Deployer) bindRunningSecurityGroup(sgname string) error {
-	return d.run("bind-running-security-group", sgname)
-}
+func (d *Deployer) userProvidedService(org, space, name, cred, route, syslog string) error {
+	path := org + "/" + space + "/" + name
+	exists, err := d.serviceExists(org, space, name)
+	if err != nil {
+		return err
+	}
 
-func (d *Deployer) bindStagingSecurityGroup(sgname string) error {
-	return d.run("bind-staging-security-group", sgname)
+	if exists {
+		d.act(OpUpdate, "user-provided-service", path)
+		return d.backend.UpdateUserProvidedService(org, space, name, cred, route, syslog)
+	}
+
+	d.act(OpCreate, "user-provided-service", path)
+	if err := d.backend.CreateUserProvidedService(org, space, name, cred, route, syslog); err != nil {
+		return d.backend.UpdateUserProvidedService(org, space, name, cred, route, syslog)
+	}
+	return nil
 }
 
-func (d *Deployer) bindSecurityGroup(sgname, org, space, lifecycle string) error {
-	args := []string{"bind-security-group", sgname, org}
-	if space != "" {
-		args = append(args, space)
+func (d *Deployer) deployServiceBroker(b *ServiceBroker) error {
+	brokers, err := d.backend.GetServiceBrokers()
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	if contains(brokers, b.Name) {
+		/* we can't read the credentials back, and updating
+		   it fetches its (perhaps new) catalog, regardless */
+		d.say("updating service broker '%s' at %s\n", b.Name, b.URL)
+		d.act(OpUpdate, "service-broker", b.Name)
+		return d.backend.UpdateServiceBroker(b.Name, b.Username, b.Password, b.URL)
 	}
-	if lifecycle != "" {
-		args = append(args, "--lifecycle", lifecycle)
+
+	var org, space string
+	if b.Space != "" {
+		x := strings.SplitN(b.Space, "/", 2)
+		org, space = x[0], x[1]
+		d.say("registering service broker '%s' at %s, in space '%s'\n", b.Name, b.URL, b.Space)
+	} else {
+		d.say("registering service broker '%s' at %s\n", b.Name, b.URL)
 	}
-	return d.run(args...)
+	d.act(OpCreate, "service-broker", b.Name)
+	return d.backend.CreateServiceBroker(b.Name, b.Username, b.Password, b.URL, org, space)
 }
 
-func (d *Deployer) Deploy() error {
-	for _, domain := range d.manifest.Domains {
-		fmt.Printf("setting up shared (global) domain '%s'\n", domain)
-		if err := d.createSharedDomain(domain); err != nil {
-			return err
-		}
+// servicePlanPath names the access to a plan of a service (or all of its
+// plans), for an org (or for everyone.)
+func servicePlanPath(service, plan, org string) string {
+	path := service
+	if plan != "" {
+		path += "/" + plan
 	}
-	for qname, quota := range d.manifest.Quotas {
-		fmt.Printf("creating/updating org quota '%s'\n", qname)
-		// NOTE: create and update are separated because there is currently no way
-		//       to pull existing top-level quota information out. This method
-		//       avoids errors/failures.
-		if err := d.createOrgQuota(qname); err != nil {
-			return err
-		}
-		if err := d.updateOrgQuota(qname, quota); err != nil {
-			return err
-		}
+	if org != "" {
+		path += "[" + org + "]"
 	}
+	return path
+}
 
-	for sgname, sgrule := range d.manifest.SecurityGroups {
-		file, cleanup, err := d.getSecurityGroupFile(sgname, sgrule)
-		if err != nil {
-			return err
-		}
-		if err := d.testSecurityGroup(sgname); err != nil {
-			fmt.Printf("creating security group '%s'\n", sgname)
-			if err := d.createSecurityGroup(sgname, file); err != nil {
-				return err
-			}
-		} else {
-			fmt.Printf("updating security group '%s'\n", sgname)
-			if err := d.updateSecurityGroup(sgname, file); err != nil {
-				return err
+// wantServiceAccess works out who the manifest wants to be able to see
+// each plan of a service, given the plans it has.
+func wantServiceAccess(entries []*ServiceAccess, have []ServicePlanAccess) map[string]*ServicePlanAccess {
+	want := map[string]*ServicePlanAccess{}
+	for _, a := range entries {
+		plans := []string{a.Plan}
+		if a.Plan == "" {
+			plans = nil
+			for _, p := range have {
+				plans = append(plans, p.Plan)
 			}
 		}
-		if cleanup {
-			os.Remove(file)
-		}
-	}
-
-	if d.manifest.SecurityGroupSets != nil {
-		for _, sgname := range d.manifest.SecurityGroupSets.Running {
-			fmt.Printf("bind running security group %s\n", sgname)
-			if err := d.bindRunningSecurityGroup(sgname); err != nil {
-				return err
+		for _, plan := range plans {
+			w, ok := want[plan]
+			if !ok {
+				w = &ServicePlanAccess{Plan: plan}
+				want[plan] = w
 			}
-		}
-		for _, sgname := range d.manifest.SecurityGroupSets.Staging {
-			fmt.Printf("bind staging security group %s\n", sgname)
-			if err := d.bindStagingSecurityGroup(sgname); err != nil {
-				return err
+			if len(a.Orgs) == 0 {
+				w.Public = true
+			}
+			for _, oname := range a.Orgs {
+				if !contains(w.Orgs, oname) {
+					w.Orgs = append(w.Orgs, oname)
+				}
 			}
 		}
 	}
+	return want
+}
 
-	for oname, org := range d.manifest.Organizations {
-		fmt.Printf("creating organization '%s'\n", oname)
-		if err := d.createOrg(oname); err != nil {
+// deployServiceAccess makes the plans of a service visible to the orgs
+// the manifest gives them to (or to everyone), and, when pruning, takes
+// them away from everyone else.
+func (d *Deployer) deployServiceAccess(service string, entries []*ServiceAccess) error {
+	have, err := d.backend.GetServiceAccess(service)
+	if err != nil {
+		if !d.tolerate(err) {
 			return err
 		}
-
-		for _, domain := range org.Domains {
-			fmt.Printf("  setting up organization domain '%s'\n", domain)
-			if err := d.createOrgDomain(oname, domain); err != nil {
-				return err
-			}
-		}
-
-		if org.Quota != "" {
-			fmt.Printf("  applying organization quota '%s'\n", org.Quota)
-			if err := d.setQuota(oname, org.Quota, false); err != nil {
-				return err
-			}
-		}
-
-		for sqname, squota := range org.Quotas {
-			fmt.Printf("  creating/updating space quota '%s'\n", sqname)
-			if err := d.createUpdateSpaceQuota(sqname, squota, oname); err != nil {
-				return err
-			}
-		}
-
-		if org.SecurityGroupSets != nil {
-			lifecycle := "staging"
-			for _, sgname := range org.SecurityGroupSets.Staging {
-				fmt.Printf("bind organization staging security group %s\n", sgname)
-				if err := d.bindSecurityGroup(sgname, oname, "", lifecycle); err != nil {
-					return err
-				}
+		/* the broker offering it is yet to be registered, so
+		   there is nothing to compare against */
+		for _, a := range entries {
+			orgs := a.Orgs
+			if len(orgs) == 0 {
+				orgs = []string{""}
 			}
-			lifecycle = ""
-			for _, sgname := range org.SecurityGroupSets.Running {
-				fmt.Printf("bind organization running security group %s\n", sgname)
-				if err := d.bindSecurityGroup(sgname, oname, "", lifecycle); err != nil {
+			for _, oname := range orgs {
+				d.act(OpCreate, "service-access", servicePlanPath(service, a.Plan, oname))
+				if err := d.backend.EnableServiceAccess(service, a.Plan, oname); err != nil {
 					return err
 				}
 			}
 		}
+		return nil
+	}
 
-		for uname, roles := range org.Users {
-			fmt.Printf("  granting org-level access to user '%s'\n", uname)
-			if err := d.createUser(uname); err != nil {
+	want := wantServiceAccess(entries, have)
+	current := map[string]ServicePlanAccess{}
+	for _, p := range have {
+		current[p.Plan] = p
+	}
+	for _, plan := range sortedKeys(want) {
+		w, p := want[plan], current[plan]
+		switch {
+		case w.Public && p.Public:
+			d.act(OpNoop, "service-access", servicePlanPath(service, plan, ""))
+		case w.Public:
+			d.say("  enabling access to plan '%s' for everyone\n", plan)
+			d.act(OpCreate, "service-access", servicePlanPath(service, plan, ""))
+			if err := d.backend.EnableServiceAccess(service, plan, ""); err != nil {
 				return err
 			}
-			for _, role := range roles {
-				fmt.Printf("    granting role '%s' to %s\n", role, uname)
-				if err := d.grantOrgRole(oname, uname, role); err != nil {
+		case p.Public:
+			/* narrowing it down to the orgs is up to pruning */
+			d.act(OpNoop, "service-access", servicePlanPath(service, plan, ""))
+		default:
+			for _, oname := range w.Orgs {
+				if contains(p.Orgs, oname) {
+					d.act(OpNoop, "service-access", servicePlanPath(service, plan, oname))
+					continue
+				}
+				d.say("  enabling access to plan '%s' for organization '%s'\n", plan, oname)
+				d.act(OpCreate, "service-access", servicePlanPath(service, plan, oname))
+				if err := d.backend.EnableServiceAccess(service, plan, oname); err != nil {
 					return err
 				}
 			}
 		}
+	}
 
-		for sname, space := range org.Spaces {
-			fmt.Printf("  creating space '%s'\n", sname)
-			if err := d.createSpace(oname, sname); err != nil {
-				return err
-			}
-			if err := d.run("target", "-o", oname, "-s", sname); err != nil {
-				return err
-			}
+	if d.prune[PruneServiceAccess] {
+		return d.pruneServiceAccess(service, want, have)
+	}
+	return nil
+}
 
-			if space.SSH != "" {
-				fmt.Printf("    setting ssh-enabled to '%s'\n", space.SSH)
-				if err := d.enableSSH(sname, boolify(space.SSH)); err != nil {
-					return err
-				}
-			}
+func (d *Deployer) createUpdateSpaceQuota(qname string, quota *Quota, oname string) error {
+	path := oname + "/" + qname
+	if d.absent(oname) {
+		d.act(OpCreate, "space-quota", path)
+		return d.backend.CreateSpaceQuota(oname, qname, quota)
+	}
 
-			if space.Domain != "" {
-				fmt.Printf("    using default domain of '%s'\n", space.Domain)
-			}
+	org, _ := d.backend.GetOrg(oname)
+	if org.Guid == "" {
+		return nil
+	}
+	for _, cname := range org.SpaceQuotas {
+		if cname.Name == qname {
+			d.act(OpUpdate, "space-quota", path)
+			return d.backend.UpdateSpaceQuota(oname, qname, quota)
+		}
+	}
 
-			if space.Quota != "" {
-				fmt.Printf("    applying space quota '%s'\n", space.Quota)
-				if err := d.setQuota(sname, space.Quota, true); err != nil {
-					return err
-				}
-			}
+	d.act(OpCreate, "space-quota", path)
+	return d.backend.CreateSpaceQuota(oname, qname, quota)
+}
 
-			if space.SecurityGroupSets != nil {
-				lifecycle := "staging"
-				for _, sgname := range space.SecurityGroupSets.Staging {
-					fmt.Printf("bind space staging security group %s\n", sgname)
-					if err := d.bindSecurityGroup(sgname, oname, sname, lifecycle); err != nil {
-						return err
-					}
-				}
-				lifecycle = ""
-				for _, sgname := range space.SecurityGroupSets.Running {
-					fmt.Printf("bind space running security group %s\n", sgname)
-					if err := d.bindSecurityGroup(sgname, oname, sname, lifecycle); err != nil {
-						return err
-					}
-				}
+func (d *Deployer) createOrgQuota(qname string) error {
+	return d.backend.CreateQuota(qname)
+}
+
+func (d *Deployer) updateOrgQuota(qname string, quota *Quota) error {
+	return d.backend.UpdateQuota(qname, quota)
+}
+
+func (d *Deployer) setOrgQuota(org, quota string) error {
+	if !d.absent(org) {
+		o, err := d.backend.GetOrg(org)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
+		if o.QuotaDefinition.Name == quota {
+			d.act(OpNoop, "org-quota-assignment", org)
+			return nil
+		}
+	}
+
+	d.act(OpUpdate, "org-quota-assignment", org)
+	return d.backend.SetOrgQuota(org, quota)
+}
+
+func (d *Deployer) setSpaceQuota(org, space, quota string) error {
+	if !d.absent(org + "/" + space) {
+		s, err := d.backend.GetSpace(org, space)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
+		if s.SpaceQuota.Name == quota {
+			d.act(OpNoop, "space-quota-assignment", org+"/"+space)
+			return nil
+		}
+	}
+
+	d.act(OpUpdate, "space-quota-assignment", org+"/"+space)
+	return d.backend.SetSpaceQuota(org, space, quota)
+}
+
+// securityGroupRules returns the rules for a security group as JSON,
+// either from its security_group_file or from the rules in the manifest.
+func (d *Deployer) securityGroupRules(sgname string, sgrule *SecurityGroup) ([]byte, error) {
+	if sgrule.SecurityGroupFile != "" {
+		if os.Getenv("DEBUG") != "" {
+			fmt.Printf("security group %s file %s\n", sgname, sgrule.SecurityGroupFile)
+		}
+		return ioutil.ReadFile(sgrule.SecurityGroupFile)
+	}
+
+	rules := dynamicYamlHelper(sgrule.Rules)
+	rulesJson, err := json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+	var prettyJson bytes.Buffer
+	json.Indent(&prettyJson, rulesJson, "", "  ")
+	prettyJson.WriteString("\n")
+	if os.Getenv("DEBUG") != "" {
+		fmt.Printf("security group rule %s\n%s", sgname, redactions.String(prettyJson.String()))
+	}
+	return prettyJson.Bytes(), nil
+}
+
+func (d *Deployer) createSecurityGroup(sgname string, rules []byte) error {
+	return d.backend.CreateSecurityGroup(sgname, rules)
+}
+
+func (d *Deployer) updateSecurityGroup(sgname string, rules []byte) error {
+	return d.backend.UpdateSecurityGroup(sgname, rules)
+}
+
+func (d *Deployer) bindRunningSecurityGroup(sgname string) error {
+	d.act(OpEnsure, "running-security-group", sgname)
+	return d.backend.BindGlobalSecurityGroup(sgname, "running")
+}
+
+func (d *Deployer) bindStagingSecurityGroup(sgname string) error {
+	d.act(OpEnsure, "staging-security-group", sgname)
+	return d.backend.BindGlobalSecurityGroup(sgname, "staging")
+}
+
+func (d *Deployer) bindSecurityGroup(sgname, org, space, lifecycle string) error {
+	path := org
+	if space != "" {
+		path = org + "/" + space
+	}
+	d.act(OpEnsure, lifecycle+"-security-group", path+"->"+sgname)
+	return d.backend.BindSecurityGroup(sgname, org, space, lifecycle)
+}
+
+// Deploy builds the graph of steps needed to deploy the manifest, and then
+// executes them, in dependency order.
+func (d *Deployer) Deploy() error {
+	if err := d.execute(d.build()); err != nil {
+		return err
+	}
+	if failed, skipped := countFailures(d.failures); failed > 0 {
+		return fmt.Errorf("%d resource(s) failed, %d skipped", failed, skipped)
+	}
+	return nil
+}
+
+// build works out every step of the deployment, and what each of them
+// depends on: quotas come before the orgs that use them, security groups
+// before their bindings, users before their roles, orgs before their
+// spaces, and spaces (and their services) before their applications.
+// Service brokers come after the applications that run them, and access
+// to their services after the brokers (but before anything that uses
+// them.)  Pruning comes after everything else in its scope.
+func (d *Deployer) build() *graph {
+	g := newGraph()
+
+	for _, domain := range d.manifest.Domains {
+		domain := domain
+		g.add("shared-domain", domain, func(d *Deployer) error {
+			d.say("setting up shared (global) domain '%s'\n", domain)
+			return d.createSharedDomain(domain)
+		})
+	}
+	for _, qname := range sortedKeys(d.manifest.Quotas) {
+		qname, quota := qname, d.manifest.Quotas[qname]
+		g.add("quota", qname, func(d *Deployer) error {
+			d.say("creating/updating org quota '%s'\n", qname)
+			// NOTE: create and update are separated because there is currently no way
+			//       to pull existing top-level quota information out. This method
+			//       avoids errors/failures.
+			d.act(OpEnsure, "quota", qname)
+			if err := d.createOrgQuota(qname); err != nil {
+				return err
 			}
+			return d.updateOrgQuota(qname, quota)
+		})
+	}
 
-			for uname, roles := range space.Users {
-				fmt.Printf("    granting space-level access to user '%s'\n", uname)
-				if err := d.createUser(uname); err != nil {
-					return err
-				}
-				for _, role := range roles {
-					fmt.Printf("      granting role '%s' to %s\n", role, uname)
-					if err := d.grantSpaceRole(oname, sname, uname, role); err != nil {
-						return err
-					}
+	for _, sgname := range sortedKeys(d.manifest.SecurityGroups) {
+		sgname, sgrule := sgname, d.manifest.SecurityGroups[sgname]
+		g.add("security-group", sgname, func(d *Deployer) error {
+			return d.deploySecurityGroup(sgname, sgrule)
+		})
+	}
+
+	mark := len(g.steps)
+	if sets := d.manifest.SecurityGroupSets; sets != nil {
+		for _, sgname := range sets.Running {
+			sgname := sgname
+			g.add("running-security-group", sgname, func(d *Deployer) error {
+				d.say("bind running security group %s\n", sgname)
+				return d.bindRunningSecurityGroup(sgname)
+			}, d.securityGroupNeeds(sgname)...)
+		}
+		for _, sgname := range sets.Staging {
+			sgname := sgname
+			g.add("staging-security-group", sgname, func(d *Deployer) error {
+				d.say("bind staging security group %s\n", sgname)
+				return d.bindStagingSecurityGroup(sgname)
+			}, d.securityGroupNeeds(sgname)...)
+		}
+	}
+	if d.prune[PruneSecurityGroups] {
+		g.add("security-group", "*", (*Deployer).pruneGlobalSecurityGroups).after = g.since(mark)
+	}
+
+	mark = len(g.steps)
+	for _, oname := range sortedKeys(d.manifest.Organizations) {
+		d.buildOrg(g, oname, d.manifest.Organizations[oname])
+	}
+	if d.prune[PruneOrgs] {
+		g.add("org", "*", (*Deployer).pruneOrgs).after = g.since(mark)
+	}
+
+	d.buildServiceBrokers(g)
+	return g
+}
+
+// buildServiceBrokers adds the steps that register service brokers, once
+// the applications that run them are up, and then the ones that give out
+// access to their services, which the service instances (and bindings)
+// that use those services then have to wait for.
+func (d *Deployer) buildServiceBrokers(g *graph) {
+	mark := len(g.steps)
+	for _, b := range d.manifest.ServiceBrokers {
+		b := b
+		var needs []string
+		if b.App != "" {
+			needs = append(needs, "app:"+b.App)
+		}
+		if d.manifest.space(b.Space) != nil {
+			needs = append(needs, "space:"+b.Space)
+		}
+		g.add("service-broker", b.Name, func(d *Deployer) error {
+			return d.deployServiceBroker(b)
+		}, needs...)
+	}
+	brokers := g.since(mark)
+
+	var services []string
+	entries := map[string][]*ServiceAccess{}
+	for _, a := range d.manifest.ServiceAccess {
+		if _, ok := entries[a.Service]; !ok {
+			services = append(services, a.Service)
+		}
+		entries[a.Service] = append(entries[a.Service], a)
+	}
+	for _, service := range services {
+		service := service
+		var needs []string
+		for _, a := range entries[service] {
+			for _, oname := range a.Orgs {
+				if _, ok := d.manifest.Organizations[oname]; ok {
+					needs = append(needs, "org:"+oname)
 				}
 			}
-			for svname, service := range space.SharedServices {
-				fmt.Printf("    setting up shared service instance '%s' (from %s)\n", svname, service)
-				broker, plan := parseService(service)
-				if err := d.createService(svname, broker, plan); err != nil {
-					return err
+		}
+		g.add("service-access", service, func(d *Deployer) error {
+			d.say("setting up access to service '%s'\n", service)
+			return d.deployServiceAccess(service, entries[service])
+		}, needs...).after = brokers
+	}
+
+	uses := func(id string, def ServiceDefinition) {
+		service := def.Service
+		s, ok := g.index[id]
+		if _, access := entries[service]; ok && access && !contains(s.needs, "service-access:"+service) {
+			s.needs = append(s.needs, "service-access:"+service)
+		}
+	}
+	for _, oname := range sortedKeys(d.manifest.Organizations) {
+		org := d.manifest.Organizations[oname]
+		for _, sname := range sortedKeys(org.Spaces) {
+			path := oname + "/" + sname
+			space := org.Spaces[sname]
+			for _, svname := range sortedKeys(space.SharedServices) {
+				uses("service:"+path+"/"+svname, space.SharedServices[svname])
+			}
+			for _, app := range space.Applications {
+				for _, svname := range sortedKeys(app.BoundServices) {
+					uses("app:"+path+"/"+app.Name, app.BoundServices[svname])
 				}
 			}
+		}
+	}
+}
 
-			for _, cups := range space.UserProvidedServices {
-				if cups.Name != "" {
-					fmt.Printf("    creating/updating a user provided service %s\n", cups.Name)
-					var cred string
-					if cups.Credentials != nil {
-						obj := dynamicYamlHelper(cups.Credentials)
-						c, err := json.Marshal(obj)
-						if err != nil {
-							return err
-						}
-						cred = string(c)
-					}
-					if err := d.userProvidedService(cups.Name, cred, cups.RouteServiceUrl, cups.SyslogDrainUrl); err != nil {
-						return err
-					}
-				}
+// buildUser adds the step that creates a user (if the manifest has their
+// password), the first time one of their roles is granted, and returns
+// the ids of the steps that granting them a role needs.
+func (d *Deployer) buildUser(g *graph, id, uname string) []string {
+	for _, u := range d.manifest.Users {
+		if u.Name == uname {
+			g.add("user", uname, func(d *Deployer) error {
+				return d.createUser(uname)
+			})
+			return []string{id, "user:" + uname}
+		}
+	}
+	return []string{id}
+}
+
+// securityGroupNeeds returns the ids of the steps that binding a security
+// group needs: the one that defines it, unless it is left to exist already.
+func (d *Deployer) securityGroupNeeds(sgname string, needs ...string) []string {
+	if _, ok := d.manifest.SecurityGroups[sgname]; ok {
+		needs = append(needs, "security-group:"+sgname)
+	}
+	return needs
+}
+
+func (d *Deployer) buildOrg(g *graph, oname string, org *Organization) {
+	mark := len(g.steps)
+	id := "org:" + oname
+
+	g.add("org", oname, func(d *Deployer) error {
+		d.say("creating organization '%s'\n", oname)
+		return d.createOrg(oname)
+	})
+
+	for _, domain := range org.Domains {
+		domain := domain
+		g.add("org-domain", oname+"/"+domain, func(d *Deployer) error {
+			d.say("  setting up organization domain '%s'\n", domain)
+			return d.createOrgDomain(oname, domain)
+		}, id)
+	}
+
+	if org.Quota != "" {
+		needs := []string{id}
+		if _, ok := d.manifest.Quotas[org.Quota]; ok {
+			needs = append(needs, "quota:"+org.Quota)
+		}
+		g.add("org-quota-assignment", oname, func(d *Deployer) error {
+			d.say("  applying organization quota '%s'\n", org.Quota)
+			return d.setOrgQuota(oname, org.Quota)
+		}, needs...)
+	}
+
+	for _, sqname := range sortedKeys(org.Quotas) {
+		sqname, squota := sqname, org.Quotas[sqname]
+		g.add("space-quota", oname+"/"+sqname, func(d *Deployer) error {
+			d.say("  creating/updating space quota '%s'\n", sqname)
+			return d.createUpdateSpaceQuota(sqname, squota, oname)
+		}, id)
+	}
+
+	if sets := org.SecurityGroupSets; sets != nil {
+		for _, lifecycle := range []string{"staging", "running"} {
+			list := sets.Staging
+			if lifecycle == "running" {
+				list = sets.Running
 			}
+			for _, sgname := range list {
+				lifecycle, sgname := lifecycle, sgname
+				g.add(lifecycle+"-security-group", oname+"->"+sgname, func(d *Deployer) error {
+					d.say("bind organization %s security group %s\n", lifecycle, sgname)
+					return d.bindSecurityGroup(sgname, oname, "", lifecycle)
+				}, d.securityGroupNeeds(sgname, id)...)
+			}
+		}
+	}
 
-			for _, app := range space.Applications {
-				fmt.Printf("    staging application '%s'\n", app.Name)
-				fmt.Printf("      spinning up %d instances\n", app.Instances)
-				if app.Hostname != "" {
-					fmt.Printf("      using hostname '%s'\n", app.Hostname)
-				}
-				if app.Domain != "" {
-					fmt.Printf("      using domain '%s'\n", app.Domain)
-				}
-				if app.Disk != "" {
-					fmt.Printf("      provisioning with %s disk\n", app.Disk)
-				}
-				if app.Memory != "" {
-					fmt.Printf("      provisioning with %s memory\n", app.Memory)
-				}
-				if app.Image != "" {
-					fmt.Printf("      deploying image '%s'\n", app.Image)
-				} else if app.Repository != "" {
-					fmt.Printf("      deploying remote codebase from '%s'\n", app.Repository)
-				} else if app.Path != "" {
-					fmt.Printf("      deploying local codebase from '%s'\n", app.Path)
-				}
-				if app.Buildpack != "" {
-					fmt.Printf("      using the '%s' buildpack\n", app.Buildpack)
-				}
+	roles := len(g.steps)
+	for _, uname := range sortedKeys(org.Users) {
+		uname := uname
+		needs := d.buildUser(g, id, uname)
+		for _, role := range org.Users[uname] {
+			role := role
+			g.add("org-role", fmt.Sprintf("%s/%s[%s]", oname, uname, role), func(d *Deployer) error {
+				d.say("  granting role '%s' to %s in organization '%s'\n", role, uname, oname)
+				return d.grantOrgRole(oname, uname, role)
+			}, needs...)
+		}
+	}
+	if d.prune[PruneRoles] {
+		g.add("org-role", oname, func(d *Deployer) error {
+			return d.pruneOrgRoles(oname, org)
+		}, id).after = g.since(roles)
+	}
 
-				if err := d.stageApp(app); err != nil {
-					return err
-				}
+	for _, sname := range sortedKeys(org.Spaces) {
+		d.buildSpace(g, oname, sname, org, org.Spaces[sname])
+	}
+	if d.prune[PruneSpaces] {
+		g.add("space", oname, func(d *Deployer) error {
+			return d.pruneSpaces(oname, org)
+		}, id).after = g.since(mark)
+	}
+}
 
-				if len(app.URLs) > 0 {
-					if err := d.mapURLs(app); err != nil {
-						return err
-					}
-				}
+func (d *Deployer) buildSpace(g *graph, oname, sname string, org *Organization, space *Space) {
+	path := oname + "/" + sname
+	mark := len(g.steps)
+	id := "space:" + path
+
+	g.add("space", path, func(d *Deployer) error {
+		d.say("  creating space '%s'\n", sname)
+		return d.createSpace(oname, sname)
+	}, "org:"+oname)
+
+	if space.SSH != "" {
+		g.add("space-ssh", path, func(d *Deployer) error {
+			d.say("    setting ssh-enabled to '%s'\n", space.SSH)
+			return d.enableSSH(oname, sname, boolify(space.SSH))
+		}, id)
+	}
 
-				for ename, value := range app.Environment {
-					fmt.Printf("      setting environment variable $%s\n", ename)
-					if err := d.setEnvVar(ename, value, app.Name); err != nil {
-						return err
-					}
-				}
+	if space.Quota != "" {
+		needs := []string{id}
+		if _, ok := org.Quotas[space.Quota]; ok {
+			needs = append(needs, "space-quota:"+oname+"/"+space.Quota)
+		}
+		g.add("space-quota-assignment", path, func(d *Deployer) error {
+			d.say("    applying space quota '%s'\n", space.Quota)
+			return d.setSpaceQuota(oname, sname, space.Quota)
+		}, needs...)
+	}
 
-				for svname, service := range app.BoundServices {
-					fmt.Printf("      binding service instance '%s' (from %s)\n", svname, service)
-					broker, plan := parseService(service)
-					if err := d.createService(svname, broker, plan); err != nil {
-						return err
-					}
-					if err := d.bindService(svname, app.Name); err != nil {
-						return err
-					}
-				}
+	bindings := len(g.steps)
+	if sets := space.SecurityGroupSets; sets != nil {
+		for _, lifecycle := range []string{"staging", "running"} {
+			list := sets.Staging
+			if lifecycle == "running" {
+				list = sets.Running
+			}
+			for _, sgname := range list {
+				lifecycle, sgname := lifecycle, sgname
+				g.add(lifecycle+"-security-group", path+"->"+sgname, func(d *Deployer) error {
+					d.say("bind space %s security group %s\n", lifecycle, sgname)
+					return d.bindSecurityGroup(sgname, oname, sname, lifecycle)
+				}, d.securityGroupNeeds(sgname, id)...)
+			}
+		}
+	}
+	if d.prune[PruneSecurityGroups] {
+		g.add("space-security-group", path, func(d *Deployer) error {
+			return d.pruneSpaceSecurityGroups(oname, sname, org, space)
+		}, id).after = g.since(bindings)
+	}
 
-				fmt.Printf("    starting application '%s'\n", app.Name)
-				if err := d.startApp(app); err != nil {
-					return err
-				}
+	roles := len(g.steps)
+	for _, uname := range sortedKeys(space.Users) {
+		uname := uname
+		needs := d.buildUser(g, id, uname)
+		for _, role := range space.Users[uname] {
+			role := role
+			g.add("space-role", fmt.Sprintf("%s/%s[%s]", path, uname, role), func(d *Deployer) error {
+				d.say("    granting role '%s' to %s in space '%s'\n", role, uname, path)
+				return d.grantSpaceRole(oname, sname, uname, role)
+			}, needs...)
+		}
+	}
+	if d.prune[PruneRoles] {
+		g.add("space-role", path, func(d *Deployer) error {
+			return d.pruneSpaceRoles(oname, sname, space)
+		}, id).after = g.since(roles)
+	}
+
+	for _, svname := range sortedKeys(space.SharedServices) {
+		svname, def := svname, space.SharedServices[svname]
+		g.add("service", path+"/"+svname, func(d *Deployer) error {
+			d.say("    setting up shared service instance '%s' (from %s)\n", svname, def)
+			return d.createService(oname, sname, svname, def)
+		}, id)
+	}
+
+	for _, cups := range space.UserProvidedServices {
+		if cups.Name != "" {
+			cups := cups
+			g.add("user-provided-service", path+"/"+cups.Name, func(d *Deployer) error {
+				d.say("    creating/updating a user provided service %s\n", cups.Name)
+				return d.deployUserProvidedService(oname, sname, cups)
+			}, id)
+		}
+	}
+
+	apps := len(g.steps)
+	for _, app := range space.Applications {
+		app := app
+		needs := []string{id}
+		if contains(d.manifest.Domains, app.Domain) {
+			needs = append(needs, "shared-domain:"+app.Domain)
+		}
+		if contains(org.Domains, app.Domain) {
+			needs = append(needs, "org-domain:"+oname+"/"+app.Domain)
+		}
+		for _, svname := range sortedKeys(app.BoundServices) {
+			/* the app's own service instances are made as it is set up */
+			if !app.scoped[svname] {
+				needs = append(needs, "service:"+path+"/"+svname)
 			}
 		}
+		g.add("app", path+"/"+app.Name, func(d *Deployer) error {
+			return d.deployApp(oname, sname, app)
+		}, needs...)
 	}
 
-	return nil
+	if d.prune[PruneApps] {
+		g.add("app", path, func(d *Deployer) error {
+			return d.pruneApps(oname, sname, space)
+		}, id).after = g.since(apps)
+	}
+	if d.prune[PruneAppServices] {
+		/* after the apps have been unbound from them */
+		g.add("app-services", path, func(d *Deployer) error {
+			return d.pruneAppServices(oname, sname, space)
+		}, id).after = g.since(apps)
+	}
+	if d.prune[PruneServices] {
+		/* after the apps have been pruned, so that nothing is still bound */
+		g.add("service", path, func(d *Deployer) error {
+			return d.pruneServices(oname, sname, space)
+		}, id).after = g.since(mark)
+	}
+	if d.prune[PruneRoutes] {
+		g.add("orphaned-routes", path, func(d *Deployer) error {
+			return d.pruneRoutes(oname, sname)
+		}, id).after = g.since(apps)
+	}
+}
+
+func (d *Deployer) deploySecurityGroup(sgname string, sgrule *SecurityGroup) error {
+	rules, err := d.securityGroupRules(sgname, sgrule)
+	if err != nil {
+		return err
+	}
+	exists, err := d.backend.SecurityGroupExists(sgname)
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	if !exists {
+		d.say("creating security group '%s'\n", sgname)
+		d.act(OpCreate, "security-group", sgname)
+		return d.createSecurityGroup(sgname, rules)
+	}
+	d.say("updating security group '%s'\n", sgname)
+	d.act(OpUpdate, "security-group", sgname)
+	return d.updateSecurityGroup(sgname, rules)
+}
+
+func (d *Deployer) deployUserProvidedService(oname, sname string, cups *UserProvidedService) error {
+	var cred string
+	if cups.Credentials != nil {
+		obj := dynamicYamlHelper(cups.Credentials)
+		c, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		cred = string(c)
+	}
+	return d.userProvidedService(oname, sname, cups.Name, cred, cups.RouteServiceUrl, cups.SyslogDrainUrl)
+}
+
+// deployApp stages, configures and starts an application; each step
+// depends on the one before it, so the first failure ends the lot.  An
+// application that is already there is only pushed again if there is
+// something new to push (see needsPush); otherwise, it is brought in line
+// with the manifest in place.
+func (d *Deployer) deployApp(oname, sname string, app *Application) error {
+	live, err := d.liveApp(oname, sname, app)
+	if err != nil {
+		return err
+	}
+	fp := d.fingerprint(app)
+	if live.Guid != "" && !needsPush(app, live, fp) {
+		return d.updateApp(oname, sname, app, live)
+	}
+
+	d.say("    staging application '%s'\n", app.Name)
+	d.say("      spinning up %d instances\n", app.Instances)
+	if app.Hostname != "" {
+		d.say("      using hostname '%s'\n", app.Hostname)
+	}
+	if app.Domain != "" {
+		d.say("      using domain '%s'\n", app.Domain)
+	}
+	if app.Disk != "" {
+		d.say("      provisioning with %s disk\n", app.Disk)
+	}
+	if app.Memory != "" {
+		d.say("      provisioning with %s memory\n", app.Memory)
+	}
+	if app.Image != "" {
+		d.say("      deploying image '%s'\n", app.Image)
+	} else if app.Repository != "" {
+		d.say("      deploying remote codebase from '%s'\n", app.Repository)
+	} else if app.Path != "" {
+		d.say("      deploying local codebase from '%s'\n", app.Path)
+	}
+	if app.Buildpack != "" {
+		d.say("      using the '%s' buildpack\n", app.Buildpack)
+	}
+
+	if app.Strategy == StrategyBlueGreen && live.Guid != "" {
+		return d.deployBlueGreen(oname, sname, app, live, fp)
+	}
+
+	if err := d.stageApp(oname, sname, app, live.Guid != ""); err != nil {
+		return err
+	}
+
+	if len(app.URLs) > 0 {
+		if err := d.mapURLs(oname, sname, app); err != nil {
+			return err
+		}
+	}
+
+	if _, err := d.configureApp(oname, sname, app, live); err != nil {
+		return err
+	}
+	if err := d.recordServices(oname, sname, app.Name, app, live); err != nil {
+		return err
+	}
+
+	d.say("    starting application '%s'\n", app.Name)
+	if err := d.startApp(oname, sname, app); err != nil {
+		return err
+	}
+	if err := d.waitHealthy(oname, sname, app.Name); err != nil {
+		return err
+	}
+	return d.recordFingerprint(oname, sname, app.Name, live, fp)
+}
+
+// recordFingerprint keeps the fingerprint of an application that has just
+// been pushed, once it is up and running.  One that failed to stage, or
+// crashed, is left with the fingerprint of its last good deployment (if
+// any), so that it is pushed again next time.
+func (d *Deployer) recordFingerprint(oname, sname, name string, live plugin_models.GetAppModel, fp string) error {
+	if fp == "" || fmt.Sprintf("%v", live.EnvironmentVars[FingerprintVar]) == fp {
+		return nil
+	}
+	return d.setEnvVar(oname, sname, FingerprintVar, fp, name)
+}
+
+// updateApp brings an application that has nothing new to push in line
+// with the manifest, without pushing it: its routes are mapped, it is
+// scaled (in place) if it has the wrong number of instances, and it is
+// restaged if any of its environment variables or service bindings had
+// to be changed.  An application with nothing to change is left running.
+func (d *Deployer) updateApp(oname, sname string, app *Application, live plugin_models.GetAppModel) error {
+	path := oname + "/" + sname + "/" + app.Name
+	d.say("    checking application '%s'\n", app.Name)
+	d.act(OpNoop, "app", path)
+
+	if len(app.URLs) > 0 {
+		if err := d.mapURLs(oname, sname, app); err != nil {
+			return err
+		}
+	}
+
+	scaled := false
+	if app.Instances != live.InstanceCount {
+		d.say("      scaling from %d to %d instances\n", live.InstanceCount, app.Instances)
+		d.act(OpUpdate, "app-instances", path)
+		if err := d.backend.ScaleApp(oname, sname, app.Name, app.Instances); err != nil {
+			return err
+		}
+		scaled = true
+	}
+
+	changed, err := d.configureApp(oname, sname, app, live)
+	if err != nil {
+		return err
+	}
+	if err := d.recordServices(oname, sname, app.Name, app, live); err != nil {
+		return err
+	}
+
+	switch {
+	case changed:
+		d.say("    restaging application '%s'\n", app.Name)
+		d.act(OpEnsure, "app-restage", path)
+		if err := d.backend.RestageApp(oname, sname, app.Name); err != nil {
+			return err
+		}
+	case live.State != "started":
+		d.say("    starting application '%s'\n", app.Name)
+		if err := d.startApp(oname, sname, app); err != nil {
+			return err
+		}
+	case !scaled && live.RunningInstances >= live.InstanceCount:
+		d.say("      nothing has changed\n")
+		return nil
+	}
+	return d.waitHealthy(oname, sname, app.Name)
+}
+
+// configureApp sets the environment variables of an application, and
+// binds it to its services (creating them, if need be), leaving out the ones it already
+// has, as it is now.  It unsets the variables that are not in the
+// manifest, unless they are managed externally, and unbinds the services
+// not in it.  It returns true if anything had to be changed.
+func (d *Deployer) configureApp(oname, sname string, app *Application, live plugin_models.GetAppModel) (bool, error) {
+	env := map[string]string{}
+	for name, value := range app.Environment {
+		env[name] = value
+	}
+
+	changed := false
+	for _, ename := range sortedKeys(env) {
+		value := env[ename]
+		if v, ok := live.EnvironmentVars[ename]; ok && fmt.Sprintf("%v", v) == value {
+			continue
+		}
+		d.say("      setting environment variable $%s\n", ename)
+		if err := d.setEnvVar(oname, sname, ename, value, app.Name); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	for _, ename := range sortedKeys(live.EnvironmentVars) {
+		if _, ok := env[ename]; ok || d.manifest.externalEnv(ename) {
+			continue
+		}
+		d.say("      unsetting environment variable $%s\n", ename)
+		d.act(OpDelete, "env", fmt.Sprintf("%s/%s/%s$%s", oname, sname, app.Name, ename))
+		if err := d.backend.UnsetEnv(oname, sname, app.Name, ename); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	bound := map[string]bool{}
+	for _, svc := range live.Services {
+		bound[svc.Name] = true
+	}
+	for _, svname := range sortedKeys(app.BoundServices) {
+		def := app.BoundServices[svname]
+		/* shared instances are the space's to set up */
+		if app.scoped[svname] {
+			if err := d.createService(oname, sname, svname, def); err != nil {
+				return changed, err
+			}
+		}
+		if bound[svname] {
+			continue
+		}
+		d.say("      binding service instance '%s' (from %s)\n", svname, def)
+		if err := d.bindService(oname, sname, svname, app.Name); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	for _, svname := range sortedKeys(bound) {
+		if _, ok := app.BoundServices[svname]; ok {
+			continue
+		}
+		d.say("      unbinding service instance '%s'\n", svname)
+		d.act(OpDelete, "service-binding", fmt.Sprintf("%s/%s/%s->%s", oname, sname, app.Name, svname))
+		if err := d.backend.UnbindService(oname, sname, app.Name, svname); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// liveApp returns an application as it is now, or nothing, if it isn't
+// there (yet.)
+func (d *Deployer) liveApp(oname, sname string, app *Application) (plugin_models.GetAppModel, error) {
+	var a plugin_models.GetAppModel
+	if d.absent(oname + "/" + sname) {
+		return a, nil
+	}
+	a, err := d.backend.GetApp(oname, sname, app.Name)
+	if err != nil && (isMissing(err) || d.tolerate(err)) {
+		return plugin_models.GetAppModel{}, nil
+	}
+	return a, err
+}
+
+// deployBlueGreen replaces a running application without taking it down:
+// the new version is pushed alongside it (as APP-new, with no routes),
+// configured and started, and only once all of its instances are running
+// are the routes moved over to it.  The old version is then renamed out of
+// the way (to APP-venerable), the new one takes its name, and the old one
+// is deleted.  If the new version never becomes healthy, it is deleted,
+// and the old one is left as it was.
+func (d *Deployer) deployBlueGreen(oname, sname string, app *Application, live plugin_models.GetAppModel, fp string) error {
+	path := oname + "/" + sname + "/"
+	green := *app
+	green.Name = app.Name + "-new"
+	green.NoRoute = true
+	old := app.Name + "-venerable"
+
+	d.act(OpUpdate, "app", path+app.Name)
+	d.say("      pushing the new version alongside, as '%s'\n", green.Name)
+	d.act(OpCreate, "app", path+green.Name)
+	dir, err := d.appSource(app)
+	if err != nil {
+		return err
+	}
+	if err := d.backend.PushApp(oname, sname, &green, dir); err != nil {
+		return d.rollBack(oname, sname, app, &green, err)
+	}
+	if _, err := d.configureApp(oname, sname, &green, plugin_models.GetAppModel{}); err != nil {
+		return d.rollBack(oname, sname, app, &green, err)
+	}
+	if err := d.recordServices(oname, sname, green.Name, app, live); err != nil {
+		return d.rollBack(oname, sname, app, &green, err)
+	}
+	d.say("    starting application '%s'\n", green.Name)
+	if err := d.startApp(oname, sname, &green); err != nil {
+		return d.rollBack(oname, sname, app, &green, err)
+	}
+	if err := d.waitHealthy(oname, sname, green.Name); err != nil {
+		return d.rollBack(oname, sname, app, &green, err)
+	}
+	if err := d.recordFingerprint(oname, sname, green.Name, plugin_models.GetAppModel{}, fp); err != nil {
+		return d.rollBack(oname, sname, app, &green, err)
+	}
+
+	/* the routes it is meant to have, or (without urls) the ones
+	   it has, along with the one its hostname and domain give it */
+	routes := map[string]URL{}
+	if len(app.URLs) > 0 {
+		for _, s := range app.URLs {
+			url := ParseURL(s, app.Domain)
+			routes[url.String()] = url
+		}
+	} else if !app.NoRoute {
+		for _, r := range live.Routes {
+			url := URL{Host: r.Host, Domain: r.Domain.Name}
+			routes[url.String()] = url
+		}
+		if app.Domain != "" {
+			url := URL{Host: app.Hostname, Domain: app.Domain}
+			if url.Host == "" {
+				url.Host = app.Name
+			}
+			routes[url.String()] = url
+		}
+	}
+	for _, u := range sortedKeys(routes) {
+		d.say("    mapping route %s to '%s'\n", u, green.Name)
+		d.act(OpCreate, "route", path+green.Name+"->"+u)
+		if err := d.backend.MapRoute(oname, sname, green.Name, routes[u]); err != nil {
+			return d.rollBack(oname, sname, app, &green, err)
+		}
+	}
+
+	/* the new version is serving now; there's no going back */
+	for _, r := range live.Routes {
+		url := URL{Host: r.Host, Domain: r.Domain.Name}
+		d.say("    unmapping route %s from '%s'\n", url, app.Name)
+		d.act(OpDelete, "route", path+app.Name+"->"+url.String())
+		if err := d.backend.UnmapRoute(oname, sname, app.Name, url); err != nil {
+			return err
+		}
+	}
+	d.say("    renaming '%s' to '%s', and '%s' to '%s'\n", app.Name, old, green.Name, app.Name)
+	d.act(OpUpdate, "app-name", path+app.Name+"->"+old)
+	if err := d.backend.RenameApp(oname, sname, app.Name, old); err != nil {
+		return err
+	}
+	d.act(OpUpdate, "app-name", path+green.Name+"->"+app.Name)
+	if err := d.backend.RenameApp(oname, sname, green.Name, app.Name); err != nil {
+		return err
+	}
+	d.say("    deleting the old version, '%s'\n", old)
+	d.act(OpDelete, "app", path+old)
+	return d.backend.DeleteApp(oname, sname, old)
+}
+
+// rollBack deletes the new version of an application that failed to come
+// up in a blue-green deployment, leaving the old one serving.
+func (d *Deployer) rollBack(oname, sname string, app, green *Application, cause error) error {
+	d.say("    rolling back: deleting '%s'\n", green.Name)
+	d.act(OpDelete, "app", oname+"/"+sname+"/"+green.Name)
+	if err := d.backend.DeleteApp(oname, sname, green.Name); err != nil && !isMissing(err) {
+		return fmt.Errorf("the new version of '%s' failed (%s), and could not be rolled back: %s", app.Name, cause, err)
+	}
+	return fmt.Errorf("the new version of '%s' failed, and was rolled back: %s", app.Name, cause)
+}
+
+// waitHealthy waits for every instance of an application to be running,
+// once it has been started.  It fails as soon as staging has failed or any
+// instance has crashed, or if they are not all running within the health
+// timeout, saying what each of the instances was up to.  There is nothing
+// to wait for when planning.
+func (d *Deployer) waitHealthy(oname, sname, name string) error {
+	if d.plan != nil || os.Getenv("DRYRUN") != "" {
+		return nil
+	}
+	timeout := d.healthTimeout
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+
+	d.say("    waiting for application '%s' to be healthy\n", name)
+	d.act(OpEnsure, "app-health", oname+"/"+sname+"/"+name)
+	deadline := time.Now().Add(timeout)
+	for {
+		a, err := d.backend.GetApp(oname, sname, name)
+		if err != nil {
+			return err
+		}
+		if a.StagingFailedReason != "" {
+			return fmt.Errorf("application '%s' failed to stage: %s", name, a.StagingFailedReason)
+		}
+		for _, inst := range a.Instances {
+			switch strings.ToLower(inst.State) {
+			case "crashed":
+				d.note("%d of %d instances running", a.RunningInstances, a.InstanceCount)
+				return fmt.Errorf("application '%s' crashed: %s", name, instanceStates(a))
+			case "down":
+				d.note("%d of %d instances running", a.RunningInstances, a.InstanceCount)
+				return fmt.Errorf("application '%s' has instances that are down: %s", name, instanceStates(a))
+			}
+		}
+		if a.RunningInstances >= a.InstanceCount {
+			d.note("%d of %d instances running", a.RunningInstances, a.InstanceCount)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			d.note("%d of %d instances running", a.RunningInstances, a.InstanceCount)
+			return fmt.Errorf("only %d of %d instances of application '%s' were running after %s: %s",
+				a.RunningInstances, a.InstanceCount, name, timeout, instanceStates(a))
+		}
+		time.Sleep(healthInterval)
+	}
+}
+
+// instanceStates describes the state of each instance of an application,
+// along with anything Cloud Foundry had to say about it.
+func instanceStates(a plugin_models.GetAppModel) string {
+	var l []string
+	for i, inst := range a.Instances {
+		s := fmt.Sprintf("#%d %s", i, strings.ToLower(inst.State))
+		if inst.Details != "" {
+			s += " (" + inst.Details + ")"
+		}
+		l = append(l, s)
+	}
+	if len(l) == 0 {
+		return "no instances reported"
+	}
+	return strings.Join(l, ", ")
 }
 
 /*
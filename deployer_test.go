@@ -0,0 +1,525 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+// parse parses a manifest, the way `cf deploy` would load it.
+func parse(t *testing.T, src string) *Manifest {
+	t.Helper()
+	m, err := ParseManifest(strings.NewReader(src), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+// deploy deploys a manifest to a fake foundation, pruning the given types
+// of resources, and returns the report of what it did.
+func deploy(t *testing.T, m *Manifest, b *FakeBackend, prune ...string) *Plan {
+	t.Helper()
+	d := &Deployer{manifest: m, backend: b, report: &Plan{}, prune: pruning(t, prune...)}
+	if err := d.Deploy(); err != nil {
+		t.Fatalf("deploy failed: %s", err)
+	}
+	return d.report
+}
+
+// plan plans the deployment of a manifest to a fake foundation, and
+// returns the plan.
+func plan(t *testing.T, m *Manifest, b *FakeBackend, prune ...string) *Plan {
+	t.Helper()
+	d := &Deployer{manifest: m, backend: b, plan: &Plan{}, prune: pruning(t, prune...)}
+	b.Record(d.plan.record)
+	defer b.Record(nil)
+	if err := d.Deploy(); err != nil {
+		t.Fatalf("plan failed: %s", err)
+	}
+	return d.plan
+}
+
+func pruning(t *testing.T, types ...string) Prune {
+	p := Prune{}
+	if len(types) > 0 {
+		if err := p.Set(strings.Join(types, ",")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// did returns true if a plan (or report) has the given action in it.
+func did(p *Plan, op, kind, path string) bool {
+	for _, a := range p.Actions {
+		if a.Op == op && a.Kind == kind && a.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+const envManifest = `
+external_env: [NR_*]
+organizations:
+  sys:
+    env:
+      STAGE: prod
+    spaces:
+      prod:
+        apps:
+          - name: web
+            image: nginx
+            env:
+              GREETING: hello
+              FAREWELL: goodbye
+`
+
+// TestEnvReconciliation unsets the environment variables the manifest
+// no longer sets, on every deploy, leaving alone the ones that something
+// else (or cf deploy itself) sets.
+func TestEnvReconciliation(t *testing.T) {
+	b := NewFakeBackend()
+	deploy(t, parse(t, envManifest), b)
+	web := b.Orgs["sys"].Spaces["prod"].Apps["web"]
+	for name, want := range map[string]string{"STAGE": "prod", "GREETING": "hello", "FAREWELL": "goodbye"} {
+		if have := web.Env[name]; have != want {
+			t.Errorf("$%s: got %q, want %q", name, have, want)
+		}
+	}
+	if web.Env[FingerprintVar] == "" {
+		t.Error("the fingerprint was not kept")
+	}
+
+	web.Env["NR_LICENSE_KEY"] = "x"
+	web.Env["LEFTOVER"] = "y"
+	m := parse(t, strings.Replace(envManifest, "FAREWELL: goodbye", "", 1))
+
+	p := plan(t, m, b)
+	for _, name := range []string{"FAREWELL", "LEFTOVER"} {
+		if !did(p, OpDelete, "env", "sys/prod/web$"+name) {
+			t.Errorf("the plan doesn't unset $%s", name)
+		}
+	}
+	for _, name := range []string{"NR_LICENSE_KEY", "GREETING", FingerprintVar} {
+		if did(p, OpDelete, "env", "sys/prod/web$"+name) {
+			t.Errorf("the plan unsets $%s", name)
+		}
+	}
+
+	deploy(t, m, b)
+	for _, name := range []string{"FAREWELL", "LEFTOVER"} {
+		if _, ok := web.Env[name]; ok {
+			t.Errorf("$%s was not unset", name)
+		}
+	}
+	for _, name := range []string{"NR_LICENSE_KEY", "GREETING", "STAGE", FingerprintVar} {
+		if _, ok := web.Env[name]; !ok {
+			t.Errorf("$%s was unset", name)
+		}
+	}
+	if web.Restages == 0 {
+		t.Error("the app was not restaged to pick up the change")
+	}
+
+	if p := deploy(t, m, b); did(p, OpDelete, "env", "sys/prod/web$NR_LICENSE_KEY") {
+		t.Error("deploying again unset an external variable")
+	}
+}
+
+const brokerManifest = `
+service_brokers:
+  - name: pg
+    app: sys/brokers/pg-broker
+    username: admin
+    password: s3cr3t
+service_access:
+  - service: postgres
+    plan: small
+    orgs: [sys]
+organizations:
+  sys:
+    spaces:
+      brokers:
+        apps:
+          - name: pg-broker
+            image: pg-broker
+            domain: apps.example.com
+      prod:
+        services:
+          db: postgres/small
+`
+
+// TestServiceBrokers registers a broker run by a manifest app, and gives
+// out access to its plans, before any instance of its services is made.
+func TestServiceBrokers(t *testing.T) {
+	b := NewFakeBackend()
+	b.BrokerCatalogs = map[string]map[string][]string{"pg": {"postgres": {"small", "large"}}}
+	m := parse(t, brokerManifest)
+	deploy(t, m, b)
+
+	broker := b.Brokers["pg"]
+	if broker == nil || broker.URL != "https://pg-broker.apps.example.com" || broker.Password != "s3cr3t" {
+		t.Fatalf("got broker %+v, want it registered at its app's route", broker)
+	}
+	if a := b.Access["postgres/small"]; a == nil || a.Public || strings.Join(a.Orgs, ",") != "sys" {
+		t.Errorf("got access to postgres/small %+v, want it for sys only", a)
+	}
+	if a := b.Access["postgres/large"]; a != nil && (a.Public || len(a.Orgs) > 0) {
+		t.Errorf("got access to postgres/large %+v, want none", a)
+	}
+	if s := b.Orgs["sys"].Spaces["prod"].Services["shared-db"]; s == nil || s.Plan != "small" {
+		t.Errorf("got service instance %+v, want a postgres/small one", s)
+	}
+
+	broker.Password = "old"
+	if p := deploy(t, m, b); did(p, OpCreate, "service-broker", "pg") {
+		t.Error("the broker was registered again")
+	}
+	if broker.Password != "s3cr3t" {
+		t.Error("the broker was not updated")
+	}
+}
+
+// TestPruneServiceAccess only takes access to plans away from orgs the
+// manifest doesn't give it to when asked to by name.
+func TestPruneServiceAccess(t *testing.T) {
+	b := NewFakeBackend()
+	b.BrokerCatalogs = map[string]map[string][]string{"pg": {"postgres": {"small", "large"}}}
+	m := parse(t, brokerManifest)
+	deploy(t, m, b)
+	if err := b.CreateOrg("other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EnableServiceAccess("postgres", "small", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	deploy(t, m, b, "true")
+	if a := b.Access["postgres/small"]; strings.Join(a.Orgs, ",") != "sys,other" {
+		t.Errorf("a bare --prune left access to postgres/small for %v, want sys and other", a.Orgs)
+	}
+
+	p := plan(t, m, b, "service-access")
+	if !did(p, OpDelete, "service-access", "postgres/small[other]") {
+		t.Error("the plan doesn't disable access for other")
+	}
+	deploy(t, m, b, "service-access")
+	if a := b.Access["postgres/small"]; strings.Join(a.Orgs, ",") != "sys" {
+		t.Errorf("got access to postgres/small for %v, want sys only", a.Orgs)
+	}
+}
+
+const bindManifest = `
+organizations:
+  sys:
+    spaces:
+      prod:
+        services:
+          cache: redis/small
+        apps:
+          - name: web
+            image: nginx
+            shared: [cache]
+            bind:
+              sessions: postgres/free
+`
+
+// TestUnbindServices unbinds apps from what they no longer bind on every
+// deploy, but only deletes the instances made for them when app-services
+// are pruned by name.
+func TestUnbindServices(t *testing.T) {
+	b := NewFakeBackend()
+	deploy(t, parse(t, bindManifest), b)
+	space := b.Orgs["sys"].Spaces["prod"]
+	web := space.Apps["web"]
+	if have := strings.Join(web.Bindings, ","); have != "shared-cache,web-sessions" {
+		t.Fatalf("got bindings %s, want shared-cache and web-sessions", have)
+	}
+	if err := b.CreateService("sys", "prod", "handmade", "redis", "small", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BindService("sys", "prod", "web", "handmade"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := parse(t, strings.Replace(strings.Replace(bindManifest, "shared: [cache]", "", 1), "sessions: postgres/free", "", 1))
+	p := plan(t, m, b)
+	for _, svname := range []string{"shared-cache", "web-sessions", "handmade"} {
+		if !did(p, OpDelete, "service-binding", "sys/prod/web->"+svname) {
+			t.Errorf("the plan doesn't unbind %s", svname)
+		}
+	}
+	deploy(t, m, b)
+	if len(web.Bindings) != 0 {
+		t.Errorf("got bindings %v, want none", web.Bindings)
+	}
+	for _, svname := range []string{"shared-cache", "web-sessions", "handmade"} {
+		if space.Services[svname] == nil {
+			t.Errorf("%s was deleted without pruning", svname)
+		}
+	}
+
+	if pruning(t, "true")[PruneAppServices] {
+		t.Error("a bare --prune prunes app-services")
+	}
+	deploy(t, m, b, "app-services")
+	if space.Services["web-sessions"] != nil {
+		t.Error("web-sessions was not deleted")
+	}
+	for _, svname := range []string{"shared-cache", "handmade"} {
+		if space.Services[svname] == nil {
+			t.Errorf("%s was deleted, though it wasn't made for web", svname)
+		}
+	}
+}
+
+const blueGreenManifest = `
+organizations:
+  sys:
+    spaces:
+      prod:
+        apps:
+          - name: web
+            image: nginx:1
+            strategy: blue-green
+            urls: [www.apps.example.com]
+            env:
+              GREETING: hello
+`
+
+// TestBlueGreen replaces an app with a new version that comes up, and
+// then with one that crashes, which must leave the old one serving.
+func TestBlueGreen(t *testing.T) {
+	b := NewFakeBackend()
+	deploy(t, parse(t, blueGreenManifest), b)
+	space := b.Orgs["sys"].Spaces["prod"]
+	old := space.Apps["web"]
+
+	p := deploy(t, parse(t, strings.Replace(blueGreenManifest, "nginx:1", "nginx:2", 1)), b)
+	for _, a := range []struct{ op, kind, path string }{
+		{OpCreate, "app", "sys/prod/web-new"},
+		{OpCreate, "route", "sys/prod/web-new->www.apps.example.com"},
+		{OpDelete, "route", "sys/prod/web->www.apps.example.com"},
+		{OpUpdate, "app-name", "sys/prod/web->web-venerable"},
+		{OpUpdate, "app-name", "sys/prod/web-new->web"},
+		{OpDelete, "app", "sys/prod/web-venerable"},
+	} {
+		if !did(p, a.op, a.kind, a.path) {
+			t.Errorf("the deploy didn't %s %s %s", a.op, a.kind, a.path)
+		}
+	}
+	web := space.Apps["web"]
+	if web == nil || web == old || web.Image != "nginx:2" || !web.Started {
+		t.Fatalf("got app %+v, want the new version running", web)
+	}
+	if strings.Join(web.Routes, ",") != "www.apps.example.com" || web.Env["GREETING"] != "hello" {
+		t.Errorf("got app %+v, want it with the old one's route and environment", web)
+	}
+	if len(space.Apps) != 1 {
+		t.Errorf("got apps %v, want only web", sortedKeys(space.Apps))
+	}
+
+	b.Crashing = map[string]bool{"web-new": true}
+	d := &Deployer{manifest: parse(t, strings.Replace(blueGreenManifest, "nginx:1", "nginx:3", 1)), backend: b, report: &Plan{}}
+	err := d.Deploy()
+	if err == nil || !strings.Contains(err.Error(), "the new version of 'web' failed, and was rolled back: application 'web-new' crashed") {
+		t.Fatalf("got %v, want the new version rolled back", err)
+	}
+	if !did(d.report, OpDelete, "app", "sys/prod/web-new") {
+		t.Error("the crashed version was not deleted")
+	}
+	if space.Apps["web"] != web || web.Image != "nginx:2" || strings.Join(web.Routes, ",") != "www.apps.example.com" {
+		t.Errorf("got app %+v, want the old version left serving", space.Apps["web"])
+	}
+	if len(space.Apps) != 1 {
+		t.Errorf("got apps %v, want only web", sortedKeys(space.Apps))
+	}
+}
+
+// slowStart is a fake foundation on which the instances of an app are
+// only ever starting.
+type slowStart struct {
+	*FakeBackend
+}
+
+func (s slowStart) Fork() Backend {
+	return slowStart{s.FakeBackend.Fork().(*FakeBackend)}
+}
+
+func (s slowStart) GetApp(org, space, app string) (plugin_models.GetAppModel, error) {
+	a, err := s.FakeBackend.GetApp(org, space, app)
+	for i := range a.Instances {
+		a.Instances[i].State = "starting"
+	}
+	a.RunningInstances = 0
+	return a, err
+}
+
+const healthManifest = `
+organizations:
+  sys:
+    spaces:
+      prod:
+        apps:
+          - name: web
+            image: nginx
+            instances: 2
+`
+
+// TestHealth checks that deploying an app waits for its instances to
+// come up, and fails if they crash, can't be placed, or take too long.
+func TestHealth(t *testing.T) {
+	defer func(d time.Duration) { healthInterval = d }(healthInterval)
+	healthInterval = time.Millisecond
+
+	for name, c := range map[string]struct {
+		backend func(*FakeBackend) Backend
+		err     string
+	}{
+		"healthy": {
+			backend: func(b *FakeBackend) Backend { return b },
+		},
+		"crashing": {
+			backend: func(b *FakeBackend) Backend { b.Crashing = map[string]bool{"web": true}; return b },
+			err:     "application 'web' crashed: #0 crashed (app instance exited), #1 crashed (app instance exited)",
+		},
+		"down": {
+			backend: func(b *FakeBackend) Backend { b.Down = map[string]bool{"web": true}; return b },
+			err:     "application 'web' has instances that are down: #0 down (insufficient resources: memory), #1 down (insufficient resources: memory)",
+		},
+		"slow": {
+			backend: func(b *FakeBackend) Backend { return slowStart{b} },
+			err:     "only 0 of 2 instances of application 'web' were running after 20ms: #0 starting, #1 starting",
+		},
+	} {
+		d := &Deployer{manifest: parse(t, healthManifest), backend: c.backend(NewFakeBackend()), report: &Plan{}, healthTimeout: 20 * time.Millisecond}
+		err := d.Deploy()
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+			}
+		} else if err == nil || !strings.HasSuffix(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want %s", name, err, c.err)
+		}
+		if !did(d.report, OpEnsure, "app-health", "sys/prod/web") {
+			t.Errorf("%s: the deploy didn't wait for the app", name)
+		}
+	}
+}
+
+const serviceManifest = `
+organizations:
+  sys:
+    spaces:
+      prod:
+        services:
+          db:
+            service: postgres
+            plan: small
+            parameters: {version: 13}
+            tags: [sql]
+`
+
+// TestUpdateServices changes the plan, parameters and tags of a service
+// instance, and leaves it alone when nothing has changed.
+func TestUpdateServices(t *testing.T) {
+	b := NewFakeBackend()
+	deploy(t, parse(t, serviceManifest), b)
+	db := b.Orgs["sys"].Spaces["prod"].Services["shared-db"]
+	if db == nil || db.Plan != "small" || db.Parameters != `{"version":13}` || strings.Join(db.Tags, ",") != "sql" {
+		t.Fatalf("got service instance %+v, want a small postgres 13", db)
+	}
+
+	if p := deploy(t, parse(t, serviceManifest), b); !did(p, OpNoop, "service", "sys/prod/shared-db") {
+		t.Error("the service instance was changed, though its definition wasn't")
+	}
+
+	manifest := serviceManifest
+	for _, c := range []struct {
+		what, from, to string
+		plan, params   string
+		tags           string
+	}{
+		{"changing the plan", "plan: small", "plan: large", "large", `{"version":13}`, "sql"},
+		{"changing the parameters", "version: 13", "version: 14", "large", `{"version":14}`, "sql"},
+		{"changing the tags", "[sql]", "[sql, primary]", "large", `{"version":14}`, "sql,primary"},
+	} {
+		manifest = strings.Replace(manifest, c.from, c.to, 1)
+		if p := deploy(t, parse(t, manifest), b); !did(p, OpUpdate, "service", "sys/prod/shared-db") {
+			t.Errorf("%s: the service instance wasn't updated", c.what)
+		}
+		if db.Plan != c.plan || db.Parameters != c.params || strings.Join(db.Tags, ",") != c.tags {
+			t.Errorf("%s: got service instance %+v", c.what, db)
+		}
+	}
+
+	b.OpaqueServices = map[string]bool{"postgres": true}
+	manifest = strings.Replace(manifest, "version: 14", "version: 15", 1)
+	if p := deploy(t, parse(t, manifest), b); !did(p, OpNoop, "service", "sys/prod/shared-db") {
+		t.Error("the parameters of a service instance that can't be read back were updated")
+	}
+
+	manifest = strings.Replace(serviceManifest, "postgres", "mysql", 1)
+	d := &Deployer{manifest: parse(t, manifest), backend: b, report: &Plan{}}
+	if err := d.Deploy(); err == nil || !strings.Contains(err.Error(), "is of service 'postgres', not 'mysql'") {
+		t.Errorf("got %v, want the change of service refused", err)
+	}
+}
+
+// TestWaitServices waits for brokers that provision service instances
+// asynchronously, and fails if they fail, or take too long.
+func TestWaitServices(t *testing.T) {
+	defer func(d time.Duration) { serviceInterval = d }(serviceInterval)
+	serviceInterval = time.Millisecond
+
+	b := NewFakeBackend()
+	b.AsyncServices = map[string]int{"postgres": 3}
+	p := plan(t, parse(t, keepGoingManifest), b)
+	if did(p, OpEnsure, "service-operation", "sys/prod/shared-db") {
+		t.Error("the plan waits for the service instance")
+	}
+	p = deploy(t, parse(t, keepGoingManifest), b)
+	if !did(p, OpEnsure, "service-operation", "sys/prod/shared-db") {
+		t.Fatal("the deploy didn't wait for the service instance")
+	}
+	for _, a := range p.Actions {
+		if a.Kind == "service-operation" && a.Detail != "create succeeded" {
+			t.Errorf("got %q for the service instance, want it created", a.Detail)
+		}
+	}
+	db := b.Orgs["sys"].Spaces["prod"].Services["shared-db"]
+	if db.Pending != 0 {
+		t.Errorf("the service instance is still pending %d reads", db.Pending)
+	}
+	if web := b.Orgs["sys"].Spaces["prod"].Apps["web"]; web == nil || !contains(web.Bindings, "shared-db") {
+		t.Error("the app wasn't bound to the service instance, once it was created")
+	}
+
+	b.FailingServices = map[string]string{"postgres": "out of disk"}
+	d := &Deployer{manifest: parse(t, strings.Replace(keepGoingManifest, "postgres/small", "postgres/large", 1)), backend: b, report: &Plan{}}
+	if err := d.Deploy(); err == nil || err.Error() != "service instance 'sys/prod/shared-db' failed to update: out of disk" {
+		t.Errorf("got %v, want the update to fail", err)
+	}
+
+	b = NewFakeBackend()
+	b.AsyncServices = map[string]int{"postgres": 1000}
+	d = &Deployer{manifest: parse(t, keepGoingManifest), backend: b, report: &Plan{}, serviceTimeout: 20 * time.Millisecond}
+	if err := d.Deploy(); err == nil || err.Error() != "service instance 'sys/prod/shared-db' was still in progress (create) after 20ms" {
+		t.Errorf("got %v, want it to time out", err)
+	}
+	if _, _, err := b.app("sys", "prod", "web"); err == nil {
+		t.Error("the app was bound to a service instance that was still being created")
+	}
+
+	/* the next deployment picks up where the last one left off */
+	b.AsyncServices = nil
+	b.Orgs["sys"].Spaces["prod"].Services["shared-db"].Pending = 2
+	deploy(t, parse(t, keepGoingManifest), b)
+	if b.Orgs["sys"].Spaces["prod"].Services["shared-db"].Pending != 0 {
+		t.Error("the deploy didn't wait for the service instance that was still being created")
+	}
+}
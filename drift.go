@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+// A Drift is a difference between the manifest and the foundation: a
+// resource in the manifest that is missing from the foundation (which a
+// deploy would create), one in the foundation that is not in the manifest
+// (which only pruning would delete, if it were asked to), or one that is
+// set differently in each.  Op is what a deploy would do about it.
+type Drift struct {
+	Op   string
+	Kind string
+	Path string
+	Want string
+	Have string
+}
+
+// A drifter collects the differences between the manifest and the
+// foundation, for Drift().
+type drifter struct {
+	d      *Deployer
+	drifts []Drift
+}
+
+func (x *drifter) missing(kind, path string) {
+	x.drifts = append(x.drifts, Drift{Op: OpCreate, Kind: kind, Path: path})
+}
+
+func (x *drifter) extra(kind, path string) {
+	x.drifts = append(x.drifts, Drift{Op: OpDelete, Kind: kind, Path: path})
+}
+
+func (x *drifter) differs(kind, path, want, have string) {
+	if want != have {
+		x.drifts = append(x.drifts, Drift{Op: OpUpdate, Kind: kind, Path: path, Want: want, Have: have})
+	}
+}
+
+// Drift compares the manifest against the current state of the
+// foundation -- the orgs, spaces and applications in it, roles, quotas,
+// SSH access, and each application's instances, memory, routes and
+// environment -- and returns every difference between the two.  Nothing
+// is changed.
+//
+// Orgs that aren't in the manifest are only reported if org pruning is
+// on, since every foundation has some (`system`, at least) that the
+// manifest is not meant to manage.
+func (d *Deployer) Drift() ([]Drift, error) {
+	x := &drifter{d: d}
+
+	if d.prune[PruneOrgs] {
+		orgs, err := d.backend.GetOrgs()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range orgs {
+			if _, ok := d.manifest.Organizations[o.Name]; !ok {
+				x.extra("org", o.Name)
+			}
+		}
+	}
+
+	for _, oname := range sortedKeys(d.manifest.Organizations) {
+		if err := x.org(oname, d.manifest.Organizations[oname]); err != nil {
+			return nil, err
+		}
+	}
+	return x.drifts, nil
+}
+
+// quota compares the limits of a quota, if the backend knows them (not
+// all of them do; see exportQuota.)
+func (x *drifter) quota(kind, path string, q *Quota, have *Quota) {
+	if q == nil || have.Memory == nil {
+		return
+	}
+	mb := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		if n, err := megabytes(s); err == nil && n != nil {
+			return fmt.Sprintf("%dM", *n)
+		}
+		return "unlimited"
+	}
+	count := func(s string) string {
+		if s == "unlimited" {
+			return "-1"
+		}
+		return s
+	}
+
+	if want := mb(q.Memory["total"]); want != "" {
+		x.differs(kind, path+"[memory]", want, mb(have.Memory["total"]))
+	}
+	if want := mb(q.Memory["per-app-instance"]); want != "" {
+		x.differs(kind, path+"[per-app-instance]", want, mb(have.Memory["per-app-instance"]))
+	}
+	if q.Routes != "" {
+		x.differs(kind, path+"[routes]", count(q.Routes), have.Routes)
+	}
+	if q.ServiceInstances != "" {
+		x.differs(kind, path+"[service-instances]", count(q.ServiceInstances), have.ServiceInstances)
+	}
+	x.differs(kind, path+"[allow-paid-plans]", strconv.FormatBool(q.PaidPlans), strconv.FormatBool(have.PaidPlans))
+}
+
+// roles compares the roles users hold against those in the manifest,
+// leaving out the ones pruning would (admins, the deploying user, and the
+// implied OrgUser.)
+func (x *drifter) roles(kind, path string, want map[string][]string, have map[string][]string, admins map[string]bool) {
+	for _, uname := range sortedKeys(want) {
+		for _, role := range want[uname] {
+			if !contains(have[uname], role) {
+				x.missing(kind, fmt.Sprintf("%s/%s[%s]", path, uname, role))
+			}
+		}
+	}
+	for _, uname := range sortedKeys(have) {
+		for _, role := range have[uname] {
+			if !contains(want[uname], role) && x.d.pruneable(uname, role, admins[uname]) {
+				x.extra(kind, fmt.Sprintf("%s/%s[%s]", path, uname, role))
+			}
+		}
+	}
+}
+
+func (x *drifter) org(oname string, org *Organization) error {
+	o, err := x.d.backend.GetOrg(oname)
+	if err != nil && !isMissing(err) {
+		return err
+	}
+	if o.Guid == "" {
+		x.missing("org", oname)
+		return nil
+	}
+
+	if org.Quota != "" {
+		x.differs("org-quota-assignment", oname, org.Quota, o.QuotaDefinition.Name)
+		if o.QuotaDefinition.Name == org.Quota {
+			q := o.QuotaDefinition
+			x.quota("quota", org.Quota, x.d.manifest.Quotas[org.Quota],
+				exportQuota(q.MemoryLimit, q.InstanceMemoryLimit, q.RoutesLimit, q.ServicesLimit, q.NonBasicServicesAllowed))
+		}
+	}
+
+	spaceQuotas := map[string]plugin_models.GetOrg_SpaceQuota{}
+	for _, q := range o.SpaceQuotas {
+		spaceQuotas[q.Name] = q
+	}
+	for _, qname := range sortedKeys(org.Quotas) {
+		q, ok := spaceQuotas[qname]
+		if !ok {
+			x.missing("space-quota", oname+"/"+qname)
+			continue
+		}
+		x.quota("space-quota", oname+"/"+qname, org.Quotas[qname],
+			exportQuota(q.MemoryLimit, q.InstanceMemoryLimit, q.RoutesLimit, q.ServicesLimit, q.NonBasicServicesAllowed))
+	}
+
+	users, err := x.d.backend.GetOrgUsers(oname)
+	if err != nil {
+		return err
+	}
+	have := map[string][]string{}
+	admins := map[string]bool{}
+	for _, u := range users {
+		have[u.Username] = u.Roles
+		admins[u.Username] = u.IsAdmin
+	}
+	x.roles("org-role", oname, org.Users, have, admins)
+
+	for _, s := range o.Spaces {
+		if _, ok := org.Spaces[s.Name]; !ok {
+			x.extra("space", oname+"/"+s.Name)
+		}
+	}
+	for _, sname := range sortedKeys(org.Spaces) {
+		found := false
+		for _, s := range o.Spaces {
+			found = found || s.Name == sname
+		}
+		if !found {
+			x.missing("space", oname+"/"+sname)
+			continue
+		}
+		if err := x.space(oname, sname, org.Spaces[sname]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *drifter) space(oname, sname string, space *Space) error {
+	path := oname + "/" + sname
+	s, err := x.d.backend.GetSpace(oname, sname)
+	if err != nil {
+		return err
+	}
+	if space.Quota != "" {
+		x.differs("space-quota-assignment", path, space.Quota, s.SpaceQuota.Name)
+	}
+
+	if space.SSH != "" {
+		on, err := x.d.backend.SSHAllowed(oname, sname)
+		if err != nil {
+			return err
+		}
+		x.differs("space-ssh", path, strconv.FormatBool(boolify(space.SSH)), strconv.FormatBool(on))
+	}
+
+	users, err := x.d.backend.GetSpaceUsers(oname, sname)
+	if err != nil {
+		return err
+	}
+	have := map[string][]string{}
+	admins := map[string]bool{}
+	for _, u := range users {
+		have[u.Username] = u.Roles
+		admins[u.Username] = u.IsAdmin
+	}
+	x.roles("space-role", path, space.Users, have, admins)
+
+	apps, err := x.d.backend.GetApps(oname, sname)
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, a := range apps {
+		exists[a.Name] = true
+	}
+	want := map[string]bool{}
+	for _, app := range space.Applications {
+		want[app.Name] = true
+		if !exists[app.Name] {
+			x.missing("app", path+"/"+app.Name)
+			continue
+		}
+		if err := x.app(oname, sname, app); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(exists) {
+		if !want[name] {
+			x.extra("app", path+"/"+name)
+		}
+	}
+	return nil
+}
+
+func (x *drifter) app(oname, sname string, app *Application) error {
+	path := oname + "/" + sname + "/" + app.Name
+	a, err := x.d.backend.GetApp(oname, sname, app.Name)
+	if err != nil {
+		return err
+	}
+
+	x.differs("app-instances", path, strconv.Itoa(app.Instances), strconv.Itoa(a.InstanceCount))
+	if app.Memory != "" {
+		if n, err := megabytes(app.Memory); err == nil && n != nil {
+			x.differs("app-memory", path, fmt.Sprintf("%dM", *n), fmt.Sprintf("%dM", a.Memory))
+		}
+	}
+
+	if len(app.URLs) > 0 {
+		want := map[string]bool{}
+		for _, s := range app.URLs {
+			want[ParseURL(s, app.Domain).String()] = true
+		}
+		have := map[string]bool{}
+		for _, r := range a.Routes {
+			have[URL{Host: r.Host, Domain: r.Domain.Name}.String()] = true
+		}
+		for _, u := range sortedKeys(want) {
+			if !have[u] {
+				x.missing("route", path+"->"+u)
+			}
+		}
+		for _, u := range sortedKeys(have) {
+			if !want[u] {
+				x.extra("route", path+"->"+u)
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(app.Environment) {
+		v, ok := a.EnvironmentVars[name]
+		if !ok {
+			x.missing("env", path+"$"+name)
+		} else {
+			x.differs("env", path+"$"+name, app.Environment[name], fmt.Sprintf("%v", v))
+		}
+	}
+	for _, name := range sortedKeys(a.EnvironmentVars) {
+		if _, ok := app.Environment[name]; !ok && !x.d.manifest.externalEnv(name) {
+			x.extra("env", path+"$"+name)
+		}
+	}
+	return nil
+}
+
+// PrintDrift prints the differences between the manifest and the
+// foundation, in the notation of a plan: `+` for what is missing from the
+// foundation, `-` for what is not in the manifest, and `~` for what is
+// set differently.
+func PrintDrift(out io.Writer, l []Drift) {
+	if len(l) == 0 {
+		fmt.Fprintf(out, "No drift: the foundation matches the manifest.\n")
+		return
+	}
+
+	sigil := map[string]string{OpCreate: "+", OpUpdate: "~", OpDelete: "-"}
+	what := map[string]string{OpCreate: "missing", OpDelete: "not in the manifest"}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, d := range l {
+		if d.Op == OpUpdate {
+			fmt.Fprintf(w, "%s %s\t%s\twant %s, have %s\n", sigil[d.Op], d.Kind, d.Path,
+				redactions.String(d.Want), redactions.String(d.Have))
+		} else {
+			fmt.Fprintf(w, "%s %s\t%s\t%s\n", sigil[d.Op], d.Kind, d.Path, what[d.Op])
+		}
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nDrift: %d difference(s) between the manifest and the foundation.\n", len(l))
+}
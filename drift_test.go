@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const driftManifest = `
+external_env: [NR_*]
+organizations:
+  sys:
+    spaces:
+      prod:
+        ssh: yes
+        apps:
+          - name: web
+            image: nginx
+            instances: 2
+            memory: 256M
+            urls: [www.apps.example.com, web.apps.example.com]
+            env:
+              GREETING: hello
+              STAGE: prod
+`
+
+// TestDrift deploys a manifest, changes the foundation behind its back,
+// and checks that every change (and nothing else) is reported as drift.
+func TestDrift(t *testing.T) {
+	m := parse(t, driftManifest)
+	b := NewFakeBackend()
+	deploy(t, m, b)
+
+	d := &Deployer{manifest: m, backend: b}
+	if l, err := d.Drift(); err != nil || len(l) != 0 {
+		t.Fatalf("got drift %v (%v) right after deploying", l, err)
+	}
+
+	space := b.Orgs["sys"].Spaces["prod"]
+	web := space.Apps["web"]
+	web.Instances = 3
+	web.Memory = 512
+	web.Routes = []string{"www.apps.example.com", "old.apps.example.com"}
+	delete(web.Env, "STAGE")
+	web.Env["GREETING"] = "hi"
+	web.Env["DEBUG"] = "1"
+	web.Env["NR_LICENSE"] = "abc"
+	space.SSH = false
+	space.Routes["old.apps.example.com"] = URL{Host: "old", Domain: "apps.example.com"}
+	space.Apps["cron"] = &FakeApp{Name: "cron", Env: map[string]string{}}
+	calls := len(b.Calls)
+
+	l, err := d.Drift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, x := range l {
+		got = append(got, fmt.Sprintf("%s %s %s %s %s", x.Op, x.Kind, x.Path, x.Want, x.Have))
+	}
+	want := []string{
+		"update space-ssh sys/prod true false",
+		"update app-instances sys/prod/web 2 3",
+		"update app-memory sys/prod/web 256M 512M",
+		"create route sys/prod/web->web.apps.example.com  ",
+		"delete route sys/prod/web->old.apps.example.com  ",
+		"update env sys/prod/web$GREETING hello hi",
+		"create env sys/prod/web$STAGE  ",
+		"delete env sys/prod/web$DEBUG  ",
+		"delete app sys/prod/cron  ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got drift:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(b.Calls) != calls {
+		t.Errorf("checking for drift made changes: %v", b.Calls[calls:])
+	}
+
+	var out bytes.Buffer
+	PrintDrift(&out, l)
+	for _, s := range []string{
+		"~ app-instances  sys/prod/web",
+		"want 2, have 3",
+		"- app",
+		"not in the manifest",
+		"Drift: 9 difference(s) between the manifest and the foundation.",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("got drift printed as:\n%s\nwant it to have %q in it", out.String(), s)
+		}
+	}
+
+	out.Reset()
+	PrintDrift(&out, nil)
+	if out.String() != "No drift: the foundation matches the manifest.\n" {
+		t.Errorf("got no drift printed as %q", out.String())
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An exporter reads the current state of a foundation into a manifest
+// that, deployed, would leave it as it is.  Not everything can be read
+// back (passwords, credentials, application bits), and not everything can
+// be written down (service instances whose names the manifest can't
+// produce); each of those is noted as a warning, for someone to fill in
+// or sort out by hand.
+type exporter struct {
+	b        Backend
+	m        *Manifest
+	warnings []string
+
+	/* security groups whose rules could not be read */
+	unknown map[string]bool
+
+	/* security groups bound to spaces for staging, whose rules
+	   are only known if they are bound for running somewhere */
+	staging []string
+}
+
+func (e *exporter) warnf(format string, args ...interface{}) {
+	e.warnings = append(e.warnings, fmt.Sprintf(format, args...))
+}
+
+// Export reads the given organizations (or all of them, if none are
+// given) from a foundation, along with the shared domains, security groups
+// and quotas they use, and returns them as a manifest, and warnings about
+// everything that could not be exported as it is.
+func Export(b Backend, orgs []string) (Manifest, []string, error) {
+	e := &exporter{b: b, m: &Manifest{}, unknown: map[string]bool{}}
+
+	if len(orgs) == 0 {
+		l, err := b.GetOrgs()
+		if err != nil {
+			return *e.m, nil, err
+		}
+		for _, o := range l {
+			orgs = append(orgs, o.Name)
+		}
+		sort.Strings(orgs)
+	}
+
+	for _, lifecycle := range []string{"running", "staging"} {
+		l, err := b.GlobalSecurityGroups(lifecycle)
+		if err != nil {
+			return *e.m, nil, err
+		}
+		if len(l) == 0 {
+			continue
+		}
+		sort.Strings(l)
+		if e.m.SecurityGroupSets == nil {
+			e.m.SecurityGroupSets = &SecurityGroupSet{}
+		}
+		if lifecycle == "running" {
+			e.m.SecurityGroupSets.Running = l
+		} else {
+			e.m.SecurityGroupSets.Staging = l
+		}
+	}
+
+	for _, oname := range orgs {
+		org, err := e.org(oname)
+		if err != nil {
+			return *e.m, nil, err
+		}
+		if e.m.Organizations == nil {
+			e.m.Organizations = map[string]*Organization{}
+		}
+		e.m.Organizations[oname] = org
+	}
+
+	/* the rules of groups that are only bound globally, or only for
+	   staging, can't be read */
+	if sets := e.m.SecurityGroupSets; sets != nil {
+		for _, sgname := range append(append([]string{}, sets.Running...), sets.Staging...) {
+			e.securityGroup(sgname, nil)
+		}
+	}
+	for _, sgname := range e.staging {
+		e.securityGroup(sgname, nil)
+	}
+	return *e.m, e.warnings, nil
+}
+
+// securityGroup adds the definition of a security group to the manifest
+// the first time it is seen, or warns that it can't, if its rules are not
+// known.
+func (e *exporter) securityGroup(sgname string, rules []map[string]interface{}) {
+	if _, ok := e.m.SecurityGroups[sgname]; ok || e.unknown[sgname] {
+		return
+	}
+	if len(rules) == 0 {
+		e.warnf("the rules of security group '%s' could not be read; add them under security_groups", sgname)
+		e.unknown[sgname] = true
+		return
+	}
+	if e.m.SecurityGroups == nil {
+		e.m.SecurityGroups = map[string]*SecurityGroup{}
+	}
+	sg := &SecurityGroup{}
+	for _, r := range rules {
+		sg.Rules = append(sg.Rules, r)
+	}
+	e.m.SecurityGroups[sgname] = sg
+}
+
+// exportQuota turns the limits of a quota into its manifest definition.
+// Backends that only know quotas by name report no limits at all, in
+// which case the quota is exported without any (and so left as it is.)
+func exportQuota(memory, instanceMemory int64, routes, services int, paid bool) *Quota {
+	q := &Quota{PaidPlans: paid}
+	if memory == 0 && instanceMemory == 0 && routes == 0 && services == 0 {
+		return q
+	}
+	q.Memory = map[string]string{"total": fmt.Sprintf("%dM", memory)}
+	if instanceMemory < 0 {
+		q.Memory["per-app-instance"] = "unlimited"
+	} else if instanceMemory > 0 {
+		q.Memory["per-app-instance"] = fmt.Sprintf("%dM", instanceMemory)
+	}
+	q.Routes = strconv.Itoa(routes)
+	q.ServiceInstances = strconv.Itoa(services)
+	return q
+}
+
+// roles returns the roles of a user that can be given in a manifest.
+func roles(have, known []string) []string {
+	var l []string
+	for _, r := range have {
+		if contains(known, r) {
+			l = append(l, r)
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+func (e *exporter) org(oname string) (*Organization, error) {
+	o, err := e.b.GetOrg(oname)
+	if err != nil {
+		return nil, err
+	}
+	org := &Organization{}
+
+	if q := o.QuotaDefinition; q.Name != "" {
+		org.Quota = q.Name
+		if e.m.Quotas == nil {
+			e.m.Quotas = map[string]*Quota{}
+		}
+		e.m.Quotas[q.Name] = exportQuota(q.MemoryLimit, q.InstanceMemoryLimit, q.RoutesLimit, q.ServicesLimit, q.NonBasicServicesAllowed)
+	}
+
+	for _, dom := range o.Domains {
+		if dom.Shared {
+			if !contains(e.m.Domains, dom.Name) {
+				e.m.Domains = append(e.m.Domains, dom.Name)
+			}
+		} else if dom.OwningOrganizationGuid == o.Guid {
+			org.Domains = append(org.Domains, dom.Name)
+		}
+	}
+	sort.Strings(e.m.Domains)
+	sort.Strings(org.Domains)
+
+	for _, q := range o.SpaceQuotas {
+		if org.Quotas == nil {
+			org.Quotas = map[string]*Quota{}
+		}
+		org.Quotas[q.Name] = exportQuota(q.MemoryLimit, q.InstanceMemoryLimit, q.RoutesLimit, q.ServicesLimit, q.NonBasicServicesAllowed)
+	}
+
+	users, err := e.b.GetOrgUsers(oname)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if l := roles(u.Roles, orgRoles); len(l) > 0 {
+			if org.Users == nil {
+				org.Users = map[string][]string{}
+			}
+			org.Users[u.Username] = l
+		}
+	}
+
+	for _, s := range o.Spaces {
+		space, err := e.space(oname, s.Name)
+		if err != nil {
+			return nil, err
+		}
+		if org.Spaces == nil {
+			org.Spaces = map[string]*Space{}
+		}
+		org.Spaces[s.Name] = space
+	}
+	return org, nil
+}
+
+func (e *exporter) space(oname, sname string) (*Space, error) {
+	path := oname + "/" + sname
+	s, err := e.b.GetSpace(oname, sname)
+	if err != nil {
+		return nil, err
+	}
+	space := &Space{Quota: s.SpaceQuota.Name}
+
+	for _, sg := range s.SecurityGroups {
+		if space.SecurityGroupSets == nil {
+			space.SecurityGroupSets = &SecurityGroupSet{}
+		}
+		space.SecurityGroupSets.Running = append(space.SecurityGroupSets.Running, sg.Name)
+		e.securityGroup(sg.Name, sg.Rules)
+	}
+	staging, err := e.b.SpaceSecurityGroups(oname, sname, "staging")
+	if err != nil {
+		return nil, err
+	}
+	for _, sgname := range staging {
+		if space.SecurityGroupSets == nil {
+			space.SecurityGroupSets = &SecurityGroupSet{}
+		}
+		space.SecurityGroupSets.Staging = append(space.SecurityGroupSets.Staging, sgname)
+		e.staging = append(e.staging, sgname)
+	}
+	if space.SecurityGroupSets != nil {
+		sort.Strings(space.SecurityGroupSets.Running)
+		sort.Strings(space.SecurityGroupSets.Staging)
+	}
+
+	users, err := e.b.GetSpaceUsers(oname, sname)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if l := roles(u.Roles, spaceRoles); len(l) > 0 {
+			if space.Users == nil {
+				space.Users = map[string][]string{}
+			}
+			space.Users[u.Username] = l
+		}
+	}
+
+	/* the manifest names shared service instances `shared-NAME`, and
+	   those bound to a single app `APP-NAME`; nothing else can be
+	   written down. */
+	services, err := e.b.GetServices(oname, sname)
+	if err != nil {
+		return nil, err
+	}
+	shared := map[string]string{}
+	managed := map[string]ServiceDefinition{}
+	bound := map[string][]string{}
+	for _, svc := range services {
+		for _, app := range svc.ApplicationNames {
+			bound[app] = append(bound[app], svc.Name)
+		}
+		if svc.IsUserProvided {
+			space.UserProvidedServices = append(space.UserProvidedServices, &UserProvidedService{Name: svc.Name})
+			e.warnf("the credentials of user-provided service '%s/%s' could not be read; add them (as a ((secret:...)), perhaps)", path, svc.Name)
+			continue
+		}
+		spec := ServiceDefinition{Service: svc.Service.Name, Plan: svc.ServicePlan.Name}
+		if strings.HasPrefix(svc.Name, "shared-") {
+			name := strings.TrimPrefix(svc.Name, "shared-")
+			if space.SharedServices == nil {
+				space.SharedServices = map[string]ServiceDefinition{}
+			}
+			space.SharedServices[name] = spec
+			shared[svc.Name] = name
+		} else {
+			managed[svc.Name] = spec
+		}
+	}
+	sort.Slice(space.UserProvidedServices, func(i, j int) bool {
+		return space.UserProvidedServices[i].Name < space.UserProvidedServices[j].Name
+	})
+
+	apps, err := e.b.GetApps(oname, sname)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	for _, a := range apps {
+		app, err := e.app(oname, sname, a.Name)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(bound[a.Name])
+		for _, name := range bound[a.Name] {
+			if svc, ok := shared[name]; ok {
+				app.SharedServices = append(app.SharedServices, svc)
+			} else if spec, ok := managed[name]; ok && strings.HasPrefix(name, a.Name+"-") {
+				if app.BoundServices == nil {
+					app.BoundServices = map[string]ServiceDefinition{}
+				}
+				app.BoundServices[strings.TrimPrefix(name, a.Name+"-")] = spec
+				delete(managed, name)
+			} else {
+				e.warnf("the binding of application '%s/%s' to service instance '%s' cannot be expressed in a manifest", path, a.Name, name)
+			}
+		}
+		space.Applications = append(space.Applications, app)
+	}
+
+	for _, name := range sortedKeys(managed) {
+		e.warnf("service instance '%s/%s' is neither named shared-NAME nor APP-NAME for an application bound to it, so it cannot be expressed in a manifest", path, name)
+	}
+	return space, nil
+}
+
+func (e *exporter) app(oname, sname, name string) (*Application, error) {
+	a, err := e.b.GetApp(oname, sname, name)
+	if err != nil {
+		return nil, err
+	}
+	app := &Application{
+		Name:      name,
+		Buildpack: a.BuildpackUrl,
+		Instances: a.InstanceCount,
+	}
+	if a.Memory > 0 {
+		app.Memory = fmt.Sprintf("%dM", a.Memory)
+	}
+	if a.DiskQuota > 0 {
+		app.Disk = fmt.Sprintf("%dM", a.DiskQuota)
+	}
+
+	for _, r := range a.Routes {
+		app.URLs = append(app.URLs, URL{Host: r.Host, Domain: r.Domain.Name}.String())
+	}
+	sort.Strings(app.URLs)
+
+	for k, v := range a.EnvironmentVars {
+		if strings.HasPrefix(k, DeployEnvPrefix) {
+			continue
+		}
+		if app.Environment == nil {
+			app.Environment = map[string]string{}
+		}
+		if s, ok := v.(string); ok {
+			app.Environment[k] = s
+		} else if b, err := json.Marshal(v); err == nil {
+			app.Environment[k] = string(b)
+		}
+	}
+	return app, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const exportManifest = `
+users:
+  - username: jobs
+    password: correct-horse
+quotas:
+  small:
+    memory: {total: 10G}
+    routes: 100
+    services: 10
+organizations:
+  sys:
+    quota: small
+    users:
+      jobs: [OrgManager]
+    spaces:
+      prod:
+        users:
+          jobs: [SpaceDeveloper]
+        services:
+          cache: redis/small
+        user-provided-services:
+          - name: smtp
+            credentials:
+              password: correct-horse
+        apps:
+          - name: web
+            image: nginx
+            instances: 2
+            memory: 256M
+            urls: [www.apps.example.com]
+            shared: [cache]
+            bind:
+              db: postgres/small
+            env:
+              GREETING: hello
+`
+
+// TestExport exports a foundation that a manifest was deployed to, and
+// deploys the exported manifest to it, which must change nothing.
+func TestExport(t *testing.T) {
+	b := NewFakeBackend()
+	deploy(t, parse(t, exportManifest), b)
+	if err := b.CreateService("sys", "prod", "legacy", "redis", "small", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m, warnings, err := Export(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"the credentials of user-provided service 'sys/prod/smtp' could not be read; add them (as a ((secret:...)), perhaps)",
+		"service instance 'sys/prod/legacy' is neither named shared-NAME nor APP-NAME for an application bound to it, so it cannot be expressed in a manifest",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got warnings:\n%s\nwant:\n%s", strings.Join(warnings, "\n"), strings.Join(want, "\n"))
+	}
+
+	out, err := yaml.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), DeployEnvPrefix) {
+		t.Errorf("the export has cf deploy's own environment variables in it:\n%s", out)
+	}
+	exported := parse(t, string(out))
+	if org := exported.Organizations["sys"]; org == nil || org.Quota != "small" || strings.Join(org.Users["jobs"], ",") != "OrgManager" {
+		t.Errorf("got sys exported as %+v", org)
+	}
+	app := exported.app("sys/prod/web")
+	if app == nil {
+		t.Fatalf("web is missing from the export:\n%s", out)
+	}
+	if app.Instances != 2 || app.Memory != "256M" || app.Environment["GREETING"] != "hello" ||
+		strings.Join(app.URLs, ",") != "www.apps.example.com" ||
+		strings.Join(app.SharedServices, ",") != "cache" || app.BoundServices["web-db"].Plan != "small" {
+		t.Errorf("got web exported as %+v", app)
+	}
+
+	d := &Deployer{manifest: exported, backend: b, report: &Plan{}, healthTimeout: time.Second}
+	if err := d.Deploy(); err != nil {
+		t.Fatalf("deploying the export failed: %s\n%s", err, out)
+	}
+	for _, a := range d.report.Actions {
+		/* user-provided services are updated on every deploy, as
+		   their credentials can't be read back */
+		if a.Op == OpCreate || a.Op == OpDelete || a.Op == OpUpdate && a.Kind != "user-provided-service" {
+			t.Errorf("deploying the export did %s %s %s", a.Op, a.Kind, a.Path)
+		}
+	}
+}
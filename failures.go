@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// A Failure is a resource that could not be deployed under --keep-going,
+// either because deploying it failed, or because something it depends on
+// did (in which case it was skipped.)
+type Failure struct {
+	Kind    string
+	Path    string
+	Err     error
+	Skipped bool
+}
+
+// check settles the outcome of deploying a single resource.  Normally,
+// any error is simply handed back up, ending the deployment; when keeping
+// going, it is recorded as a failure of that resource instead, and the
+// deployment carries on with whatever doesn't depend on it.
+func (d *Deployer) check(kind, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if !d.keepGoing {
+		return err
+	}
+
+	d.say("  %s %s failed: %s\n", kind, path, err)
+	d.failures = append(d.failures, Failure{
+		Kind: kind,
+		Path: path,
+		Err:  err,
+	})
+	return nil
+}
+
+// skip records a resource that won't be deployed, because the thing it
+// depends on failed.
+func (d *Deployer) skip(kind, path, cause string) {
+	if !d.keepGoing {
+		return
+	}
+	d.failures = append(d.failures, Failure{
+		Kind:    kind,
+		Path:    path,
+		Err:     fmt.Errorf("skipped, since %s failed", cause),
+		Skipped: true,
+	})
+}
+
+func countFailures(l []Failure) (failed, skipped int) {
+	for _, f := range l {
+		if f.Skipped {
+			skipped++
+		} else {
+			failed++
+		}
+	}
+	return
+}
+
+// PrintFailures prints a summary table of everything that failed (first)
+// or was skipped during a --keep-going deployment.
+func PrintFailures(out io.Writer, l []Failure) {
+	failed, skipped := countFailures(l)
+	fmt.Fprintf(out, "\n%d resource(s) failed, %d skipped:\n\n", failed, skipped)
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "STATUS\tTYPE\tPATH\tERROR\n")
+	for _, skip := range []bool{false, true} {
+		for _, f := range l {
+			if f.Skipped != skip {
+				continue
+			}
+			status := "failed"
+			if f.Skipped {
+				status = "skipped"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", status, f.Kind, f.Path, f.Err)
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+const keepGoingManifest = `
+organizations:
+  sys:
+    spaces:
+      prod:
+        services:
+          db: postgres/small
+        apps:
+          - name: web
+            image: nginx
+            shared: [db]
+          - name: worker
+            image: busybox
+`
+
+// TestKeepGoing deploys a manifest with a service that fails to be
+// created, skipping only the app that is bound to it.
+func TestKeepGoing(t *testing.T) {
+	m := parse(t, keepGoingManifest)
+	b := NewFakeBackend()
+	b.AsyncServices = map[string]int{"postgres": 1}
+	b.FailingServices = map[string]string{"postgres": "out of disk"}
+	defer func(d time.Duration) { serviceInterval = d }(serviceInterval)
+	serviceInterval = time.Millisecond
+
+	d := &Deployer{manifest: m, backend: b, report: &Plan{}, keepGoing: true, healthTimeout: time.Second}
+	err := d.Deploy()
+	if err == nil || err.Error() != "1 resource(s) failed, 1 skipped" {
+		t.Fatalf("got %v (%v), want one failure and one skip", err, d.failures)
+	}
+	if len(d.failures) != 2 {
+		t.Fatalf("got failures %v, want two", d.failures)
+	}
+	if f := d.failures[0]; f.Skipped || f.Path != "sys/prod/shared-db" || !strings.Contains(f.Err.Error(), "out of disk") {
+		t.Errorf("got failure %+v, want the service to have failed", f)
+	}
+	if f := d.failures[1]; !f.Skipped || f.Path != "sys/prod/web" {
+		t.Errorf("got failure %+v, want the app bound to the service to be skipped", f)
+	}
+	if _, _, err := b.app("sys", "prod", "web"); err == nil {
+		t.Error("the app bound to the failed service was pushed")
+	}
+	if _, a, err := b.app("sys", "prod", "worker"); err != nil || !a.Started {
+		t.Error("the app that doesn't need the service wasn't deployed")
+	}
+
+	var out bytes.Buffer
+	PrintFailures(&out, d.failures)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || lines[0] != "1 resource(s) failed, 1 skipped:" ||
+		!strings.HasPrefix(lines[3], "failed ") || !strings.HasPrefix(lines[4], "skipped ") {
+		t.Errorf("got failures printed as:\n%s", out.String())
+	}
+}
+
+// TestStopAtFailure checks that, without --keep-going, a deployment stops
+// at the first failure.
+func TestStopAtFailure(t *testing.T) {
+	m := parse(t, keepGoingManifest)
+	b := NewFakeBackend()
+	b.FailingServices = map[string]string{"postgres": "out of disk"}
+	b.AsyncServices = map[string]int{"postgres": 1}
+	defer func(d time.Duration) { serviceInterval = d }(serviceInterval)
+	serviceInterval = time.Millisecond
+
+	d := &Deployer{manifest: m, backend: b, report: &Plan{}, healthTimeout: time.Second}
+	if err := d.Deploy(); err == nil || !strings.Contains(err.Error(), "out of disk") {
+		t.Fatalf("got %v, want the service's failure", err)
+	}
+	if len(d.failures) != 0 {
+		t.Errorf("got failures %v without keeping going", d.failures)
+	}
+}
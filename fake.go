@@ -0,0 +1,1554 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+// The FakeBackend is an in-memory Cloud Foundry, for exercising the
+// Deployer without a real foundation.  It keeps track of orgs, spaces,
+// users and their roles, quotas, domains, security groups, services and
+// apps, and fails the way a real foundation would: changes to things
+// that don't exist fail with a NotFoundError, and creating things that
+// already exist (where the real thing refuses to) fails too.
+//
+// Everything is exported, so that a foundation can be set up beforehand
+// and inspected afterwards.  Every change made is also logged in Calls.
+type FakeBackend struct {
+	*FakeFoundation
+	record  func([]string)
+	observe func([]string)
+}
+
+// A FakeFoundation is the state of the fake Cloud Foundry behind a
+// FakeBackend, shared with all of its forks.
+type FakeFoundation struct {
+	Username       string
+	Users          map[string]string
+	Admins         map[string]bool
+	SharedDomains  []string
+	Quotas         map[string]*Quota
+	SecurityGroups map[string]*FakeSecurityGroup
+	Orgs           map[string]*FakeOrg
+
+	/* the service plans that can be created, by service;
+	   if nil, any service and plan will do */
+	Catalog map[string][]string
+
+	/* apps (by name) whose instances crash whenever they are started,
+	   or can't be placed anywhere, and so stay down */
+	Crashing map[string]bool
+	Down     map[string]bool
+
+	/* services whose brokers don't let instance parameters be read */
+	OpaqueServices map[string]bool
+
+	/* services whose brokers provision (and update) instances
+	   asynchronously: each operation is still in progress for
+	   this many reads of the instance, and then succeeds -- or
+	   fails, with the description in FailingServices */
+	AsyncServices   map[string]int
+	FailingServices map[string]string
+
+	/* registered service brokers, and who can see each plan (by
+	   service/plan); the services a broker offers, if it is in
+	   BrokerCatalogs, are added to the Catalog when it registers */
+	Brokers        map[string]*FakeBroker
+	BrokerCatalogs map[string]map[string][]string
+	Access         map[string]*ServicePlanAccess
+
+	Calls [][]string
+	guids int
+
+	/* held for every read and change, since forks of the
+	   backend may be used concurrently */
+	mu sync.Mutex
+}
+
+type FakeSecurityGroup struct {
+	GUID    string
+	Rules   []byte
+	Running bool
+	Staging bool
+}
+
+type FakeOrg struct {
+	GUID        string
+	Name        string
+	Quota       string
+	Domains     []string
+	SpaceQuotas map[string]*Quota
+	Roles       map[string][]string
+	Spaces      map[string]*FakeSpace
+}
+
+type FakeSpace struct {
+	GUID           string
+	Name           string
+	SSH            bool
+	Quota          string
+	Roles          map[string][]string
+	SecurityGroups map[string][]string
+	Routes         map[string]URL
+	Apps           map[string]*FakeApp
+	Services       map[string]*FakeService
+}
+
+type FakeApp struct {
+	GUID      string
+	Name      string
+	Image     string
+	Path      string
+	Buildpack string
+	Instances int
+	Memory    int64
+	Disk      int64
+	Started   bool
+	Pushes    int
+	Restages  int
+	PushedAt  time.Time
+	Env       map[string]string
+	Routes    []string
+	Bindings  []string
+}
+
+type FakeBroker struct {
+	GUID     string
+	Name     string
+	URL      string
+	Username string
+	Password string
+	Space    string
+}
+
+type FakeService struct {
+	GUID         string
+	Name         string
+	Service      string
+	Plan         string
+	Parameters   string
+	Tags         []string
+	UserProvided bool
+	Operation    string
+	Pending      int
+	Credentials  string
+	RouteService string
+	SyslogDrain  string
+}
+
+// NewFakeBackend returns an empty foundation with a single admin user,
+// who is the one logged in, and a shared domain for apps to default to.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		FakeFoundation: &FakeFoundation{
+			Username:       "admin",
+			Users:          map[string]string{"admin": "admin"},
+			Admins:         map[string]bool{"admin": true},
+			SharedDomains:  []string{"apps.example.com"},
+			Quotas:         map[string]*Quota{},
+			SecurityGroups: map[string]*FakeSecurityGroup{},
+			Orgs:           map[string]*FakeOrg{},
+			Brokers:        map[string]*FakeBroker{},
+			Access:         map[string]*ServicePlanAccess{},
+		},
+	}
+}
+
+// Fork returns a backend for the same fake foundation, with hooks of its
+// own.
+func (f *FakeBackend) Fork() Backend {
+	return &FakeBackend{FakeFoundation: f.FakeFoundation}
+}
+
+func (f *FakeBackend) Record(fn func([]string)) {
+	f.record = fn
+}
+
+func (f *FakeBackend) Observe(fn func([]string)) {
+	f.observe = fn
+}
+
+// recorded logs a change, and returns true if it is only being recorded
+// (in which case it must not be made.)
+func (f *FakeBackend) recorded(call ...string) bool {
+	if os.Getenv("DEBUG") != "" {
+		fmt.Printf(">> %s\n", strings.Join(redactions.Call(call), " "))
+	}
+	if f.record != nil {
+		f.record(call)
+		return true
+	}
+	if f.observe != nil {
+		f.observe(call)
+	}
+	f.Calls = append(f.Calls, call)
+	return false
+}
+
+func (f *FakeBackend) guid() string {
+	f.guids++
+	return fmt.Sprintf("fake-guid-%d", f.guids)
+}
+
+func (f *FakeBackend) org(org string) (*FakeOrg, error) {
+	if o, ok := f.Orgs[org]; ok {
+		return o, nil
+	}
+	return nil, NotFoundError{Kind: "Organization", Name: org}
+}
+
+func (f *FakeBackend) space(org, space string) (*FakeSpace, error) {
+	o, err := f.org(org)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := o.Spaces[space]; ok {
+		return s, nil
+	}
+	return nil, NotFoundError{Kind: "Space", Name: space}
+}
+
+func (f *FakeBackend) app(org, space, app string) (*FakeSpace, *FakeApp, error) {
+	s, err := f.space(org, space)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a, ok := s.Apps[app]; ok {
+		return s, a, nil
+	}
+	return s, nil, NotFoundError{Kind: "App", Name: app}
+}
+
+func (f *FakeBackend) service(org, space, name string) (*FakeSpace, *FakeService, error) {
+	s, err := f.space(org, space)
+	if err != nil {
+		return nil, nil, err
+	}
+	if svc, ok := s.Services[name]; ok {
+		return s, svc, nil
+	}
+	return s, nil, NotFoundError{Kind: "Service instance", Name: name}
+}
+
+func (f *FakeBackend) user(user string) error {
+	if _, ok := f.Users[user]; !ok {
+		return NotFoundError{Kind: "User", Name: user}
+	}
+	return nil
+}
+
+// domain returns true if the domain can be used in the org.
+func (f *FakeBackend) domain(o *FakeOrg, domain string) bool {
+	return contains(f.SharedDomains, domain) || contains(o.Domains, domain)
+}
+
+func (f *FakeBackend) CurrentUser() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Username, nil
+}
+
+func (f *FakeBackend) GetOrgs() ([]plugin_models.GetOrgs_Model, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var l []plugin_models.GetOrgs_Model
+	for _, name := range sortedKeys(f.Orgs) {
+		l = append(l, plugin_models.GetOrgs_Model{Guid: f.Orgs[name].GUID, Name: name})
+	}
+	return l, nil
+}
+
+func (f *FakeBackend) GetOrg(org string) (plugin_models.GetOrg_Model, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var m plugin_models.GetOrg_Model
+	o, err := f.org(org)
+	if err != nil {
+		return m, err
+	}
+
+	m.Guid = o.GUID
+	m.Name = o.Name
+	m.QuotaDefinition.Name = o.Quota
+	for _, name := range sortedKeys(o.Spaces) {
+		m.Spaces = append(m.Spaces, plugin_models.GetOrg_Space{Guid: o.Spaces[name].GUID, Name: name})
+	}
+	for _, d := range f.SharedDomains {
+		m.Domains = append(m.Domains, plugin_models.GetOrg_Domains{Name: d, Shared: true})
+	}
+	for _, d := range o.Domains {
+		m.Domains = append(m.Domains, plugin_models.GetOrg_Domains{Name: d, OwningOrganizationGuid: o.GUID})
+	}
+	for _, name := range sortedKeys(o.SpaceQuotas) {
+		m.SpaceQuotas = append(m.SpaceQuotas, plugin_models.GetOrg_SpaceQuota{Name: name})
+	}
+	return m, nil
+}
+
+func (f *FakeBackend) GetOrgUsers(org string) ([]plugin_models.GetOrgUsers_Model, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, err := f.org(org)
+	if err != nil {
+		return nil, err
+	}
+	var l []plugin_models.GetOrgUsers_Model
+	for _, u := range sortedKeys(o.Roles) {
+		l = append(l, plugin_models.GetOrgUsers_Model{Username: u, IsAdmin: f.Admins[u], Roles: o.Roles[u]})
+	}
+	return l, nil
+}
+
+func (f *FakeBackend) GetSpace(org, space string) (plugin_models.GetSpace_Model, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var m plugin_models.GetSpace_Model
+	s, err := f.space(org, space)
+	if err != nil {
+		return m, err
+	}
+
+	m.Guid = s.GUID
+	m.Name = s.Name
+	m.Organization.Guid = f.Orgs[org].GUID
+	m.Organization.Name = org
+	m.SpaceQuota.Name = s.Quota
+	for _, name := range sortedKeys(s.Apps) {
+		m.Applications = append(m.Applications, plugin_models.GetSpace_Apps{Guid: s.Apps[name].GUID, Name: name})
+	}
+	for _, name := range sortedKeys(s.Services) {
+		m.ServiceInstances = append(m.ServiceInstances, plugin_models.GetSpace_ServiceInstance{Guid: s.Services[name].GUID, Name: name})
+	}
+	for _, name := range sortedKeys(s.SecurityGroups) {
+		if contains(s.SecurityGroups[name], "running") {
+			m.SecurityGroups = append(m.SecurityGroups, plugin_models.GetSpace_SecurityGroup{Guid: f.SecurityGroups[name].GUID, Name: name})
+		}
+	}
+	return m, nil
+}
+
+func (f *FakeBackend) GetSpaceUsers(org, space string) ([]plugin_models.GetSpaceUsers_Model, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.space(org, space)
+	if err != nil {
+		return nil, err
+	}
+	var l []plugin_models.GetSpaceUsers_Model
+	for _, u := range sortedKeys(s.Roles) {
+		l = append(l, plugin_models.GetSpaceUsers_Model{Username: u, IsAdmin: f.Admins[u], Roles: s.Roles[u]})
+	}
+	return l, nil
+}
+
+func (a *FakeApp) state() string {
+	if a.Started {
+		return "started"
+	}
+	return "stopped"
+}
+
+func (f *FakeBackend) GetApps(org, space string) ([]plugin_models.GetAppsModel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.space(org, space)
+	if err != nil {
+		return nil, err
+	}
+	var l []plugin_models.GetAppsModel
+	for _, name := range sortedKeys(s.Apps) {
+		a := s.Apps[name]
+		l = append(l, plugin_models.GetAppsModel{
+			Guid:           a.GUID,
+			Name:           name,
+			State:          a.state(),
+			TotalInstances: a.Instances,
+			Memory:         a.Memory,
+			DiskQuota:      a.Disk,
+		})
+	}
+	return l, nil
+}
+
+func (f *FakeBackend) GetApp(org, space, app string) (plugin_models.GetAppModel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var m plugin_models.GetAppModel
+	s, a, err := f.app(org, space, app)
+	if err != nil {
+		return m, err
+	}
+
+	m.Guid = a.GUID
+	m.Name = a.Name
+	m.SpaceGuid = s.GUID
+	m.State = a.state()
+	m.InstanceCount = a.Instances
+	m.Memory = a.Memory
+	m.DiskQuota = a.Disk
+	m.PackageState = "STAGED"
+	pushed := a.PushedAt
+	m.PackageUpdatedAt = &pushed
+
+	if a.Started {
+		inst := plugin_models.GetApp_AppInstanceFields{State: "running"}
+		if f.Crashing[a.Name] {
+			inst = plugin_models.GetApp_AppInstanceFields{State: "crashed", Details: "app instance exited"}
+		} else if f.Down[a.Name] {
+			inst = plugin_models.GetApp_AppInstanceFields{State: "down", Details: "insufficient resources: memory"}
+		} else {
+			m.RunningInstances = a.Instances
+		}
+		for i := 0; i < a.Instances; i++ {
+			m.Instances = append(m.Instances, inst)
+		}
+	}
+
+	m.EnvironmentVars = map[string]interface{}{}
+	for k, v := range a.Env {
+		m.EnvironmentVars[k] = v
+	}
+	for _, r := range a.Routes {
+		url := s.Routes[r]
+		m.Routes = append(m.Routes, plugin_models.GetApp_RouteSummary{
+			Host:   url.Host,
+			Domain: plugin_models.GetApp_DomainFields{Name: url.Domain},
+		})
+	}
+	for _, b := range a.Bindings {
+		m.Services = append(m.Services, plugin_models.GetApp_ServiceSummary{Guid: s.Services[b].GUID, Name: b})
+	}
+	return m, nil
+}
+
+func (f *FakeBackend) GetServices(org, space string) ([]plugin_models.GetServices_Model, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.space(org, space)
+	if err != nil {
+		return nil, err
+	}
+
+	var l []plugin_models.GetServices_Model
+	for _, name := range sortedKeys(s.Services) {
+		svc := s.Services[name]
+		m := plugin_models.GetServices_Model{
+			Guid:           svc.GUID,
+			Name:           name,
+			IsUserProvided: svc.UserProvided,
+		}
+		m.Service.Name = svc.Service
+		m.ServicePlan.Name = svc.Plan
+		m.LastOperation.Type = "create"
+		m.LastOperation.State = "succeeded"
+		for _, aname := range sortedKeys(s.Apps) {
+			if contains(s.Apps[aname].Bindings, name) {
+				m.ApplicationNames = append(m.ApplicationNames, aname)
+			}
+		}
+		l = append(l, m)
+	}
+	return l, nil
+}
+
+func (f *FakeBackend) GetService(org, space, name string) (plugin_models.GetService_Model, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var m plugin_models.GetService_Model
+	_, svc, err := f.service(org, space, name)
+	if err != nil {
+		return m, err
+	}
+	m.Guid = svc.GUID
+	m.Name = svc.Name
+	m.IsUserProvided = svc.UserProvided
+	m.ServiceOffering.Name = svc.Service
+	m.ServicePlan.Name = svc.Plan
+	m.LastOperation.Type = svc.Operation
+	switch {
+	case svc.Operation == "":
+		m.LastOperation.Type = "create"
+		m.LastOperation.State = "succeeded"
+	case svc.Pending > 0:
+		m.LastOperation.State = "in progress"
+		svc.Pending--
+	case f.FailingServices[svc.Service] != "":
+		m.LastOperation.State = "failed"
+		m.LastOperation.Description = f.FailingServices[svc.Service]
+	default:
+		m.LastOperation.State = "succeeded"
+	}
+	return m, nil
+}
+
+// GetServiceParameters returns the parameters a service instance was
+// created (or last updated) with, or nil, if its service is one of the
+// OpaqueServices, whose brokers don't let them be read back.
+func (f *FakeBackend) GetServiceParameters(org, space, name string) (map[string]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, svc, err := f.service(org, space, name)
+	if err != nil {
+		return nil, err
+	}
+	if f.OpaqueServices[svc.Service] {
+		return nil, nil
+	}
+	params := map[string]interface{}{}
+	if svc.Parameters != "" {
+		if err := json.Unmarshal([]byte(svc.Parameters), &params); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+func (f *FakeBackend) GetServiceTags(org, space, name string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, svc, err := f.service(org, space, name)
+	if err != nil {
+		return nil, err
+	}
+	return svc.Tags, nil
+}
+
+func (f *FakeBackend) SecurityGroupExists(name string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.SecurityGroups[name]
+	return ok, nil
+}
+
+func (f *FakeBackend) GlobalSecurityGroups(lifecycle string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var l []string
+	for _, name := range sortedKeys(f.SecurityGroups) {
+		sg := f.SecurityGroups[name]
+		if (lifecycle == "running" && sg.Running) || (lifecycle == "staging" && sg.Staging) {
+			l = append(l, name)
+		}
+	}
+	return l, nil
+}
+
+func (f *FakeBackend) SpaceSecurityGroups(org, space, lifecycle string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.space(org, space)
+	if err != nil {
+		return nil, err
+	}
+	var l []string
+	for _, name := range sortedKeys(s.SecurityGroups) {
+		if contains(s.SecurityGroups[name], lifecycle) {
+			l = append(l, name)
+		}
+	}
+	return l, nil
+}
+
+func (f *FakeBackend) SSHAllowed(org, space string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.space(org, space)
+	if err != nil {
+		return false, err
+	}
+	return s.SSH, nil
+}
+
+func (f *FakeBackend) GetServiceBrokers() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return sortedKeys(f.Brokers), nil
+}
+
+// plans returns the plans of a service: those in the Catalog or, if
+// there is none, those that anyone has been given access to.
+func (f *FakeBackend) plans(service string) []string {
+	if f.Catalog != nil {
+		return f.Catalog[service]
+	}
+	var l []string
+	for _, k := range sortedKeys(f.Access) {
+		if strings.HasPrefix(k, service+"/") {
+			l = append(l, strings.TrimPrefix(k, service+"/"))
+		}
+	}
+	return l
+}
+
+func (f *FakeBackend) GetServiceAccess(service string) ([]ServicePlanAccess, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	plans := f.plans(service)
+	if len(plans) == 0 {
+		return nil, NotFoundError{Kind: "Service", Name: service}
+	}
+	var l []ServicePlanAccess
+	for _, plan := range plans {
+		a := ServicePlanAccess{Plan: plan}
+		if x, ok := f.Access[service+"/"+plan]; ok {
+			a.Public, a.Orgs = x.Public, append([]string{}, x.Orgs...)
+		}
+		l = append(l, a)
+	}
+	return l, nil
+}
+
+func (f *FakeBackend) CreateUser(user, password string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-user", user, password) {
+		return nil
+	}
+	if _, ok := f.Users[user]; ok {
+		return fmt.Errorf("user %s already exists", user)
+	}
+	f.Users[user] = password
+	return nil
+}
+
+func (f *FakeBackend) CreateSharedDomain(domain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-shared-domain", domain) {
+		return nil
+	}
+	if contains(f.SharedDomains, domain) {
+		return fmt.Errorf("domain %s already exists", domain)
+	}
+	f.SharedDomains = append(f.SharedDomains, domain)
+	return nil
+}
+
+/* like `cf create-quota`, creating a quota that exists is not an error */
+func (f *FakeBackend) CreateQuota(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-quota", name) {
+		return nil
+	}
+	if _, ok := f.Quotas[name]; !ok {
+		f.Quotas[name] = &Quota{}
+	}
+	return nil
+}
+
+func (f *FakeBackend) UpdateQuota(name string, quota *Quota) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("update-quota", name) {
+		return nil
+	}
+	if _, ok := f.Quotas[name]; !ok {
+		return NotFoundError{Kind: "Quota", Name: name}
+	}
+	q := *quota
+	f.Quotas[name] = &q
+	return nil
+}
+
+func (f *FakeBackend) CreateSecurityGroup(name string, rules []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-security-group", name) {
+		return nil
+	}
+	if _, ok := f.SecurityGroups[name]; ok {
+		return fmt.Errorf("security group %s already exists", name)
+	}
+	f.SecurityGroups[name] = &FakeSecurityGroup{GUID: f.guid(), Rules: rules}
+	return nil
+}
+
+func (f *FakeBackend) UpdateSecurityGroup(name string, rules []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("update-security-group", name) {
+		return nil
+	}
+	sg, ok := f.SecurityGroups[name]
+	if !ok {
+		return NotFoundError{Kind: "Security group", Name: name}
+	}
+	sg.Rules = rules
+	return nil
+}
+
+func (f *FakeBackend) globalSecurityGroup(name, lifecycle string, on bool) error {
+	sg, ok := f.SecurityGroups[name]
+	if !ok {
+		return NotFoundError{Kind: "Security group", Name: name}
+	}
+	switch lifecycle {
+	case "running":
+		sg.Running = on
+	case "staging":
+		sg.Staging = on
+	default:
+		return fmt.Errorf("unknown lifecycle '%s'", lifecycle)
+	}
+	return nil
+}
+
+func (f *FakeBackend) BindGlobalSecurityGroup(name, lifecycle string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("bind-"+lifecycle+"-security-group", name) {
+		return nil
+	}
+	return f.globalSecurityGroup(name, lifecycle, true)
+}
+
+func (f *FakeBackend) UnbindGlobalSecurityGroup(name, lifecycle string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("unbind-"+lifecycle+"-security-group", name) {
+		return nil
+	}
+	return f.globalSecurityGroup(name, lifecycle, false)
+}
+
+func (f *FakeBackend) BindSecurityGroup(name, org, space, lifecycle string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("bind-security-group", name, org, space, lifecycle) {
+		return nil
+	}
+	if _, ok := f.SecurityGroups[name]; !ok {
+		return NotFoundError{Kind: "Security group", Name: name}
+	}
+	o, err := f.org(org)
+	if err != nil {
+		return err
+	}
+
+	var spaces []*FakeSpace
+	if space == "" {
+		for _, s := range o.Spaces {
+			spaces = append(spaces, s)
+		}
+	} else {
+		s, err := f.space(org, space)
+		if err != nil {
+			return err
+		}
+		spaces = append(spaces, s)
+	}
+	for _, s := range spaces {
+		if !contains(s.SecurityGroups[name], lifecycle) {
+			s.SecurityGroups[name] = append(s.SecurityGroups[name], lifecycle)
+		}
+	}
+	return nil
+}
+
+func (f *FakeBackend) UnbindSecurityGroup(name, org, space, lifecycle string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("unbind-security-group", name, org, space, lifecycle) {
+		return nil
+	}
+	s, err := f.space(org, space)
+	if err != nil {
+		return err
+	}
+	var l []string
+	for _, lc := range s.SecurityGroups[name] {
+		if lc != lifecycle {
+			l = append(l, lc)
+		}
+	}
+	if len(l) == 0 {
+		delete(s.SecurityGroups, name)
+	} else {
+		s.SecurityGroups[name] = l
+	}
+	return nil
+}
+
+func (f *FakeBackend) CreateOrg(org string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-org", org) {
+		return nil
+	}
+	if _, ok := f.Orgs[org]; ok {
+		return fmt.Errorf("organization %s already exists", org)
+	}
+	f.Orgs[org] = &FakeOrg{
+		GUID:        f.guid(),
+		Name:        org,
+		SpaceQuotas: map[string]*Quota{},
+		Roles:       map[string][]string{},
+		Spaces:      map[string]*FakeSpace{},
+	}
+	return nil
+}
+
+func (f *FakeBackend) DeleteOrg(org string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("delete-org", org) {
+		return nil
+	}
+	if _, err := f.org(org); err != nil {
+		return err
+	}
+	delete(f.Orgs, org)
+	return nil
+}
+
+func (f *FakeBackend) CreateOrgDomain(org, domain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-domain", org, domain) {
+		return nil
+	}
+	o, err := f.org(org)
+	if err != nil {
+		return err
+	}
+	if f.domain(o, domain) {
+		return fmt.Errorf("domain %s already exists", domain)
+	}
+	o.Domains = append(o.Domains, domain)
+	return nil
+}
+
+func (f *FakeBackend) SetOrgQuota(org, quota string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("set-quota", org, quota) {
+		return nil
+	}
+	o, err := f.org(org)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.Quotas[quota]; !ok {
+		return NotFoundError{Kind: "Quota", Name: quota}
+	}
+	o.Quota = quota
+	return nil
+}
+
+func (f *FakeBackend) CreateSpaceQuota(org, name string, quota *Quota) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-space-quota", org, name) {
+		return nil
+	}
+	o, err := f.org(org)
+	if err != nil {
+		return err
+	}
+	if _, ok := o.SpaceQuotas[name]; ok {
+		return fmt.Errorf("space quota %s already exists", name)
+	}
+	q := *quota
+	o.SpaceQuotas[name] = &q
+	return nil
+}
+
+func (f *FakeBackend) UpdateSpaceQuota(org, name string, quota *Quota) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("update-space-quota", org, name) {
+		return nil
+	}
+	o, err := f.org(org)
+	if err != nil {
+		return err
+	}
+	if _, ok := o.SpaceQuotas[name]; !ok {
+		return NotFoundError{Kind: "Space quota", Name: name}
+	}
+	q := *quota
+	o.SpaceQuotas[name] = &q
+	return nil
+}
+
+func grant(roles map[string][]string, user, role string) {
+	if !contains(roles[user], role) {
+		roles[user] = append(roles[user], role)
+	}
+}
+
+func revoke(roles map[string][]string, user, role string) {
+	var l []string
+	for _, r := range roles[user] {
+		if r != role {
+			l = append(l, r)
+		}
+	}
+	if len(l) == 0 {
+		delete(roles, user)
+	} else {
+		roles[user] = l
+	}
+}
+
+/* any role in an org (or one of its spaces) makes the user an OrgUser */
+func (f *FakeBackend) SetOrgRole(org, user, role string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("set-org-role", user, org, role) {
+		return nil
+	}
+	o, err := f.org(org)
+	if err != nil {
+		return err
+	}
+	if err := f.user(user); err != nil {
+		return err
+	}
+	grant(o.Roles, user, "OrgUser")
+	grant(o.Roles, user, role)
+	return nil
+}
+
+func (f *FakeBackend) UnsetOrgRole(org, user, role string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("unset-org-role", user, org, role) {
+		return nil
+	}
+	o, err := f.org(org)
+	if err != nil {
+		return err
+	}
+	revoke(o.Roles, user, role)
+	return nil
+}
+
+func (f *FakeBackend) CreateSpace(org, space string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-space", space, "-o", org) {
+		return nil
+	}
+	o, err := f.org(org)
+	if err != nil {
+		return err
+	}
+	if _, ok := o.Spaces[space]; ok {
+		return fmt.Errorf("space %s already exists", space)
+	}
+	o.Spaces[space] = &FakeSpace{
+		GUID:           f.guid(),
+		Name:           space,
+		Roles:          map[string][]string{},
+		SecurityGroups: map[string][]string{},
+		Routes:         map[string]URL{},
+		Apps:           map[string]*FakeApp{},
+		Services:       map[string]*FakeService{},
+	}
+	return nil
+}
+
+func (f *FakeBackend) DeleteSpace(org, space string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("delete-space", space, "-o", org) {
+		return nil
+	}
+	if _, err := f.space(org, space); err != nil {
+		return err
+	}
+	delete(f.Orgs[org].Spaces, space)
+	return nil
+}
+
+func (f *FakeBackend) AllowSSH(org, space string, on bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("allow-space-ssh", org, space, fmt.Sprintf("%v", on)) {
+		return nil
+	}
+	s, err := f.space(org, space)
+	if err != nil {
+		return err
+	}
+	s.SSH = on
+	return nil
+}
+
+func (f *FakeBackend) SetSpaceQuota(org, space, quota string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("set-space-quota", org, space, quota) {
+		return nil
+	}
+	s, err := f.space(org, space)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.Orgs[org].SpaceQuotas[quota]; !ok {
+		return NotFoundError{Kind: "Space quota", Name: quota}
+	}
+	s.Quota = quota
+	return nil
+}
+
+func (f *FakeBackend) SetSpaceRole(org, space, user, role string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("set-space-role", user, org, space, role) {
+		return nil
+	}
+	s, err := f.space(org, space)
+	if err != nil {
+		return err
+	}
+	if err := f.user(user); err != nil {
+		return err
+	}
+	grant(f.Orgs[org].Roles, user, "OrgUser")
+	grant(s.Roles, user, role)
+	return nil
+}
+
+func (f *FakeBackend) UnsetSpaceRole(org, space, user, role string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("unset-space-role", user, org, space, role) {
+		return nil
+	}
+	s, err := f.space(org, space)
+	if err != nil {
+		return err
+	}
+	revoke(s.Roles, user, role)
+	return nil
+}
+
+func (f *FakeBackend) DeleteOrphanedRoutes(org, space string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("delete-orphaned-routes", org, space) {
+		return nil
+	}
+	s, err := f.space(org, space)
+	if err != nil {
+		return err
+	}
+	for r := range s.Routes {
+		used := false
+		for _, a := range s.Apps {
+			used = used || contains(a.Routes, r)
+		}
+		if !used {
+			delete(s.Routes, r)
+		}
+	}
+	return nil
+}
+
+func (f *FakeBackend) mapRoute(o *FakeOrg, s *FakeSpace, a *FakeApp, url URL) error {
+	if !f.domain(o, url.Domain) {
+		return NotFoundError{Kind: "Domain", Name: url.Domain}
+	}
+	s.Routes[url.String()] = url
+	if !contains(a.Routes, url.String()) {
+		a.Routes = append(a.Routes, url.String())
+	}
+	return nil
+}
+
+func (f *FakeBackend) PushApp(org, space string, app *Application, path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("push", org, space, app.Name) {
+		return nil
+	}
+	s, err := f.space(org, space)
+	if err != nil {
+		return err
+	}
+	if app.Image == "" {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+
+	a, ok := s.Apps[app.Name]
+	if !ok {
+		a = &FakeApp{GUID: f.guid(), Name: app.Name, Env: map[string]string{}}
+		s.Apps[app.Name] = a
+	}
+	a.Image = app.Image
+	a.Path = path
+	a.Buildpack = app.Buildpack
+	a.Instances = app.Instances
+	if app.Memory != "" {
+		mb, err := megabytes(app.Memory)
+		if err != nil {
+			return err
+		}
+		if mb != nil {
+			a.Memory = *mb
+		}
+	}
+	if app.Disk != "" {
+		mb, err := megabytes(app.Disk)
+		if err != nil {
+			return err
+		}
+		if mb != nil {
+			a.Disk = *mb
+		}
+	}
+	a.Pushes++
+	a.PushedAt = time.Now()
+
+	if len(app.URLs) == 0 && !app.NoRoute {
+		url := URL{Host: app.Hostname, Domain: app.Domain}
+		if url.Host == "" {
+			url.Host = app.Name
+		}
+		if url.Domain == "" && len(f.SharedDomains) > 0 {
+			url.Domain = f.SharedDomains[0]
+		}
+		return f.mapRoute(f.Orgs[org], s, a, url)
+	}
+	return nil
+}
+
+func (f *FakeBackend) DeleteApp(org, space, app string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("delete", org, space, app) {
+		return nil
+	}
+	s, _, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	delete(s.Apps, app)
+	return nil
+}
+
+func (f *FakeBackend) RenameApp(org, space, app, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("rename", org, space, app, name) {
+		return nil
+	}
+	s, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.Apps[name]; ok {
+		return fmt.Errorf("app %s already exists", name)
+	}
+	delete(s.Apps, app)
+	a.Name = name
+	s.Apps[name] = a
+	return nil
+}
+
+func (f *FakeBackend) MapRoute(org, space, app string, url URL) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("map-route", org, space, app, url.String()) {
+		return nil
+	}
+	s, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	return f.mapRoute(f.Orgs[org], s, a, url)
+}
+
+func (f *FakeBackend) UnmapRoute(org, space, app string, url URL) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("unmap-route", org, space, app, url.String()) {
+		return nil
+	}
+	_, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	var l []string
+	for _, r := range a.Routes {
+		if r != url.String() {
+			l = append(l, r)
+		}
+	}
+	a.Routes = l
+	return nil
+}
+
+func (f *FakeBackend) SetEnv(org, space, app, name, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("set-env", org, space, app, name, value) {
+		return nil
+	}
+	_, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	a.Env[name] = value
+	return nil
+}
+
+func (f *FakeBackend) UnsetEnv(org, space, app, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("unset-env", org, space, app, name) {
+		return nil
+	}
+	_, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	delete(a.Env, name)
+	return nil
+}
+
+func (f *FakeBackend) StartApp(org, space, app string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("start", org, space, app) {
+		return nil
+	}
+	_, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	a.Started = true
+	return nil
+}
+
+func (f *FakeBackend) ScaleApp(org, space, app string, instances int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("scale", org, space, app, fmt.Sprintf("%v", instances)) {
+		return nil
+	}
+	_, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	a.Instances = instances
+	return nil
+}
+
+func (f *FakeBackend) RestageApp(org, space, app string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("restage", org, space, app) {
+		return nil
+	}
+	_, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	a.Restages++
+	a.Started = true
+	return nil
+}
+
+func (f *FakeBackend) CreateService(org, space, name, service, plan, parameters string, tags []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded(serviceArgs([]string{"create-service", org, space, service, plan, name}, parameters, tags)...) {
+		return nil
+	}
+	s, _, err := f.service(org, space, name)
+	if err == nil {
+		return fmt.Errorf("service instance %s already exists", name)
+	}
+	if s == nil {
+		return err
+	}
+	if f.Catalog != nil && !contains(f.Catalog[service], plan) {
+		return NotFoundError{Kind: "Service plan", Name: service + "/" + plan}
+	}
+	s.Services[name] = &FakeService{GUID: f.guid(), Name: name, Service: service, Plan: plan, Parameters: parameters, Tags: tags}
+	f.operation(s.Services[name], "create")
+	return nil
+}
+
+func (f *FakeBackend) UpdateService(org, space, name, plan, parameters string, tags []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	args := []string{"update-service", org, space, name}
+	if plan != "" {
+		args = append(args, "-p", plan)
+	}
+	if f.recorded(serviceArgs(args, parameters, tags)...) {
+		return nil
+	}
+	_, svc, err := f.service(org, space, name)
+	if err != nil {
+		return err
+	}
+	if plan != "" {
+		if f.Catalog != nil && !contains(f.Catalog[svc.Service], plan) {
+			return NotFoundError{Kind: "Service plan", Name: svc.Service + "/" + plan}
+		}
+		svc.Plan = plan
+	}
+	if parameters != "" {
+		svc.Parameters = parameters
+	}
+	if len(tags) > 0 {
+		svc.Tags = tags
+	}
+	f.operation(svc, "update")
+	return nil
+}
+
+// operation starts an operation on a service instance, which is left in
+// progress if its service is one of the AsyncServices.
+func (f *FakeBackend) operation(svc *FakeService, op string) {
+	svc.Operation = op
+	svc.Pending = f.AsyncServices[svc.Service]
+}
+
+func (f *FakeBackend) DeleteService(org, space, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("delete-service", org, space, name) {
+		return nil
+	}
+	s, _, err := f.service(org, space, name)
+	if err != nil {
+		return err
+	}
+	for _, a := range s.Apps {
+		if contains(a.Bindings, name) {
+			return fmt.Errorf("cannot delete service instance %s: it is still bound to %s", name, a.Name)
+		}
+	}
+	delete(s.Services, name)
+	return nil
+}
+
+/* like `cf bind-service`, binding a bound service is not an error */
+func (f *FakeBackend) BindService(org, space, app, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("bind-service", org, space, app, name) {
+		return nil
+	}
+	_, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	_, svc, err := f.service(org, space, name)
+	if err != nil {
+		return err
+	}
+	if svc.Pending > 0 {
+		return fmt.Errorf("An operation for service instance %s is in progress.", name)
+	}
+	if !contains(a.Bindings, name) {
+		a.Bindings = append(a.Bindings, name)
+	}
+	return nil
+}
+
+func (f *FakeBackend) UnbindService(org, space, app, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("unbind-service", org, space, app, name) {
+		return nil
+	}
+	_, a, err := f.app(org, space, app)
+	if err != nil {
+		return err
+	}
+	var l []string
+	for _, b := range a.Bindings {
+		if b != name {
+			l = append(l, b)
+		}
+	}
+	a.Bindings = l
+	return nil
+}
+
+func (f *FakeBackend) CreateUserProvidedService(org, space, name, credentials, route, syslog string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-user-provided-service", org, space, name) {
+		return nil
+	}
+	s, _, err := f.service(org, space, name)
+	if err == nil {
+		return fmt.Errorf("service instance %s already exists", name)
+	}
+	if s == nil {
+		return err
+	}
+	s.Services[name] = &FakeService{
+		GUID:         f.guid(),
+		Name:         name,
+		UserProvided: true,
+		Credentials:  credentials,
+		RouteService: route,
+		SyslogDrain:  syslog,
+	}
+	return nil
+}
+
+func (f *FakeBackend) UpdateUserProvidedService(org, space, name, credentials, route, syslog string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("update-user-provided-service", org, space, name) {
+		return nil
+	}
+	_, svc, err := f.service(org, space, name)
+	if err != nil {
+		return err
+	}
+	if !svc.UserProvided {
+		return fmt.Errorf("service instance %s is not user-provided", name)
+	}
+	if credentials != "" {
+		svc.Credentials = credentials
+	}
+	if route != "" {
+		svc.RouteService = route
+	}
+	if syslog != "" {
+		svc.SyslogDrain = syslog
+	}
+	return nil
+}
+
+func (f *FakeBackend) CreateServiceBroker(name, username, password, url, org, space string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("create-service-broker", name, username, password, url, org, space) {
+		return nil
+	}
+	if _, ok := f.Brokers[name]; ok {
+		return fmt.Errorf("service broker %s already exists", name)
+	}
+	b := &FakeBroker{GUID: f.guid(), Name: name, URL: url, Username: username, Password: password}
+	if space != "" {
+		if _, err := f.space(org, space); err != nil {
+			return err
+		}
+		b.Space = org + "/" + space
+	}
+	f.Brokers[name] = b
+
+	if catalog, ok := f.BrokerCatalogs[name]; ok {
+		if f.Catalog == nil {
+			f.Catalog = map[string][]string{}
+		}
+		for service, plans := range catalog {
+			f.Catalog[service] = plans
+		}
+	}
+	return nil
+}
+
+func (f *FakeBackend) UpdateServiceBroker(name, username, password, url string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("update-service-broker", name, username, password, url) {
+		return nil
+	}
+	b, ok := f.Brokers[name]
+	if !ok {
+		return NotFoundError{Kind: "Service broker", Name: name}
+	}
+	b.Username, b.Password, b.URL = username, password, url
+	return nil
+}
+
+// access returns the plans of a service that access is being changed for,
+// and the org (if any) it is being changed for.
+func (f *FakeBackend) access(service, plan, org string) ([]string, error) {
+	plans := f.plans(service)
+	if plan != "" {
+		if f.Catalog != nil && !contains(plans, plan) {
+			return nil, NotFoundError{Kind: "Service plan", Name: service + "/" + plan}
+		}
+		plans = []string{plan}
+	}
+	if len(plans) == 0 {
+		return nil, NotFoundError{Kind: "Service", Name: service}
+	}
+	if org != "" {
+		if _, err := f.org(org); err != nil {
+			return nil, err
+		}
+	}
+	return plans, nil
+}
+
+func (f *FakeBackend) EnableServiceAccess(service, plan, org string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("enable-service-access", service, plan, org) {
+		return nil
+	}
+	plans, err := f.access(service, plan, org)
+	if err != nil {
+		return err
+	}
+	for _, p := range plans {
+		a, ok := f.Access[service+"/"+p]
+		if !ok {
+			a = &ServicePlanAccess{Plan: p}
+			f.Access[service+"/"+p] = a
+		}
+		if org == "" {
+			a.Public, a.Orgs = true, nil
+		} else if !a.Public && !contains(a.Orgs, org) {
+			a.Orgs = append(a.Orgs, org)
+		}
+	}
+	return nil
+}
+
+func (f *FakeBackend) DisableServiceAccess(service, plan, org string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.recorded("disable-service-access", service, plan, org) {
+		return nil
+	}
+	plans, err := f.access(service, plan, org)
+	if err != nil {
+		return err
+	}
+	for _, p := range plans {
+		a, ok := f.Access[service+"/"+p]
+		if !ok {
+			continue
+		}
+		if org == "" {
+			a.Public, a.Orgs = false, nil
+			continue
+		}
+		if a.Public {
+			return fmt.Errorf("cannot disable access to %s/%s for org %s: it is public", service, p, org)
+		}
+		var l []string
+		for _, o := range a.Orgs {
+			if o != org {
+				l = append(l, o)
+			}
+		}
+		a.Orgs = l
+	}
+	return nil
+}
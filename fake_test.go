@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func notFound(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
+}
+
+// TestFakeFailures checks that the fake foundation refuses what a real
+// one would: changes to things that aren't there, and creating things
+// that already are.
+func TestFakeFailures(t *testing.T) {
+	b := NewFakeBackend()
+	for what, err := range map[string]error{
+		"create-space in a missing org": b.CreateSpace("sys", "prod"),
+		"set-org-role of a missing org": b.SetOrgRole("sys", "admin", "OrgManager"),
+		"start of a missing app":        b.StartApp("sys", "prod", "web"),
+	} {
+		if !notFound(err) {
+			t.Errorf("%s: got %v, want it not to be found", what, err)
+		}
+	}
+	if _, err := b.GetApp("sys", "prod", "web"); !notFound(err) {
+		t.Errorf("reading a missing app: got %v, want it not to be found", err)
+	}
+
+	if err := b.CreateOrg("sys"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CreateSpace("sys", "prod"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CreateOrg("sys"); err == nil {
+		t.Error("created org sys twice")
+	}
+	if err := b.CreateSpace("sys", "prod"); err == nil {
+		t.Error("created space sys/prod twice")
+	}
+	if err := b.SetOrgRole("sys", "jobs", "OrgManager"); !notFound(err) {
+		t.Errorf("granting a role to a missing user: got %v, want them not to be found", err)
+	}
+	if err := b.CreateService("sys", "prod", "db", "postgres", "small", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BindService("sys", "prod", "web", "db"); !notFound(err) {
+		t.Errorf("binding a missing app: got %v, want it not to be found", err)
+	}
+}
+
+// TestFakeRecording checks that a fake backend that is recording (for a
+// plan) only notes the changes it would make, and that one being observed
+// (for a report) makes them, and that forks share the one foundation.
+func TestFakeRecording(t *testing.T) {
+	b := NewFakeBackend()
+	var recorded [][]string
+	b.Record(func(call []string) { recorded = append(recorded, call) })
+	if err := b.CreateOrg("sys"); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Orgs) != 0 || len(b.Calls) != 0 {
+		t.Errorf("recording created orgs %v, and logged calls %v", sortedKeys(b.Orgs), b.Calls)
+	}
+	if len(recorded) != 1 || strings.Join(recorded[0], " ") != "create-org sys" {
+		t.Errorf("got recorded calls %v, want create-org sys", recorded)
+	}
+
+	b.Record(nil)
+	var observed [][]string
+	f := b.Fork().(*FakeBackend)
+	f.Observe(func(call []string) { observed = append(observed, call) })
+	if err := f.CreateOrg("sys"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Orgs["sys"] == nil {
+		t.Error("the org created through a fork is missing from the foundation")
+	}
+	if len(observed) != 1 || len(b.Calls) != 1 || strings.Join(b.Calls[0], " ") != "create-org sys" {
+		t.Errorf("got observed calls %v and logged calls %v, want create-org sys in both", observed, b.Calls)
+	}
+}
+
+// TestFakeApps checks that apps pushed to the fake foundation are routed,
+// and run (or crash, or stay down) as they were set up to.
+func TestFakeApps(t *testing.T) {
+	b := NewFakeBackend()
+	b.Crashing = map[string]bool{"flaky": true}
+	b.Down = map[string]bool{"huge": true}
+	b.CreateOrg("sys")
+	b.CreateSpace("sys", "prod")
+	for _, name := range []string{"web", "flaky", "huge"} {
+		if err := b.PushApp("sys", "prod", &Application{Name: name, Image: "nginx", Instances: 2}, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.StartApp("sys", "prod", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{"web": "running", "flaky": "crashed", "huge": "down"} {
+		a, err := b.GetApp("sys", "prod", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(a.Instances) != 2 || a.Instances[0].State != want {
+			t.Errorf("%s: got instances %v, want 2 %s", name, a.Instances, want)
+		}
+		if len(a.Routes) != 1 || a.Routes[0].Host != name || a.Routes[0].Domain.Name != "apps.example.com" {
+			t.Errorf("%s: got routes %v, want %s.apps.example.com", name, a.Routes, name)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+// DeployEnvPrefix starts the names of the environment variables that we
+// keep on applications ourselves, which are none of the manifest's business.
+const DeployEnvPrefix = "CF_DEPLOY_"
+
+// FingerprintVar is the environment variable an application's fingerprint
+// is kept in, so that the next deployment can tell whether there is
+// anything new to push.
+const FingerprintVar = "CF_DEPLOY_FINGERPRINT"
+
+// fingerprint sums up everything about an application that only pushing it
+// can change, and that can't be read back from Cloud Foundry: its source
+// (the commit its repository is at, or the contents of its local path), its
+// image, its buildpack, and the route its hostname and domain give it.
+// Everything else (instances, memory, disk, environment and bindings) is
+// compared against the application as it is.
+//
+// If the source can't be read (a repository that hasn't been cloned yet,
+// say, or a path that isn't there), the fingerprint is empty, and the
+// application is pushed regardless.
+func (d *Deployer) fingerprint(app *Application) string {
+	var source string
+	switch {
+	case app.Image != "":
+		source = "image " + app.Image
+	case app.Repository != "" || app.Path != "":
+		dir, err := d.appSource(app)
+		if err != nil {
+			return ""
+		}
+		if app.Repository != "" {
+			source, err = commit(dir)
+		} else {
+			source, err = checksum(dir)
+		}
+		if err != nil || source == "" {
+			return ""
+		}
+	default:
+		return ""
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "source: %s\n", source)
+	fmt.Fprintf(h, "buildpack: %s\n", app.Buildpack)
+	if len(app.URLs) == 0 {
+		fmt.Fprintf(h, "route: %s.%s %v\n", app.Hostname, app.Domain, app.NoRoute)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// commit returns the commit a clone of a repository is at.
+func commit(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return "commit " + strings.TrimSpace(string(out)), nil
+}
+
+// checksum sums up the names and contents of every file in a directory
+// (or of a single file, like a jar), leaving out any .git directories.
+func checksum(path string) (string, error) {
+	var files []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, file := range files {
+		rel, _ := filepath.Rel(path, file)
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\n", filepath.ToSlash(rel))
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("checksum %x", h.Sum(nil)), nil
+}
+
+// needsPush says whether an application that is already there has to be
+// pushed again: because its fingerprint has changed, or it has been given
+// a different amount of memory or disk.  Applications with nothing to push
+// (as exported) never are.
+func needsPush(app *Application, live plugin_models.GetAppModel, fp string) bool {
+	if app.Image == "" && app.Repository == "" && app.Path == "" {
+		return false
+	}
+	if fp == "" || fmt.Sprintf("%v", live.EnvironmentVars[FingerprintVar]) != fp {
+		return true
+	}
+	if app.Memory != "" {
+		if n, err := megabytes(app.Memory); err == nil && n != nil && *n != live.Memory {
+			return true
+		}
+	}
+	if app.Disk != "" {
+		if n, err := megabytes(app.Disk); err == nil && n != nil && *n != live.DiskQuota {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const fingerprintManifest = `
+organizations:
+  sys:
+    spaces:
+      prod:
+        apps:
+          - name: web
+            image: nginx:1
+            instances: 1
+            memory: 256M
+          - name: site
+            path: SITE
+`
+
+// TestFingerprint deploys apps again and again, which must only push them
+// when there is something new to push.
+func TestFingerprint(t *testing.T) {
+	site := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(site, "index.html"), []byte("hello\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	manifest := strings.Replace(fingerprintManifest, "SITE", site, 1)
+	b := NewFakeBackend()
+	pushes := func(name string) int {
+		return b.Orgs["sys"].Spaces["prod"].Apps[name].Pushes
+	}
+
+	deploy(t, parse(t, manifest), b)
+	deploy(t, parse(t, manifest), b)
+	if pushes("web") != 1 || pushes("site") != 1 {
+		t.Fatalf("got web pushed %d times and site %d, want once each", pushes("web"), pushes("site"))
+	}
+
+	for _, c := range []struct {
+		what, from, to string
+		pushed         bool
+	}{
+		{"scaling", "instances: 1", "instances: 3", false},
+		{"adding an environment variable", "memory: 256M", "memory: 256M\n            env: {A: b}", false},
+		{"giving it more memory", "memory: 256M", "memory: 512M", true},
+		{"changing its image", "nginx:1", "nginx:2", true},
+		{"giving it a buildpack", "nginx:1", "nginx:1\n            buildpack: go_buildpack", true},
+	} {
+		before := pushes("web")
+		deploy(t, parse(t, strings.Replace(manifest, c.from, c.to, 1)), b)
+		if pushed := pushes("web") > before; pushed != c.pushed {
+			t.Errorf("%s: got web pushed %v, want %v", c.what, pushed, c.pushed)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(site, ".git"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(site, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	deploy(t, parse(t, manifest), b)
+	if pushes("site") != 1 {
+		t.Error("site was pushed again for a change to its .git directory")
+	}
+	if err := ioutil.WriteFile(filepath.Join(site, "index.html"), []byte("hello again\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	deploy(t, parse(t, manifest), b)
+	if pushes("site") != 2 {
+		t.Error("site was not pushed again when its contents changed")
+	}
+}
+
+// TestFingerprintCrash checks that an app that crashes keeps the
+// fingerprint of its last good deployment, so that it is pushed again.
+func TestFingerprintCrash(t *testing.T) {
+	b := NewFakeBackend()
+	deploy(t, parse(t, healthManifest), b)
+	web := b.Orgs["sys"].Spaces["prod"].Apps["web"]
+	good := web.Env[FingerprintVar]
+
+	manifest := strings.Replace(healthManifest, "image: nginx", "image: httpd", 1)
+	b.Crashing = map[string]bool{"web": true}
+	d := &Deployer{manifest: parse(t, manifest), backend: b, report: &Plan{}}
+	if err := d.Deploy(); err == nil {
+		t.Fatal("a crashing app deployed")
+	}
+	if web.Env[FingerprintVar] != good {
+		t.Error("the crashed app got a new fingerprint")
+	}
+
+	b.Crashing = nil
+	deploy(t, parse(t, manifest), b)
+	if web.Pushes != 3 {
+		t.Errorf("got the app pushed %d times, want it pushed again after crashing", web.Pushes)
+	}
+	if web.Env[FingerprintVar] == good {
+		t.Error("the fixed app kept its old fingerprint")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A step is a single unit of work in a deployment: deploying (or pruning)
+// one resource, once the steps it needs have succeeded, and the steps it
+// merely has to come after have run.  It is run with a fork of the
+// Deployer of its own.
+type step struct {
+	kind  string
+	path  string
+	needs []string
+	after []string
+	run   func(d *Deployer) error
+
+	/* set once the step has failed, or been skipped because a step it
+	   needs did; cause names the step that failed in the first place. */
+	failed bool
+	cause  string
+
+	/* what the step did (or would do), for the plan or report */
+	actions []*Action
+}
+
+func (s *step) id() string {
+	return s.kind + ":" + s.path
+}
+
+func (s *step) String() string {
+	return fmt.Sprintf("%s '%s'", s.kind, s.path)
+}
+
+// A graph holds the steps of a deployment and the dependencies between
+// them.  Steps are added in a stable order (manifest lists in order, and
+// maps by sorted key), which is used to break ties between steps that are
+// ready to run at the same time, so that every deployment of the same
+// manifest runs its steps in the same order.
+type graph struct {
+	steps []*step
+	index map[string]*step
+}
+
+func newGraph() *graph {
+	return &graph{index: map[string]*step{}}
+}
+
+// add adds a step to the graph, unless it is already there.  The steps it
+// needs may be added later on; they are looked for once the graph is
+// complete.
+func (g *graph) add(kind, path string, run func(d *Deployer) error, needs ...string) *step {
+	s := &step{kind: kind, path: path, run: run, needs: needs}
+	if existing, ok := g.index[s.id()]; ok {
+		return existing
+	}
+	g.index[s.id()] = s
+	g.steps = append(g.steps, s)
+	return s
+}
+
+// resolve checks that every step that the steps of the graph need is in
+// it.  Whatever the manifest only refers to (a quota or a security group
+// that already exists, say) is not something to depend on.
+func (g *graph) resolve() error {
+	for _, s := range g.steps {
+		for _, id := range s.needs {
+			if _, ok := g.index[id]; !ok {
+				return fmt.Errorf("%s needs %s, which is not part of the deployment", s, strings.Replace(id, ":", " '", 1)+"'")
+			}
+		}
+	}
+	return nil
+}
+
+// since returns the ids of every step added after the first n.
+func (g *graph) since(n int) []string {
+	var l []string
+	for _, s := range g.steps[n:] {
+		l = append(l, s.id())
+	}
+	return l
+}
+
+// A schedule keeps track of which steps of a graph are ready to run: those
+// that everything they need or are to run after has finished for.  Of the
+// steps that are ready at any point, the one added to the graph first goes
+// next.
+type schedule struct {
+	g          *graph
+	seq        map[string]int
+	waiting    map[string]int
+	dependents map[string][]string
+	ready      []int
+}
+
+func (g *graph) schedule() *schedule {
+	q := &schedule{
+		g:          g,
+		seq:        map[string]int{},
+		waiting:    map[string]int{},
+		dependents: map[string][]string{},
+	}
+	for i, s := range g.steps {
+		q.seq[s.id()] = i
+	}
+	for _, s := range g.steps {
+		for _, id := range append(append([]string{}, s.needs...), s.after...) {
+			if id == s.id() {
+				continue
+			}
+			q.waiting[s.id()]++
+			q.dependents[id] = append(q.dependents[id], s.id())
+		}
+	}
+	for i, s := range g.steps {
+		if q.waiting[s.id()] == 0 {
+			q.ready = append(q.ready, i)
+		}
+	}
+	return q
+}
+
+// next returns the next step that is ready to run, if there is one.
+func (q *schedule) next() *step {
+	if len(q.ready) == 0 {
+		return nil
+	}
+	sort.Ints(q.ready)
+	s := q.g.steps[q.ready[0]]
+	q.ready = q.ready[1:]
+	return s
+}
+
+// done notes that a step has finished, so that whatever was waiting for
+// it may be ready to go.
+func (q *schedule) done(s *step) {
+	for _, id := range q.dependents[s.id()] {
+		q.waiting[id]--
+		if q.waiting[id] == 0 {
+			q.ready = append(q.ready, q.seq[id])
+		}
+	}
+}
+
+// order returns the steps in a topological order: each one comes after
+// everything it needs or is to run after.  This is the order they run in,
+// one at a time.
+func (g *graph) order() ([]*step, error) {
+	if err := g.resolve(); err != nil {
+		return nil, err
+	}
+	q := g.schedule()
+	l := make([]*step, 0, len(g.steps))
+	for s := q.next(); s != nil; s = q.next() {
+		l = append(l, s)
+		q.done(s)
+	}
+
+	if len(l) != len(g.steps) {
+		var stuck []string
+		for _, s := range g.steps {
+			if q.waiting[s.id()] > 0 {
+				stuck = append(stuck, s.String())
+			}
+		}
+		return nil, fmt.Errorf("dependency cycle between %s", strings.Join(stuck, ", "))
+	}
+	return l, nil
+}
+
+// blocked returns the step that failed in the first place, if any of the
+// steps this one needs failed (or were skipped.)
+func (g *graph) blocked(s *step) string {
+	for _, id := range s.needs {
+		if n := g.index[id]; n.failed {
+			return n.cause
+		}
+	}
+	return ""
+}
+
+// execute runs the steps of the graph, as many at once as we were asked
+// to, each on a fork of the deployer.  When a step fails, no more are
+// started (though those already running are waited for), unless we are
+// keeping going, in which case every step that needs it is skipped, and
+// everything else carries on.
+//
+// However the steps happened to interleave, the actions they took are
+// logged in the order they would have run in one at a time.
+func (d *Deployer) execute(g *graph) error {
+	order, err := g.order()
+	if err != nil {
+		return err
+	}
+
+	workers := d.parallel
+	if workers < 1 {
+		workers = 1
+	}
+
+	type result struct {
+		step *step
+		fork *Deployer
+		err  error
+	}
+	results := make(chan result)
+
+	q := g.schedule()
+	running := 0
+	var failed error
+	for {
+		for failed == nil && running < workers {
+			s := q.next()
+			if s == nil {
+				break
+			}
+			if cause := g.blocked(s); cause != "" {
+				s.failed, s.cause = true, cause
+				d.skip(s.kind, s.path, cause)
+				q.done(s)
+				continue
+			}
+
+			running++
+			go func(s *step, f *Deployer) {
+				err := redactions.Error(s.run(f))
+				if log := f.log(); log != nil {
+					if err != nil {
+						log.fail(err)
+					}
+					log.finish()
+				}
+				results <- result{step: s, fork: f, err: err}
+			}(s, d.fork(s))
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		if log := r.fork.log(); log != nil {
+			r.step.actions = log.Actions
+			d.log().Actions = append(d.log().Actions, log.Actions...)
+		}
+		if r.err != nil {
+			r.step.failed, r.step.cause = true, r.step.String()
+			if err := d.check(r.step.kind, r.step.path, r.err); err != nil && failed == nil {
+				failed = err
+			}
+		}
+		q.done(r.step)
+	}
+
+	if log := d.log(); log != nil {
+		log.Actions = nil
+		for _, s := range order {
+			log.Actions = append(log.Actions, s.actions...)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ids(steps []*step) string {
+	var l []string
+	for _, s := range steps {
+		l = append(l, s.id())
+	}
+	return strings.Join(l, " ")
+}
+
+func TestGraphOrder(t *testing.T) {
+	g := newGraph()
+	g.add("app", "sys/prod/web", nil, "space:sys/prod", "service:sys/prod/shared-db")
+	g.add("org", "sys", nil)
+	g.add("service", "sys/prod/shared-db", nil, "space:sys/prod")
+	g.add("space", "sys/prod", nil, "org:sys")
+	g.add("org", "sys", nil, "app:sys/prod/web")
+	g.add("quota", "small", nil)
+
+	order, err := g.order()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "org:sys space:sys/prod service:sys/prod/shared-db app:sys/prod/web quota:small"
+	if have := ids(order); have != want {
+		t.Errorf("got order %s, want %s", have, want)
+	}
+}
+
+func TestGraphUnknownNeeds(t *testing.T) {
+	g := newGraph()
+	g.add("org", "sys", nil)
+	g.add("org-quota-assignment", "sys", nil, "org:sys", "quota:small")
+	_, err := g.order()
+	if err == nil || !strings.Contains(err.Error(), "quota 'small'") {
+		t.Errorf("got %v, want an error about the missing quota", err)
+	}
+}
+
+func TestGraphCycle(t *testing.T) {
+	g := newGraph()
+	g.add("org", "sys", nil)
+	g.add("space", "sys/prod", nil, "app:sys/prod/web")
+	g.add("app", "sys/prod/web", nil, "space:sys/prod")
+	_, err := g.order()
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("got %v, want a dependency cycle", err)
+	}
+}
+
+// TestDeployPreexisting deploys a manifest that refers to a quota, a
+// security group and a domain it leaves to exist already.
+func TestDeployPreexisting(t *testing.T) {
+	m, err := ParseManifest(strings.NewReader(`
+organizations:
+  sys:
+    quota: default
+    spaces:
+      prod:
+        security_group_sets:
+          running: [public_networks]
+        apps:
+          - name: web
+            domain: apps.example.com
+            image: nginx
+`), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewFakeBackend()
+	b.SharedDomains = append(b.SharedDomains, "apps.example.com")
+	b.Quotas["default"] = &Quota{}
+	b.SecurityGroups["public_networks"] = &FakeSecurityGroup{GUID: "sg-1"}
+	d := &Deployer{manifest: &m, backend: b, report: &Plan{}}
+	if err := d.Deploy(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Orgs["sys"] == nil || b.Orgs["sys"].Quota != "default" {
+		t.Errorf("got org %v, want it with the default quota", b.Orgs["sys"])
+	}
+	if sgs := b.Orgs["sys"].Spaces["prod"].SecurityGroups["public_networks"]; !contains(sgs, "running") {
+		t.Errorf("got public_networks bound for %v, want it for running", sgs)
+	}
+}
+
+const parallelManifest = `
+quotas:
+  small:
+    memory: {total: 10G}
+organizations:
+  sys:
+    quota: small
+    spaces:
+      prod:
+        services:
+          db: postgres/small
+        apps:
+          - name: web
+            image: nginx
+            shared: [db]
+          - name: worker
+            image: busybox
+            shared: [db]
+      dev:
+        apps:
+          - name: web
+            image: nginx
+  apps:
+    spaces:
+      prod:
+        apps:
+          - name: api
+            image: httpd
+            instances: 2
+`
+
+// actions lists the actions of a plan (or report), one per line.
+func actions(p *Plan) string {
+	var l []string
+	for _, a := range p.Actions {
+		l = append(l, a.Op+" "+a.Kind+" "+a.Path)
+	}
+	return strings.Join(l, "\n")
+}
+
+// TestParallel deploys (and plans) a manifest a step at a time, and then
+// several steps at a time, which must log the same actions in the same
+// order, and leave the foundation the same.
+func TestParallel(t *testing.T) {
+	m := parse(t, parallelManifest)
+	run := func(parallel int, planning bool) (*Plan, *FakeBackend) {
+		b := NewFakeBackend()
+		d := &Deployer{manifest: m, backend: b, parallel: parallel, healthTimeout: time.Second}
+		if planning {
+			d.plan = &Plan{}
+			b.Record(d.plan.record)
+		} else {
+			d.report = &Plan{}
+		}
+		if err := d.Deploy(); err != nil {
+			t.Fatalf("deploying %d at a time: %s", parallel, err)
+		}
+		return d.log(), b
+	}
+
+	for _, planning := range []bool{true, false} {
+		want, seq := run(1, planning)
+		for i := 0; i < 5; i++ {
+			have, par := run(4, planning)
+			if actions(have) != actions(want) {
+				t.Fatalf("got actions:\n%s\nwant:\n%s", actions(have), actions(want))
+			}
+			if !reflect.DeepEqual(sortedKeys(par.Orgs), sortedKeys(seq.Orgs)) {
+				t.Errorf("got orgs %v, want %v", sortedKeys(par.Orgs), sortedKeys(seq.Orgs))
+			}
+			if planning {
+				var a, b bytes.Buffer
+				have.Print(&a)
+				want.Print(&b)
+				if a.String() != b.String() {
+					t.Errorf("got plan:\n%s\nwant:\n%s", a.String(), b.String())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Position struct {
+	Line   int
+	Column int
+}
+
+// A Locator knows where in a YAML document each key is defined, so that
+// problems found in the parsed Manifest can be traced back to the source.
+//
+// The YAML library we use doesn't tell us this, so we work it out from
+// the indentation of the block-style YAML that manifests are written in.
+// Paths are lists of mapping keys; a list item is identified by the value
+// of its `name` or `username` key when that is the first key of the item
+// (`- name: app1`), and by its index otherwise.
+type Locator struct {
+	keys map[string]Position
+}
+
+type locatorFrame struct {
+	indent int
+	path   []string
+	item   bool
+	items  int
+}
+
+var yamlKey = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"\[\]{}][^#]*?)\s*:(\s+|$)`)
+
+func locatorKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+func uncomment(s string) string {
+	if strings.HasPrefix(s, "#") {
+		return ""
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		return strings.TrimRight(s[:i], " ")
+	}
+	return s
+}
+
+func NewLocator(src []byte) *Locator {
+	l := &Locator{keys: map[string]Position{}}
+	var stack []*locatorFrame
+	top := func() *locatorFrame {
+		if len(stack) == 0 {
+			return &locatorFrame{indent: -1}
+		}
+		return stack[len(stack)-1]
+	}
+	child := func(parent *locatorFrame, name string) []string {
+		path := make([]string, len(parent.path), len(parent.path)+1)
+		copy(path, parent.path)
+		return append(path, name)
+	}
+
+	block := -1 /* indentation of a key whose value is a block scalar */
+	for n, line := range strings.Split(string(src), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		indent := len(line) - len(trimmed)
+		content := uncomment(strings.TrimRight(trimmed, " \t\r"))
+
+		if block >= 0 {
+			if content == "" || indent > block {
+				continue
+			}
+			block = -1
+		}
+		if content == "" || content == "---" || content == "..." {
+			continue
+		}
+
+		/* peel off any `- ` list item markers */
+		for content == "-" || strings.HasPrefix(content, "- ") {
+			for len(stack) > 0 && top().indent > indent {
+				stack = stack[:len(stack)-1]
+			}
+			if top().item && top().indent == indent {
+				stack = stack[:len(stack)-1]
+			}
+			parent := top()
+
+			rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+			name := ""
+			if m := yamlKey.FindStringSubmatch(rest); m != nil {
+				k := unquote(m[1])
+				if k == "name" || k == "username" {
+					name = unquote(strings.TrimSpace(rest[len(m[0]):]))
+				}
+			}
+			if name == "" || l.has(child(parent, name)) {
+				name = strconv.Itoa(parent.items)
+			}
+			parent.items++
+
+			path := child(parent, name)
+			l.keys[locatorKey(path)] = Position{Line: n + 1, Column: indent + 1}
+			stack = append(stack, &locatorFrame{indent: indent, path: path, item: true})
+
+			indent += len(content) - len(rest)
+			content = rest
+		}
+		if content == "" {
+			continue
+		}
+
+		m := yamlKey.FindStringSubmatch(content)
+		if m == nil {
+			continue
+		}
+		for len(stack) > 0 && top().indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		/* the last definition of a duplicated key is the one that counts */
+		path := child(top(), unquote(m[1]))
+		l.keys[locatorKey(path)] = Position{Line: n + 1, Column: indent + 1}
+		stack = append(stack, &locatorFrame{indent: indent, path: path})
+
+		value := strings.TrimSpace(content[len(m[0]):])
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			block = indent
+		}
+	}
+	return l
+}
+
+func (l *Locator) has(path []string) bool {
+	_, ok := l.keys[locatorKey(path)]
+	return ok
+}
+
+// Locate returns the position of the given path in the document, or of
+// its closest ancestor that can be found.  The boolean is false if none
+// of the path could be found.
+func (l *Locator) Locate(path []string) (Position, bool) {
+	for n := len(path); n > 0; n-- {
+		if p, ok := l.keys[locatorKey(path[:n])]; ok {
+			return p, true
+		}
+	}
+	return Position{}, false
+}
@@ -1,31 +1,359 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cloudfoundry/cli/plugin"
+	"gopkg.in/yaml.v2"
 )
 
 type Plugin struct{}
 
+type Options struct {
+	Plan      bool
+	Validate  bool
+	Export    bool
+	Drift     bool
+	KeepGoing bool
+	Parallel  int
+	Health    time.Duration
+	Services  time.Duration
+	Retry     *RetryPolicy
+	Vars      *Vars
+	Secrets   string
+	Encrypt   bool
+	Prune     Prune
+	Backend   string
+	Format    string
+	Files     []string
+}
+
+func parseOptions(args []string) (Options, error) {
+	opts := Options{
+		Prune: Prune{},
+		Retry: DefaultRetryPolicy(),
+		Vars:  NewVars(),
+	}
+
+	fs := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.BoolVar(&opts.Plan, "plan", false, "")
+	fs.BoolVar(&opts.Validate, "validate", false, "")
+	fs.BoolVar(&opts.Export, "export", false, "")
+	fs.BoolVar(&opts.Drift, "check-drift", false, "")
+	fs.BoolVar(&opts.KeepGoing, "keep-going", false, "")
+	fs.IntVar(&opts.Parallel, "parallel", 1, "")
+	fs.DurationVar(&opts.Health, "health-timeout", DefaultHealthTimeout, "")
+	fs.DurationVar(&opts.Services, "service-timeout", DefaultServiceTimeout, "")
+	fs.Var(opts.Retry, "retry", "")
+	fs.Var(opts.Vars, "var", "")
+	fs.Var(&varsFile{vars: opts.Vars}, "vars-file", "")
+	fs.StringVar(&opts.Secrets, "secrets", "env", "")
+	fs.BoolVar(&opts.Encrypt, "encrypt-secrets", false, "")
+	fs.Var(opts.Prune, "prune", "")
+	fs.StringVar(&opts.Backend, "backend", "cli", "")
+	fs.StringVar(&opts.Format, "format", "text", "")
+
+	/* manifest files and flags can be given in any order */
+	for {
+		if err := fs.Parse(args); err != nil {
+			return opts, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		opts.Files = append(opts.Files, args[0])
+		args = args[1:]
+	}
+
+	if opts.Backend != "cli" && opts.Backend != "api" {
+		return opts, fmt.Errorf("unknown backend '%s' (expected cli or api)", opts.Backend)
+	}
+	if opts.Parallel < 1 {
+		return opts, fmt.Errorf("--parallel must be at least 1")
+	}
+	if opts.Health <= 0 {
+		return opts, fmt.Errorf("--health-timeout must be more than zero")
+	}
+	if opts.Services <= 0 {
+		return opts, fmt.Errorf("--service-timeout must be more than zero")
+	}
+	if opts.Parallel > 1 && opts.Backend != "api" {
+		return opts, fmt.Errorf("--parallel needs --backend api, since the cf CLI can only target one org and space at a time")
+	}
+	if opts.Format != "text" && opts.Format != "json" && opts.Format != "yaml" {
+		return opts, fmt.Errorf("unknown format '%s' (expected text, json or yaml)", opts.Format)
+	}
+	if opts.Validate && opts.Format != "text" {
+		return opts, fmt.Errorf("--format cannot be used with --validate")
+	}
+	if opts.Drift && (opts.Plan || opts.Validate || opts.Export || opts.Format != "text") {
+		return opts, fmt.Errorf("--check-drift cannot be used with --plan, --validate, --export or --format")
+	}
+	if opts.Export && (opts.Plan || opts.Validate || opts.Encrypt || opts.Format != "text") {
+		return opts, fmt.Errorf("--export cannot be used with --plan, --validate, --encrypt-secrets or --format")
+	}
+	if opts.Export {
+		/* the arguments are orgs to export, not manifests */
+		return opts, nil
+	}
+	if opts.Encrypt && (opts.Plan || opts.Validate || len(opts.Files) > 1) {
+		return opts, fmt.Errorf("--encrypt-secrets takes a single file of secrets, and nothing else")
+	}
+	if len(opts.Files) == 0 {
+		opts.Files = []string{"-"}
+	}
+	return opts, nil
+}
+
+func describeFiles(files []string) string {
+	l := make([]string, len(files))
+	for i, f := range files {
+		if f == "-" {
+			l[i] = "standard input"
+		} else {
+			l[i] = f
+		}
+	}
+	return strings.Join(l, ", ")
+}
+
+// validate checks the manifest files, printing every problem found with
+// its location, and returns false if any of them were errors.
+func validate(files []string, vars *Vars) bool {
+	srcs, err := ReadSources(files)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return false
+	}
+	b, err := MergeSources(srcs)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return false
+	}
+	b, err = vars.Interpolate(b)
+	if err != nil {
+		fmt.Printf("%s: %s\n", describeFiles(files), err)
+		return false
+	}
+	m, err := decodeManifest(b)
+	if err != nil {
+		fmt.Printf("%s: %s\n", describeFiles(files), err)
+		return false
+	}
+
+	errors := 0
+	var problems []Problem
+	locs := make([]*Locator, len(srcs))
+	for i, src := range srcs {
+		locs[i] = NewLocator(src.Data)
+		l, err := StrictProblems(src, locs[i])
+		if err != nil {
+			fmt.Printf("%s: %s\n", sourceName(src.Name), err)
+			return false
+		}
+		for _, p := range l {
+			fmt.Printf("%s: %s\n", p.Where(srcs[i:i+1], locs[i:i+1]), p)
+			errors++
+		}
+		problems = append(problems, l...)
+	}
+
+	for _, p := range ValidateManifest(&m) {
+		problems = append(problems, p)
+		fmt.Printf("%s: %s\n", p.Where(srcs, locs), p)
+		if !p.Warning {
+			errors++
+		}
+	}
+
+	if errors > 0 {
+		fmt.Printf("\n%d error(s), %d warning(s)\n", errors, len(problems)-errors)
+		return false
+	}
+	fmt.Printf("%s is valid (%d warning(s))\n", describeFiles(files), len(problems))
+	return true
+}
+
+// encryptSecrets encrypts a YAML file of secrets (see SecretsFile) with
+// the passphrase in $CF_DEPLOY_SECRETS_PASSPHRASE, printing the result.
+func encryptSecrets(file string) error {
+	var b []byte
+	var err error
+	if file == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	b, err = EncryptSecrets(b, os.Getenv("CF_DEPLOY_SECRETS_PASSPHRASE"))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// newBackend sets up the backend asked for, retrying as asked.
+func newBackend(c plugin.CliConnection, opts Options) (Backend, error) {
+	var backend Backend = NewCLIBackend(c)
+	if opts.Backend == "api" {
+		var err error
+		if backend, err = NewAPIBackendFromCLI(c); err != nil {
+			return nil, err
+		}
+	}
+	return NewRetryBackend(backend, opts.Retry), nil
+}
+
+// export writes the given orgs (or all of them) out as a manifest, and
+// anything that could not be exported as it is, as warnings.
+func export(b Backend, orgs []string) error {
+	m, warnings, err := Export(b, orgs)
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("---\n%s", out)
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	return nil
+}
+
 func (p Plugin) Run(c plugin.CliConnection, args []string) {
-	m, err := ParseManifest(os.Stdin)
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	opts, err := parseOptions(args)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+
+	if opts.Encrypt {
+		if err := encryptSecrets(opts.Files[0]); err != nil {
+			fmt.Printf("Failed to encrypt %s: %s\n", describeFiles(opts.Files), err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	secrets, err := NewSecretProvider(opts.Secrets)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+	opts.Vars.UseSecrets(secrets)
+
+	if opts.Validate {
+		if !validate(opts.Files, opts.Vars) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.Export {
+		backend, err := newBackend(c, opts)
+		if err != nil {
+			fmt.Printf("Failed to connect to the Cloud Controller: %s\n", err)
+			os.Exit(1)
+		}
+		if err := export(backend, opts.Files); err != nil {
+			fmt.Printf("Export failed: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	m, err := LoadManifests(opts.Files, opts.Vars)
+	if err != nil {
+		fmt.Printf("Failed to parse manifest from %s: %s\n", describeFiles(opts.Files), err)
+		os.Exit(1)
+	}
+
+	backend, err := newBackend(c, opts)
 	if err != nil {
-		fmt.Printf("Failed to parse manifest from standard input: %s\n", err)
+		fmt.Printf("Failed to connect to the Cloud Controller: %s\n", err)
 		os.Exit(1)
 	}
 
+	if opts.Drift {
+		drifts, err := (&Deployer{manifest: &m, backend: backend, prune: opts.Prune}).Drift()
+		if err != nil {
+			fmt.Printf("Drift check failed: %s\n", redactions.Error(err))
+			os.Exit(1)
+		}
+		PrintDrift(os.Stdout, drifts)
+		if len(drifts) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	d := &Deployer{
-		manifest: &m,
-		cf:       c,
+		manifest:       &m,
+		backend:        backend,
+		prune:          opts.Prune,
+		keepGoing:      opts.KeepGoing,
+		parallel:       opts.Parallel,
+		healthTimeout:  opts.Health,
+		serviceTimeout: opts.Services,
 	}
-	if err := d.Deploy(); err != nil {
-		fmt.Printf("Deployment failed: %s\n", err)
+	if opts.Plan {
+		d.plan = &Plan{}
+		backend.Record(d.plan.record)
+	} else if opts.Format != "text" {
+		d.report = &Plan{}
+		backend.Observe(d.report.record)
+	}
+
+	started := time.Now()
+	err = d.Deploy()
+	if opts.Format != "text" {
+		actions := d.report
+		if opts.Plan {
+			actions = d.plan
+		}
+		if err := NewReport(actions, d.failures, opts.Plan, started, err).Write(os.Stdout, opts.Format); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write the report: %s\n", err)
+			os.Exit(1)
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if opts.Plan && opts.KeepGoing {
+		d.plan.Print(os.Stdout)
+	}
+	if len(d.failures) > 0 {
+		PrintFailures(os.Stdout, d.failures)
+	}
+	if err != nil {
+		if opts.Plan {
+			fmt.Printf("Planning failed: %s\n", err)
+		} else {
+			fmt.Printf("Deployment failed: %s\n", err)
+		}
 		os.Exit(1)
 	}
+
+	if opts.Plan && !opts.KeepGoing {
+		d.plan.Print(os.Stdout)
+	}
 }
 
 var Version string
@@ -71,6 +399,27 @@ func (Plugin) GetMetadata() plugin.PluginMetadata {
 			{
 				Name:     "deploy",
 				HelpText: "Deploys all the things, including orgs, spaces, domains, users, services and applications",
+				UsageDetails: plugin.Usage{
+					Usage: "cf deploy [--plan | --validate | --check-drift] [--keep-going] [--prune[=TYPE,...]] [--backend cli|api] [--parallel N] [--health-timeout DURATION] [--service-timeout DURATION] [--retry [OP=]N,...] [--var NAME=VALUE ...] [--vars-file FILE ...] [--secrets env|file:PATH|vault:URL|credhub:URL] [--format text|json|yaml] [MANIFEST ...]\n   cf deploy --export [--backend cli|api] [ORG ...]\n   cf deploy --encrypt-secrets [SECRETS]",
+					Options: map[string]string{
+						"validate":        "Check the manifest for problems, without deploying it",
+						"export":          "Print a manifest of the given organizations (or all of them) as they are now, to start deploying an existing foundation from",
+						"check-drift":     "Compare the manifest against the foundation, without changing anything, and exit non-zero if they differ",
+						"plan":            "Print the changes the deployment would make, without making them",
+						"keep-going":      "Carry on past resources that fail to deploy, skipping only what depends on them, and summarize the failures at the end",
+						"prune":           "Remove resources not in the manifest (" + strings.Join(pruneTypes, ", ") + ", or, only by name, " + strings.Join(optInPruneTypes, ", ") + ")",
+						"backend":         "Make changes by running cf commands (cli, the default), or through the Cloud Controller v3 API (api)",
+						"parallel":        "Deploy up to N independent resources at once (needs --backend api)",
+						"health-timeout":  "How long to wait for every instance of an application to be running after starting it, before giving up on it (5m by default)",
+						"service-timeout": "How long to wait for a service broker to create or update a service instance, before giving up on it (30m by default)",
+						"retry":           "Retry operations that fail for transient reasons N times (3 by default, 5 for push, start and restage, and never for create-user), or OP (e.g. push) N times",
+						"var":             "Set the value of a ((NAME)) placeholder in the manifest",
+						"vars-file":       "Set the values of ((NAME)) placeholders in the manifest from a YAML file",
+						"secrets":         "Look up ((secret:PATH)) placeholders in environment variables (env, the default), a file encrypted with --encrypt-secrets, Vault or CredHub",
+						"encrypt-secrets": "Encrypt a YAML file of secrets for --secrets file:PATH, with the passphrase in $CF_DEPLOY_SECRETS_PASSPHRASE",
+						"format":          "Print a report of every resource deployed (or planned), as json or yaml, instead of progress messages",
+					},
+				},
 			},
 		},
 	}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"path"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -33,103 +34,227 @@ func (u URL) String() string {
 }
 
 type User struct {
-	Name     string `yaml:"username"`
-	Password string `yaml:"password"`
+	Name     string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
 }
 
 type Organization struct {
-	Users             map[string][]string `yaml:"users"`
-	Domains           []string            `yaml:"domains"`
-	Environment       map[string]string   `yaml:"env"`
-	Spaces            map[string]*Space   `yaml:"spaces"`
-	Quota             string              `yaml:"quota"`
-	Quotas            map[string]*Quota   `yaml:"quotas"`
-	SecurityGroupSets *SecurityGroupSet   `yaml:"security_group_sets"`
+	Users             map[string][]string `yaml:"users,omitempty"`
+	Domains           []string            `yaml:"domains,omitempty"`
+	Environment       map[string]string   `yaml:"env,omitempty"`
+	Spaces            map[string]*Space   `yaml:"spaces,omitempty"`
+	Quota             string              `yaml:"quota,omitempty"`
+	Quotas            map[string]*Quota   `yaml:"quotas,omitempty"`
+	SecurityGroupSets *SecurityGroupSet   `yaml:"security_group_sets,omitempty"`
 }
 
 type Space struct {
-	SSH                  string                 `yaml:"ssh"`
-	Domain               string                 `yaml:"domain"`
-	Users                map[string][]string    `yaml:"users"`
-	Environment          map[string]string      `yaml:"env"`
-	SharedServices       map[string]string      `yaml:"services"`
-	Quota                string                 `yaml:"quota"`
-	Applications         []*Application         `yaml:"apps"`
-	UserProvidedServices []*UserProvidedService `yaml:"user-provided-services"`
-	SecurityGroupSets    *SecurityGroupSet      `yaml:"security_group_sets"`
+	SSH                  string                       `yaml:"ssh,omitempty"`
+	Domain               string                       `yaml:"domain,omitempty"`
+	Users                map[string][]string          `yaml:"users,omitempty"`
+	Environment          map[string]string            `yaml:"env,omitempty"`
+	SharedServices       map[string]ServiceDefinition `yaml:"services,omitempty"`
+	Quota                string                       `yaml:"quota,omitempty"`
+	Applications         []*Application               `yaml:"apps,omitempty"`
+	UserProvidedServices []*UserProvidedService       `yaml:"user-provided-services,omitempty"`
+	SecurityGroupSets    *SecurityGroupSet            `yaml:"security_group_sets,omitempty"`
 }
 
 type Application struct {
-	Name     string   `yaml:"name"`
-	Hostname string   `yaml:"hostname"`
-	Domain   string   `yaml:"domain"`
-	URLs     []string `yaml:"urls"`
+	Name     string   `yaml:"name,omitempty"`
+	Hostname string   `yaml:"hostname,omitempty"`
+	Domain   string   `yaml:"domain,omitempty"`
+	URLs     []string `yaml:"urls,omitempty"`
+	NoRoute  bool     `yaml:"no-route,omitempty"`
 
-	Repository string `yaml:"repo"`
-	Path       string `yaml:"path"`
-	Image      string `yaml:"image"`
-	Buildpack  string `yaml:"buildpack"`
+	Repository string `yaml:"repo,omitempty"`
+	Path       string `yaml:"path,omitempty"`
+	Image      string `yaml:"image,omitempty"`
+	Buildpack  string `yaml:"buildpack,omitempty"`
 
-	Memory      string            `yaml:"memory"`
-	Disk        string            `yaml:"disk"`
-	Instances   int               `yaml:"instances"`
-	Environment map[string]string `yaml:"env"`
+	Memory      string            `yaml:"memory,omitempty"`
+	Disk        string            `yaml:"disk,omitempty"`
+	Instances   int               `yaml:"instances,omitempty"`
+	Environment map[string]string `yaml:"env,omitempty"`
 
-	BoundServices  map[string]string `yaml:"bind"`
-	SharedServices []string          `yaml:"shared"`
+	BoundServices  map[string]ServiceDefinition `yaml:"bind,omitempty"`
+	SharedServices []string                     `yaml:"shared,omitempty"`
+
+	Strategy string `yaml:"strategy,omitempty"`
+
+	/* the service instances in BoundServices made for this
+	   application's own `bind` list (APP-NAME), as opposed to
+	   the shared ones its space makes */
+	scoped map[string]bool
 }
 
+// How an application that is already running is redeployed: by pushing
+// over it and restarting it (the default), or by pushing a new copy of it
+// alongside, and moving its routes over once that is up.
+const (
+	StrategyRestart   = "restart"
+	StrategyBlueGreen = "blue-green"
+)
+
 type Quota struct {
-	Memory                map[string]string `yaml:"memory"`
-	TotalAppInstances     string            `yaml:"app-instances"`
-	ServiceInstances      string            `yaml:"service-instances"`
-	Routes                string            `yaml:"routes"`
-	PaidPlans             bool              `yaml:"allow-paid-plans"`
-	NumRoutesWithResPorts string            `yaml:"reserve-route-ports"`
+	Memory                map[string]string `yaml:"memory,omitempty"`
+	TotalAppInstances     string            `yaml:"app-instances,omitempty"`
+	ServiceInstances      string            `yaml:"service-instances,omitempty"`
+	Routes                string            `yaml:"routes,omitempty"`
+	PaidPlans             bool              `yaml:"allow-paid-plans,omitempty"`
+	NumRoutesWithResPorts string            `yaml:"reserve-route-ports,omitempty"`
 }
 
 type Manifest struct {
-	Domains           []string                  `yaml:"domains"`
-	Users             []User                    `yaml:"users"`
-	Quotas            map[string]*Quota         `yaml:"quotas"`
-	Organizations     map[string]*Organization  `yaml:"organizations"`
-	SecurityGroups    map[string]*SecurityGroup `yaml:"security_groups"`
-	SecurityGroupSets *SecurityGroupSet         `yaml:"security_group_sets"`
+	Domains           []string                  `yaml:"domains,omitempty"`
+	Users             []User                    `yaml:"users,omitempty"`
+	Quotas            map[string]*Quota         `yaml:"quotas,omitempty"`
+	Organizations     map[string]*Organization  `yaml:"organizations,omitempty"`
+	SecurityGroups    map[string]*SecurityGroup `yaml:"security_groups,omitempty"`
+	SecurityGroupSets *SecurityGroupSet         `yaml:"security_group_sets,omitempty"`
+	ServiceBrokers    []*ServiceBroker          `yaml:"service_brokers,omitempty"`
+	ServiceAccess     []*ServiceAccess          `yaml:"service_access,omitempty"`
+
+	/* environment variables (or patterns, like `NEWRELIC_*`) that are
+	   set on applications by something else, and never unset */
+	ExternalEnv []string `yaml:"external_env,omitempty"`
+}
+
+// A ServiceBroker is registered at its url or, if it has none, at the
+// first route of the manifest application (`ORG/SPACE/APP`) that runs it,
+// once that application is up.  A space-scoped broker is registered in
+// the given space (`ORG/SPACE`), or else in its application's space.
+type ServiceBroker struct {
+	Name        string `yaml:"name,omitempty"`
+	URL         string `yaml:"url,omitempty"`
+	App         string `yaml:"app,omitempty"`
+	Username    string `yaml:"username,omitempty"`
+	Password    string `yaml:"password,omitempty"`
+	SpaceScoped bool   `yaml:"space_scoped,omitempty"`
+	Space       string `yaml:"space,omitempty"`
+}
+
+// A ServiceAccess entry enables a plan of a service (or all of them, if
+// no plan is given) for the listed orgs, or for everyone, if none are.
+type ServiceAccess struct {
+	Service string   `yaml:"service,omitempty"`
+	Plan    string   `yaml:"plan,omitempty"`
+	Orgs    []string `yaml:"orgs,omitempty"`
+}
+
+// A ServiceDefinition is what a service instance is made from: a plan of
+// a service, and the parameters (arbitrary JSON, like the credentials of a
+// user-provided service) and tags to give it.  Without parameters or tags,
+// it can be written as just `service/plan`.
+type ServiceDefinition struct {
+	Service    string      `yaml:"service,omitempty"`
+	Plan       string      `yaml:"plan,omitempty"`
+	Parameters interface{} `yaml:"parameters,omitempty"`
+	Tags       []string    `yaml:"tags,omitempty"`
+
+	/* the short form it was written in, if it was */
+	short string
+}
+
+func (s *ServiceDefinition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var short string
+	if err := unmarshal(&short); err == nil {
+		x := strings.SplitN(short, "/", 2)
+		*s = ServiceDefinition{Service: x[0], short: short}
+		if len(x) == 2 {
+			s.Plan = x[1]
+		}
+		return nil
+	}
+	type plain ServiceDefinition
+	return unmarshal((*plain)(s))
+}
+
+func (s ServiceDefinition) MarshalYAML() (interface{}, error) {
+	if s.Parameters == nil && len(s.Tags) == 0 {
+		return s.Service + "/" + s.Plan, nil
+	}
+	type plain ServiceDefinition
+	return plain(s), nil
+}
+
+func (s ServiceDefinition) String() string {
+	if s.short != "" {
+		return s.short
+	}
+	return s.Service + "/" + s.Plan
 }
 
 type UserProvidedService struct {
-	Name            string      `yaml:"name"`
-	Credentials     interface{} `yaml:"credentials"`
-	RouteServiceUrl string      `yaml:"route_service_url"`
-	SyslogDrainUrl  string      `yaml:"syslog_drain_url"`
+	Name            string      `yaml:"name,omitempty"`
+	Credentials     interface{} `yaml:"credentials,omitempty"`
+	RouteServiceUrl string      `yaml:"route_service_url,omitempty"`
+	SyslogDrainUrl  string      `yaml:"syslog_drain_url,omitempty"`
 }
 
 type SecurityGroup struct {
-	Rules             []interface{} `yaml:"rules"`
-	SecurityGroupFile string        `yaml:"security_group_file"`
+	Rules             []interface{} `yaml:"rules,omitempty"`
+	SecurityGroupFile string        `yaml:"security_group_file,omitempty"`
 }
 
 type SecurityGroupSet struct {
-	Running []string `yaml:"running"`
-	Staging []string `yaml:"staging"`
+	Running []string `yaml:"running,omitempty"`
+	Staging []string `yaml:"staging,omitempty"`
 }
 
-func ParseManifest(src io.Reader) (Manifest, error) {
+// ParseManifest parses a manifest, replacing its `((name))` placeholders
+// with the values of the given variables first.
+func ParseManifest(src io.Reader, vars *Vars) (Manifest, error) {
 	var m Manifest
 	b, err := ioutil.ReadAll(src)
 	if err != nil {
 		return m, err
 	}
 
-	err = yaml.Unmarshal(b, &m)
+	b, err = vars.Interpolate(b)
 	if err != nil {
 		return m, err
 	}
 
-	/* resolve out the defaults */
+	m, err = decodeManifest(b)
+	if err != nil {
+		return m, err
+	}
+
+	err = m.resolve()
+	return m, err
+}
+
+func decodeManifest(b []byte) (Manifest, error) {
+	var m Manifest
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return m, err
+	}
+
+	/* `Space1:` (with nothing after it) is an empty space, not a nil one */
+	for o, org := range m.Organizations {
+		if org == nil {
+			org = &Organization{}
+			m.Organizations[o] = org
+		}
+		for s, space := range org.Spaces {
+			if space == nil {
+				org.Spaces[s] = &Space{}
+			}
+		}
+	}
+	redactions.AddManifest(&m)
+	return m, nil
+}
+
+// resolve fills in the defaults that the rest of the manifest implies:
+// instance counts, app domains, service instance names, environment
+// variables inherited from the space and organization, and the URLs (and
+// spaces) of service brokers run by manifest applications.
+func (m *Manifest) resolve() error {
 	for o, org := range m.Organizations {
 		for s, space := range org.Spaces {
-			shared := map[string]string{}
+			shared := map[string]ServiceDefinition{}
 			for svc, details := range space.SharedServices {
 				shared[fmt.Sprintf("%s-%s", "shared", svc)] = details
 			}
@@ -144,7 +269,7 @@ func ParseManifest(src io.Reader) (Manifest, error) {
 				/* if we have a hostname or domain, *and* URLs,
 				   we need to throw an error. */
 				if (app.Domain != "" || app.Hostname != "") && len(app.URLs) > 0 {
-					return m, fmt.Errorf("Both hostname/domain and list of urls specified -- this is not allowed")
+					return fmt.Errorf("Both hostname/domain and list of urls specified -- this is not allowed")
 				}
 
 				/* use the default domain for the space, if present */
@@ -152,15 +277,17 @@ func ParseManifest(src io.Reader) (Manifest, error) {
 					m.Organizations[o].Spaces[s].Applications[a].Domain = space.Domain
 				}
 
-				services := map[string]string{}
+				services := map[string]ServiceDefinition{}
+				app.scoped = map[string]bool{}
 				for svc, details := range app.BoundServices {
 					services[fmt.Sprintf("%s-%s", app.Name, svc)] = details
+					app.scoped[fmt.Sprintf("%s-%s", app.Name, svc)] = true
 				}
 				for _, sv_ := range app.SharedServices {
 					svc := fmt.Sprintf("shared-%s", sv_)
 					bind, ok := space.SharedServices[svc]
 					if !ok {
-						return m, fmt.Errorf("reference to shared service '%s' in %s/%s application %s could not be found",
+						return fmt.Errorf("reference to shared service '%s' in %s/%s application %s could not be found",
 							svc, o, s, app.Name)
 					}
 					services[svc] = bind
@@ -182,5 +309,86 @@ func ParseManifest(src io.Reader) (Manifest, error) {
 		}
 	}
 
-	return m, nil
+	for _, b := range m.ServiceBrokers {
+		if b.App == "" {
+			continue
+		}
+		app := m.app(b.App)
+		if app == nil {
+			return fmt.Errorf("application '%s' of service broker '%s' could not be found", b.App, b.Name)
+		}
+		if b.SpaceScoped && b.Space == "" {
+			b.Space = b.App[:strings.LastIndex(b.App, "/")]
+		}
+		if b.URL == "" {
+			url := URL{Host: app.Hostname, Domain: app.Domain}
+			if len(app.URLs) > 0 {
+				url = ParseURL(app.URLs[0], app.Domain)
+			} else if url.Host == "" {
+				url.Host = app.Name
+			}
+			if url.Domain == "" {
+				return fmt.Errorf("application '%s' of service broker '%s' has no domain to find it at; give the broker a url", b.App, b.Name)
+			}
+			b.URL = "https://" + url.String()
+		}
+	}
+
+	return nil
+}
+
+// externalEnv returns true if an environment variable is managed by
+// something other than the manifest: one that matches an `external_env`
+// pattern, or one of the CF_DEPLOY_* variables we keep ourselves (like the
+// fingerprint.)
+func (m *Manifest) externalEnv(name string) bool {
+	if strings.HasPrefix(name, DeployEnvPrefix) {
+		return true
+	}
+	for _, pattern := range m.ExternalEnv {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// app finds an application in the space, by name.
+func (s *Space) app(name string) *Application {
+	for _, app := range s.Applications {
+		if app.Name == name {
+			return app
+		}
+	}
+	return nil
+}
+
+// space finds the space at `ORG/SPACE` in the manifest.
+func (m *Manifest) space(path string) *Space {
+	p := strings.Split(path, "/")
+	if len(p) != 2 {
+		return nil
+	}
+	if org, ok := m.Organizations[p[0]]; ok {
+		return org.Spaces[p[1]]
+	}
+	return nil
+}
+
+// app finds the application at `ORG/SPACE/APP` in the manifest.
+func (m *Manifest) app(path string) *Application {
+	p := strings.Split(path, "/")
+	if len(p) != 3 {
+		return nil
+	}
+	if org, ok := m.Organizations[p[0]]; ok {
+		if space, ok := org.Spaces[p[1]]; ok && space != nil {
+			for _, app := range space.Applications {
+				if app.Name == p[2] {
+					return app
+				}
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A Source is the raw contents of one of the manifest files.
+type Source struct {
+	Name string
+	Data []byte
+}
+
+// ReadSources reads each of the named manifest files, `-` being standard
+// input.
+func ReadSources(files []string) ([]Source, error) {
+	var l []Source
+	for _, file := range files {
+		var b []byte
+		var err error
+		if file == "-" {
+			b, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			b, err = ioutil.ReadFile(file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, Source{Name: file, Data: b})
+	}
+	return l, nil
+}
+
+// MergeSources deep-merges the YAML documents from each of the sources,
+// in order, and returns the merged document.
+//
+// When merging a later file into an earlier one:
+//
+//   - maps are merged key by key, recursively;
+//   - lists of maps that all have a `name` (or `username`) key are merged
+//     item by item, matching on that key; new items are appended;
+//   - any other list is replaced outright, as is any scalar;
+//   - an explicit null removes the value from the earlier file.
+func MergeSources(srcs []Source) ([]byte, error) {
+	if len(srcs) == 1 {
+		return srcs[0].Data, nil
+	}
+
+	var merged interface{}
+	for _, src := range srcs {
+		var doc interface{}
+		if err := yaml.Unmarshal(src.Data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %s", src.Name, err)
+		}
+		merged = mergeYaml(merged, doc)
+	}
+	return yaml.Marshal(merged)
+}
+
+// LoadManifests reads one or more YAML manifest files, checks each of them
+// for unknown and duplicate keys, merges them together with MergeSources,
+// and parses the result as a single Manifest, with its variables filled in.
+func LoadManifests(files []string, vars *Vars) (Manifest, error) {
+	srcs, err := ReadSources(files)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var bad []string
+	for _, src := range srcs {
+		loc := NewLocator(src.Data)
+		problems, err := StrictProblems(src, loc)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("%s: %s", sourceName(src.Name), err)
+		}
+		for _, p := range problems {
+			bad = append(bad, fmt.Sprintf("  %s: %s", p.Where([]Source{src}, []*Locator{loc}), p.Message))
+		}
+	}
+	if len(bad) > 0 {
+		return Manifest{}, fmt.Errorf("unknown or duplicate keys found:\n%s", strings.Join(bad, "\n"))
+	}
+
+	b, err := MergeSources(srcs)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return ParseManifest(bytes.NewReader(b), vars)
+}
+
+func mergeYaml(a, b interface{}) interface{} {
+	switch bb := b.(type) {
+	case map[interface{}]interface{}:
+		aa, ok := a.(map[interface{}]interface{})
+		if !ok {
+			return b
+		}
+		for k, v := range bb {
+			if v == nil {
+				delete(aa, k)
+				continue
+			}
+			aa[k] = mergeYaml(aa[k], v)
+		}
+		return aa
+
+	case []interface{}:
+		aa, ok := a.([]interface{})
+		if !ok {
+			return b
+		}
+		key := mergeKey(aa, bb)
+		if key == "" {
+			return b
+		}
+		for _, v := range bb {
+			id := v.(map[interface{}]interface{})[key]
+			found := false
+			for i, x := range aa {
+				if x.(map[interface{}]interface{})[key] == id {
+					aa[i] = mergeYaml(x, v)
+					found = true
+					break
+				}
+			}
+			if !found {
+				aa = append(aa, v)
+			}
+		}
+		return aa
+	}
+	return b
+}
+
+// mergeKey returns the key that identifies the items of both lists, if
+// they are lists of maps that can be merged item by item.
+func mergeKey(a, b []interface{}) string {
+	for _, key := range []string{"name", "username"} {
+		ok := true
+		for _, l := range [][]interface{}{a, b} {
+			for _, v := range l {
+				m, isMap := v.(map[interface{}]interface{})
+				if !isMap {
+					ok = false
+					break
+				}
+				if _, has := m[key]; !has {
+					ok = false
+					break
+				}
+			}
+		}
+		if ok {
+			return key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestMergeSources(t *testing.T) {
+	b, err := MergeSources([]Source{
+		{Name: "base.yml", Data: []byte(`
+users:
+  - username: jobs
+    password: one
+organizations:
+  sys:
+    domains: [a.example.com, b.example.com]
+    quota: small
+    spaces:
+      prod:
+        apps:
+          - name: web
+            instances: 1
+            memory: 256M
+          - name: worker
+`)},
+		{Name: "prod.yml", Data: []byte(`
+users:
+  - username: jobs
+    password: two
+  - username: woz
+organizations:
+  sys:
+    domains: [c.example.com]
+    quota: ~
+    spaces:
+      prod:
+        apps:
+          - name: web
+            instances: 4
+          - name: cron
+`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have, want interface{}
+	if err := yaml.Unmarshal(b, &have); err != nil {
+		t.Fatal(err)
+	}
+	yaml.Unmarshal([]byte(`
+users:
+  - username: jobs
+    password: two
+  - username: woz
+organizations:
+  sys:
+    domains: [c.example.com]
+    spaces:
+      prod:
+        apps:
+          - name: web
+            instances: 4
+            memory: 256M
+          - name: worker
+          - name: cron
+`), &want)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("got merged manifest:\n%s", b)
+	}
+
+	if _, err := MergeSources([]Source{{Name: "a.yml", Data: []byte("a: 1")}, {Name: "b.yml", Data: []byte("a: [")}}); err == nil {
+		t.Error("merged a file that isn't YAML")
+	}
+}
+
+// TestLoadManifests loads a manifest from two files, the second of which
+// scales up an app of the first.
+func TestLoadManifests(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yml")
+	prod := filepath.Join(dir, "prod.yml")
+	ioutil.WriteFile(base, []byte(`
+organizations:
+  sys:
+    spaces:
+      prod:
+        apps:
+          - name: web
+            image: nginx
+            instances: 1
+`), 0666)
+	ioutil.WriteFile(prod, []byte(`
+organizations:
+  sys:
+    spaces:
+      prod:
+        apps:
+          - name: web
+            instances: 3
+`), 0666)
+
+	m, err := LoadManifests([]string{base, prod}, NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := m.app("sys/prod/web")
+	if web == nil || web.Image != "nginx" || web.Instances != 3 {
+		t.Errorf("got app %+v, want nginx with 3 instances", web)
+	}
+
+	if _, err := LoadManifests([]string{base, filepath.Join(dir, "missing.yml")}, NewVars()); err == nil {
+		t.Error("loaded a manifest file that doesn't exist")
+	}
+}
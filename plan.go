@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+	OpNoop   = "no-op"
+	OpEnsure = "ensure"
+)
+
+// An Action describes what a deployment would do (or did) to a single
+// resource in the foundation, along with the calls the backend would make
+// (or made) to get there: cf commands, or Cloud Controller API requests.
+// Resources whose current state cannot be queried (shared domains, quota
+// definitions, users, etc.) are planned as `ensure` actions, since their
+// commands are re-issued on every deploy.
+type Action struct {
+	Op       string
+	Kind     string
+	Path     string
+	Commands [][]string
+
+	/* only set when deploying; Detail is what was found out about
+	   the resource (like how many instances of an app are running) */
+	Detail   string
+	Duration time.Duration
+	Error    error
+	started  time.Time
+}
+
+type Plan struct {
+	Actions []*Action
+
+	/* the actions of the steps that had already finished when this
+	   plan was forked off for another one; see creates() */
+	prior []*Action
+}
+
+func (p *Plan) add(op, kind, path string) *Action {
+	p.finish()
+	a := &Action{
+		Op:      op,
+		Kind:    kind,
+		Path:    path,
+		started: time.Now(),
+	}
+	p.Actions = append(p.Actions, a)
+	return a
+}
+
+// finish notes how long the last action took; an action lasts until the
+// next one starts.
+func (p *Plan) finish() {
+	if len(p.Actions) == 0 {
+		return
+	}
+	a := p.Actions[len(p.Actions)-1]
+	if a.Duration == 0 {
+		a.Duration = time.Since(a.started)
+	}
+}
+
+// fail marks the last action as the one that failed.
+func (p *Plan) fail(err error) {
+	p.finish()
+	if len(p.Actions) > 0 {
+		p.Actions[len(p.Actions)-1].Error = err
+	}
+}
+
+func (p *Plan) record(args []string) {
+	if len(p.Actions) == 0 {
+		p.add(OpEnsure, "command", "")
+	}
+	a := p.Actions[len(p.Actions)-1]
+	a.Commands = append(a.Commands, redactions.Call(args))
+}
+
+// creates returns true if the plan has already decided to create the
+// resource at the given path, i.e. it does not exist yet.
+func (p *Plan) creates(path string) bool {
+	for _, a := range append(p.prior[:len(p.prior):len(p.prior)], p.Actions...) {
+		if a.Op == OpCreate && a.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plan) count(op string) int {
+	n := 0
+	for _, a := range p.Actions {
+		if a.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *Plan) Changes() bool {
+	for _, a := range p.Actions {
+		if a.Op != OpNoop {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plan) Print(out io.Writer) {
+	sigil := map[string]string{
+		OpCreate: "+",
+		OpUpdate: "~",
+		OpDelete: "-",
+		OpNoop:   "=",
+		OpEnsure: "*",
+	}
+
+	for _, a := range p.Actions {
+		fmt.Fprintf(out, "%s %-7s %-20s %s\n", sigil[a.Op], a.Op, a.Kind, a.Path)
+		for _, cmd := range a.Commands {
+			fmt.Fprintf(out, "      %s\n", strings.Join(cmd, " "))
+		}
+	}
+	fmt.Fprintf(out, "\nPlan: %d to create, %d to update, %d to delete, %d to ensure, %d unchanged.\n",
+		p.count(OpCreate), p.count(OpUpdate), p.count(OpDelete), p.count(OpEnsure), p.count(OpNoop))
+}
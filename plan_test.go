@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const planManifest = `
+organizations:
+  sys:
+    users:
+      admin: [OrgManager]
+    spaces:
+      prod:
+        apps:
+          - name: web
+            image: nginx
+            env:
+              GREETING: hello
+`
+
+// TestPlan plans a deployment to an empty foundation, which is left as it
+// was, and then plans it again once it has been deployed, and changed.
+func TestPlan(t *testing.T) {
+	b := NewFakeBackend()
+	m := parse(t, planManifest)
+	p := plan(t, m, b)
+	if len(b.Orgs) != 0 || len(b.Calls) != 0 {
+		t.Fatalf("planning created orgs %v, and made calls %v", sortedKeys(b.Orgs), b.Calls)
+	}
+
+	var ops []string
+	for _, a := range p.Actions {
+		ops = append(ops, a.Op+" "+a.Kind+" "+a.Path)
+	}
+	want := []string{
+		"create org sys",
+		"create org-role sys/admin[OrgManager]",
+		"create space sys/prod",
+		"create app sys/prod/web",
+		"ensure env sys/prod/web$GREETING",
+		"ensure app-start sys/prod/web",
+		"ensure env sys/prod/web$" + FingerprintVar,
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("got plan:\n%s\nwant:\n%s", strings.Join(ops, "\n"), strings.Join(want, "\n"))
+	}
+	if !reflect.DeepEqual(p.Actions[0].Commands, [][]string{{"create-org", "sys"}}) {
+		t.Errorf("got commands %v for the org, want create-org sys", p.Actions[0].Commands)
+	}
+
+	var out bytes.Buffer
+	p.Print(&out)
+	for _, line := range []string{
+		"+ create  org                  sys\n      create-org sys\n",
+		"* ensure  app-start            sys/prod/web\n",
+		"Plan: 4 to create, 0 to update, 0 to delete, 3 to ensure, 0 unchanged.",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("the printed plan is missing %q:\n%s", line, out.String())
+		}
+	}
+
+	deploy(t, m, b)
+	if p := plan(t, m, b); p.Changes() {
+		t.Errorf("planning the deployed manifest again found changes: %v", p.Actions)
+	}
+
+	m = parse(t, strings.Replace(planManifest, "image: nginx", "image: nginx\n            instances: 3", 1))
+	p = plan(t, m, b)
+	if !p.Changes() || !did(p, OpUpdate, "app-instances", "sys/prod/web") {
+		var out bytes.Buffer
+		p.Print(&out)
+		t.Errorf("the plan doesn't scale the app:\n%s", out.String())
+	}
+	if web := b.Orgs["sys"].Spaces["prod"].Apps["web"]; web.Instances != 1 {
+		t.Errorf("planning scaled the app to %d instances", web.Instances)
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+const (
+	PruneOrgs           = "orgs"
+	PruneSpaces         = "spaces"
+	PruneRoles          = "roles"
+	PruneApps           = "apps"
+	PruneServices       = "services"
+	PruneRoutes         = "routes"
+	PruneSecurityGroups = "security-groups"
+	PruneServiceAccess  = "service-access"
+	PruneAppServices    = "app-services"
+)
+
+// the resource types pruned by a bare `--prune`
+var pruneTypes = []string{PruneSpaces, PruneRoles, PruneApps, PruneServices, PruneRoutes, PruneSecurityGroups}
+
+// the resource types that are only pruned when asked for by name, since
+// they reach beyond what the manifest declares: org deletion, service
+// access, which takes plans away from orgs the manifest may know nothing
+// about, and the instances of app services, which go (along with their
+// data) as soon as they are dropped from a `bind` list
+var optInPruneTypes = []string{PruneOrgs, PruneServiceAccess, PruneAppServices}
+
+// Prune is the set of resource types that the manifest is authoritative
+// for; anything of those types that exists in the foundation but is not
+// in the manifest gets removed.
+//
+// It is a flag.Value, so that a bare `--prune` turns on the pruneTypes,
+// and `--prune=roles,spaces` turns on just those types.
+type Prune map[string]bool
+
+func (p Prune) String() string {
+	var l []string
+	for k := range p {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+func (p Prune) IsBoolFlag() bool {
+	return true
+}
+
+func (p Prune) Set(s string) error {
+	if s == "true" || s == "all" {
+		for _, k := range pruneTypes {
+			p[k] = true
+		}
+		return nil
+	}
+	if s == "false" {
+		for k := range p {
+			delete(p, k)
+		}
+		return nil
+	}
+
+	for _, k := range strings.Split(s, ",") {
+		if !contains(pruneTypes, k) && !contains(optInPruneTypes, k) {
+			return fmt.Errorf("unknown resource type '%s' to prune", k)
+		}
+		p[k] = true
+	}
+	return nil
+}
+
+// pruneOrgs deletes every organization not in the manifest, along with
+// everything in them, so it is never turned on by a bare `--prune`.
+func (d *Deployer) pruneOrgs() error {
+	if !d.prune[PruneOrgs] {
+		return nil
+	}
+
+	orgs, err := d.backend.GetOrgs()
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	for _, o := range orgs {
+		if _, ok := d.manifest.Organizations[o.Name]; ok {
+			continue
+		}
+		d.say("deleting organization '%s'\n", o.Name)
+		d.act(OpDelete, "org", o.Name)
+		if err := d.backend.DeleteOrg(o.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Deployer) pruneSpaces(oname string, org *Organization) error {
+	if !d.prune[PruneSpaces] || d.absent(oname) {
+		return nil
+	}
+
+	o, err := d.backend.GetOrg(oname)
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	for _, s := range o.Spaces {
+		if _, ok := org.Spaces[s.Name]; ok {
+			continue
+		}
+		d.say("  deleting space '%s'\n", s.Name)
+		d.act(OpDelete, "space", oname+"/"+s.Name)
+		if err := d.backend.DeleteSpace(oname, s.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneable returns true if a role held by a user can be unset.  We never
+// touch admins, or the user running the deploy (lest we lock ourselves
+// out halfway through), and OrgUser is implied by every other org role.
+func (d *Deployer) pruneable(user, role string, admin bool) bool {
+	if admin || role == "OrgUser" {
+		return false
+	}
+	me, _ := d.backend.CurrentUser()
+	return user != me
+}
+
+func (d *Deployer) pruneOrgRoles(oname string, org *Organization) error {
+	if !d.prune[PruneRoles] || d.absent(oname) {
+		return nil
+	}
+
+	users, err := d.backend.GetOrgUsers(oname)
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	for _, u := range users {
+		for _, r := range u.Roles {
+			if contains(org.Users[u.Username], r) || !d.pruneable(u.Username, r, u.IsAdmin) {
+				continue
+			}
+			d.say("    revoking role '%s' from %s\n", r, u.Username)
+			d.act(OpDelete, "org-role", fmt.Sprintf("%s/%s[%s]", oname, u.Username, r))
+			if err := d.backend.UnsetOrgRole(oname, u.Username, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Deployer) pruneSpaceRoles(oname, sname string, space *Space) error {
+	if !d.prune[PruneRoles] || d.absent(oname+"/"+sname) {
+		return nil
+	}
+
+	users, err := d.backend.GetSpaceUsers(oname, sname)
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	for _, u := range users {
+		for _, r := range u.Roles {
+			if contains(space.Users[u.Username], r) || !d.pruneable(u.Username, r, u.IsAdmin) {
+				continue
+			}
+			d.say("      revoking role '%s' from %s\n", r, u.Username)
+			d.act(OpDelete, "space-role", fmt.Sprintf("%s/%s/%s[%s]", oname, sname, u.Username, r))
+			if err := d.backend.UnsetSpaceRole(oname, sname, u.Username, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneApps deletes applications in the space that are not in the
+// manifest.  It has to run before pruneServices, since
+// a service instance cannot be deleted while an app is still bound to it.
+func (d *Deployer) pruneApps(oname, sname string, space *Space) error {
+	if !d.prune[PruneApps] || d.absent(oname+"/"+sname) {
+		return nil
+	}
+
+	apps, err := d.backend.GetApps(oname, sname)
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	var orphans []string
+	for _, a := range apps {
+		if space.app(a.Name) != nil {
+			continue
+		}
+		if d.prune[PruneAppServices] {
+			live, err := d.backend.GetApp(oname, sname, a.Name)
+			if err != nil && !d.tolerate(err) {
+				return err
+			}
+			orphans = append(orphans, recordedServices(live)...)
+		}
+		d.say("    deleting application '%s'\n", a.Name)
+		d.act(OpDelete, "app", oname+"/"+sname+"/"+a.Name)
+		if err := d.backend.DeleteApp(oname, sname, a.Name); err != nil {
+			return err
+		}
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	/* along with the service instances made for them */
+	services, err := d.backend.GetServices(oname, sname)
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	sort.Strings(orphans)
+	for _, svname := range orphans {
+		if _, err := d.deleteOrphan(oname, sname, svname, space, services); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneServices deletes service instances in the space that are neither
+// shared, bound to an app, nor user-provided in the manifest.
+func (d *Deployer) pruneServices(oname, sname string, space *Space) error {
+	if !d.prune[PruneServices] || d.absent(oname+"/"+sname) {
+		return nil
+	}
+
+	want := map[string]bool{}
+	for name := range space.SharedServices {
+		want[name] = true
+	}
+	for _, cups := range space.UserProvidedServices {
+		want[cups.Name] = true
+	}
+	for _, app := range space.Applications {
+		for name := range app.BoundServices {
+			want[name] = true
+		}
+	}
+
+	services, err := d.backend.GetServices(oname, sname)
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	for _, s := range services {
+		if want[s.Name] {
+			continue
+		}
+		d.say("    deleting service instance '%s'\n", s.Name)
+		d.act(OpDelete, "service", oname+"/"+sname+"/"+s.Name)
+		for _, app := range s.ApplicationNames {
+			if err := d.backend.UnbindService(oname, sname, app, s.Name); err != nil {
+				return err
+			}
+		}
+		if err := d.backend.DeleteService(oname, sname, s.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServicesVar is the environment variable that the service instances made
+// for an application's `bind` list are recorded in, so that the ones the
+// manifest no longer asks for can be told apart from instances that were
+// made by hand (whatever they are called), even once the application they
+// were made for is gone from the manifest.
+const ServicesVar = "CF_DEPLOY_SERVICES"
+
+// recordedServices returns the service instances recorded as made for an
+// application.
+func recordedServices(live plugin_models.GetAppModel) []string {
+	s, _ := live.EnvironmentVars[ServicesVar].(string)
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// recordServices adds the service instances made for an application's
+// `bind` list to those recorded on it (given as they were before it was
+// deployed, if it was pushed anew.)  Instances that are no longer in the
+// list are kept in the record until pruning deletes them.  Changing the
+// record doesn't need a restage.
+func (d *Deployer) recordServices(oname, sname, name string, app *Application, live plugin_models.GetAppModel) error {
+	have := recordedServices(live)
+	l := append([]string{}, have...)
+	for _, svname := range sortedKeys(app.scoped) {
+		if !contains(l, svname) {
+			l = append(l, svname)
+		}
+	}
+	sort.Strings(l)
+	if len(l) == 0 {
+		return nil
+	}
+	/* a new copy of the application (pushed alongside, for a
+	   blue-green deployment) has no record of its own yet */
+	if strings.Join(l, ",") == strings.Join(have, ",") && live.Name == name {
+		return nil
+	}
+	return d.setEnvVar(oname, sname, ServicesVar, strings.Join(l, ","), name)
+}
+
+// pruneAppServices deletes the service instances made for the `bind` lists
+// of the applications in the space (as recorded on them) that the manifest
+// no longer asks for, once nothing binds them any more.  Unlike pruning
+// services, it leaves every other instance alone.  The instances of
+// applications that have been pruned are deleted along with them, by
+// pruneApps.
+func (d *Deployer) pruneAppServices(oname, sname string, space *Space) error {
+	if !d.prune[PruneAppServices] || d.absent(oname+"/"+sname) {
+		return nil
+	}
+
+	services, err := d.backend.GetServices(oname, sname)
+	if err != nil && !d.tolerate(err) {
+		return err
+	}
+	for _, app := range space.Applications {
+		if d.absent(oname + "/" + sname + "/" + app.Name) {
+			continue
+		}
+		live, err := d.backend.GetApp(oname, sname, app.Name)
+		if err != nil {
+			if d.tolerate(err) {
+				continue
+			}
+			return err
+		}
+
+		have := recordedServices(live)
+		var keep []string
+		for _, svname := range have {
+			if app.scoped[svname] {
+				keep = append(keep, svname)
+				continue
+			}
+			deleted, err := d.deleteOrphan(oname, sname, svname, space, services)
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				keep = append(keep, svname)
+			}
+		}
+		if len(keep) == len(have) {
+			continue
+		}
+		if len(keep) == 0 {
+			d.act(OpDelete, "env", fmt.Sprintf("%s/%s/%s$%s", oname, sname, app.Name, ServicesVar))
+			if err := d.backend.UnsetEnv(oname, sname, app.Name, ServicesVar); err != nil {
+				return err
+			}
+		} else if err := d.setEnvVar(oname, sname, ServicesVar, strings.Join(keep, ","), app.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOrphan deletes a service instance made for an application's `bind`
+// list, unless the manifest still asks for it, or something still binds it,
+// and returns true if it is gone.  Bindings that have been taken away (or
+// will have, by the time a plan is carried out) don't count: those of the
+// manifest's apps, and those of apps being pruned.
+func (d *Deployer) deleteOrphan(oname, sname, svname string, space *Space, services []plugin_models.GetServices_Model) (bool, error) {
+	if _, ok := space.SharedServices[svname]; ok {
+		return false, nil
+	}
+	for _, app := range space.Applications {
+		if _, ok := app.BoundServices[svname]; ok {
+			return false, nil
+		}
+	}
+
+	for _, s := range services {
+		if s.Name != svname {
+			continue
+		}
+		for _, aname := range s.ApplicationNames {
+			app := space.app(aname)
+			/* manifest apps are unbound from what they no
+			   longer bind, but other apps only go if pruned */
+			if app == nil && !d.prune[PruneApps] {
+				return false, nil
+			}
+		}
+		d.say("    deleting orphaned service instance '%s'\n", svname)
+		d.act(OpDelete, "service", oname+"/"+sname+"/"+svname)
+		return true, d.backend.DeleteService(oname, sname, svname)
+	}
+
+	/* already gone */
+	return true, nil
+}
+
+// pruneRoutes deletes the routes in the space that no
+// application is using any more.  (Routes mapped to apps are already
+// reconciled against each app's `urls` list by mapURLs.)
+func (d *Deployer) pruneRoutes(oname, sname string) error {
+	if !d.prune[PruneRoutes] || d.absent(oname+"/"+sname) {
+		return nil
+	}
+
+	d.act(OpEnsure, "orphaned-routes", oname+"/"+sname)
+	return d.backend.DeleteOrphanedRoutes(oname, sname)
+}
+
+// pruneGlobalSecurityGroups unbinds the platform-wide running and staging
+// security groups that are not listed in the top-level security_group_sets.
+// If the manifest does not have security_group_sets at all, the platform
+// defaults are left alone.
+func (d *Deployer) pruneGlobalSecurityGroups() error {
+	sets := d.manifest.SecurityGroupSets
+	if !d.prune[PruneSecurityGroups] || sets == nil {
+		return nil
+	}
+
+	for _, lifecycle := range []string{"running", "staging"} {
+		want := sets.Running
+		if lifecycle == "staging" {
+			want = sets.Staging
+		}
+
+		have, err := d.backend.GlobalSecurityGroups(lifecycle)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
+		for _, sgname := range have {
+			if contains(want, sgname) {
+				continue
+			}
+			d.say("unbind %s security group %s\n", lifecycle, sgname)
+			d.act(OpDelete, lifecycle+"-security-group", sgname)
+			if err := d.backend.UnbindGlobalSecurityGroup(sgname, lifecycle); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneSpaceSecurityGroups unbinds running and staging security groups
+// from the space that are not listed for that lifecycle in either the
+// space's or its organization's security_group_sets.
+func (d *Deployer) pruneSpaceSecurityGroups(oname, sname string, org *Organization, space *Space) error {
+	if !d.prune[PruneSecurityGroups] || d.absent(oname+"/"+sname) {
+		return nil
+	}
+	if org.SecurityGroupSets == nil && space.SecurityGroupSets == nil {
+		return nil
+	}
+
+	for _, lifecycle := range []string{"staging", "running"} {
+		var want []string
+		for _, sets := range []*SecurityGroupSet{org.SecurityGroupSets, space.SecurityGroupSets} {
+			if sets == nil {
+				continue
+			}
+			if lifecycle == "running" {
+				want = append(want, sets.Running...)
+			} else {
+				want = append(want, sets.Staging...)
+			}
+		}
+
+		have, err := d.backend.SpaceSecurityGroups(oname, sname, lifecycle)
+		if err != nil && !d.tolerate(err) {
+			return err
+		}
+		for _, sgname := range have {
+			if contains(want, sgname) {
+				continue
+			}
+			d.say("unbind space %s security group %s\n", lifecycle, sgname)
+			d.act(OpDelete, lifecycle+"-security-group", oname+"/"+sname+"->"+sgname)
+			if err := d.backend.UnbindSecurityGroup(sgname, oname, sname, lifecycle); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneServiceAccess takes access to the plans of a service away from
+// everyone the manifest doesn't give it to.  Only services listed under
+// service_access are touched.  A public plan that the manifest only gives
+// to some orgs is made private first, and then given to them.
+func (d *Deployer) pruneServiceAccess(service string, want map[string]*ServicePlanAccess, have []ServicePlanAccess) error {
+	for _, p := range have {
+		w, ok := want[p.Plan]
+		if !ok {
+			w = &ServicePlanAccess{Plan: p.Plan}
+		}
+		if w.Public {
+			continue
+		}
+
+		if p.Public || (len(w.Orgs) == 0 && len(p.Orgs) > 0) {
+			d.say("  disabling access to plan '%s'\n", p.Plan)
+			d.act(OpDelete, "service-access", servicePlanPath(service, p.Plan, ""))
+			if err := d.backend.DisableServiceAccess(service, p.Plan, ""); err != nil {
+				return err
+			}
+			if !p.Public {
+				continue
+			}
+			for _, oname := range w.Orgs {
+				d.say("  enabling access to plan '%s' for organization '%s'\n", p.Plan, oname)
+				d.act(OpCreate, "service-access", servicePlanPath(service, p.Plan, oname))
+				if err := d.backend.EnableServiceAccess(service, p.Plan, oname); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		for _, oname := range p.Orgs {
+			if contains(w.Orgs, oname) {
+				continue
+			}
+			d.say("  disabling access to plan '%s' for organization '%s'\n", p.Plan, oname)
+			d.act(OpDelete, "service-access", servicePlanPath(service, p.Plan, oname))
+			if err := d.backend.DisableServiceAccess(service, p.Plan, oname); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func contains(l []string, s string) bool {
+	for _, x := range l {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
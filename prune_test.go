@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPruneTypes(t *testing.T) {
+	p := Prune{}
+	if err := p.Set("true"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := p.String(), "apps,roles,routes,security-groups,services,spaces"; have != want {
+		t.Errorf("a bare --prune pruned %s, want %s", have, want)
+	}
+	if err := p.Set("false"); err != nil || len(p) != 0 {
+		t.Errorf("--prune=false left %s pruned (%v)", p, err)
+	}
+	if err := p.Set("roles,orgs"); err != nil || p.String() != "orgs,roles" {
+		t.Errorf("--prune=roles,orgs pruned %s (%v)", p, err)
+	}
+	if err := p.Set("roles,users"); err == nil {
+		t.Error("pruned an unknown type")
+	}
+}
+
+const pruneManifest = `
+security_groups:
+  dns:
+    rules:
+      - {destination: 10.0.0.2, protocol: udp, ports: "53"}
+security_group_sets:
+  running: [dns]
+organizations:
+  sys:
+    users:
+      jobs: [OrgManager]
+    spaces:
+      prod:
+        users:
+          jobs: [SpaceDeveloper]
+        security_group_sets:
+          running: [dns]
+        services:
+          db: postgres/small
+        apps:
+          - name: web
+            image: nginx
+`
+
+// pruned sets up a foundation with the pruneManifest deployed to it, and
+// then everything that pruning would remove added on.
+func pruned(t *testing.T) (*Manifest, *FakeBackend) {
+	b := NewFakeBackend()
+	b.Users["jobs"] = "s3cr3t"
+	b.Users["woz"] = "s3cr3t"
+	m := parse(t, pruneManifest)
+	deploy(t, m, b)
+
+	b.SecurityGroups["public"] = &FakeSecurityGroup{GUID: "sg-public"}
+	for _, err := range []error{
+		b.SetOrgRole("sys", "woz", "OrgAuditor"),
+		b.SetOrgRole("sys", "admin", "BillingManager"),
+		b.SetSpaceRole("sys", "prod", "woz", "SpaceDeveloper"),
+		b.SetSpaceRole("sys", "prod", "jobs", "SpaceManager"),
+		b.CreateSpace("sys", "dev"),
+		b.CreateOrg("other"),
+		b.PushApp("sys", "prod", &Application{Name: "stray", Image: "nginx", Instances: 1}, ""),
+		b.CreateService("sys", "prod", "stray-db", "postgres", "small", "", nil),
+		b.BindService("sys", "prod", "stray", "stray-db"),
+		b.BindGlobalSecurityGroup("public", "running"),
+		b.BindGlobalSecurityGroup("public", "staging"),
+		b.BindSecurityGroup("public", "sys", "prod", "running"),
+		b.BindSecurityGroup("public", "sys", "prod", "staging"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	/* a route nothing is mapped to */
+	prod := b.Orgs["sys"].Spaces["prod"]
+	prod.Routes["old.apps.example.com"] = URL{Host: "old", Domain: "apps.example.com"}
+	return m, b
+}
+
+// TestPrune removes everything in the orgs of the manifest that it doesn't
+// declare, but only when pruning, and never the roles of admins.
+func TestPrune(t *testing.T) {
+	m, b := pruned(t)
+	if p := deploy(t, m, b); p.count(OpDelete) != 0 {
+		t.Fatalf("deleted things without pruning: %v", p.Actions)
+	}
+
+	p := plan(t, m, b, "true")
+	want := []struct{ kind, path string }{
+		{"org-role", "sys/woz[OrgAuditor]"},
+		{"space-role", "sys/prod/woz[SpaceDeveloper]"},
+		{"space-role", "sys/prod/jobs[SpaceManager]"},
+		{"space", "sys/dev"},
+		{"app", "sys/prod/stray"},
+		{"service", "sys/prod/stray-db"},
+		{"running-security-group", "public"},
+		{"staging-security-group", "public"},
+		{"running-security-group", "sys/prod->public"},
+		{"staging-security-group", "sys/prod->public"},
+	}
+	for _, w := range want {
+		if !did(p, OpDelete, w.kind, w.path) {
+			t.Errorf("the plan doesn't delete %s %s", w.kind, w.path)
+		}
+	}
+	if n := p.count(OpDelete); n != len(want) {
+		t.Errorf("the plan deletes %d things, want %d", n, len(want))
+	}
+
+	deploy(t, m, b, "true")
+	o := b.Orgs["sys"]
+	prod := o.Spaces["prod"]
+	/* OrgUser goes with every other org role, so it stays */
+	if roles := strings.Join(o.Roles["woz"], ","); roles != "OrgUser" {
+		t.Errorf("woz has org roles %s, want just OrgUser", roles)
+	}
+	if roles := strings.Join(o.Roles["admin"], ","); !strings.Contains(roles, "BillingManager") {
+		t.Errorf("the admin's roles were revoked: %s", roles)
+	}
+	if roles := strings.Join(prod.Roles["jobs"], ","); roles != "SpaceDeveloper" {
+		t.Errorf("jobs has space roles %s, want SpaceDeveloper", roles)
+	}
+	if o.Spaces["dev"] != nil || prod.Apps["stray"] != nil || prod.Services["stray-db"] != nil {
+		t.Error("the dev space, the stray app or its service instance is still there")
+	}
+	if _, ok := prod.Routes["old.apps.example.com"]; ok {
+		t.Error("the orphaned route is still there")
+	}
+	if _, ok := prod.Routes["web.apps.example.com"]; !ok {
+		t.Error("the route of web was deleted")
+	}
+	if sg := b.SecurityGroups["public"]; sg.Running || sg.Staging {
+		t.Errorf("public is still bound platform-wide: %+v", sg)
+	}
+	if sgs := prod.SecurityGroups["public"]; len(sgs) != 0 {
+		t.Errorf("public is still bound to the space for %v", sgs)
+	}
+	if sg := b.SecurityGroups["dns"]; !sg.Running || !contains(prod.SecurityGroups["dns"], "running") {
+		t.Error("dns was unbound")
+	}
+	if b.Orgs["other"] == nil {
+		t.Error("the org that isn't in the manifest was deleted without pruning orgs")
+	}
+
+	deploy(t, m, b, "orgs")
+	if b.Orgs["other"] != nil || b.Orgs["sys"] == nil {
+		t.Error("pruning orgs didn't delete just the org that isn't in the manifest")
+	}
+}
+
+// TestPruneSome only prunes the types of resources it is asked to.
+func TestPruneSome(t *testing.T) {
+	m, b := pruned(t)
+	deploy(t, m, b, "roles")
+	o := b.Orgs["sys"]
+	if contains(o.Roles["woz"], "OrgAuditor") {
+		t.Error("woz's roles were not revoked")
+	}
+	if o.Spaces["dev"] == nil || o.Spaces["prod"].Apps["stray"] == nil || !b.SecurityGroups["public"].Running {
+		t.Error("pruning roles pruned more than roles")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// masked is what sensitive values are replaced with, wherever they would
+// otherwise be printed.
+const masked = "********"
+
+// minRedacted is the length of the shortest password or credential that is
+// masked wherever it turns up.  Shorter ones (like a `port: 5432` in a set
+// of credentials) would mangle too much else; they are still masked in the
+// arguments and request bodies they are known to be in.  Secrets are always
+// masked, however short.
+const minRedacted = 6
+
+// sensitiveFields are the fields of a request body that are masked,
+// whatever their value.
+var sensitiveFields = map[string]bool{
+	"password":    true,
+	"credentials": true,
+}
+
+// A Redactor knows which values are sensitive -- user passwords,
+// credentials for user-provided services, and anything that came from a
+// secret reference -- and masks them in debugging output, plans, reports
+// and error messages.
+type Redactor struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// redactions is the Redactor for everything printed by the plugin.
+var redactions = &Redactor{}
+
+// Add marks a value as sensitive, if it is long enough to be masked
+// wherever it turns up.
+func (r *Redactor) Add(s string) {
+	if len(s) < minRedacted {
+		return
+	}
+	r.add(s)
+}
+
+// AddSecret marks a value resolved from a secret reference as sensitive,
+// however short it is.
+func (r *Redactor) AddSecret(s string) {
+	if s != "" {
+		r.add(s)
+	}
+}
+
+func (r *Redactor) add(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range r.values {
+		if v == s {
+			return
+		}
+	}
+	r.values = append(r.values, s)
+	/* longest first, so that no value is left partly unmasked by a
+	   shorter one that is part of it */
+	sort.Slice(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+}
+
+// AddValue marks every scalar in a (YAML) value as sensitive, if it is
+// long enough.
+func (r *Redactor) AddValue(x interface{}) {
+	scalars(x, r.Add)
+}
+
+// AddSecretValue marks every scalar in a (YAML) value resolved from a
+// secret reference as sensitive.
+func (r *Redactor) AddSecretValue(x interface{}) {
+	scalars(x, r.AddSecret)
+}
+
+// scalars calls fn with every scalar in a (YAML) value.
+func scalars(x interface{}, fn func(string)) {
+	switch x := x.(type) {
+	case map[interface{}]interface{}:
+		for _, v := range x {
+			scalars(v, fn)
+		}
+	case map[string]interface{}:
+		for _, v := range x {
+			scalars(v, fn)
+		}
+	case []interface{}:
+		for _, v := range x {
+			scalars(v, fn)
+		}
+	case nil:
+	default:
+		fn(fmt.Sprintf("%v", x))
+	}
+}
+
+// AddManifest marks the passwords and credentials in a manifest as
+// sensitive.
+func (r *Redactor) AddManifest(m *Manifest) {
+	for _, u := range m.Users {
+		r.Add(u.Password)
+	}
+	for _, b := range m.ServiceBrokers {
+		r.Add(b.Password)
+	}
+	for _, org := range m.Organizations {
+		for _, space := range org.Spaces {
+			for _, cups := range space.UserProvidedServices {
+				r.AddValue(cups.Credentials)
+			}
+		}
+	}
+}
+
+// String masks every sensitive value in s.
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, v := range r.values {
+		s = strings.Replace(s, v, masked, -1)
+	}
+	return s
+}
+
+// Call masks a cf command or API request, as logged or recorded: the
+// password given to `cf create-user` (or `cf create-service-broker`), the
+// credentials given to `cf create-user-provided-service`, the sensitive
+// fields of a request body, and any sensitive value anywhere else.
+func (r *Redactor) Call(call []string) []string {
+	l := make([]string, len(call))
+	cups := false
+	for i, arg := range call {
+		switch {
+		case i >= 2 && call[i-2] == "create-user":
+			l[i] = masked
+		case i >= 3 && (call[i-3] == "create-service-broker" || call[i-3] == "update-service-broker"):
+			l[i] = masked
+		case cups && call[i-1] == "-p":
+			l[i] = masked
+		case strings.HasPrefix(arg, "{"):
+			l[i] = r.Body(arg)
+		default:
+			l[i] = r.String(arg)
+		}
+		cups = cups || strings.HasSuffix(arg, "user-provided-service")
+	}
+	return l
+}
+
+// Body masks the sensitive fields of a JSON request body, and any
+// sensitive value anywhere else in it.
+func (r *Redactor) Body(body string) string {
+	var x interface{}
+	if json.Unmarshal([]byte(body), &x) != nil || !maskFields(x) {
+		return r.String(body)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(x); err != nil {
+		return r.String(body)
+	}
+	return r.String(string(bytes.TrimSpace(buf.Bytes())))
+}
+
+// maskFields masks the sensitive fields of a decoded request body, and
+// returns true if there were any.
+func maskFields(x interface{}) bool {
+	found := false
+	switch x := x.(type) {
+	case map[string]interface{}:
+		for k, v := range x {
+			if sensitiveFields[k] && v != nil {
+				x[k] = masked
+				found = true
+			} else if maskFields(v) {
+				found = true
+			}
+		}
+	case []interface{}:
+		for _, v := range x {
+			if maskFields(v) {
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// Error masks every sensitive value in an error message.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	s := err.Error()
+	if m := r.String(s); m != s {
+		return redactedError{err: err, msg: m}
+	}
+	return err
+}
+
+// A redactedError is an error whose message has been masked.  The original
+// is kept, for anything that needs to know what kind of error it was.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e redactedError) Error() string {
+	return e.msg
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	r := &Redactor{}
+	r.Add("hunter2")
+	r.Add("5432")
+	r.AddSecret("pw")
+	r.AddValue(map[interface{}]interface{}{"uri": "postgres://admin:hunter2hunter2@db", "port": 5432})
+
+	for s, want := range map[string]string{
+		"login with hunter2":                     "login with " + masked,
+		"postgres://admin:hunter2hunter2@db now": masked + " now",
+		"port 5432":                              "port 5432",
+		"pwd":                                    masked + "d",
+	} {
+		if have := r.String(s); have != want {
+			t.Errorf("%q: got %q, want %q", s, have, want)
+		}
+	}
+
+	for _, c := range []struct{ call, want []string }{
+		{[]string{"create-user", "jobs", "abc"}, []string{"create-user", "jobs", masked}},
+		{[]string{"create-service-broker", "pg", "admin", "abc", "https://pg.example.com"}, []string{"create-service-broker", "pg", "admin", masked, "https://pg.example.com"}},
+		{[]string{"create-user-provided-service", "db", "-p", `{"port":5432}`}, []string{"create-user-provided-service", "db", "-p", masked}},
+		{[]string{"set-env", "web", "DB_PASSWORD", "hunter2"}, []string{"set-env", "web", "DB_PASSWORD", masked}},
+		{[]string{"POST", "/v3/service_credential_bindings", `{"name":"db","credentials":{"port":5432},"type":"key"}`},
+			[]string{"POST", "/v3/service_credential_bindings", `{"credentials":"` + masked + `","name":"db","type":"key"}`}},
+		{[]string{"POST", "/v3/organizations", `{"name":"hunter2"}`}, []string{"POST", "/v3/organizations", `{"name":"` + masked + `"}`}},
+	} {
+		if have := r.Call(c.call); !reflect.DeepEqual(have, c.want) {
+			t.Errorf("got %q, want %q", have, c.want)
+		}
+	}
+
+	err := r.Error(NotFoundError{Kind: "user", Name: "hunter2"})
+	if want := "user " + masked + " not found"; err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+	var nf NotFoundError
+	if !errors.As(err, &nf) {
+		t.Errorf("the masked error is no longer a %T", nf)
+	}
+	plain := errors.New("nothing to see here")
+	if r.Error(plain) != plain {
+		t.Error("an error without anything sensitive in it was replaced")
+	}
+}
+
+// TestRedactedPlan plans a manifest with passwords and secrets in it, none
+// of which may show up in the plan.
+func TestRedactedPlan(t *testing.T) {
+	t.Setenv("CF_DEPLOY_SECRET_CF_DB_PASSWORD", "xyzzy")
+	m, err := ParseManifest(strings.NewReader(`
+users:
+  - username: jobs
+    password: correct-horse
+organizations:
+  sys:
+    users:
+      jobs: [OrgManager]
+    spaces:
+      prod:
+        user-provided-services:
+          - name: db
+            credentials:
+              username: admin
+              password: ((secret:/cf/db/password))
+        apps:
+          - name: web
+            image: nginx
+            env:
+              DB_PASSWORD: ((secret:/cf/db/password))
+`), NewVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	plan(t, &m, NewFakeBackend()).Print(&out)
+	for _, s := range []string{"correct-horse", "xyzzy"} {
+		if strings.Contains(out.String(), s) {
+			t.Errorf("the plan gives away %s:\n%s", s, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "create-user jobs "+masked) {
+		t.Errorf("got plan:\n%s\nwant it to create jobs, with the password masked", out.String())
+	}
+}
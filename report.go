@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusPlanned   = "planned"
+	StatusSkipped   = "skipped"
+)
+
+// A Report is the machine-readable account of a deployment (or a plan),
+// printed by `--format json` or `--format yaml`: one entry per resource,
+// with what was done to it, the cf commands or API requests that did it,
+// how long that took, and what went wrong, if anything.
+type Report struct {
+	Status    string         `json:"status" yaml:"status"`
+	Error     string         `json:"error,omitempty" yaml:"error,omitempty"`
+	Started   time.Time      `json:"started" yaml:"started"`
+	Duration  float64        `json:"duration" yaml:"duration"`
+	Summary   map[string]int `json:"summary" yaml:"summary"`
+	Resources []ReportEntry  `json:"resources" yaml:"resources"`
+}
+
+type ReportEntry struct {
+	Type     string   `json:"type" yaml:"type"`
+	Path     string   `json:"path" yaml:"path"`
+	Action   string   `json:"action" yaml:"action"`
+	Status   string   `json:"status" yaml:"status"`
+	Calls    []string `json:"calls" yaml:"calls"`
+	Duration float64  `json:"duration" yaml:"duration"`
+	Detail   string   `json:"detail,omitempty" yaml:"detail,omitempty"`
+	Error    string   `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// NewReport builds a report from the actions logged (or planned) by a
+// Deployer, and the resources it skipped under --keep-going; err is
+// whatever Deploy() returned.
+func NewReport(p *Plan, failures []Failure, planned bool, started time.Time, err error) Report {
+	r := Report{
+		Status:    StatusSucceeded,
+		Started:   started,
+		Duration:  time.Since(started).Seconds(),
+		Summary:   map[string]int{},
+		Resources: []ReportEntry{},
+	}
+	if planned {
+		r.Status = StatusPlanned
+	}
+	if err != nil {
+		r.Status = StatusFailed
+		r.Error = err.Error()
+	}
+
+	p.finish()
+	for _, a := range p.Actions {
+		e := ReportEntry{
+			Type:     a.Kind,
+			Path:     a.Path,
+			Action:   a.Op,
+			Status:   StatusSucceeded,
+			Calls:    []string{},
+			Duration: a.Duration.Seconds(),
+			Detail:   a.Detail,
+		}
+		if planned {
+			e.Status = StatusPlanned
+			e.Duration = 0
+		}
+		if a.Error != nil {
+			e.Status = StatusFailed
+			e.Error = a.Error.Error()
+		}
+		for _, call := range a.Commands {
+			e.Calls = append(e.Calls, strings.Join(call, " "))
+		}
+		r.Summary[a.Op]++
+		r.Resources = append(r.Resources, e)
+	}
+	for _, f := range failures {
+		if f.Skipped {
+			r.Summary["skip"]++
+			r.Resources = append(r.Resources, ReportEntry{
+				Type:   f.Kind,
+				Path:   f.Path,
+				Action: "skip",
+				Status: StatusSkipped,
+				Calls:  []string{},
+				Error:  f.Err.Error(),
+			})
+		}
+	}
+	return r
+}
+
+func (r Report) Write(out io.Writer, format string) error {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", b)
+		return err
+
+	case "yaml":
+		b, err := yaml.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(b)
+		return err
+	}
+	return fmt.Errorf("unknown report format '%s'", format)
+}
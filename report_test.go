@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const reportManifest = `
+organizations:
+  sys:
+    users:
+      woz: [OrgManager]
+    spaces:
+      prod:
+        apps:
+          - name: web
+            image: nginx
+`
+
+// entry returns the entry of a report for a resource.
+func entry(r Report, kind, path string) *ReportEntry {
+	for i := range r.Resources {
+		if r.Resources[i].Type == kind && r.Resources[i].Path == path {
+			return &r.Resources[i]
+		}
+	}
+	return nil
+}
+
+func TestReport(t *testing.T) {
+	m := parse(t, reportManifest)
+	b := NewFakeBackend()
+	b.Users["woz"] = "s3cr3t"
+
+	d := &Deployer{manifest: m, backend: b, report: &Plan{}, healthTimeout: time.Second}
+	b.Observe(d.report.record)
+	started := time.Now()
+	r := NewReport(d.report, d.failures, false, started, d.Deploy())
+	if r.Status != StatusSucceeded || r.Error != "" {
+		t.Fatalf("got status %s (%s), want %s", r.Status, r.Error, StatusSucceeded)
+	}
+	if r.Summary[OpCreate] == 0 || r.Summary[OpCreate] != d.report.count(OpCreate) {
+		t.Errorf("got summary %v, for %d creates", r.Summary, d.report.count(OpCreate))
+	}
+	e := entry(r, "org", "sys")
+	if e == nil || e.Action != OpCreate || e.Status != StatusSucceeded {
+		t.Fatalf("got org entry %+v, want it created", e)
+	}
+	if len(e.Calls) != 1 || e.Calls[0] != "create-org sys" {
+		t.Errorf("got calls %v for the org, want create-org sys", e.Calls)
+	}
+
+	var out bytes.Buffer
+	if err := r.Write(&out, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON Report
+	if err := json.Unmarshal(out.Bytes(), &fromJSON); err != nil {
+		t.Fatalf("the json report doesn't parse: %s\n%s", err, out.String())
+	}
+	if len(fromJSON.Resources) != len(r.Resources) || !fromJSON.Started.Equal(started) {
+		t.Errorf("the json report lost something:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := r.Write(&out, "yaml"); err != nil {
+		t.Fatal(err)
+	}
+	var fromYAML Report
+	if err := yaml.Unmarshal(out.Bytes(), &fromYAML); err != nil {
+		t.Fatalf("the yaml report doesn't parse: %s\n%s", err, out.String())
+	}
+	if fromYAML.Status != StatusSucceeded || len(fromYAML.Resources) != len(r.Resources) {
+		t.Errorf("the yaml report lost something:\n%s", out.String())
+	}
+
+	if err := r.Write(&out, "xml"); err == nil {
+		t.Error("wrote an xml report")
+	}
+}
+
+func TestFailedReport(t *testing.T) {
+	m := parse(t, reportManifest)
+	b := NewFakeBackend()
+
+	d := &Deployer{manifest: m, backend: b, report: &Plan{}}
+	b.Observe(d.report.record)
+	err := d.Deploy()
+	if err == nil {
+		t.Fatal("granted a role to a user that doesn't exist")
+	}
+	r := NewReport(d.report, d.failures, false, time.Now(), err)
+	if r.Status != StatusFailed || r.Error != err.Error() {
+		t.Errorf("got status %s (%s), want %s (%s)", r.Status, r.Error, StatusFailed, err)
+	}
+	e := r.Resources[len(r.Resources)-1]
+	if e.Status != StatusFailed || e.Error == "" || !strings.Contains(e.Path, "woz") {
+		t.Errorf("got last entry %+v, want woz' role to have failed", e)
+	}
+	for _, e := range r.Resources[:len(r.Resources)-1] {
+		if e.Status != StatusSucceeded {
+			t.Errorf("got entry %+v, want only the last one to have failed", e)
+		}
+	}
+}
+
+func TestPlannedReport(t *testing.T) {
+	m := parse(t, reportManifest)
+	b := NewFakeBackend()
+	b.Users["woz"] = "s3cr3t"
+
+	r := NewReport(plan(t, m, b), nil, true, time.Now(), nil)
+	if r.Status != StatusPlanned {
+		t.Errorf("got status %s, want %s", r.Status, StatusPlanned)
+	}
+	for _, e := range r.Resources {
+		if e.Status != StatusPlanned || e.Duration != 0 {
+			t.Errorf("got entry %+v, want it planned", e)
+		}
+	}
+	if e := entry(r, "app", "sys/prod/web"); e == nil || e.Action != OpCreate || len(e.Calls) == 0 {
+		t.Errorf("got app entry %+v, want it to be created", e)
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/cli/plugin/models"
+)
+
+// A RetryPolicy says how many times an operation that failed for what
+// looks like a transient reason (a 502 from the Cloud Controller, a token
+// that expired mid-flight, staging that timed out) is retried before
+// giving up, with exponential backoff (and some jitter) in between.
+//
+// Operations are named for the cf commands that carry them out (`push`,
+// `create-user`, `set-org-role`, etc.), or for what they read (`org`,
+// `space-users`, `apps`, etc.), and can be given retries of their own.
+//
+// It is a flag.Value, so that `--retry 5` sets the number of retries for
+// everything, and `--retry push=8,create-user=0` sets it for just those.
+type RetryPolicy struct {
+	Retries int
+	Ops     map[string]int
+
+	/* the first wait, doubled each time, up to the maximum */
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy retries most things a few times, apps (which are
+// slow and flaky to stage) a few more, and never creates a user twice,
+// since we can't tell whether the first attempt did.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		Retries: 3,
+		Ops: map[string]int{
+			"push":        5,
+			"start":       5,
+			"restage":     5,
+			"create-user": 0,
+		},
+		Backoff:    time.Second,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+func (p *RetryPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	l := []string{strconv.Itoa(p.Retries)}
+	for _, op := range sortedKeys(p.Ops) {
+		l = append(l, fmt.Sprintf("%s=%d", op, p.Ops[op]))
+	}
+	return strings.Join(l, ",")
+}
+
+func (p *RetryPolicy) Set(s string) error {
+	for _, x := range strings.Split(s, ",") {
+		op, n := "", x
+		if i := strings.Index(x, "="); i >= 0 {
+			op, n = x[:i], x[i+1:]
+		}
+		retries, err := strconv.Atoi(n)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("invalid number of retries '%s'", n)
+		}
+		if op == "" {
+			p.Retries = retries
+		} else {
+			p.Ops[op] = retries
+		}
+	}
+	return nil
+}
+
+func (p *RetryPolicy) retries(op string) int {
+	if n, ok := p.Ops[op]; ok {
+		return n
+	}
+	return p.Retries
+}
+
+// wait returns how long to wait before the given retry (counting from
+// zero): somewhere between half and all of the backoff for that retry.
+func (p *RetryPolicy) wait(retry int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// retryable returns true if an error looks like it might go away if the
+// operation was tried again: the Cloud Controller (or something in front
+// of it) being overloaded or unavailable, connections going away, tokens
+// expiring, and waits timing out.  Anything the Cloud Controller refused
+// outright, or that isn't there, is permanent.
+//
+// A create that timed out may well have created what it was asked to, so
+// trying it again could make a duplicate; those aren't retried either.
+//
+// The CLI never tells plugins why a cf command failed, so a failed command
+// is retried if running it again can do no harm: anything but a create (a
+// second one fails, or makes a duplicate) or a rename (a second one fails,
+// once the first has gone through.)  Reads, pushes, restarts and sets all
+// end up the same however many times they are run.
+func retryable(op string, err error) bool {
+	creates := strings.HasPrefix(op, "create-")
+	switch e := err.(type) {
+	case nil:
+		return false
+	case NotFoundError:
+		return false
+	case *CommandError:
+		return !creates && op != "rename"
+	case *APIError:
+		switch e.Status {
+		case 500, 502, 503, 504, 429:
+			return true
+		case 401:
+			/* CF-InvalidAuthToken: it expired between
+			   our getting it and the CC checking it */
+			for _, x := range e.Errors {
+				if x.Code == 1000 {
+					return true
+				}
+			}
+		}
+		return false
+	case net.Error:
+		return !(creates && e.Timeout())
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	transient := []string{"connection reset", "connection refused", "broken pipe", "eof"}
+	if !creates {
+		transient = append(transient, "timed out", "timeout")
+	}
+	for _, s := range transient {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// The RetryBackend wraps another backend, retrying whatever fails for a
+// transient reason, as its policy says.
+type RetryBackend struct {
+	Backend
+	policy *RetryPolicy
+}
+
+func NewRetryBackend(b Backend, policy *RetryPolicy) *RetryBackend {
+	return &RetryBackend{Backend: b, policy: policy}
+}
+
+func (b *RetryBackend) Fork() Backend {
+	return &RetryBackend{Backend: b.Backend.Fork(), policy: b.policy}
+}
+
+func (b *RetryBackend) retry(op string, fn func() error) error {
+	retries := b.policy.retries(op)
+	for n := 0; ; n++ {
+		err := fn()
+		if n >= retries || !retryable(op, err) {
+			return err
+		}
+		wait := b.policy.wait(n)
+		fmt.Fprintf(os.Stderr, "%s failed (%s); retrying in %s (%d of %d)\n", op, redactions.Error(err), wait, n+1, retries)
+		time.Sleep(wait)
+	}
+}
+
+func (b *RetryBackend) GetOrgs() (v []plugin_models.GetOrgs_Model, err error) {
+	err = b.retry("orgs", func() error {
+		v, err = b.Backend.GetOrgs()
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetOrg(org string) (v plugin_models.GetOrg_Model, err error) {
+	err = b.retry("org", func() error {
+		v, err = b.Backend.GetOrg(org)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetOrgUsers(org string) (v []plugin_models.GetOrgUsers_Model, err error) {
+	err = b.retry("org-users", func() error {
+		v, err = b.Backend.GetOrgUsers(org)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetSpace(org, space string) (v plugin_models.GetSpace_Model, err error) {
+	err = b.retry("space", func() error {
+		v, err = b.Backend.GetSpace(org, space)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetSpaceUsers(org, space string) (v []plugin_models.GetSpaceUsers_Model, err error) {
+	err = b.retry("space-users", func() error {
+		v, err = b.Backend.GetSpaceUsers(org, space)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetApps(org, space string) (v []plugin_models.GetAppsModel, err error) {
+	err = b.retry("apps", func() error {
+		v, err = b.Backend.GetApps(org, space)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetApp(org, space, app string) (v plugin_models.GetAppModel, err error) {
+	err = b.retry("app", func() error {
+		v, err = b.Backend.GetApp(org, space, app)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetServices(org, space string) (v []plugin_models.GetServices_Model, err error) {
+	err = b.retry("services", func() error {
+		v, err = b.Backend.GetServices(org, space)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetService(org, space, name string) (v plugin_models.GetService_Model, err error) {
+	err = b.retry("service", func() error {
+		v, err = b.Backend.GetService(org, space, name)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetServiceParameters(org, space, name string) (v map[string]interface{}, err error) {
+	err = b.retry("service", func() error {
+		v, err = b.Backend.GetServiceParameters(org, space, name)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetServiceTags(org, space, name string) (v []string, err error) {
+	err = b.retry("service", func() error {
+		v, err = b.Backend.GetServiceTags(org, space, name)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) SecurityGroupExists(name string) (v bool, err error) {
+	err = b.retry("security-group", func() error {
+		v, err = b.Backend.SecurityGroupExists(name)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GlobalSecurityGroups(lifecycle string) (v []string, err error) {
+	err = b.retry(lifecycle+"-security-groups", func() error {
+		v, err = b.Backend.GlobalSecurityGroups(lifecycle)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) SpaceSecurityGroups(org, space, lifecycle string) (v []string, err error) {
+	err = b.retry(lifecycle+"-security-groups", func() error {
+		v, err = b.Backend.SpaceSecurityGroups(org, space, lifecycle)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) SSHAllowed(org, space string) (v bool, err error) {
+	err = b.retry("space-ssh-allowed", func() error {
+		v, err = b.Backend.SSHAllowed(org, space)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetServiceBrokers() (v []string, err error) {
+	err = b.retry("service-brokers", func() error {
+		v, err = b.Backend.GetServiceBrokers()
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) GetServiceAccess(service string) (v []ServicePlanAccess, err error) {
+	err = b.retry("service-access", func() error {
+		v, err = b.Backend.GetServiceAccess(service)
+		return err
+	})
+	return
+}
+
+func (b *RetryBackend) CreateUser(user, password string) error {
+	return b.retry("create-user", func() error {
+		return b.Backend.CreateUser(user, password)
+	})
+}
+
+func (b *RetryBackend) CreateSharedDomain(domain string) error {
+	return b.retry("create-shared-domain", func() error {
+		return b.Backend.CreateSharedDomain(domain)
+	})
+}
+
+func (b *RetryBackend) CreateQuota(name string) error {
+	return b.retry("create-quota", func() error {
+		return b.Backend.CreateQuota(name)
+	})
+}
+
+func (b *RetryBackend) UpdateQuota(name string, quota *Quota) error {
+	return b.retry("update-quota", func() error {
+		return b.Backend.UpdateQuota(name, quota)
+	})
+}
+
+func (b *RetryBackend) CreateSecurityGroup(name string, rules []byte) error {
+	return b.retry("create-security-group", func() error {
+		return b.Backend.CreateSecurityGroup(name, rules)
+	})
+}
+
+func (b *RetryBackend) UpdateSecurityGroup(name string, rules []byte) error {
+	return b.retry("update-security-group", func() error {
+		return b.Backend.UpdateSecurityGroup(name, rules)
+	})
+}
+
+func (b *RetryBackend) BindGlobalSecurityGroup(name, lifecycle string) error {
+	return b.retry("bind-"+lifecycle+"-security-group", func() error {
+		return b.Backend.BindGlobalSecurityGroup(name, lifecycle)
+	})
+}
+
+func (b *RetryBackend) UnbindGlobalSecurityGroup(name, lifecycle string) error {
+	return b.retry("unbind-"+lifecycle+"-security-group", func() error {
+		return b.Backend.UnbindGlobalSecurityGroup(name, lifecycle)
+	})
+}
+
+func (b *RetryBackend) BindSecurityGroup(name, org, space, lifecycle string) error {
+	return b.retry("bind-security-group", func() error {
+		return b.Backend.BindSecurityGroup(name, org, space, lifecycle)
+	})
+}
+
+func (b *RetryBackend) UnbindSecurityGroup(name, org, space, lifecycle string) error {
+	return b.retry("unbind-security-group", func() error {
+		return b.Backend.UnbindSecurityGroup(name, org, space, lifecycle)
+	})
+}
+
+func (b *RetryBackend) CreateOrg(org string) error {
+	return b.retry("create-org", func() error {
+		return b.Backend.CreateOrg(org)
+	})
+}
+
+func (b *RetryBackend) DeleteOrg(org string) error {
+	return b.retry("delete-org", func() error {
+		return b.Backend.DeleteOrg(org)
+	})
+}
+
+func (b *RetryBackend) CreateOrgDomain(org, domain string) error {
+	return b.retry("create-domain", func() error {
+		return b.Backend.CreateOrgDomain(org, domain)
+	})
+}
+
+func (b *RetryBackend) SetOrgQuota(org, quota string) error {
+	return b.retry("set-quota", func() error {
+		return b.Backend.SetOrgQuota(org, quota)
+	})
+}
+
+func (b *RetryBackend) CreateSpaceQuota(org, name string, quota *Quota) error {
+	return b.retry("create-space-quota", func() error {
+		return b.Backend.CreateSpaceQuota(org, name, quota)
+	})
+}
+
+func (b *RetryBackend) UpdateSpaceQuota(org, name string, quota *Quota) error {
+	return b.retry("update-space-quota", func() error {
+		return b.Backend.UpdateSpaceQuota(org, name, quota)
+	})
+}
+
+func (b *RetryBackend) SetOrgRole(org, user, role string) error {
+	return b.retry("set-org-role", func() error {
+		return b.Backend.SetOrgRole(org, user, role)
+	})
+}
+
+func (b *RetryBackend) UnsetOrgRole(org, user, role string) error {
+	return b.retry("unset-org-role", func() error {
+		return b.Backend.UnsetOrgRole(org, user, role)
+	})
+}
+
+func (b *RetryBackend) CreateSpace(org, space string) error {
+	return b.retry("create-space", func() error {
+		return b.Backend.CreateSpace(org, space)
+	})
+}
+
+func (b *RetryBackend) DeleteSpace(org, space string) error {
+	return b.retry("delete-space", func() error {
+		return b.Backend.DeleteSpace(org, space)
+	})
+}
+
+func (b *RetryBackend) AllowSSH(org, space string, on bool) error {
+	return b.retry("allow-space-ssh", func() error {
+		return b.Backend.AllowSSH(org, space, on)
+	})
+}
+
+func (b *RetryBackend) SetSpaceQuota(org, space, quota string) error {
+	return b.retry("set-space-quota", func() error {
+		return b.Backend.SetSpaceQuota(org, space, quota)
+	})
+}
+
+func (b *RetryBackend) SetSpaceRole(org, space, user, role string) error {
+	return b.retry("set-space-role", func() error {
+		return b.Backend.SetSpaceRole(org, space, user, role)
+	})
+}
+
+func (b *RetryBackend) UnsetSpaceRole(org, space, user, role string) error {
+	return b.retry("unset-space-role", func() error {
+		return b.Backend.UnsetSpaceRole(org, space, user, role)
+	})
+}
+
+func (b *RetryBackend) DeleteOrphanedRoutes(org, space string) error {
+	return b.retry("delete-orphaned-routes", func() error {
+		return b.Backend.DeleteOrphanedRoutes(org, space)
+	})
+}
+
+func (b *RetryBackend) PushApp(org, space string, app *Application, path string) error {
+	return b.retry("push", func() error {
+		return b.Backend.PushApp(org, space, app, path)
+	})
+}
+
+func (b *RetryBackend) DeleteApp(org, space, app string) error {
+	return b.retry("delete", func() error {
+		return b.Backend.DeleteApp(org, space, app)
+	})
+}
+
+func (b *RetryBackend) RenameApp(org, space, app, name string) error {
+	return b.retry("rename", func() error {
+		return b.Backend.RenameApp(org, space, app, name)
+	})
+}
+
+func (b *RetryBackend) MapRoute(org, space, app string, url URL) error {
+	return b.retry("map-route", func() error {
+		return b.Backend.MapRoute(org, space, app, url)
+	})
+}
+
+func (b *RetryBackend) UnmapRoute(org, space, app string, url URL) error {
+	return b.retry("unmap-route", func() error {
+		return b.Backend.UnmapRoute(org, space, app, url)
+	})
+}
+
+func (b *RetryBackend) SetEnv(org, space, app, name, value string) error {
+	return b.retry("set-env", func() error {
+		return b.Backend.SetEnv(org, space, app, name, value)
+	})
+}
+
+func (b *RetryBackend) UnsetEnv(org, space, app, name string) error {
+	return b.retry("unset-env", func() error {
+		return b.Backend.UnsetEnv(org, space, app, name)
+	})
+}
+
+func (b *RetryBackend) StartApp(org, space, app string) error {
+	return b.retry("start", func() error {
+		return b.Backend.StartApp(org, space, app)
+	})
+}
+
+func (b *RetryBackend) ScaleApp(org, space, app string, instances int) error {
+	return b.retry("scale", func() error {
+		return b.Backend.ScaleApp(org, space, app, instances)
+	})
+}
+
+func (b *RetryBackend) RestageApp(org, space, app string) error {
+	return b.retry("restage", func() error {
+		return b.Backend.RestageApp(org, space, app)
+	})
+}
+
+func (b *RetryBackend) CreateService(org, space, name, service, plan, parameters string, tags []string) error {
+	return b.retry("create-service", func() error {
+		return b.Backend.CreateService(org, space, name, service, plan, parameters, tags)
+	})
+}
+
+func (b *RetryBackend) UpdateService(org, space, name, plan, parameters string, tags []string) error {
+	return b.retry("update-service", func() error {
+		return b.Backend.UpdateService(org, space, name, plan, parameters, tags)
+	})
+}
+
+func (b *RetryBackend) DeleteService(org, space, name string) error {
+	return b.retry("delete-service", func() error {
+		return b.Backend.DeleteService(org, space, name)
+	})
+}
+
+func (b *RetryBackend) BindService(org, space, app, name string) error {
+	return b.retry("bind-service", func() error {
+		return b.Backend.BindService(org, space, app, name)
+	})
+}
+
+func (b *RetryBackend) UnbindService(org, space, app, name string) error {
+	return b.retry("unbind-service", func() error {
+		return b.Backend.UnbindService(org, space, app, name)
+	})
+}
+
+func (b *RetryBackend) CreateUserProvidedService(org, space, name, credentials, route, syslog string) error {
+	return b.retry("create-user-provided-service", func() error {
+		return b.Backend.CreateUserProvidedService(org, space, name, credentials, route, syslog)
+	})
+}
+
+func (b *RetryBackend) UpdateUserProvidedService(org, space, name, credentials, route, syslog string) error {
+	return b.retry("update-user-provided-service", func() error {
+		return b.Backend.UpdateUserProvidedService(org, space, name, credentials, route, syslog)
+	})
+}
+
+func (b *RetryBackend) CreateServiceBroker(name, username, password, url, org, space string) error {
+	return b.retry("create-service-broker", func() error {
+		return b.Backend.CreateServiceBroker(name, username, password, url, org, space)
+	})
+}
+
+func (b *RetryBackend) UpdateServiceBroker(name, username, password, url string) error {
+	return b.retry("update-service-broker", func() error {
+		return b.Backend.UpdateServiceBroker(name, username, password, url)
+	})
+}
+
+func (b *RetryBackend) EnableServiceAccess(service, plan, org string) error {
+	return b.retry("enable-service-access", func() error {
+		return b.Backend.EnableServiceAccess(service, plan, org)
+	})
+}
+
+func (b *RetryBackend) DisableServiceAccess(service, plan, org string) error {
+	return b.retry("disable-service-access", func() error {
+		return b.Backend.DisableServiceAccess(service, plan, org)
+	})
+}
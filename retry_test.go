@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := DefaultRetryPolicy()
+	if err := p.Set("push=8,create-service=0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Set("4"); err != nil {
+		t.Fatal(err)
+	}
+	for op, want := range map[string]int{"push": 8, "start": 5, "create-service": 0, "create-user": 0, "set-env": 4} {
+		if have := p.retries(op); have != want {
+			t.Errorf("%s: got %d retries, want %d", op, have, want)
+		}
+	}
+	if have, want := p.String(), "4,create-service=0,create-user=0,push=8,restage=5,start=5"; have != want {
+		t.Errorf("got %s, want %s", have, want)
+	}
+	for _, bad := range []string{"push=lots", "-1", "push="} {
+		if err := p.Set(bad); err == nil {
+			t.Errorf("%s: set a number of retries", bad)
+		}
+	}
+
+	for retry, max := range []int{1, 2, 4, 8, 8, 8} {
+		for i := 0; i < 10; i++ {
+			p := &RetryPolicy{Backoff: 4, MaxBackoff: 32}
+			if w := p.wait(retry); int(w) < max*2 || int(w) >= max*4 {
+				t.Errorf("retry %d: waited %d, want between %d and %d", retry, w, max*2, max*4)
+			}
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Err: timeoutError{}}
+	failed := &CommandError{Args: []string{"push", "web"}, Err: errors.New("Error executing cli core command")}
+	for _, c := range []struct {
+		op   string
+		err  error
+		want bool
+	}{
+		{"push", nil, false},
+		{"org", NotFoundError{"org", "sys"}, false},
+		{"org", &APIError{Status: 502}, true},
+		{"org", &APIError{Status: 429}, true},
+		{"create-org", &APIError{Status: 503}, true},
+		{"org", &APIError{Status: 422}, false},
+		{"org", &APIError{Status: 403}, false},
+		{"org", apiError(401, 1000), true},
+		{"org", apiError(401, 1002), false},
+		{"org", timeout, true},
+		{"create-org", timeout, false},
+		{"org", io.EOF, true},
+		{"org", errors.New("read: connection reset by peer"), true},
+		{"push", errors.New("staging timed out"), true},
+		{"create-service", errors.New("request timed out"), false},
+		{"org", errors.New("quota 'small' not found"), false},
+		{"push", failed, true},
+		{"set-env", failed, true},
+		{"delete-service", failed, true},
+		{"create-org", failed, false},
+		{"rename", failed, false},
+	} {
+		if have := retryable(c.op, c.err); have != c.want {
+			t.Errorf("%s: %v: got retryable %v, want %v", c.op, c.err, have, c.want)
+		}
+	}
+}
+
+// apiError returns an error the Cloud Controller might answer with.
+func apiError(status, code int) *APIError {
+	e := &APIError{Status: status}
+	json.Unmarshal([]byte(fmt.Sprintf(`{"errors":[{"code":%d}]}`, code)), e)
+	return e
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestRetryCommands retries failed cf commands that are safe to run again,
+// and gives up on the rest straight away.
+func TestRetryCommands(t *testing.T) {
+	cf := &cfStub{failing: map[string]int{
+		"set-env web GREETING hello": 2,
+		"create-org sys":             1,
+		"rename web web-old":         1,
+		"unset-env web GREETING":     5,
+	}}
+	b := NewRetryBackend(NewCLIBackend(cf), &RetryPolicy{Retries: 3})
+	count := func(cmd string) int {
+		n := 0
+		for _, x := range cf.ran {
+			if x == cmd {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := b.SetEnv("sys", "prod", "web", "GREETING", "hello"); err != nil {
+		t.Errorf("set-env failed: %s", err)
+	}
+	if n := count("set-env web GREETING hello"); n != 3 {
+		t.Errorf("set-env ran %d times, want 3", n)
+	}
+	if err := b.UnsetEnv("sys", "prod", "web", "GREETING"); err == nil {
+		t.Error("unset-env succeeded, though it failed every time")
+	}
+	if n := count("unset-env web GREETING"); n != 4 {
+		t.Errorf("unset-env ran %d times, want 4", n)
+	}
+	if err := b.CreateOrg("sys"); err == nil {
+		t.Error("create-org was retried")
+	}
+	if err := b.RenameApp("sys", "prod", "web", "web-old"); err == nil {
+		t.Error("rename was retried")
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A SecretProvider looks up the secrets referred to by `((secret:PATH))`
+// placeholders in a manifest, so that passwords and credentials don't have
+// to be written down in it.  A path can end in `:KEY`, to pick a single
+// value out of a secret that is a map (like a user's credentials.)
+//
+// Secret lookups fail with a NotFoundError if there is no such secret.
+type SecretProvider interface {
+	Secret(path string) (interface{}, error)
+}
+
+// NewSecretProvider sets up a secret provider from its --secrets spec:
+//
+//	env             environment variables (the default)
+//	file:PATH       a local file, encrypted with --encrypt-secrets
+//	vault:URL       the Vault KV API, with the token in $VAULT_TOKEN
+//	credhub:URL     the CredHub data API, with the token in $CREDHUB_TOKEN
+func NewSecretProvider(spec string) (SecretProvider, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "env":
+		return EnvSecrets{getenv: os.Getenv}, nil
+
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("no secrets file given (expected file:PATH)")
+		}
+		return OpenSecretsFile(arg, os.Getenv("CF_DEPLOY_SECRETS_PASSPHRASE"))
+
+	case "vault", "credhub":
+		if arg == "" {
+			return nil, fmt.Errorf("no %s URL given (expected %s:URL)", kind, kind)
+		}
+		token := os.Getenv("VAULT_TOKEN")
+		if kind == "credhub" {
+			token = os.Getenv("CREDHUB_TOKEN")
+		}
+		if token == "" {
+			return nil, fmt.Errorf("no %s token found in $%s_TOKEN", kind, strings.ToUpper(kind))
+		}
+		client := http.DefaultClient
+		if os.Getenv("CF_DEPLOY_SECRETS_INSECURE") != "" {
+			client = &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+		}
+		return NewHTTPSecrets(kind, arg, token, client), nil
+	}
+	return nil, fmt.Errorf("unknown secret provider '%s' (expected env, file:PATH, vault:URL or credhub:URL)", kind)
+}
+
+// splitSecret splits a secret reference into its path, and the key (if
+// any) to pick out of it.
+func splitSecret(ref string) (string, string) {
+	if i := strings.LastIndex(ref, ":"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// pick returns the value of a key in a secret that is a map, or the whole
+// of the secret, if no key was asked for.
+func pick(ref string, secret interface{}, key string) (interface{}, error) {
+	if key == "" {
+		return secret, nil
+	}
+	switch m := secret.(type) {
+	case map[interface{}]interface{}:
+		if v, ok := m[key]; ok {
+			return v, nil
+		}
+	case map[string]interface{}:
+		if v, ok := m[key]; ok {
+			return v, nil
+		}
+	default:
+		return nil, fmt.Errorf("secret %s is not a map, so it has no '%s'", ref, key)
+	}
+	return nil, NotFoundError{Kind: "Secret", Name: ref}
+}
+
+// EnvSecrets finds secrets in environment variables named for their paths:
+// `/cf/users/jobs` is $CF_DEPLOY_SECRET_CF_USERS_JOBS, and
+// `/cf/db:password` is $CF_DEPLOY_SECRET_CF_DB_PASSWORD.
+type EnvSecrets struct {
+	getenv func(string) string
+}
+
+func (e EnvSecrets) Secret(ref string) (interface{}, error) {
+	name := "CF_DEPLOY_SECRET_" + strings.ToUpper(nonword.ReplaceAllString(strings.TrimLeft(ref, "/"), "_"))
+	if v := e.getenv(name); v != "" {
+		return v, nil
+	}
+	return nil, NotFoundError{Kind: "Secret", Name: ref + " ($" + name + ")"}
+}
+
+// A SecretsFile is a local file of secrets, encrypted (with AES-256-GCM,
+// under a key derived from a passphrase) so that it can be kept alongside
+// the manifests.  Decrypted, it is a YAML map of secret paths to values.
+type SecretsFile struct {
+	secrets map[string]interface{}
+}
+
+const (
+	secretsHeader     = "cf-deploy-secrets:v1:"
+	secretsIterations = 100000
+)
+
+// pbkdf2 derives a key from a passphrase, as per RFC 2898, with
+// HMAC-SHA256.
+func pbkdf2(passphrase, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, passphrase)
+	var key []byte
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:size]
+}
+
+func secretsCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("no passphrase for the secrets file found in $CF_DEPLOY_SECRETS_PASSPHRASE")
+	}
+	block, err := aes.NewCipher(pbkdf2([]byte(passphrase), salt, secretsIterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecrets encrypts a YAML map of secrets, for a SecretsFile.
+func EncryptSecrets(plain []byte, passphrase string) ([]byte, error) {
+	var check map[string]interface{}
+	if err := yaml.Unmarshal(plain, &check); err != nil {
+		return nil, fmt.Errorf("secrets must be a map of paths to values: %s", err)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := secretsCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append(append(salt, nonce...), aead.Seal(nil, nonce, plain, []byte(secretsHeader))...)
+	return []byte(secretsHeader + base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// DecryptSecrets decrypts the contents of a SecretsFile.
+func DecryptSecrets(b []byte, passphrase string) ([]byte, error) {
+	s := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(s, secretsHeader) {
+		return nil, fmt.Errorf("not an encrypted secrets file")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(s[len(secretsHeader):])
+	if err != nil || len(sealed) < 16 {
+		return nil, fmt.Errorf("corrupt secrets file")
+	}
+	salt, sealed := sealed[:16], sealed[16:]
+	aead, err := secretsCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("corrupt secrets file")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, []byte(secretsHeader))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt secrets file (wrong passphrase?)")
+	}
+	return plain, nil
+}
+
+func OpenSecretsFile(file, passphrase string) (*SecretsFile, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := DecryptSecrets(b, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	f := &SecretsFile{}
+	if err := yaml.Unmarshal(plain, &f.secrets); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return f, nil
+}
+
+func (f *SecretsFile) Secret(ref string) (interface{}, error) {
+	if v, ok := f.secrets[ref]; ok {
+		return v, nil
+	}
+	path, key := splitSecret(ref)
+	if v, ok := f.secrets[path]; ok && key != "" {
+		return pick(ref, v, key)
+	}
+	return nil, NotFoundError{Kind: "Secret", Name: ref}
+}
+
+// HTTPSecrets looks secrets up in Vault (from its key/value secrets
+// engine, version 1 or 2), or in CredHub (from its data API).
+type HTTPSecrets struct {
+	kind     string
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+func NewHTTPSecrets(kind, endpoint, token string, client *http.Client) *HTTPSecrets {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPSecrets{
+		kind:     kind,
+		endpoint: strings.TrimRight(endpoint, "/"),
+		token:    token,
+		client:   client,
+	}
+}
+
+func (h *HTTPSecrets) get(path string, out interface{}) (bool, error) {
+	req, err := http.NewRequest("GET", h.endpoint+path, nil)
+	if err != nil {
+		return false, err
+	}
+	if h.kind == "vault" {
+		req.Header.Set("X-Vault-Token", h.token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, err
+	}
+	if res.StatusCode == 404 {
+		return false, nil
+	}
+	if res.StatusCode != 200 {
+		return false, fmt.Errorf("%s GET %s failed with %s: %s", h.kind, path, res.Status, bytes.TrimSpace(b))
+	}
+	return true, json.Unmarshal(b, out)
+}
+
+func (h *HTTPSecrets) Secret(ref string) (interface{}, error) {
+	path, key := splitSecret(ref)
+	var secret interface{}
+
+	if h.kind == "vault" {
+		var r struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		found, err := h.get("/v1/"+strings.TrimLeft(path, "/"), &r)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, NotFoundError{Kind: "Secret", Name: ref}
+		}
+		/* version 2 of the KV engine wraps the secret up again */
+		if inner, ok := r.Data["data"].(map[string]interface{}); ok && r.Data["metadata"] != nil {
+			r.Data = inner
+		}
+		secret = r.Data
+		if v, ok := r.Data["value"]; ok && len(r.Data) == 1 {
+			secret = v
+		}
+
+	} else {
+		var r struct {
+			Data []struct {
+				Value interface{} `json:"value"`
+			} `json:"data"`
+		}
+		found, err := h.get("/api/v1/data?current=true&name="+url.QueryEscape(path), &r)
+		if err != nil {
+			return nil, err
+		}
+		if !found || len(r.Data) == 0 {
+			return nil, NotFoundError{Kind: "Secret", Name: ref}
+		}
+		secret = r.Data[0].Value
+	}
+
+	return pick(ref, secret, key)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestPBKDF2 checks the key derivation against the PBKDF2-HMAC-SHA256
+// test vectors of RFC 7914 (section 11), and ones published alongside it.
+func TestPBKDF2(t *testing.T) {
+	for _, v := range []struct {
+		passphrase, salt string
+		iterations, size int
+		key              string
+	}{
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 40, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, 16, "89b69d0516f829893c696226650a8687"},
+	} {
+		key := hex.EncodeToString(pbkdf2([]byte(v.passphrase), []byte(v.salt), v.iterations, v.size))
+		if key != v.key {
+			t.Errorf("%q, %q, %d iterations: got %s, want %s", v.passphrase, v.salt, v.iterations, key, v.key)
+		}
+	}
+}
+
+func TestSecretsFile(t *testing.T) {
+	plain := []byte(`
+/cf/users/jobs: s3cr3t
+/cf/db:
+  username: admin
+  password: hunter2
+`)
+	sealed, err := EncryptSecrets(plain, "open sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sealed), "hunter2") {
+		t.Fatal("the encrypted secrets give away a password")
+	}
+	file := filepath.Join(t.TempDir(), "secrets")
+	if err := ioutil.WriteFile(file, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenSecretsFile(file, "open sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, want := range map[string]interface{}{
+		"/cf/users/jobs":  "s3cr3t",
+		"/cf/db:password": "hunter2",
+		"/cf/db:username": "admin",
+	} {
+		have, err := f.Secret(ref)
+		if err != nil {
+			t.Errorf("%s: %s", ref, err)
+		} else if have != want {
+			t.Errorf("%s: got %v, want %v", ref, have, want)
+		}
+	}
+	for _, ref := range []string{"/cf/users/gates", "/cf/db:port"} {
+		if _, err := f.Secret(ref); !notFound(err) {
+			t.Errorf("%s: got %v, want it not to be found", ref, err)
+		}
+	}
+	if _, err := f.Secret("/cf/users/jobs:password"); err == nil || notFound(err) {
+		t.Errorf("picking a key out of a secret that isn't a map: got %v", err)
+	}
+
+	if _, err := OpenSecretsFile(file, "open barley"); err == nil {
+		t.Error("the secrets file opened with the wrong passphrase")
+	}
+	if _, err := OpenSecretsFile(file, ""); err == nil {
+		t.Error("the secrets file opened without a passphrase")
+	}
+	if _, err := EncryptSecrets([]byte("- not\n- a map\n"), "open sesame"); err == nil {
+		t.Error("a list of secrets was encrypted")
+	}
+}
+
+// vault stands in for Vault, with a version 1 key/value engine mounted at
+// kv/ and a version 2 one at secret/.
+func vault() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "t0ken" {
+			http.Error(w, `{"errors":["permission denied"]}`, 403)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/cf/users/jobs":
+			w.Write([]byte(`{"data":{"value":"s3cr3t"}}`))
+		case "/v1/kv/cf/db":
+			w.Write([]byte(`{"data":{"username":"admin","password":"hunter2"}}`))
+		case "/v1/secret/data/cf/db":
+			w.Write([]byte(`{"data":{"data":{"username":"root","password":"swordfish"},"metadata":{"version":3}}}`))
+		case "/v1/kv/broken":
+			http.Error(w, `{"errors":["internal error"]}`, 500)
+		default:
+			http.Error(w, `{"errors":[]}`, 404)
+		}
+	}))
+}
+
+func TestVaultSecrets(t *testing.T) {
+	srv := vault()
+	defer srv.Close()
+
+	t.Setenv("VAULT_TOKEN", "t0ken")
+	p, err := NewSecretProvider("vault:" + srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, want := range map[string]interface{}{
+		"/kv/cf/users/jobs":           "s3cr3t",
+		"kv/cf/db:password":           "hunter2",
+		"/secret/data/cf/db:password": "swordfish",
+	} {
+		have, err := p.Secret(ref)
+		if err != nil {
+			t.Errorf("%s: %s", ref, err)
+		} else if have != want {
+			t.Errorf("%s: got %v, want %v", ref, have, want)
+		}
+	}
+
+	have, err := p.Secret("/secret/data/cf/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"username": "root", "password": "swordfish"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("got %v, want %v", have, want)
+	}
+
+	for _, ref := range []string{"/kv/cf/users/gates", "/kv/cf/db:port"} {
+		if _, err := p.Secret(ref); !notFound(err) {
+			t.Errorf("%s: got %v, want it not to be found", ref, err)
+		}
+	}
+	if _, err := p.Secret("/kv/broken"); err == nil || notFound(err) {
+		t.Errorf("got %v, want the server's error", err)
+	}
+
+	if _, err := NewHTTPSecrets("vault", srv.URL, "wrong", nil).Secret("/kv/cf/users/jobs"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("with the wrong token: got %v, want it to be refused", err)
+	}
+
+	t.Setenv("VAULT_TOKEN", "")
+	if _, err := NewSecretProvider("vault:" + srv.URL); err == nil {
+		t.Error("set up a vault provider without a token")
+	}
+}
+
+func TestCredHubSecrets(t *testing.T) {
+	secrets := map[string]interface{}{
+		"/cf/users/jobs": "s3cr3t",
+		"/cf/db":         map[string]interface{}{"username": "admin", "password": "hunter2"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			http.Error(w, `{"error":"invalid_token"}`, 401)
+			return
+		}
+		if r.URL.Path != "/api/v1/data" || r.URL.Query().Get("current") != "true" {
+			http.Error(w, `{"error":"not found"}`, 404)
+			return
+		}
+		v, ok := secrets[r.URL.Query().Get("name")]
+		if !ok {
+			http.Error(w, `{"error":"The request could not be completed because the credential does not exist or you do not have sufficient authorization."}`, 404)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": []interface{}{map[string]interface{}{"type": "json", "value": v}},
+		})
+	}))
+	defer srv.Close()
+
+	t.Setenv("CREDHUB_TOKEN", "t0ken")
+	p, err := NewSecretProvider("credhub:" + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, want := range map[string]interface{}{
+		"/cf/users/jobs":  "s3cr3t",
+		"/cf/db:password": "hunter2",
+	} {
+		have, err := p.Secret(ref)
+		if err != nil {
+			t.Errorf("%s: %s", ref, err)
+		} else if have != want {
+			t.Errorf("%s: got %v, want %v", ref, have, want)
+		}
+	}
+	for _, ref := range []string{"/cf/users/gates", "/cf/db:port"} {
+		if _, err := p.Secret(ref); !notFound(err) {
+			t.Errorf("%s: got %v, want it not to be found", ref, err)
+		}
+	}
+	if _, err := NewHTTPSecrets("credhub", srv.URL, "wrong", nil).Secret("/cf/users/jobs"); err == nil || notFound(err) {
+		t.Errorf("with the wrong token: got %v, want it to be refused", err)
+	}
+}
+
+func TestSecretsInManifest(t *testing.T) {
+	t.Setenv("CF_DEPLOY_SECRET_CF_USERS_JOBS", "s3cr3t")
+	p, err := NewSecretProvider("env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := NewVars()
+	vars.UseSecrets(p)
+	m, err := ParseManifest(strings.NewReader(`
+users:
+  - username: jobs
+    password: ((secret:/cf/users/jobs))
+`), vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Users) != 1 || m.Users[0].Password != "s3cr3t" {
+		t.Errorf("got users %v, want jobs' password filled in", m.Users)
+	}
+
+	if _, err := NewSecretProvider("gpg:/tmp/x"); err == nil {
+		t.Error("set up an unknown secret provider")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// extension returns true if a key is not part of the manifest schema, and
+// so should be left alone by the strict checks: the top-level `meta` key
+// (used by spruce), and anything starting with `x-`.
+func extension(path []string, key string) bool {
+	return (len(path) == 0 && key == "meta") || strings.HasPrefix(key, "x-")
+}
+
+func yamlName(f reflect.StructField) string {
+	tag := f.Tag.Get("yaml")
+	if i := strings.Index(tag, ","); i >= 0 {
+		tag = tag[:i]
+	}
+	if tag == "" {
+		return strings.ToLower(f.Name)
+	}
+	return tag
+}
+
+type keyChecker struct {
+	problems []Problem
+}
+
+func (c *keyChecker) walk(path []string, v interface{}, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		for k, val := range m {
+			key := fmt.Sprintf("%v", k)
+			if extension(path, key) {
+				continue
+			}
+			found := false
+			for i := 0; i < t.NumField(); i++ {
+				if t.Field(i).PkgPath == "" && yamlName(t.Field(i)) == key {
+					c.walk(at(path, key), val, t.Field(i).Type)
+					found = true
+					break
+				}
+			}
+			if !found {
+				c.problems = append(c.problems, Problem{
+					Path:    at(path, key),
+					Message: fmt.Sprintf("unknown key '%s'%s", key, within(path)),
+				})
+			}
+		}
+
+	case reflect.Map:
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		for k, val := range m {
+			c.walk(at(path, fmt.Sprintf("%v", k)), val, t.Elem())
+		}
+
+	case reflect.Slice:
+		l, ok := v.([]interface{})
+		if !ok {
+			return
+		}
+		for i, val := range l {
+			c.walk(at(path, itemName(i, val)), val, t.Elem())
+		}
+	}
+}
+
+// itemName identifies a list item the way the Locator does: by its
+// `name` or `username`, or else by its index.
+func itemName(i int, val interface{}) string {
+	switch m := val.(type) {
+	case map[interface{}]interface{}:
+		if n, ok := m["name"]; ok {
+			return fmt.Sprintf("%v", n)
+		} else if n, ok := m["username"]; ok {
+			return fmt.Sprintf("%v", n)
+		}
+	case yaml.MapSlice:
+		for _, k := range []string{"name", "username"} {
+			for _, item := range m {
+				if item.Key == k {
+					return fmt.Sprintf("%v", item.Value)
+				}
+			}
+		}
+	}
+	return strconv.Itoa(i)
+}
+
+// duplicates checks a document, decoded as a yaml.MapSlice (which keeps
+// every key, in order, even those defined more than once) for keys that
+// are defined more than once in the same map, wherever and however the
+// map is written.
+func (c *keyChecker) duplicates(path []string, v interface{}) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		seen := map[string]bool{}
+		for _, item := range v {
+			key := fmt.Sprintf("%v", item.Key)
+			if extension(path, key) {
+				continue
+			}
+			if seen[key] {
+				c.problems = append(c.problems, Problem{
+					Path:    at(path, key),
+					Message: fmt.Sprintf("duplicate key '%s'%s", key, within(path)),
+				})
+			}
+			seen[key] = true
+			c.duplicates(at(path, key), item.Value)
+		}
+
+	case []interface{}:
+		for i, val := range v {
+			c.duplicates(at(path, itemName(i, val)), val)
+		}
+	}
+}
+
+func within(path []string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" in %s", strings.Join(path, "/"))
+}
+
+// StrictProblems checks a single manifest file for keys that are not part
+// of the manifest schema (usually typos, which would otherwise be silently
+// ignored), and for keys that are defined more than once in the same map
+// (of which all but the last would otherwise be silently ignored.)
+func StrictProblems(src Source, loc *Locator) ([]Problem, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(src.Data, &doc); err != nil {
+		return nil, err
+	}
+
+	var keys yaml.MapSlice
+	if err := yaml.Unmarshal(src.Data, &keys); err != nil {
+		return nil, err
+	}
+
+	c := &keyChecker{}
+	c.walk(nil, doc, reflect.TypeOf(Manifest{}))
+	c.duplicates(nil, keys)
+
+	sortProblems(c.problems, loc)
+	return c.problems, nil
+}
+
+// sortProblems puts problems in the order they appear in the source.
+func sortProblems(l []Problem, loc *Locator) {
+	sort.SliceStable(l, func(i, j int) bool {
+		a, _ := loc.Locate(l[i].Path)
+		b, _ := loc.Locate(l[j].Path)
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
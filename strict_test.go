@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const typoManifest = `meta:
+  anything: goes
+x-defaults: &defaults
+  memory: 256M
+securitygroups:
+  db: {rules: []}
+organizations:
+  sys:
+    spaces:
+      prod:
+        apps:
+          - name: web
+            image: nginx
+            instance: 2
+            env: {A: 1, B: 2, A: 3}
+          - name: worker
+            x-owner: ops
+            image: nginx
+            image: httpd
+    quota: small
+    quota: large
+`
+
+func TestStrictProblems(t *testing.T) {
+	src := Source{Name: "manifest.yml", Data: []byte(typoManifest)}
+	loc := NewLocator(src.Data)
+	l, err := StrictProblems(src, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range l {
+		got = append(got, p.Where([]Source{src}, []*Locator{loc})+": "+p.Message)
+	}
+	want := []string{
+		"manifest.yml:5:1: unknown key 'securitygroups'",
+		"manifest.yml:14:13: unknown key 'instance' in organizations/sys/spaces/prod/apps/web",
+		"manifest.yml:15:13: duplicate key 'A' in organizations/sys/spaces/prod/apps/web/env",
+		"manifest.yml:19:13: duplicate key 'image' in organizations/sys/spaces/prod/apps/worker",
+		"manifest.yml:21:5: duplicate key 'quota' in organizations/sys",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLoadStrictManifests(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.yml")
+	bad := filepath.Join(dir, "bad.yml")
+	if err := ioutil.WriteFile(good, []byte("organizations:\n  sys: {}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bad, []byte("organizations: {sys: {spaces: {prod: {}}, spacse: {dev: {}}}}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadManifests([]string{good}, NewVars()); err != nil {
+		t.Errorf("loading a good manifest: %s", err)
+	}
+	_, err := LoadManifests([]string{good, bad}, NewVars())
+	if err == nil {
+		t.Fatal("loaded a manifest with a misspelled key")
+	}
+	/* keys in flow-style maps are reported at the nearest key the locator can find */
+	if want := bad + ":1:1: unknown key 'spacse' in organizations/sys"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to mention %q", err, want)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var orgRoles = []string{"OrgManager", "BillingManager", "OrgAuditor"}
+var spaceRoles = []string{"SpaceManager", "SpaceDeveloper", "SpaceAuditor"}
+
+// A Problem is something wrong with a manifest, found before deploying it.
+// Warnings are for things that only work if the foundation already has
+// something that the manifest doesn't define (like a user).
+type Problem struct {
+	Path    []string
+	Message string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	if p.Warning {
+		return "warning: " + p.Message
+	}
+	return "error: " + p.Message
+}
+
+type validator struct {
+	m        *Manifest
+	problems []Problem
+}
+
+func (v *validator) errorf(path []string, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) warnf(path []string, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+		Warning: true,
+	})
+}
+
+// sortedKeys returns the keys of a map with string keys, in order.
+func sortedKeys(m interface{}) []string {
+	var l []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		l = append(l, k.String())
+	}
+	sort.Strings(l)
+	return l
+}
+
+func at(path []string, more ...string) []string {
+	l := make([]string, 0, len(path)+len(more))
+	l = append(l, path...)
+	return append(l, more...)
+}
+
+// serviceDefinition checks that a service definition names a service and
+// a plan, and that its parameters (if any) are a map.
+func (v *validator) serviceDefinition(path []string, what string, def ServiceDefinition) {
+	if def.Service == "" || def.Plan == "" {
+		if def.short != "" {
+			v.errorf(path, "%s is '%s', which is not of the form service/plan", what, def)
+		} else {
+			v.errorf(path, "%s needs both a service and a plan", what)
+		}
+	}
+	if def.Parameters != nil {
+		if _, ok := def.Parameters.(map[interface{}]interface{}); !ok {
+			v.errorf(at(path, "parameters"), "the parameters of %s must be a map", what)
+		}
+	}
+}
+
+// ValidateManifest checks a manifest (as decoded, before its defaults have
+// been resolved) for everything that we can tell is wrong without asking
+// the foundation, and returns every problem it finds.
+func ValidateManifest(m *Manifest) []Problem {
+	v := &validator{m: m}
+
+	for i, u := range m.Users {
+		if u.Name == "" {
+			v.errorf([]string{"users", strconv.Itoa(i)}, "user #%d has no username", i+1)
+		}
+	}
+
+	for _, qname := range sortedKeys(m.Quotas) {
+		v.quota([]string{"quotas", qname}, qname, m.Quotas[qname])
+	}
+
+	for _, sgname := range sortedKeys(m.SecurityGroups) {
+		path := []string{"security_groups", sgname}
+		sg := m.SecurityGroups[sgname]
+		if sg == nil || (len(sg.Rules) == 0 && sg.SecurityGroupFile == "") {
+			v.errorf(path, "security group '%s' has neither rules nor a security_group_file", sgname)
+		} else if len(sg.Rules) > 0 && sg.SecurityGroupFile != "" {
+			v.errorf(path, "security group '%s' has both rules and a security_group_file", sgname)
+		}
+	}
+	v.securityGroupSets([]string{"security_group_sets"}, m.SecurityGroupSets)
+
+	for _, oname := range sortedKeys(m.Organizations) {
+		v.org([]string{"organizations", oname}, oname, m.Organizations[oname])
+	}
+
+	v.serviceBrokers()
+	v.serviceAccess()
+
+	for i, pattern := range m.ExternalEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			v.errorf([]string{"external_env", strconv.Itoa(i)}, "external_env pattern '%s' is malformed", pattern)
+		}
+	}
+
+	return v.problems
+}
+
+func (v *validator) quota(path []string, qname string, q *Quota) {
+	if q == nil {
+		return
+	}
+	for _, k := range sortedKeys(q.Memory) {
+		if k != "total" && k != "per-app-instance" {
+			v.errorf(at(path, "memory", k), "quota '%s' has an unknown memory limit '%s' (expected total or per-app-instance)", qname, k)
+		}
+	}
+}
+
+func (v *validator) securityGroupSets(path []string, sets *SecurityGroupSet) {
+	if sets == nil {
+		return
+	}
+	for _, lifecycle := range []string{"running", "staging"} {
+		l := sets.Running
+		if lifecycle == "staging" {
+			l = sets.Staging
+		}
+		for _, sgname := range l {
+			if _, ok := v.m.SecurityGroups[sgname]; !ok {
+				v.errorf(at(path, lifecycle), "%s security group '%s' is not defined under security_groups", lifecycle, sgname)
+			}
+		}
+	}
+}
+
+func (v *validator) users(path []string, users map[string][]string, roles []string) {
+	for _, uname := range sortedKeys(users) {
+		known := false
+		for _, u := range v.m.Users {
+			if u.Name == uname {
+				known = true
+			}
+		}
+		if !known {
+			v.warnf(at(path, uname), "user '%s' is not listed under the top-level users, and must already exist", uname)
+		}
+		for _, role := range users[uname] {
+			if !contains(roles, role) {
+				v.errorf(at(path, uname), "unknown role '%s' for user '%s' (expected one of %s)", role, uname, strings.Join(roles, ", "))
+			}
+		}
+	}
+}
+
+func (v *validator) org(path []string, oname string, org *Organization) {
+	if org == nil {
+		return
+	}
+	if org.Quota != "" {
+		if _, ok := v.m.Quotas[org.Quota]; !ok {
+			v.errorf(at(path, "quota"), "quota '%s' for organization '%s' is not defined under the top-level quotas", org.Quota, oname)
+		}
+	}
+	for _, qname := range sortedKeys(org.Quotas) {
+		v.quota(at(path, "quotas", qname), qname, org.Quotas[qname])
+	}
+	v.users(at(path, "users"), org.Users, orgRoles)
+	v.securityGroupSets(at(path, "security_group_sets"), org.SecurityGroupSets)
+
+	for _, sname := range sortedKeys(org.Spaces) {
+		v.space(at(path, "spaces", sname), oname, sname, org, org.Spaces[sname])
+	}
+}
+
+func (v *validator) space(path []string, oname, sname string, org *Organization, space *Space) {
+	if space == nil {
+		return
+	}
+	if space.Quota != "" {
+		if _, ok := org.Quotas[space.Quota]; !ok {
+			v.errorf(at(path, "quota"), "quota '%s' for space '%s/%s' is not defined under the organization's quotas", space.Quota, oname, sname)
+		}
+	}
+	v.users(at(path, "users"), space.Users, spaceRoles)
+	v.securityGroupSets(at(path, "security_group_sets"), space.SecurityGroupSets)
+
+	for _, svc := range sortedKeys(space.SharedServices) {
+		v.serviceDefinition(at(path, "services", svc), fmt.Sprintf("shared service '%s'", svc), space.SharedServices[svc])
+	}
+
+	for i, cups := range space.UserProvidedServices {
+		if cups.Name == "" {
+			v.errorf(at(path, "user-provided-services", strconv.Itoa(i)), "user-provided service #%d in space '%s/%s' has no name", i+1, oname, sname)
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, app := range space.Applications {
+		if app.Name == "" {
+			v.errorf(at(path, "apps", strconv.Itoa(i)), "application #%d in space '%s/%s' has no name", i+1, oname, sname)
+			continue
+		}
+		apath := at(path, "apps", app.Name)
+		if seen[app.Name] {
+			v.errorf(apath, "application '%s' is defined more than once in space '%s/%s'", app.Name, oname, sname)
+		}
+		seen[app.Name] = true
+
+		if (app.Domain != "" || app.Hostname != "") && len(app.URLs) > 0 {
+			v.errorf(at(apath, "urls"), "application '%s' has both hostname/domain and a list of urls", app.Name)
+		}
+		if app.NoRoute && (app.Domain != "" || app.Hostname != "" || len(app.URLs) > 0) {
+			v.errorf(at(apath, "no-route"), "application '%s' has no-route, as well as a hostname, domain or urls", app.Name)
+		}
+		if app.Strategy != "" && app.Strategy != StrategyRestart && app.Strategy != StrategyBlueGreen {
+			v.errorf(at(apath, "strategy"), "application '%s' has an unknown strategy '%s' (expected %s or %s)", app.Name, app.Strategy, StrategyRestart, StrategyBlueGreen)
+		}
+		if app.Image == "" && app.Repository == "" && app.Path == "" {
+			v.warnf(apath, "application '%s' has no image, repo or path, and must already exist", app.Name)
+		}
+		if app.Instances < 0 {
+			v.errorf(at(apath, "instances"), "application '%s' cannot have %d instances", app.Name, app.Instances)
+		}
+		for _, svc := range sortedKeys(app.BoundServices) {
+			v.serviceDefinition(at(apath, "bind", svc), fmt.Sprintf("service '%s' of application '%s'", svc, app.Name), app.BoundServices[svc])
+		}
+		for _, svc := range app.SharedServices {
+			if _, ok := space.SharedServices[svc]; !ok {
+				v.errorf(at(apath, "shared"), "application '%s' uses shared service '%s', which is not defined under the space's services", app.Name, svc)
+			}
+		}
+	}
+}
+
+func (v *validator) serviceBrokers() {
+	seen := map[string]bool{}
+	for i, b := range v.m.ServiceBrokers {
+		if b.Name == "" {
+			v.errorf([]string{"service_brokers", strconv.Itoa(i)}, "service broker #%d has no name", i+1)
+			continue
+		}
+		path := []string{"service_brokers", b.Name}
+		if seen[b.Name] {
+			v.errorf(path, "service broker '%s' is defined more than once", b.Name)
+		}
+		seen[b.Name] = true
+
+		if b.Username == "" || b.Password == "" {
+			v.errorf(path, "service broker '%s' needs both a username and a password", b.Name)
+		}
+		if b.URL == "" && b.App == "" {
+			v.errorf(path, "service broker '%s' has neither a url nor an app", b.Name)
+		}
+		if b.App != "" {
+			v.brokerApp(at(path, "app"), b)
+		}
+		if b.Space != "" {
+			p := strings.Split(b.Space, "/")
+			if len(p) != 2 || p[0] == "" || p[1] == "" {
+				v.errorf(at(path, "space"), "space '%s' of service broker '%s' is not of the form ORG/SPACE", b.Space, b.Name)
+			} else if org, ok := v.m.Organizations[p[0]]; !ok || org == nil || org.Spaces[p[1]] == nil {
+				v.warnf(at(path, "space"), "space '%s' of service broker '%s' is not in the manifest, and must already exist", b.Space, b.Name)
+			}
+		} else if b.SpaceScoped && b.App == "" {
+			v.errorf(at(path, "space_scoped"), "service broker '%s' is space-scoped, but has neither a space nor an app to take it from", b.Name)
+		}
+	}
+}
+
+// brokerApp checks that the application running a service broker is in
+// the manifest, and that, if the broker has no url, there is a route to
+// register it at.
+func (v *validator) brokerApp(path []string, b *ServiceBroker) {
+	p := strings.Split(b.App, "/")
+	app := v.m.app(b.App)
+	if len(p) != 3 || app == nil {
+		v.errorf(path, "application '%s' of service broker '%s' is not defined in the manifest (expected ORG/SPACE/APP)", b.App, b.Name)
+		return
+	}
+	if b.URL == "" && len(app.URLs) == 0 && app.Domain == "" && v.m.Organizations[p[0]].Spaces[p[1]].Domain == "" {
+		v.errorf(path, "application '%s' of service broker '%s' has no domain (or urls) to register the broker at; give the broker a url", b.App, b.Name)
+	}
+}
+
+func (v *validator) serviceAccess() {
+	for i, a := range v.m.ServiceAccess {
+		path := []string{"service_access", strconv.Itoa(i)}
+		if a.Service == "" {
+			v.errorf(path, "service access #%d has no service", i+1)
+		}
+		for _, oname := range a.Orgs {
+			if _, ok := v.m.Organizations[oname]; !ok {
+				v.warnf(at(path, "orgs"), "organization '%s' given access to service '%s' is not in the manifest, and must already exist", oname, a.Service)
+			}
+		}
+	}
+}
+
+// Where returns the `file:line:column` that a problem should be reported
+// at, looking through the sources from the last (which wins when they are
+// merged) to the first.
+func (p Problem) Where(srcs []Source, locs []*Locator) string {
+	for i := len(srcs) - 1; i >= 0; i-- {
+		if pos, ok := locs[i].Locate(p.Path); ok {
+			return fmt.Sprintf("%s:%d:%d", sourceName(srcs[i].Name), pos.Line, pos.Column)
+		}
+	}
+	return sourceName(srcs[len(srcs)-1].Name)
+}
+
+func sourceName(file string) string {
+	if file == "-" {
+		return "<stdin>"
+	}
+	return file
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const invalidManifest = `users:
+  - username: jobs
+quotas:
+  small:
+    memory:
+      total: 1G
+      peak: 2G
+organizations:
+  sys:
+    quota: large
+    users:
+      jobs: [OrgManager]
+      woz: [OrgOwner]
+    spaces:
+      prod:
+        security_group_sets:
+          running: [db]
+        services:
+          cache: redis
+        apps:
+          - name: web
+            image: nginx
+            hostname: www
+            urls: [web.example.com]
+            shared: [cache, queue]
+          - name: worker
+            instances: -1
+          - name: web
+            image: httpd
+`
+
+func TestValidateManifest(t *testing.T) {
+	m, err := decodeManifest([]byte(invalidManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := []Source{{Name: "manifest.yml", Data: []byte(invalidManifest)}}
+	loc := []*Locator{NewLocator(src[0].Data)}
+
+	var got []string
+	for _, p := range ValidateManifest(&m) {
+		got = append(got, p.Where(src, loc)+": "+p.String())
+	}
+	want := []string{
+		"manifest.yml:7:7: error: quota 'small' has an unknown memory limit 'peak' (expected total or per-app-instance)",
+		"manifest.yml:10:5: error: quota 'large' for organization 'sys' is not defined under the top-level quotas",
+		"manifest.yml:13:7: warning: user 'woz' is not listed under the top-level users, and must already exist",
+		"manifest.yml:13:7: error: unknown role 'OrgOwner' for user 'woz' (expected one of OrgManager, BillingManager, OrgAuditor)",
+		"manifest.yml:17:11: error: running security group 'db' is not defined under security_groups",
+		"manifest.yml:19:11: error: shared service 'cache' is 'redis', which is not of the form service/plan",
+		"manifest.yml:24:13: error: application 'web' has both hostname/domain and a list of urls",
+		"manifest.yml:25:13: error: application 'web' uses shared service 'queue', which is not defined under the space's services",
+		"manifest.yml:26:11: warning: application 'worker' has no image, repo or path, and must already exist",
+		"manifest.yml:27:13: error: application 'worker' cannot have -1 instances",
+		/* the second web is found by name, so it is reported at the first */
+		"manifest.yml:21:11: error: application 'web' is defined more than once in space 'sys/prod'",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestValidManifest(t *testing.T) {
+	m, err := decodeManifest([]byte(`
+users:
+  - username: jobs
+quotas:
+  small:
+    memory: {total: 1G}
+organizations:
+  sys:
+    quota: small
+    users:
+      jobs: [OrgManager]
+    spaces:
+      prod:
+        services:
+          cache: redis/small
+        apps:
+          - name: web
+            image: nginx
+            shared: [cache]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := ValidateManifest(&m); len(l) != 0 {
+		t.Errorf("got problems %v with a valid manifest", l)
+	}
+}
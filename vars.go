@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// variable matches a `((name))` placeholder in a manifest value.  Names
+// can have dots in them, to reach into the values from a vars file.
+// (Spruce's `(( grab ... ))` operators always have spaces in them, so
+// they are left alone.)  A `((secret:PATH))` placeholder is looked up with
+// the SecretProvider instead.
+var variable = regexp.MustCompile(`\(\(([-\w./]+|secret:[-\w./:]+)\)\)`)
+
+var nonword = regexp.MustCompile(`\W`)
+
+// Vars are the values for the `((name))` placeholders in a manifest.  They
+// come from (in order of precedence) `--var name=value` options, YAML
+// `--vars-file` files (later files taking precedence over earlier ones),
+// and environment variables named CF_DEPLOY_VAR_NAME.  Secrets come from
+// a SecretProvider, and nowhere else.
+type Vars struct {
+	vars    map[string]interface{}
+	files   map[interface{}]interface{}
+	secrets SecretProvider
+	found   map[string]interface{}
+
+	/* where environment variables come from; nil to ignore them */
+	getenv func(string) string
+}
+
+func NewVars() *Vars {
+	return &Vars{
+		vars:    map[string]interface{}{},
+		files:   map[interface{}]interface{}{},
+		getenv:  os.Getenv,
+		secrets: EnvSecrets{getenv: os.Getenv},
+	}
+}
+
+// UseSecrets sets the provider for `((secret:PATH))` placeholders.
+func (v *Vars) UseSecrets(p SecretProvider) {
+	v.secrets = p
+	v.found = nil
+}
+
+// Set takes a `name=value` pair from a --var option.
+func (v *Vars) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("'%s' is not of the form name=value", s)
+	}
+	v.vars[s[:i]] = s[i+1:]
+	return nil
+}
+
+func (v *Vars) String() string {
+	if v == nil {
+		return ""
+	}
+	return strings.Join(sortedKeys(v.vars), ",")
+}
+
+// ReadFile merges in the values from a --vars-file.
+func (v *Vars) ReadFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var m map[interface{}]interface{}
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	if m == nil {
+		return nil
+	}
+	v.files = mergeYaml(v.files, m).(map[interface{}]interface{})
+	return nil
+}
+
+// varsFile is the flag.Value for --vars-file.
+type varsFile struct {
+	vars  *Vars
+	files []string
+}
+
+func (f *varsFile) Set(file string) error {
+	f.files = append(f.files, file)
+	return f.vars.ReadFile(file)
+}
+
+func (f *varsFile) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.files, ",")
+}
+
+// envName returns the environment variable for a manifest variable:
+// `system-domain` comes from $CF_DEPLOY_VAR_SYSTEM_DOMAIN.
+func envName(name string) string {
+	return "CF_DEPLOY_VAR_" + strings.ToUpper(nonword.ReplaceAllString(name, "_"))
+}
+
+// secret resolves a `secret:PATH` placeholder, noting it as missing if
+// there is no such secret, or the error if it couldn't be looked up.
+func (v *Vars) secret(name string, missing map[string]bool, errs *[]string) (interface{}, bool) {
+	if x, ok := v.found[name]; ok {
+		return x, true
+	}
+	if v.secrets == nil {
+		missing[name] = true
+		return nil, false
+	}
+	x, err := v.secrets.Secret(strings.TrimPrefix(name, "secret:"))
+	if nf, ok := err.(NotFoundError); ok {
+		missing["secret:"+nf.Name] = true
+		return nil, false
+	}
+	if err != nil {
+		*errs = append(*errs, fmt.Sprintf("unable to look up %s: %s", name, err))
+		return nil, false
+	}
+	if v.found == nil {
+		v.found = map[string]interface{}{}
+	}
+	v.found[name] = x
+	redactions.AddSecretValue(x)
+	return x, true
+}
+
+func (v *Vars) lookup(name string, missing map[string]bool, errs *[]string) (interface{}, bool) {
+	if strings.HasPrefix(name, "secret:") {
+		return v.secret(name, missing, errs)
+	}
+
+	if x, ok := v.vars[name]; ok {
+		return x, true
+	}
+
+	if x, ok := v.files[name]; ok && x != nil {
+		return x, true
+	}
+	var x interface{} = v.files
+	for _, k := range strings.Split(name, ".") {
+		if m, ok := x.(map[interface{}]interface{}); ok {
+			x = m[k]
+		} else {
+			x = nil
+		}
+	}
+	if x != nil {
+		return x, true
+	}
+
+	if v.getenv != nil {
+		if s := v.getenv(envName(name)); s != "" {
+			return s, true
+		}
+	}
+	missing[name] = true
+	return nil, false
+}
+
+// Interpolate replaces every placeholder in a YAML document with the value
+// of its variable.  A placeholder that is the whole of a value is replaced
+// by the variable's value, whatever it is (a number, or a map of
+// credentials, say); one that is only part of a value has the variable's
+// value spliced into it, which therefore has to be a string or a number.
+// It is an error for any placeholder to have no variable (or secret.)
+func (v *Vars) Interpolate(b []byte) ([]byte, error) {
+	if !variable.Match(b) {
+		return b, nil
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	var errs []string
+	missing := map[string]bool{}
+	doc = v.interpolate(doc, missing, &errs)
+
+	var vars, secrets []string
+	for _, name := range sortedKeys(missing) {
+		if strings.HasPrefix(name, "secret:") {
+			secrets = append(secrets, strings.TrimPrefix(name, "secret:"))
+		} else {
+			vars = append(vars, name)
+		}
+	}
+	if len(vars) > 0 {
+		errs = append(errs, fmt.Sprintf("no value for variable(s) %s (use --var, --vars-file, or $%s, etc.)",
+			strings.Join(vars, ", "), envName(vars[0])))
+	}
+	if len(secrets) > 0 {
+		errs = append(errs, fmt.Sprintf("no such secret(s) %s", strings.Join(secrets, ", ")))
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return yaml.Marshal(doc)
+}
+
+func (v *Vars) interpolate(x interface{}, missing map[string]bool, errs *[]string) interface{} {
+	switch x := x.(type) {
+	case map[interface{}]interface{}:
+		for k, val := range x {
+			x[k] = v.interpolate(val, missing, errs)
+		}
+		return x
+
+	case []interface{}:
+		for i, val := range x {
+			x[i] = v.interpolate(val, missing, errs)
+		}
+		return x
+
+	case string:
+		if m := variable.FindStringSubmatch(x); m != nil && m[0] == x {
+			val, ok := v.lookup(m[1], missing, errs)
+			if !ok {
+				return x
+			}
+			return val
+		}
+		return variable.ReplaceAllStringFunc(x, func(s string) string {
+			name := s[2 : len(s)-2]
+			val, ok := v.lookup(name, missing, errs)
+			if !ok {
+				return s
+			}
+			switch val.(type) {
+			case map[interface{}]interface{}, []interface{}, nil:
+				*errs = append(*errs, fmt.Sprintf("variable %s is not a string, so it cannot be part of '%s'", name, x))
+				return s
+			}
+			return fmt.Sprintf("%v", val)
+		})
+	}
+	return x
+}
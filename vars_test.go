@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func varsFiles(t *testing.T, v *Vars, files ...string) {
+	dir := t.TempDir()
+	for i, src := range files {
+		file := filepath.Join(dir, fmt.Sprintf("vars%d.yml", i))
+		if err := ioutil.WriteFile(file, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.ReadFile(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// interpolate fills in the variables of a YAML document, and decodes the
+// result.
+func interpolate(t *testing.T, v *Vars, src string) map[interface{}]interface{} {
+	t.Helper()
+	b, err := v.Interpolate([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestVars(t *testing.T) {
+	v := NewVars()
+	v.getenv = func(name string) string {
+		return map[string]string{
+			"CF_DEPLOY_VAR_SYSTEM_DOMAIN": "env.example.com",
+			"CF_DEPLOY_VAR_STAGE":         "env",
+			"CF_DEPLOY_VAR_REGION":        "env",
+		}[name]
+	}
+	varsFiles(t, v, `
+stage: base
+region: base
+db:
+  host: db.internal
+  port: 5432
+`, `
+region: prod
+db:
+  port: 6432
+`)
+	if err := v.Set("stage=cli"); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := interpolate(t, v, `
+stage: ((stage))
+region: ((region))
+domain: ((system-domain))
+url: postgres://((db.host)):((db.port))/((stage))
+db: ((db))
+grab: (( grab meta.stage ))
+`)
+	want := map[interface{}]interface{}{
+		"stage":  "cli",
+		"region": "prod",
+		"domain": "env.example.com",
+		"url":    "postgres://db.internal:6432/cli",
+		"db":     map[interface{}]interface{}{"host": "db.internal", "port": 6432},
+		"grab":   "(( grab meta.stage ))",
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("got %v, want %v", doc, want)
+	}
+}
+
+func TestVarsErrors(t *testing.T) {
+	v := NewVars()
+	v.getenv = nil
+	if err := v.Set("stage"); err == nil {
+		t.Error("set a variable without a value")
+	}
+	if err := v.Set("=prod"); err == nil {
+		t.Error("set a variable without a name")
+	}
+	varsFiles(t, v, "db: {host: db.internal}\n")
+
+	for src, want := range map[string]string{
+		"a: ((stage))\nb: ((system-domain))\nc: ((stage))\n": "no value for variable(s) stage, system-domain (use --var, --vars-file, or $CF_DEPLOY_VAR_STAGE, etc.)",
+		"url: postgres://((db))/\n":                          "variable db is not a string, so it cannot be part of 'postgres://((db))/'",
+		"a: ((db.port))\n":                                   "no value for variable(s) db.port (use --var, --vars-file, or $CF_DEPLOY_VAR_DB_PORT, etc.)",
+	} {
+		_, err := v.Interpolate([]byte(src))
+		if err == nil || err.Error() != want {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	}
+
+	if _, err := ParseManifest(strings.NewReader("organizations:\n  sys:\n    quota: ((quota))\n"), v); err == nil {
+		t.Error("parsed a manifest with a variable that has no value")
+	}
+}